@@ -31,29 +31,21 @@ const LOG_FILE_NAME = "data/bumble.log"
 // [BTREE]
 // Listens for SIGINT or SIGTERM and calls table.CloseDB().
 func setupCloseHandler(database *db.Database) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		fmt.Println("closehandler invoked")
 		database.Close()
+		query.DrainPool()
 		os.Exit(0)
 	}()
 }
 
 // [CONCURRENCY]
 // Start listening for connections at port `port`.
-func startServer(repl *repl.REPL, tm *concurrency.TransactionManager, prompt string, port int) {
-	// Handle a connection by running the repl on it.
-	handleConn := func(c net.Conn) {
-		clientId := uuid.New()
-		defer c.Close()
-		if tm != nil {
-			defer tm.Commit(clientId)
-		}
-		repl.Run(c, clientId, prompt)
-	}
-	// Start listening for new connections.
+// onDisconnect cleans up after a client whose connection closed.
+func startServer(r *repl.REPL, onDisconnect func(uuid.UUID), prompt string, port int) {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%v", port))
 	if err != nil {
 		log.Fatal(err)
@@ -62,13 +54,8 @@ func startServer(repl *repl.REPL, tm *concurrency.TransactionManager, prompt str
 	fmt.Printf("%v server started listening on localhost:%v\n", dbName,
 		listener.Addr().(*net.TCPAddr).Port)
 	// Handle each connection.
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Print(err)
-			continue
-		}
-		go handleConn(conn)
+	if err := repl.NewServer(r, onDisconnect, prompt).Serve(listener); err != nil {
+		log.Fatal(err)
 	}
 }
 
@@ -83,6 +70,7 @@ func main() {
 
 	// [CONCURRENCY]
 	var portFlag = flag.Int("p", DEFAULT_PORT, "port number")
+	var maxTxFlag = flag.Duration("maxtx", 0, "abort transactions running longer than this (0 for no limit)")
 
 	flag.Parse()
 
@@ -103,6 +91,7 @@ func main() {
 	// [BTREE]
 	// Setup close conditions.
 	defer database.Close()
+	defer query.DrainPool()
 	setupCloseHandler(database)
 
 	// Set up REPL resources.
@@ -178,7 +167,14 @@ func main() {
 	// Start server if server (concurrency or recovery), else run REPL here.
 	if server {
 		// 	[CONCURRENCY]
-		startServer(r, tm, prompt, *portFlag)
+		onDisconnect := tm.ReleaseOnDisconnect()
+		if rm != nil {
+			onDisconnect = rm.AbortOnDisconnect()
+		}
+		// Expired transactions are ended the same way as a disconnected client's.
+		tm.SetExpiryHandler(onDisconnect)
+		tm.SetMaxTransactionDuration(*maxTxFlag)
+		startServer(r, onDisconnect, prompt, *portFlag)
 	} else {
 		r.Run(nil, uuid.New(), prompt)
 	}
@@ -23,7 +23,7 @@ var MAX_DELAY int64 = 10
 
 // Listens for SIGINT or SIGTERM and calls table.CloseDB().
 func setupCloseHandler(database *db.Database) {
-	c := make(chan os.Signal)
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
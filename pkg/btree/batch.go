@@ -0,0 +1,82 @@
+package btree
+
+import (
+	"sort"
+)
+
+// DeleteBatch removes the given keys from the table, returning how many were found. The keys
+// are sorted and the leaves holding them are walked once, left to right, rewriting each leaf
+// at most once instead of shifting its entries for every key. As with Delete, leaves aren't
+// merged or rebalanced afterwards. With duplicate keys, each occurrence in keys removes one entry.
+func (table *BTreeIndex) DeleteBatch(keys []int64) (deleted int64, err error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	table.rwlock.RLock()
+	defer table.rwlock.RUnlock()
+	sorted := append([]int64(nil), keys...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// Get the root node.
+	rootPage, err := table.pager.GetPage(table.rootPN)
+	if err != nil {
+		return 0, err
+	}
+	defer rootPage.Put()
+	// [CONCURRENCY] Hold the root for the whole batch, so that no writer gets in between.
+	lockRoot(rootPage)
+	defer SUPER_NODE.page.WUnlock()
+	defer rootPage.WUnlock()
+	leaf, _, err := pageToNode(rootPage).keyToNodeEntry(sorted[0])
+	if err != nil {
+		return 0, err
+	}
+	// Walk the leaves until every key has been looked for.
+	for pn := leaf.page.GetPageNum(); pn >= 0 && len(sorted) > 0; {
+		page, err := table.pager.GetPage(pn)
+		if err != nil {
+			return deleted, err
+		}
+		if pn != table.rootPN {
+			page.WLock()
+		}
+		leaf := pageToLeafNode(page)
+		var n int64
+		n, sorted = leaf.deleteSorted(sorted, table.compress)
+		deleted += n
+		pn = leaf.rightSiblingPN
+		if pn != table.rootPN {
+			page.WUnlock()
+		}
+		page.Put()
+	}
+	return deleted, nil
+}
+
+// deleteSorted removes the entries matching the given sorted keys that belong in this leaf,
+// rewriting it once, compressed if compress is set and its keys allow. Returns how many were
+// removed, and the keys left for later leaves.
+func (node *LeafNode) deleteSorted(keys []int64, compress bool) (int64, []int64) {
+	entries := node.getEntries()
+	kept := make([]BTreeEntry, 0, len(entries))
+	i := 0
+	for _, entry := range entries {
+		// Keys before this entry aren't in the table.
+		for i < len(keys) && keys[i] < entry.key {
+			i++
+		}
+		if i < len(keys) && keys[i] == entry.key {
+			i++
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	// The last leaf is the only place the remaining keys could be.
+	if node.rightSiblingPN < 0 {
+		i = len(keys)
+	}
+	removed := int64(len(entries) - len(kept))
+	if removed > 0 {
+		node.rewrite(kept, compress)
+	}
+	return removed, keys[i:]
+}
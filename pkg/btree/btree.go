@@ -2,7 +2,12 @@ package btree
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 
 	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
 	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
@@ -10,30 +15,181 @@ import (
 
 // Tables are an abstraction over the entries stored in our database.
 type BTreeIndex struct {
-	pager  *pager.Pager // The page handler to read from files.
-	rootPN int64        // The root page number.
+	pager           *pager.Pager // The page handler to read from files.
+	rootPN          int64        // The root page number.
+	allowDuplicates bool         // Whether Insert accepts keys that already exist.
+	codec           string       // Name of the codec entries are stored with.
+	compress        bool         // Whether leaves use the compressed layout where their keys allow.
+	hotKeys         *hotKeyCache // Leaves of recently found keys; nil if disabled.
+	onInsert        func(int64)  // Called with each key an insert adds; see SetInsertHook.
+	// Guards the pager, root and hot key cache, which Reindex replaces. Operations read-lock it
+	// while they run, and cursors until they are closed.
+	rwlock sync.RWMutex
 }
 
+// Options used when creating a new table.
+type TableOptions struct {
+	// Store leaf keys as deltas from a per-node base key, in each leaf whose keys span a small
+	// enough range. A new table records it in a file next to it, named with OPTIONS_FILE_SUFFIX.
+	PrefixCompression bool
+	// Let Insert add entries with keys that already exist, e.g. for value-keyed indexes.
+	// Find, Update and Delete then act on one of the duplicates; use TableFindAll for every
+	// entry with a key. Like PrefixCompression, a new table records it.
+	AllowDuplicates bool
+	// Name of the registered codec entries are stored with (see utils.RegisterCodec). A new
+	// table records it in a file next to it, named with CODEC_FILE_SUFFIX, unless it is the
+	// default codec. Empty uses the recorded codec, or the default codec for a new table; any
+	// other codec must match the recorded one. Prefix-compressed leaves have their own layout,
+	// so a table can't have both.
+	Codec string
+	// Number of recently found keys to remember the leaves of, so that finding them again
+	// skips the internal nodes; 0 disables the cache. This isn't persisted.
+	HotKeyCacheSize int
+	// Size of the table's pages, which its node layout follows; pager.DEFAULT_PAGESIZE if 0.
+	// Like HotKeyCacheSize, this isn't persisted.
+	PageSize int64
+	// Read and write the table in page layout 0, as written before pages had trailers, e.g. to
+	// convert it; see pager.SetPageLayout.
+	LegacyPageLayout bool
+}
+
+// Suffix of the file next to a table that records the codec its entries are stored with.
+// Tables using the default codec have none.
+const CODEC_FILE_SUFFIX = ".codec"
+
+// Suffix of the file next to a table that records the options it was created with, other than
+// its codec, one name per line. Tables created with none of them have none.
+const OPTIONS_FILE_SUFFIX = ".options"
+
+// Names of the options recorded in a table's options file.
+const (
+	PREFIX_COMPRESSION_OPTION = "prefix-compression"
+	ALLOW_DUPLICATES_OPTION   = "allow-duplicates"
+)
+
 // OpenTable returns a table associated with the given database filename.
 func OpenTable(filename string) (table *BTreeIndex, err error) {
+	return OpenTableWithOptions(filename, TableOptions{})
+}
+
+// OpenTableWithOptions returns a table associated with the given database filename.
+// The options only apply if the table is new; existing tables keep their on-disk layout.
+func OpenTableWithOptions(filename string, options TableOptions) (table *BTreeIndex, err error) {
+	recorded, err := readCodecFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	codecName, err := utils.ResolveCodec(recorded, options.Codec)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := utils.GetCodec(codecName)
+	if err != nil {
+		return nil, err
+	}
+	if options.PrefixCompression && codecName != "" {
+		return nil, errors.New("prefix-compressed tables can't use a custom codec")
+	}
+	recordedOptions, err := readOptionsFile(filename)
+	if err != nil {
+		return nil, err
+	}
 	// Create a pager for the table
-	pager := pager.NewPager()
+	pageSize := options.PageSize
+	if pageSize == 0 {
+		pageSize = pager.DEFAULT_PAGESIZE
+	}
+	pager, err := pager.NewPagerWithSize(pageSize)
+	if err != nil {
+		return nil, err
+	}
+	if options.LegacyPageLayout {
+		pager.SetPageLayout(0)
+	}
+	pager.SetEntryCodec(codec)
 	err = pager.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	// Initialize the pager if it's new.
 	if pager.GetNumPages() == 0 {
+		if codecName != "" && recorded == "" {
+			if err = ioutil.WriteFile(filename+CODEC_FILE_SUFFIX, []byte(codecName), 0666); err != nil {
+				pager.Close()
+				return nil, err
+			}
+		}
+		if err = writeOptionsFile(filename, options); err != nil {
+			pager.Close()
+			return nil, err
+		}
+		recordedOptions = options
 		rootPage, err := pager.GetPage(ROOT_PN)
 		if err != nil {
 			return nil, err
 		}
 		defer rootPage.Put()
 		initPage(rootPage, LEAF_NODE)
+		if options.PrefixCompression {
+			(*rootPage.GetData())[NODETYPE_OFFSET] = byte(COMPRESSED_LEAF_LAYOUT)
+		}
 		rootNode := pageToLeafNode(rootPage)
 		rootNode.setRightSibling(-1)
 	}
-	return &BTreeIndex{pager: pager, rootPN: ROOT_PN}, nil
+	table = &BTreeIndex{pager: pager, rootPN: ROOT_PN, allowDuplicates: recordedOptions.AllowDuplicates,
+		codec: codecName, compress: recordedOptions.PrefixCompression}
+	if options.HotKeyCacheSize > 0 {
+		table.hotKeys = newHotKeyCache(options.HotKeyCacheSize)
+	}
+	return table, nil
+}
+
+// Read the name of the codec recorded next to a table; "" if it has none.
+func readCodecFile(filename string) (string, error) {
+	data, err := ioutil.ReadFile(filename + CODEC_FILE_SUFFIX)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(data), err
+}
+
+// Read the options recorded next to a table; only the recorded ones are set.
+func readOptionsFile(filename string) (options TableOptions, err error) {
+	data, err := ioutil.ReadFile(filename + OPTIONS_FILE_SUFFIX)
+	if os.IsNotExist(err) {
+		return options, nil
+	} else if err != nil {
+		return options, err
+	}
+	for _, name := range strings.Fields(string(data)) {
+		switch name {
+		case PREFIX_COMPRESSION_OPTION:
+			options.PrefixCompression = true
+		case ALLOW_DUPLICATES_OPTION:
+			options.AllowDuplicates = true
+		default:
+			return options, fmt.Errorf("unknown table option %q", name)
+		}
+	}
+	return options, nil
+}
+
+// Record a new table's options next to it, removing any stale record if it has none.
+func writeOptionsFile(filename string, options TableOptions) error {
+	names := make([]string, 0)
+	if options.PrefixCompression {
+		names = append(names, PREFIX_COMPRESSION_OPTION)
+	}
+	if options.AllowDuplicates {
+		names = append(names, ALLOW_DUPLICATES_OPTION)
+	}
+	if len(names) == 0 {
+		if err := os.Remove(filename + OPTIONS_FILE_SUFFIX); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(filename+OPTIONS_FILE_SUFFIX, []byte(strings.Join(names, "\n")+"\n"), 0666)
 }
 
 // Get this index's filename.
@@ -52,8 +208,17 @@ func (table *BTreeIndex) Close() (err error) {
 	return err
 }
 
-// Finds the given key.
+// Finds the given key, going straight to its leaf if the hot key cache remembers it.
 func (table *BTreeIndex) Find(key int64) (utils.Entry, error) {
+	table.rwlock.RLock()
+	defer table.rwlock.RUnlock()
+	if table.hotKeys != nil {
+		entry, hit := table.findCached(key)
+		table.hotKeys.record(hit)
+		if hit {
+			return entry, nil
+		}
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -66,8 +231,11 @@ func (table *BTreeIndex) Find(key int64) (utils.Entry, error) {
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
 	// Insert the entry into the root node.
-	value, found := rootNode.get(key)
+	value, leafPN, found := rootNode.get(key)
 	if found {
+		if table.hotKeys != nil {
+			table.hotKeys.put(key, leafPN)
+		}
 		return BTreeEntry{key: key, value: value}, nil
 	}
 	return nil, errors.New("entry could not be found")
@@ -75,10 +243,44 @@ func (table *BTreeIndex) Find(key int64) (utils.Entry, error) {
 
 // Inserts an entry to the table.
 func (table *BTreeIndex) Insert(key int64, value int64) error {
+	mode := INSERT_UNIQUE
+	if table.allowDuplicates {
+		mode = INSERT_DUPLICATE
+	}
+	err := table.insert(key, value, mode).err
+	if err == nil && table.onInsert != nil {
+		table.onInsert(key)
+	}
+	return err
+}
+
+// Upsert sets a key to the given value, inserting it if need be, in one traversal of the
+// tree. Reports the value it had, if it existed.
+func (table *BTreeIndex) Upsert(key int64, value int64) (oldValue int64, existed bool, err error) {
+	result := table.insert(key, value, UPSERT)
+	if result.err == nil && !result.replaced && table.onInsert != nil {
+		table.onInsert(key)
+	}
+	return result.oldValue, result.replaced, result.err
+}
+
+// Set a function to call with each key Insert or Upsert adds to the table, once the write is done
+// and the table unlocked. Set it before the table is shared.
+func (table *BTreeIndex) SetInsertHook(hook func(key int64)) {
+	table.onInsert = hook
+}
+
+// insert adds an entry to the table as the mode says, splitting the root if need be.
+func (table *BTreeIndex) insert(key int64, value int64, mode insertMode) (result Split) {
+	table.rwlock.RLock()
+	defer table.rwlock.RUnlock()
+	if err := checkEntry(table.pager, BTreeEntry{key: key, value: value}); err != nil {
+		return Split{err: err}
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
-		return err
+		return Split{err: err}
 	}
 	// [CONCURRENCY] Lock and eventually unlock the root node.
 	lockRoot(rootPage)
@@ -87,7 +289,7 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
 	// Insert the entry into the root node.
-	result := rootNode.insert(key, value, false)
+	result = rootNode.insert(key, value, mode, table.compress, table.hotKeys)
 	// Check if we need to split the root node.
 	// Remember to preserve the invariant that the root node occupies page 0.
 	if result.isSplit {
@@ -95,7 +297,7 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 		defer SUPER_NODE.unlock()
 		// Ensure that our left PN hasn't changed.
 		if result.leftPN != 0 {
-			return errors.New("splitting was corrupted")
+			return Split{err: errors.New("splitting was corrupted")}
 		}
 		// Create a new node to transfer our data.
 		var newNodePN int64
@@ -104,7 +306,7 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 			// Create a new leaf node.
 			newNode, err := createLeafNode(table.pager)
 			if err != nil {
-				return errors.New("failed to split root node")
+				return Split{err: errors.New("failed to split root node")}
 			}
 			defer newNode.page.Put()
 			// Copy the attributes from the root node.
@@ -115,7 +317,7 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 			// Create a new internal node.
 			newNode, err := createInternalNode(table.pager)
 			if err != nil {
-				return errors.New("failed to split root node")
+				return Split{err: errors.New("failed to split root node")}
 			}
 			defer newNode.page.Put()
 			// Copy the attributes from the root node.
@@ -132,11 +334,16 @@ func (table *BTreeIndex) Insert(key int64, value int64) error {
 		newRoot.updatePNAt(1, result.rightPN)
 		newRoot.updateNumKeys(1)
 	}
-	return result.err
+	return result
 }
 
 // Update modifies an existing entry.
 func (table *BTreeIndex) Update(key int64, value int64) error {
+	table.rwlock.RLock()
+	defer table.rwlock.RUnlock()
+	if err := checkEntry(table.pager, BTreeEntry{key: key, value: value}); err != nil {
+		return err
+	}
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -149,12 +356,14 @@ func (table *BTreeIndex) Update(key int64, value int64) error {
 	defer unsafeUnlockRoot(rootNode)
 	defer rootPage.Put()
 	// Update the entry.
-	result := rootNode.insert(key, value, true)
+	result := rootNode.insert(key, value, UPDATE_EXISTING, table.compress, table.hotKeys)
 	return result.err
 }
 
 // Delete removes a key from the table.
 func (table *BTreeIndex) Delete(key int64) error {
+	table.rwlock.RLock()
+	defer table.rwlock.RUnlock()
 	// Get the root node.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
@@ -179,6 +388,7 @@ func (table *BTreeIndex) Select() ([]utils.Entry, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer cursor.Close()
 
 	// Traverse over all entries.
 	for {
@@ -200,6 +410,8 @@ func (table *BTreeIndex) Select() ([]utils.Entry, error) {
 
 // Print will pretty-print all nodes in the table.
 func (table *BTreeIndex) Print(w io.Writer) {
+	table.rwlock.RLock()
+	defer table.rwlock.RUnlock()
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
 		return
@@ -211,6 +423,8 @@ func (table *BTreeIndex) Print(w io.Writer) {
 
 // PrintPN will pretty-print the node with page number PN.
 func (table *BTreeIndex) PrintPN(pagenum int, w io.Writer) {
+	table.rwlock.RLock()
+	defer table.rwlock.RUnlock()
 	page, err := table.pager.GetPage(int64(pagenum))
 	if err != nil {
 		return
@@ -3,9 +3,10 @@ package btree
 import (
 	"encoding/binary"
 	"errors"
-	"fmt"
+	"math"
 
 	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 // We'll always maintain the invariant that the root's pagenum is 0.
@@ -24,17 +25,52 @@ var NODE_HEADER_SIZE int64 = NODETYPE_SIZE + NUM_KEYS_SIZE
 var RIGHT_SIBLING_PN_OFFSET int64 = NODE_HEADER_SIZE
 var RIGHT_SIBLING_PN_SIZE int64 = binary.MaxVarintLen64
 var LEAF_NODE_HEADER_SIZE int64 = NODE_HEADER_SIZE + RIGHT_SIBLING_PN_SIZE
-var ENTRIES_PER_LEAF_NODE int64 = ((pager.PAGESIZE - LEAF_NODE_HEADER_SIZE) / ENTRYSIZE) - 1
+
+// Prefix-compressed leaf node constants. Compressed leaves store a base key
+// after the regular leaf header, and each entry stores its key as a fixed-width
+// delta from that base.
+var BASE_KEY_OFFSET int64 = LEAF_NODE_HEADER_SIZE
+var BASE_KEY_SIZE int64 = binary.MaxVarintLen64
+var COMPRESSED_LEAF_NODE_HEADER_SIZE int64 = LEAF_NODE_HEADER_SIZE + BASE_KEY_SIZE
+var KEY_DELTA_SIZE int64 = 4 // uint32 delta from the base key
+var COMPRESSED_ENTRYSIZE int64 = KEY_DELTA_SIZE + binary.MaxVarintLen64
+
+// LeafLayout versions the serialization of a leaf node. It is stored in the
+// node type byte, so any nonzero value denotes a leaf.
+type LeafLayout byte
+
+const (
+	PLAIN_LEAF_LAYOUT      LeafLayout = 1 // Full-width keys.
+	COMPRESSED_LEAF_LAYOUT LeafLayout = 2 // Base key plus per-entry deltas.
+)
 
 // Internal node header constants.
 var KEY_SIZE int64 = binary.MaxVarintLen64
 var PN_SIZE int64 = binary.MaxVarintLen64
 var INTERNAL_NODE_HEADER_SIZE int64 = NODE_HEADER_SIZE
-var ptrSpace int64 = pager.PAGESIZE - INTERNAL_NODE_HEADER_SIZE - KEY_SIZE
-var KEYS_PER_INTERNAL_NODE int64 = (ptrSpace / (KEY_SIZE + PN_SIZE)) - 1
 var KEYS_OFFSET int64 = INTERNAL_NODE_HEADER_SIZE
-var KEYS_SIZE int64 = KEY_SIZE * (KEYS_PER_INTERNAL_NODE + 1)
-var PNS_OFFSET int64 = KEYS_OFFSET + KEYS_SIZE
+
+// The node layout constants that depend on the size of a pager's pages.
+type nodeLayout struct {
+	entriesPerLeaf           int64 // Entries a plain leaf holds before splitting.
+	entriesPerCompressedLeaf int64 // Entries a compressed leaf holds before splitting.
+	keysPerInternal          int64 // Keys an internal node holds before splitting.
+	pnsOffset                int64 // Offset of an internal node's first child pagenumber.
+}
+
+// layoutOf computes the node layout of a pager's pages. Nodes stop short of the pager's page
+// trailer.
+func layoutOf(p *pager.Pager) nodeLayout {
+	nodeSize := p.GetUsableSize()
+	ptrSpace := nodeSize - INTERNAL_NODE_HEADER_SIZE - KEY_SIZE
+	keysPerInternal := (ptrSpace / (KEY_SIZE + PN_SIZE)) - 1
+	return nodeLayout{
+		entriesPerLeaf:           ((nodeSize - LEAF_NODE_HEADER_SIZE) / ENTRYSIZE) - 1,
+		entriesPerCompressedLeaf: ((nodeSize - COMPRESSED_LEAF_NODE_HEADER_SIZE) / COMPRESSED_ENTRYSIZE) - 1,
+		keysPerInternal:          keysPerInternal,
+		pnsOffset:                KEYS_OFFSET + KEY_SIZE*(keysPerInternal+1),
+	}
+}
 
 // [CONCURRENCY]
 var SUPER_NODE *InternalNode = &InternalNode{NodeHeader{INTERNAL_NODE, 0, &pager.Page{}}, nil}
@@ -56,9 +92,11 @@ type NodeHeader struct {
 
 // Leaf Node definition
 type LeafNode struct {
-	NodeHeader           // Include header information
-	rightSiblingPN int64 // Page number of the right sibling node
-	parent         Node  // Pointer to the parent node for unlocking.
+	NodeHeader                // Include header information
+	rightSiblingPN int64      // Page number of the right sibling node
+	parent         Node       // Pointer to the parent node for unlocking.
+	layout         LeafLayout // Serialization version of this leaf.
+	baseKey        int64      // Base key for compressed leaves.
 }
 
 // Internal Node definition
@@ -74,9 +112,9 @@ type InternalNode struct {
 // initPage resets the page then sets the nodeType variable.
 func initPage(page *pager.Page, nodeType NodeType) {
 	page.SetDirty(true)
-	copy(*page.GetData(), make([]byte, pager.PAGESIZE))
+	copy(*page.GetData(), make([]byte, len(*page.GetData())))
 	if nodeType == LEAF_NODE {
-		(*page.GetData())[int(NODETYPE_OFFSET)] = 1 // Set the nodeType bit
+		(*page.GetData())[int(NODETYPE_OFFSET)] = byte(PLAIN_LEAF_LAYOUT) // Set the nodeType bit
 	}
 }
 
@@ -118,8 +156,8 @@ func keyPos(index int64) int64 {
 }
 
 // pnPos returns the page offset to the internal node's ith child's pagenumber
-func pnPos(index int64) int64 {
-	return PNS_OFFSET + index*PN_SIZE
+func (node *InternalNode) pnPos(index int64) int64 {
+	return layoutOf(node.page.GetPager()).pnsOffset + index*PN_SIZE
 }
 
 /////////////////////////////////////////////////////////////////////////////
@@ -132,10 +170,19 @@ func pageToLeafNode(page *pager.Page) *LeafNode {
 	rightSiblingPN, _ := binary.Varint(
 		(*page.GetData())[RIGHT_SIBLING_PN_OFFSET : RIGHT_SIBLING_PN_OFFSET+RIGHT_SIBLING_PN_SIZE],
 	)
+	layout := LeafLayout((*page.GetData())[NODETYPE_OFFSET])
+	var baseKey int64
+	if layout == COMPRESSED_LEAF_LAYOUT {
+		baseKey, _ = binary.Varint(
+			(*page.GetData())[BASE_KEY_OFFSET : BASE_KEY_OFFSET+BASE_KEY_SIZE],
+		)
+	}
 	return &LeafNode{
 		nodeHeader,
 		rightSiblingPN,
 		nil,
+		layout,
+		baseKey,
 	}
 }
 
@@ -164,6 +211,8 @@ func (node *LeafNode) getNodeType() NodeType {
 // copy copies the attributes and data of toCopy to the leaf node.
 func (node *LeafNode) copy(toCopy *LeafNode) {
 	copy(*node.page.GetData(), *toCopy.page.GetData())
+	node.layout = toCopy.layout
+	node.baseKey = toCopy.baseKey
 	node.updateNumKeys(toCopy.numKeys)
 	node.setRightSibling(toCopy.rightSiblingPN)
 }
@@ -190,24 +239,134 @@ func (node *LeafNode) setRightSibling(siblingPN int64) int64 {
 	return oldSiblingPN
 }
 
+// isCompressed returns true if the leaf uses the prefix-compressed layout.
+func (node *LeafNode) isCompressed() bool {
+	return node.layout == COMPRESSED_LEAF_LAYOUT
+}
+
+// capacity returns the number of entries the leaf can hold before splitting.
+func (node *LeafNode) capacity() int64 {
+	return layoutCapacity(node.page.GetPager(), node.layout)
+}
+
+// layoutCapacity returns the number of entries a leaf with the given layout
+// can hold before splitting, on the given pager's pages.
+func layoutCapacity(p *pager.Pager, layout LeafLayout) int64 {
+	if layout == COMPRESSED_LEAF_LAYOUT {
+		return layoutOf(p).entriesPerCompressedLeaf
+	}
+	return layoutOf(p).entriesPerLeaf
+}
+
+// entrySize returns the size of a single serialized entry in this leaf.
+func (node *LeafNode) entrySize() int64 {
+	if node.isCompressed() {
+		return COMPRESSED_ENTRYSIZE
+	}
+	return ENTRYSIZE
+}
+
 // entryPos returns the page offset to the entry at the given index.
 func (node *LeafNode) entryPos(index int64) int64 {
+	if node.isCompressed() {
+		return COMPRESSED_LEAF_NODE_HEADER_SIZE + index*COMPRESSED_ENTRYSIZE
+	}
 	return entryPos(LEAF_NODE_HEADER_SIZE, index)
 }
 
+// fits returns true if the given key can be stored in this leaf's current layout.
+func (node *LeafNode) fits(key int64) bool {
+	if !node.isCompressed() {
+		return true
+	}
+	return key >= node.baseKey && uint64(key)-uint64(node.baseKey) <= math.MaxUint32
+}
+
 // modifyEntry updates the data stored in the entry at the given index.
 func (node *LeafNode) modifyEntry(index int64, entry BTreeEntry) {
-	newdata := entry.Marshal()
+	var newdata []byte
+	if node.isCompressed() {
+		newdata = make([]byte, KEY_DELTA_SIZE)
+		binary.BigEndian.PutUint32(newdata, uint32(uint64(entry.key)-uint64(node.baseKey)))
+		bin := make([]byte, binary.MaxVarintLen64)
+		binary.PutVarint(bin, entry.value)
+		newdata = append(newdata, bin...)
+	} else {
+		newdata = encodeEntry(node.page, entry)
+	}
 	startPos := node.entryPos(index)
-	node.page.Update(newdata, startPos, ENTRYSIZE)
+	node.page.Update(newdata, startPos, node.entrySize())
 }
 
 // getEntry returns the entry stored in the entry at the given index.
 func (node *LeafNode) getEntry(index int64) BTreeEntry {
 	startPos := node.entryPos(index)
+	data := (*node.page.GetData())[startPos : startPos+node.entrySize()]
+	if node.isCompressed() {
+		delta := binary.BigEndian.Uint32(data[:KEY_DELTA_SIZE])
+		value, _ := binary.Varint(data[KEY_DELTA_SIZE:])
+		return BTreeEntry{key: int64(uint64(node.baseKey) + uint64(delta)), value: value}
+	}
 	// Deserialize the entry.
-	entry := unmarshalEntry((*node.page.GetData())[startPos : startPos+ENTRYSIZE])
-	return entry
+	return decodeEntry(node.page, data)
+}
+
+// getEntries returns every entry stored in the leaf node.
+func (node *LeafNode) getEntries() []BTreeEntry {
+	entries := make([]BTreeEntry, node.numKeys)
+	for i := int64(0); i < node.numKeys; i++ {
+		entries[i] = node.getEntry(i)
+	}
+	return entries
+}
+
+// rewrite replaces the contents of the leaf with the given sorted entries.
+// If compress is set and the entries span a small enough key range, the
+// compressed layout is used; otherwise the plain layout is used.
+func (node *LeafNode) rewrite(entries []BTreeEntry, compress bool) {
+	layout, baseKey := chooseLayout(entries, compress)
+	node.layout = layout
+	node.baseKey = baseKey
+	node.page.Update([]byte{byte(layout)}, NODETYPE_OFFSET, NODETYPE_SIZE)
+	if layout == COMPRESSED_LEAF_LAYOUT {
+		baseData := make([]byte, BASE_KEY_SIZE)
+		binary.PutVarint(baseData, baseKey)
+		node.page.Update(baseData, BASE_KEY_OFFSET, BASE_KEY_SIZE)
+	}
+	for i, entry := range entries {
+		node.modifyEntry(int64(i), entry)
+	}
+	node.updateNumKeys(int64(len(entries)))
+}
+
+// chooseLayout returns the layout and base key to store the given sorted entries with.
+func chooseLayout(entries []BTreeEntry, compress bool) (LeafLayout, int64) {
+	if compress {
+		if base, ok := chooseBaseKey(entries); ok {
+			return COMPRESSED_LEAF_LAYOUT, base
+		}
+	}
+	return PLAIN_LEAF_LAYOUT, 0
+}
+
+// chooseBaseKey picks a base key from which every entry's key can be stored as
+// a uint32 delta, centering the slack so that nearby keys on either side will
+// still fit later. Returns false if the entries span too wide a range.
+func chooseBaseKey(entries []BTreeEntry) (int64, bool) {
+	if len(entries) == 0 {
+		return 0, false
+	}
+	min := entries[0].key
+	max := entries[len(entries)-1].key
+	span := uint64(max) - uint64(min)
+	if span > math.MaxUint32 {
+		return 0, false
+	}
+	slack := (math.MaxUint32 - span) / 2
+	if uint64(min)^(1<<63) < slack { // Distance from math.MinInt64.
+		return math.MinInt64, true
+	}
+	return min - int64(slack), true
 }
 
 // getKeyAt returns the key stored at the given index of the leaf node.
@@ -304,7 +463,7 @@ func (node *InternalNode) updateKeyAt(index int64, key int64) {
 
 // getPNAt returns the pagenumber stored at the given index of the internal node.
 func (node *InternalNode) getPNAt(index int64) int64 {
-	startPos := pnPos(index)
+	startPos := node.pnPos(index)
 	pagenum, _ := binary.Varint((*node.page.GetData())[startPos : startPos+PN_SIZE])
 	return pagenum
 }
@@ -314,7 +473,7 @@ func (node *InternalNode) updatePNAt(index int64, pagenum int64) {
 	// Serialize the pagenum data
 	data := make([]byte, PN_SIZE)
 	binary.PutVarint(data, pagenum)
-	startPos := pnPos(int64(index))
+	startPos := node.pnPos(int64(index))
 	node.page.Update(data, startPos, PN_SIZE)
 }
 
@@ -379,7 +538,7 @@ func unsafeUnlockRoot(root Node) {
 	case *InternalNode:
 		if castedRootNode.parent != nil {
 			// Emit a warning to disable this function call.
-			fmt.Println("WARNING: unsafeUnlockRoot was called. This function will only be called if theroot node is not being unlocked properly.")
+			utils.GetLogger().Warn("unsafeUnlockRoot was called; the root node is not being unlocked properly")
 			castedRootNode.parent = nil
 			castedRootNode.page.WUnlock()
 			SUPER_NODE.page.WUnlock()
@@ -387,7 +546,7 @@ func unsafeUnlockRoot(root Node) {
 	case *LeafNode:
 		if castedRootNode.parent != nil {
 			// Emit a warning to disable this function call.
-			fmt.Println("WARNING: unsafeUnlockRoot was called. This function will only be called if the root node is not being unlocked properly.")
+			utils.GetLogger().Warn("unsafeUnlockRoot was called; the root node is not being unlocked properly")
 			castedRootNode.parent = nil
 			castedRootNode.page.WUnlock()
 			SUPER_NODE.page.WUnlock()
@@ -410,7 +569,7 @@ func (node *InternalNode) initChild(child Node) {
 // only checks if force == false
 func (node *InternalNode) unlockParent(force bool) error {
 	// If we could split and if we're not writing, don't unlock the parents.
-	if !force && node.numKeys == KEYS_PER_INTERNAL_NODE {
+	if !force && node.numKeys == layoutOf(node.page.GetPager()).keysPerInternal {
 		return nil
 	}
 	// Else, unlock the parents recursively, and remove parent pointers.
@@ -439,7 +598,10 @@ func (node *InternalNode) unlock() {
 // only checks if force == false
 func (node *LeafNode) unlockParent(force bool) error {
 	// If we could split and if we're not writing, don't unlock the parents.
-	if !force && node.numKeys == ENTRIES_PER_LEAF_NODE {
+	// A compressed leaf may also split early if a key outside its range forces
+	// it back into the plain layout.
+	if !force && (node.numKeys == node.capacity() ||
+		(node.isCompressed() && node.numKeys >= layoutOf(node.page.GetPager()).entriesPerLeaf)) {
 		return nil
 	}
 	// Unlock the parents recursively, and remove parent pointers.
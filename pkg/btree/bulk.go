@@ -0,0 +1,232 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
+// A node built during a bulk load, keyed by the smallest key beneath it.
+type bulkChild struct {
+	key int64
+	pn  int64
+}
+
+// BulkLoad creates a new table at filename holding the given entries, which must be sorted by
+// key, without duplicates unless options.AllowDuplicates is set. Leaves are packed full and
+// internal levels are built bottom-up, instead of inserting one entry at a time.
+func BulkLoad(filename string, entries []utils.Entry, options TableOptions) (*BTreeIndex, error) {
+	if _, err := os.Stat(filename); err == nil {
+		return nil, errors.New("bulk load target already exists")
+	}
+	if !utils.EntrySliceSorted(entries) {
+		return nil, errors.New("bulk load entries must be sorted by key")
+	}
+	leafEntries := make([]BTreeEntry, len(entries))
+	for i, entry := range entries {
+		if i > 0 && entry.GetKey() == entries[i-1].GetKey() && !options.AllowDuplicates {
+			return nil, fmt.Errorf("bulk load entries contain duplicate key %d", entry.GetKey())
+		}
+		leafEntries[i] = BTreeEntry{key: entry.GetKey(), value: entry.GetValue()}
+	}
+	table, err := OpenTableWithOptions(filename, options)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range leafEntries {
+		if err = checkEntry(table.pager, entry); err != nil {
+			table.Close()
+			os.Remove(filename)
+			os.Remove(filename + CODEC_FILE_SUFFIX)
+			os.Remove(filename + OPTIONS_FILE_SUFFIX)
+			return nil, err
+		}
+	}
+	if err = table.bulkLoad(leafEntries, options.PrefixCompression); err != nil {
+		table.Close()
+		return nil, err
+	}
+	return table, nil
+}
+
+// Fill an empty table with the given sorted entries.
+func (table *BTreeIndex) bulkLoad(entries []BTreeEntry, compress bool) error {
+	rootPage, err := table.pager.GetPage(ROOT_PN)
+	if err != nil {
+		return err
+	}
+	defer rootPage.Put()
+	layout := layoutOf(table.pager)
+	// Small tables fit in the root leaf.
+	if int64(len(entries)) <= layout.entriesPerLeaf {
+		pageToLeafNode(rootPage).rewrite(entries, compress)
+		return nil
+	}
+	// Pack the entries into a chain of leaves.
+	children := make([]bulkChild, 0)
+	var prev *LeafNode
+	for _, run := range bulkRuns(len(entries), layout.entriesPerLeaf) {
+		leaf, err := createLeafNode(table.pager)
+		if err != nil {
+			if prev != nil {
+				prev.page.Put()
+			}
+			return err
+		}
+		leaf.setRightSibling(-1)
+		leaf.rewrite(entries[run[0]:run[1]], compress)
+		if prev != nil {
+			prev.setRightSibling(leaf.page.GetPageNum())
+			prev.page.Put()
+		}
+		prev = leaf
+		children = append(children, bulkChild{key: entries[run[0]].key, pn: leaf.page.GetPageNum()})
+	}
+	prev.page.Put()
+	// Build internal levels until the remaining children fit under the root.
+	for int64(len(children)) > layout.keysPerInternal+1 {
+		parents := make([]bulkChild, 0)
+		for _, run := range bulkRuns(len(children), layout.keysPerInternal+1) {
+			node, err := createInternalNode(table.pager)
+			if err != nil {
+				return err
+			}
+			node.fill(children[run[0]:run[1]])
+			parents = append(parents, bulkChild{key: children[run[0]].key, pn: node.page.GetPageNum()})
+			node.page.Put()
+		}
+		children = parents
+	}
+	initPage(rootPage, INTERNAL_NODE)
+	pageToInternalNode(rootPage).fill(children)
+	return nil
+}
+
+// fill sets an internal node's children, separated by each child's smallest key.
+func (node *InternalNode) fill(children []bulkChild) {
+	for i, child := range children {
+		node.updatePNAt(int64(i), child.pn)
+		if i > 0 {
+			node.updateKeyAt(int64(i-1), child.key)
+		}
+	}
+	node.updateNumKeys(int64(len(children) - 1))
+}
+
+// bulkRuns splits n items into the fewest [start, end) runs of at most max items,
+// with run lengths differing by at most one.
+func bulkRuns(n int, max int64) [][2]int {
+	numRuns := (n + int(max) - 1) / int(max)
+	runs := make([][2]int, numRuns)
+	start := 0
+	for i := range runs {
+		size := n / numRuns
+		if i < n%numRuns {
+			size++
+		}
+		runs[i] = [2]int{start, start + size}
+		start += size
+	}
+	return runs
+}
+
+// LeafEntries returns every entry stored in the table's leaves, sorted by key. It reads every
+// page of the file rather than walking the tree, so it doesn't depend on internal nodes.
+func (table *BTreeIndex) LeafEntries() ([]utils.Entry, error) {
+	table.rwlock.RLock()
+	defer table.rwlock.RUnlock()
+	return table.leafEntries()
+}
+
+// Read every leaf's entries.
+func (table *BTreeIndex) leafEntries() (entries []utils.Entry, err error) {
+	entries = make([]utils.Entry, 0)
+	for pn := int64(0); pn < table.pager.GetNumPages(); pn++ {
+		page, err := table.pager.GetPage(pn)
+		if err != nil {
+			return nil, err
+		}
+		if leaf, ok := pageToNode(page).(*LeafNode); ok {
+			for _, entry := range leaf.getEntries() {
+				entries = append(entries, entry)
+			}
+		}
+		page.Put()
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return utils.CompareEntries(entries[i], entries[j]) < 0
+	})
+	for i := 1; i < len(entries) && !table.allowDuplicates; i++ {
+		if entries[i].GetKey() == entries[i-1].GetKey() {
+			return nil, fmt.Errorf("key %d found in more than one leaf", entries[i].GetKey())
+		}
+	}
+	return entries, nil
+}
+
+// Reindex rebuilds the table from the entries in its leaves, discarding its internal nodes.
+// The new tree is bulk loaded into a sibling file, which is then renamed over the old one. The
+// table is locked throughout, so it waits for open cursors to be closed. If the new tree can't
+// be put in place, the table is reopened on its original file.
+func (table *BTreeIndex) Reindex() error {
+	table.rwlock.Lock()
+	defer table.rwlock.Unlock()
+	entries, err := table.leafEntries()
+	if err != nil {
+		return err
+	}
+	filename := table.pager.GetFilePath()
+	tmpname, backup := filename+".reindex", filename+".old"
+	removeTmp := func() {
+		os.Remove(tmpname)
+		os.Remove(tmpname + CODEC_FILE_SUFFIX)
+		os.Remove(tmpname + OPTIONS_FILE_SUFFIX)
+	}
+	removeTmp()
+	options := TableOptions{PrefixCompression: table.compress, AllowDuplicates: table.allowDuplicates, Codec: table.codec,
+		PageSize: table.pager.GetPageSize(), LegacyPageLayout: table.pager.GetPageLayout() == 0}
+	if table.hotKeys != nil {
+		options.HotKeyCacheSize = table.hotKeys.capacity
+	}
+	rebuilt, err := BulkLoad(tmpname, entries, options)
+	if err != nil {
+		removeTmp()
+		return err
+	}
+	if err = rebuilt.Close(); err != nil {
+		removeTmp()
+		return err
+	}
+	// Once the table is closed, any failure puts the original file back and reopens it.
+	restore := func(cause error) error {
+		removeTmp()
+		if _, err := os.Stat(backup); err == nil {
+			os.Rename(backup, filename)
+		}
+		if reopened, err := OpenTableWithOptions(filename, options); err == nil {
+			table.pager, table.rootPN, table.hotKeys = reopened.pager, reopened.rootPN, reopened.hotKeys
+		}
+		return cause
+	}
+	if err = table.Close(); err != nil {
+		return restore(err)
+	}
+	if err = os.Rename(filename, backup); err != nil {
+		return restore(err)
+	}
+	if err = os.Rename(tmpname, filename); err != nil {
+		return restore(err)
+	}
+	reopened, err := OpenTableWithOptions(filename, options)
+	if err != nil {
+		return restore(err)
+	}
+	table.pager, table.rootPN, table.hotKeys = reopened.pager, reopened.rootPN, reopened.hotKeys
+	// The table keeps the codec and options files it has; the rebuilt ones record the same.
+	removeTmp()
+	os.Remove(backup)
+	return nil
+}
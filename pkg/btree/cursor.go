@@ -9,19 +9,27 @@ import (
 
 // Cursors are an abstration to represent locations in a table.
 type BTreeCursor struct {
-	table   *BTreeIndex  // The table that this cursor point to.
-	cellnum int64        // The cell number within a leaf node.
-	isEnd   bool         // Indicates that this cursor is at the end of a node.
-	curNode *LeafNode    // Current node.
-	mu      sync.RWMutex // Mutex for cursor
+	table    *BTreeIndex  // The table that this cursor point to.
+	cellnum  int64        // The cell number within a leaf node.
+	isEnd    bool         // Set while the cursor is past the last entry of its node.
+	curNode  *LeafNode    // Current node.
+	released bool         // Set once the lock on the current node has been released.
+	mu       sync.RWMutex // Mutex for cursor
+	// Read-ahead of sequential scans; see SetScanHint.
+	hint        ScanHint
+	prefetching int32          // Set while leaves are being read ahead.
+	prefetches  sync.WaitGroup // Leaves being read ahead, waited on once the cursor is released.
 }
 
-// TableStart returns a cursor pointing to the first entry of the table and lock it.
+// TableStart returns a cursor pointing to the first entry of the table and locks it until the
+// cursor is closed.
 func (table *BTreeIndex) TableStart() (utils.Cursor, error) {
 	cursor := BTreeCursor{table: table, cellnum: 0}
+	table.rwlock.RLock()
 	// Get the root page.
 	curPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
+		table.rwlock.RUnlock()
 		return nil, err
 	}
 	defer curPage.Put()
@@ -32,6 +40,7 @@ func (table *BTreeIndex) TableStart() (utils.Cursor, error) {
 		leftmostPN := curNode.getPNAt(0)
 		curPage, err = table.pager.GetPage(leftmostPN)
 		if err != nil {
+			table.rwlock.RUnlock()
 			return nil, err
 		}
 		defer curPage.Put()
@@ -45,13 +54,15 @@ func (table *BTreeIndex) TableStart() (utils.Cursor, error) {
 	return &cursor, nil
 }
 
-// TableEnd returns a cursor pointing to the last entry in the db.
-// If the db is empty, returns a cursor to the new insertion position.
+// TableEnd returns a cursor pointing to the last entry in the db and locks it until the cursor
+// is closed. If the db is empty, returns a cursor to the new insertion position.
 func (table *BTreeIndex) TableEnd() (utils.Cursor, error) {
 	cursor := BTreeCursor{table: table, cellnum: 0}
+	table.rwlock.RLock()
 	// Get the root page.
 	curPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
+		table.rwlock.RUnlock()
 		return &BTreeCursor{}, err
 	}
 	defer curPage.Put()
@@ -62,6 +73,7 @@ func (table *BTreeIndex) TableEnd() (utils.Cursor, error) {
 		rightmostPN := curNode.getPNAt(curHeader.numKeys)
 		curPage, err = table.pager.GetPage(rightmostPN)
 		if err != nil {
+			table.rwlock.RUnlock()
 			return &BTreeCursor{}, err
 		}
 		defer curPage.Put()
@@ -69,34 +81,108 @@ func (table *BTreeIndex) TableEnd() (utils.Cursor, error) {
 	}
 	// Set the cursor to point to the last entry in the rightmost leaf node.
 	rightmostNode := pageToLeafNode(curPage)
-	cursor.isEnd = false
+	rightmostNode.page.RLock()
+	cursor.isEnd = (rightmostNode.numKeys == 0)
 	cursor.cellnum = rightmostNode.numKeys - 1
 	cursor.curNode = rightmostNode
 	return &cursor, nil
 }
 
-// TableFind returns a cursor pointing to the given key.
+// TableFind returns a cursor pointing to the given key, or to its first occurrence if
+// the key has duplicates, and locks it until the cursor is closed.
 // If the key is not found, returns a cursor to the new insertion position.
 // Hint: use keyToNodeEntry
 func (table *BTreeIndex) TableFind(key int64) (utils.Cursor, error) {
-	cursor := BTreeCursor{table: table}
+	return table.find(key)
+}
+
+// find returns a read-locked cursor to the first entry with a key >= the given key.
+func (table *BTreeIndex) find(key int64) (*BTreeCursor, error) {
+	cursor := &BTreeCursor{table: table}
+	if err := cursor.seek(key); err != nil {
+		return &BTreeCursor{}, err
+	}
+	return cursor, nil
+}
+
+// Reset repositions the cursor at the first entry with a key >= startKey, as TableFind does,
+// so that it can be reused for a new scan. The lock on the node the cursor was on is released
+// first, so it is safe to call mid-scan, as well as after the scan reached the end.
+func (cursor *BTreeCursor) Reset(startKey int64) error {
+	if cursor.curNode != nil {
+		cursor.release()
+	}
+	if err := cursor.seek(startKey); err != nil {
+		cursor.isEnd = true
+		return err
+	}
+	return nil
+}
+
+// seek read-locks the table and the leaf holding the first entry with a key >= the given key,
+// and points the cursor at that entry. Expects the cursor to hold no lock.
+func (cursor *BTreeCursor) seek(key int64) error {
+	table := cursor.table
+	table.rwlock.RLock()
 	// Get the root page.
 	rootPage, err := table.pager.GetPage(table.rootPN)
 	if err != nil {
-		return &BTreeCursor{}, err
+		table.rwlock.RUnlock()
+		return err
 	}
 	defer rootPage.Put()
 	rootNode := pageToNode(rootPage)
 	// Find the leaf node and cellnum that this key belongs to.
 	leaf, cellnum, err := rootNode.keyToNodeEntry(key)
 	if err != nil {
-		return &BTreeCursor{}, err
+		table.rwlock.RUnlock()
+		return err
 	}
-	// Initialize cursor.
+	leaf.page.RLock()
 	cursor.cellnum = cellnum
-	cursor.isEnd = (cellnum == leaf.numKeys)
 	cursor.curNode = leaf
-	return &cursor, nil
+	cursor.released = false
+	// The leftmost leaf that may hold the key can end just before it does.
+	for cursor.cellnum >= cursor.curNode.numKeys && cursor.curNode.rightSiblingPN > 0 {
+		nextPage, err := table.pager.GetPage(cursor.curNode.rightSiblingPN)
+		if err != nil {
+			cursor.release()
+			return err
+		}
+		nextNode := pageToLeafNode(nextPage)
+		nextNode.page.RLock()
+		cursor.curNode.page.RUnlock()
+		nextPage.Put()
+		cursor.cellnum = 0
+		cursor.curNode = nextNode
+	}
+	// Initialize cursor.
+	cursor.isEnd = (cursor.cellnum >= cursor.curNode.numKeys)
+	return nil
+}
+
+// TableFindAll returns every entry with the given key, in insertion order.
+func (table *BTreeIndex) TableFindAll(key int64) ([]utils.Entry, error) {
+	entries := make([]utils.Entry, 0)
+	cursor, err := table.find(key)
+	if err != nil {
+		return entries, err
+	}
+	defer cursor.release()
+	for !cursor.IsEnd() {
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			return entries, err
+		}
+		if entry.GetKey() != key {
+			break
+		}
+		entries = append(entries, entry)
+		if cursor.StepForward() {
+			break
+		}
+	}
+	return entries, nil
 }
 
 // TableFindRange returns a slice of Entries with keys between the startKey and endKey.
@@ -104,42 +190,70 @@ func (table *BTreeIndex) TableFindRange(startKey int64, endKey int64) ([]utils.E
 	/* SOLUTION {{{ */
 	// Initialize entries array, get starting cursor.
 	entries := make([]utils.Entry, 0)
-	cursor, err := table.TableFind(startKey)
+	cursor, err := table.find(startKey)
 	if err != nil {
 		return entries, err
 	}
+	defer cursor.release()
 	// Keep advancing the cursor and adding the current entry to the list of
-	// entries until reaching the end key.
-	curEntry, err := cursor.GetEntry()
-	if err != nil {
-		return entries, err
-	}
-	for endKey > curEntry.GetKey() && !cursor.IsEnd() {
-		entries = append(entries, curEntry)
-		cursor.StepForward()
-		curEntry, err = cursor.GetEntry()
+	// entries until reaching the end key, or the end of the table.
+	for !cursor.IsEnd() {
+		curEntry, err := cursor.GetEntry()
 		if err != nil {
 			return entries, err
 		}
+		if !utils.KeyInRange(curEntry, startKey, endKey, false) {
+			break
+		}
+		entries = append(entries, curEntry)
+		if cursor.StepForward() {
+			break
+		}
 	}
 	return entries, nil
 	/* SOLUTION }}} */
 }
 
-// stepForward moves the cursor ahead by one entry. Returns true at the end of the BTree.
+// Close releases the cursor's lock on its node; after that, it is at the end. Closing a cursor
+// that has already reached the end, or closing it twice, does nothing.
+func (cursor *BTreeCursor) Close() {
+	if cursor.curNode != nil {
+		cursor.release()
+		cursor.isEnd = true
+	}
+}
+
+// release drops the read lock on the cursor's node, unless stepping past the end already has,
+// then waits for any leaves still being read ahead before dropping its read lock on the table.
+func (cursor *BTreeCursor) release() {
+	released := cursor.released
+	if !released {
+		cursor.released = true
+		cursor.curNode.page.RUnlock()
+	}
+	cursor.prefetches.Wait()
+	if !released {
+		cursor.table.rwlock.RUnlock()
+	}
+}
+
+// stepForward moves the cursor ahead by one entry. Returns true at the end of the BTree, after
+// which IsEnd is true as well, and GetEntry fails.
 func (cursor *BTreeCursor) StepForward() (atEnd bool) {
 	// If the cursor is at the end of the node, go to the next node.
 	if cursor.cellnum+1 >= cursor.curNode.numKeys {
 		// Get the next node's page number.
 		nextPN := cursor.curNode.rightSiblingPN
 		if nextPN < 0 {
-			cursor.curNode.page.RUnlock()
+			cursor.isEnd = true
+			cursor.release()
 			return true
 		}
 		// Convert the page into a node.
 		nextPage, err := cursor.table.pager.GetPage(nextPN)
 		if err != nil {
-			cursor.curNode.page.RUnlock()
+			cursor.isEnd = true
+			cursor.release()
 			return true
 		}
 		defer nextPage.Put()
@@ -149,6 +263,11 @@ func (cursor *BTreeCursor) StepForward() (atEnd bool) {
 		// Reinitialize the cursor.
 		cursor.cellnum = 0
 		cursor.curNode = nextNode
+		cursor.isEnd = false
+		// Stepping onto a sibling is how sequential scans go; read on ahead of it.
+		if cursor.hint == SEQUENTIAL_SCAN {
+			cursor.readAhead(nextNode.rightSiblingPN)
+		}
 		// If the next node is empty, step to the next node.
 		if cursor.cellnum == nextNode.numKeys {
 			return cursor.StepForward()
@@ -168,11 +287,11 @@ func (cursor *BTreeCursor) IsEnd() bool {
 // getEntry returns the entry currently pointed to by the cursor.
 func (cursor *BTreeCursor) GetEntry() (utils.Entry, error) {
 	// Check if we're retrieving a non-existent entry.
-	if cursor.isEnd {
+	if cursor.isEnd || cursor.curNode == nil || cursor.cellnum >= cursor.curNode.numKeys {
 		return BTreeEntry{}, errors.New("getEntry: entry is non-existent")
 	}
-	cursor.curNode.page.WLock()
-	defer cursor.curNode.page.WUnlock()
+	// Every cursor holds a read lock on its current node until it steps off it or is closed,
+	// so the node can't be rewritten while it is decoded.
 	entry := cursor.curNode.getEntry(cursor.cellnum)
 	return entry, nil
 }
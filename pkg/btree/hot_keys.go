@@ -0,0 +1,136 @@
+package btree
+
+import (
+	"sync"
+
+	list "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/list"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
+// Counts of how a table's hot key cache has been used.
+type HotKeyStats struct {
+	Hits          int64 // Lookups that went straight to the cached leaf and found the key.
+	Misses        int64 // Lookups that traversed the tree, as the key wasn't cached or had moved.
+	Invalidations int64 // Cached keys dropped because their leaf split.
+}
+
+// An LRU cache of the leaves recently looked up keys were found on, so that looking them up
+// again skips the internal nodes. A cached leaf is only a hint: lookups check that the key is
+// still there, and traverse the tree if not.
+type hotKeyCache struct {
+	mtx      sync.Mutex
+	capacity int
+	keys     map[int64]*list.Link // Links to the hotKey for each cached key.
+	lru      *list.List           // Cached keys, most recently used first.
+	stats    HotKeyStats
+}
+
+// A key and the page number of the leaf it was found on.
+type hotKey struct {
+	key    int64
+	leafPN int64
+}
+
+// Create a cache holding up to capacity keys.
+func newHotKeyCache(capacity int) *hotKeyCache {
+	return &hotKeyCache{capacity: capacity, keys: make(map[int64]*list.Link), lru: list.NewList()}
+}
+
+// Get the leaf a key was last found on, marking it most recently used.
+func (cache *hotKeyCache) get(key int64) (leafPN int64, found bool) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	link, found := cache.keys[key]
+	if !found {
+		return 0, false
+	}
+	link.PopSelf()
+	cache.keys[key] = cache.lru.PushHead(link.GetKey())
+	return link.GetKey().(hotKey).leafPN, true
+}
+
+// Remember the leaf a key was found on, evicting the least recently used key if full.
+func (cache *hotKeyCache) put(key int64, leafPN int64) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	if link, found := cache.keys[key]; found {
+		link.PopSelf()
+	} else if len(cache.keys) >= cache.capacity {
+		oldest := cache.lru.PeekTail()
+		oldest.PopSelf()
+		delete(cache.keys, oldest.GetKey().(hotKey).key)
+	}
+	cache.keys[key] = cache.lru.PushHead(hotKey{key: key, leafPN: leafPN})
+}
+
+// Forget a key, e.g. once it is no longer on its cached leaf.
+func (cache *hotKeyCache) remove(key int64) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	if link, found := cache.keys[key]; found {
+		link.PopSelf()
+		delete(cache.keys, key)
+	}
+}
+
+// Forget every key cached as being on the given leaf.
+func (cache *hotKeyCache) invalidate(leafPN int64) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	for key, link := range cache.keys {
+		if link.GetKey().(hotKey).leafPN == leafPN {
+			link.PopSelf()
+			delete(cache.keys, key)
+			cache.stats.Invalidations++
+		}
+	}
+}
+
+// Count a lookup as a hit or a miss.
+func (cache *hotKeyCache) record(hit bool) {
+	cache.mtx.Lock()
+	defer cache.mtx.Unlock()
+	if hit {
+		cache.stats.Hits++
+	} else {
+		cache.stats.Misses++
+	}
+}
+
+// Get how the table's hot key cache has been used; all zero if it has none.
+func (table *BTreeIndex) HotKeyStats() HotKeyStats {
+	table.rwlock.RLock()
+	defer table.rwlock.RUnlock()
+	if table.hotKeys == nil {
+		return HotKeyStats{}
+	}
+	table.hotKeys.mtx.Lock()
+	defer table.hotKeys.mtx.Unlock()
+	return table.hotKeys.stats
+}
+
+// Look a key up on the leaf it was last found on, without traversing the tree.
+func (table *BTreeIndex) findCached(key int64) (utils.Entry, bool) {
+	leafPN, found := table.hotKeys.get(key)
+	if !found {
+		return nil, false
+	}
+	page, err := table.pager.GetPage(leafPN)
+	if err != nil {
+		table.hotKeys.remove(key)
+		return nil, false
+	}
+	defer page.Put()
+	page.RLock()
+	defer page.RUnlock()
+	// The leaf may have become the root's internal node since, or the key may have moved.
+	if pageToNodeHeader(page).nodeType == LEAF_NODE {
+		leaf := pageToLeafNode(page)
+		index := leaf.search(key)
+		if index < leaf.numKeys && leaf.getKeyAt(index) == key {
+			return leaf.getEntry(index), true
+		}
+	}
+	table.hotKeys.remove(key)
+	return nil, false
+}
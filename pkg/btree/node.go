@@ -17,15 +17,28 @@ type Split struct {
 	leftPN  int64 // The pagenumber for the left node.
 	rightPN int64 // The pagenumber for the right node.
 	err     error // Used to propagate errors upwards.
+	// Set if an upsert overwrote an existing entry, whose value was oldValue.
+	replaced bool
+	oldValue int64
 }
 
+// insertMode controls how an insert treats an existing entry with the same key.
+type insertMode int
+
+const (
+	INSERT_UNIQUE    insertMode = 0 // Fail if the key exists.
+	INSERT_DUPLICATE insertMode = 1 // Add another entry after any with the same key.
+	UPDATE_EXISTING  insertMode = 2 // Overwrite the entry with the key; fail if there is none.
+	UPSERT           insertMode = 3 // Overwrite the entry with the key, or add one if there is none.
+)
+
 // Node defines a common interface for leaf and internal nodes.
 type Node interface {
 	// Interface for main node functions.
 	search(int64) int64
-	insert(int64, int64, bool) Split
+	insert(int64, int64, insertMode, bool, *hotKeyCache) Split
 	delete(int64)
-	get(int64) (int64, bool)
+	get(int64) (int64, int64, bool)
 
 	// Interface for helper functions.
 	keyToNodeEntry(int64) (*LeafNode, int64, error)
@@ -53,30 +66,55 @@ func (node *LeafNode) search(key int64) int64 {
 	/* SOLUTION }}} */
 }
 
+// searchAfter returns the first index where key > given key.
+// If no key satisfies this condition, returns numKeys.
+func (node *LeafNode) searchAfter(key int64) int64 {
+	return int64(sort.Search(
+		int(node.numKeys),
+		func(idx int) bool {
+			return node.getKeyAt(int64(idx)) > key
+		},
+	))
+}
+
 // insert finds the appropriate place in a leaf node to insert a new tuple.
-// if update is true, allow overwriting existing keys. else, error.
-func (node *LeafNode) insert(key int64, value int64, update bool) Split {
+// The mode decides whether existing keys are overwritten, duplicated, or an error,
+// compress whether the table stores leaves in the compressed layout where their keys allow,
+// and hotKeys, if not nil, is the table's hot key cache to invalidate on a split.
+func (node *LeafNode) insert(key int64, value int64, mode insertMode, compress bool, hotKeys *hotKeyCache) Split {
 	/* SOLUTION {{{ */
 	node.unlockParent(false)
 	defer node.unlock()
 	// Get insert position.
 	insertPos := node.search(key)
-	// Check if this is a duplicate entry.
-	if insertPos < node.numKeys && node.getKeyAt(insertPos) == key {
-		if update {
+	if mode == INSERT_DUPLICATE {
+		// Keep duplicates in insertion order.
+		insertPos = node.searchAfter(key)
+	} else if insertPos < node.numKeys && node.getKeyAt(insertPos) == key {
+		// Check if this is a duplicate entry.
+		if mode == UPDATE_EXISTING {
 			node.updateValueAt(insertPos, value)
 			node.unlockParent(true)
 			return Split{}
+		} else if mode == UPSERT {
+			oldValue := node.getValueAt(insertPos)
+			node.updateValueAt(insertPos, value)
+			node.unlockParent(true)
+			return Split{replaced: true, oldValue: oldValue}
 		} else {
 			node.unlockParent(true)
 			return Split{err: errors.New("cannot insert duplicate key")}
 		}
 	}
 	// Return an error if we're updating a non-existent entry.
-	if update {
+	if mode == UPDATE_EXISTING {
 		node.unlockParent(true)
 		return Split{err: errors.New("cannot update non-existent entry")}
 	}
+	// If the key can't be stored in the current layout, rebuild the node.
+	if !node.fits(key) || (compress && node.numKeys == 0) {
+		return node.insertRewrite(insertPos, key, value, compress, hotKeys)
+	}
 	// Shift entries to the right if needed.
 	for i := node.numKeys - 1; i >= insertPos; i-- {
 		node.updateKeyAt(i+1, node.getKeyAt(i))
@@ -86,8 +124,8 @@ func (node *LeafNode) insert(key int64, value int64, update bool) Split {
 	// Modify the Entry at this position.
 	node.modifyEntry(insertPos, BTreeEntry{key: key, value: value})
 	// Check if we need to split the node.
-	if node.numKeys > ENTRIES_PER_LEAF_NODE {
-		split := node.split()
+	if node.numKeys > node.capacity() {
+		split := node.split(compress, hotKeys)
 		return split
 	}
 	node.unlockParent(true)
@@ -95,6 +133,22 @@ func (node *LeafNode) insert(key int64, value int64, update bool) Split {
 	/* SOLUTION }}} */
 }
 
+// insertRewrite inserts an entry that doesn't fit the leaf's current layout by
+// rewriting the leaf's entries, splitting the node if they no longer fit.
+func (node *LeafNode) insertRewrite(insertPos int64, key int64, value int64, compress bool, hotKeys *hotKeyCache) Split {
+	entries := node.getEntries()
+	entries = append(entries, BTreeEntry{})
+	copy(entries[insertPos+1:], entries[insertPos:])
+	entries[insertPos] = BTreeEntry{key: key, value: value}
+	layout, _ := chooseLayout(entries, compress)
+	if int64(len(entries)) > layoutCapacity(node.page.GetPager(), layout) {
+		return node.splitEntries(entries, compress, hotKeys)
+	}
+	node.rewrite(entries, compress)
+	node.unlockParent(true)
+	return Split{}
+}
+
 // delete removes a given tuple from the leaf node, if the given key exists.
 func (node *LeafNode) delete(key int64) {
 	// Find entry.
@@ -115,36 +169,43 @@ func (node *LeafNode) delete(key int64) {
 }
 
 // split is a helper function to split a leaf node, then propagate the split upwards.
-func (node *LeafNode) split() Split {
+// The halves are compressed if the table compresses leaves and their keys allow.
+func (node *LeafNode) split(compress bool, hotKeys *hotKeyCache) Split {
 	/* SOLUTION {{{ */
+	return node.splitEntries(node.getEntries(), compress, hotKeys)
+	/* SOLUTION }}} */
+}
+
+// splitEntries divides the given sorted entries between this leaf and a new
+// right sibling, then propagates the split upwards.
+func (node *LeafNode) splitEntries(entries []BTreeEntry, compress bool, hotKeys *hotKeyCache) Split {
 	// Create a new leaf node to split our keys.
 	newNode, err := createLeafNode(node.page.GetPager())
 	if err != nil {
 		return Split{err: err}
 	}
+	// Keys cached as being on this leaf may move to the new one.
+	if hotKeys != nil {
+		hotKeys.invalidate(node.page.GetPageNum())
+	}
 	defer newNode.getPage().Put()
 	// Set the right sibling for our two nodes.
 	prevSiblingPN := node.setRightSibling(newNode.page.GetPageNum())
 	newNode.setRightSibling(prevSiblingPN)
 	// Transfer entries to the new node (plus the new entry) accordingly.
-	midpoint := node.numKeys / 2
-	for i := midpoint; i < node.numKeys; i++ {
-		newNode.updateKeyAt(newNode.numKeys, node.getKeyAt(i))
-		newNode.updateValueAt(newNode.numKeys, node.getValueAt(i))
-		newNode.updateNumKeys(newNode.numKeys + 1)
-	}
-	node.updateNumKeys(midpoint)
+	midpoint := len(entries) / 2
+	newNode.rewrite(entries[midpoint:], compress)
+	node.rewrite(entries[:midpoint], compress)
 	return Split{
 		isSplit: true,
 		key:     newNode.getKeyAt(0), // Get the right node's first key
 		leftPN:  node.page.GetPageNum(),
 		rightPN: newNode.page.GetPageNum(),
 	}
-	/* SOLUTION }}} */
 }
 
-// get returns the value associated with a given key from the leaf node.
-func (node *LeafNode) get(key int64) (value int64, found bool) {
+// get returns the value associated with a given key from the leaf node, and the leaf's page number.
+func (node *LeafNode) get(key int64) (value int64, leafPN int64, found bool) {
 	// Unlock parents, eventually unlock this node.
 	node.unlockParent(true)
 	defer node.unlock()
@@ -152,10 +213,10 @@ func (node *LeafNode) get(key int64) (value int64, found bool) {
 	index := node.search(key)
 	if index >= node.numKeys || node.getKeyAt(index) != key {
 		// Thank you Mario! But our key is in another castle!
-		return 0, false
+		return 0, 0, false
 	}
 	entry := node.getEntry(index)
-	return entry.GetValue(), true
+	return entry.GetValue(), node.page.GetPageNum(), true
 }
 
 // keyToNodeEntry is a helper function to create cursors that point to a given index within a leaf node.
@@ -206,8 +267,19 @@ func (node *InternalNode) search(key int64) int64 {
 	return int64(minIndex)
 }
 
+// searchFirst returns the first index where key >= given key, which is the leftmost
+// child that can hold the key when it has duplicates. If no such index exists, it returns numKeys.
+func (node *InternalNode) searchFirst(key int64) int64 {
+	return int64(sort.Search(
+		int(node.numKeys),
+		func(idx int) bool {
+			return node.getKeyAt(int64(idx)) >= key
+		},
+	))
+}
+
 // insert finds the appropriate place in a leaf node to insert a new tuple.
-func (node *InternalNode) insert(key int64, value int64, update bool) Split {
+func (node *InternalNode) insert(key int64, value int64, mode insertMode, compress bool, hotKeys *hotKeyCache) Split {
 	node.unlockParent(false)
 	// Insert the entry into the appropriate child node. Use getChildAt for the indexing
 	childIdx := node.search(key)
@@ -219,11 +291,11 @@ func (node *InternalNode) insert(key int64, value int64, update bool) Split {
 	defer child.getPage().Put()
 
 	// Insert value into the child.
-	result := child.insert(key, value, update)
+	result := child.insert(key, value, mode, compress, hotKeys)
 	// Insert a new key into our node if necessary.
 	if !result.isSplit {
 		node.unlockParent(true)
-		return Split{err: result.err}
+		return Split{err: result.err, replaced: result.replaced, oldValue: result.oldValue}
 	} else {
 		defer node.unlock()
 		s := node.insertSplit(result)
@@ -254,7 +326,7 @@ func (node *InternalNode) insertSplit(split Split) Split {
 	node.updatePNAt(insertPos+1, split.rightPN)
 	node.updateNumKeys(node.numKeys + 1)
 	// Check if we need to split.
-	if node.numKeys > KEYS_PER_INTERNAL_NODE {
+	if node.numKeys > layoutOf(node.page.GetPager()).keysPerInternal {
 		return node.split()
 	}
 	return Split{}
@@ -308,14 +380,14 @@ func (node *InternalNode) split() Split {
 }
 
 // get returns the value associated with a given key from the leaf node.
-func (node *InternalNode) get(key int64) (value int64, found bool) {
+func (node *InternalNode) get(key int64) (value int64, leafPN int64, found bool) {
 	// [CONCURRENCY] Unlock parents
 	node.unlockParent(true)
 	// Find the child.
 	childIdx := node.search(key)
 	child, err := node.getAndLockChildAt(childIdx)
 	if err != nil {
-		return 0, false
+		return 0, 0, false
 	}
 	node.initChild(child)
 	defer child.getPage().Put()
@@ -324,7 +396,7 @@ func (node *InternalNode) get(key int64) (value int64, found bool) {
 
 // keyToNodeEntry is a helper function to create cursors that point to a given index within a leaf node.
 func (node *InternalNode) keyToNodeEntry(key int64) (*LeafNode, int64, error) {
-	index := node.search(key)
+	index := node.searchFirst(key)
 	child, err := node.getChildAt(index)
 	if err != nil {
 		return &LeafNode{}, 0, err
@@ -0,0 +1,62 @@
+package btree
+
+import (
+	"sync/atomic"
+
+	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+)
+
+// How a cursor is going to be used, so that it can prepare for it; see SetScanHint.
+type ScanHint int
+
+const (
+	POINT_SCAN      ScanHint = iota // Reads a few entries; leaves are read as the cursor gets to them.
+	SEQUENTIAL_SCAN                 // Reads on through the table; leaves are read ahead of the cursor.
+)
+
+// Number of leaves a sequential scan reads ahead of its cursor.
+var PREFETCH_DEPTH = 4
+
+// SetScanHint tells the cursor how it is going to be used. Once a cursor hinted with
+// SEQUENTIAL_SCAN steps onto a sibling leaf, it reads the next PREFETCH_DEPTH leaves into the
+// buffer pool in the background, so that it rarely waits on the disk when it gets to them; see
+// pager.Prefetch.
+func (cursor *BTreeCursor) SetScanHint(hint ScanHint) {
+	cursor.hint = hint
+}
+
+// readAhead reads the leaves from the given one on into the buffer pool in the background,
+// unless the cursor already is. Errors are left for the cursor to run into when it gets there.
+func (cursor *BTreeCursor) readAhead(pn int64) {
+	if pn <= 0 || PREFETCH_DEPTH <= 0 || !atomic.CompareAndSwapInt32(&cursor.prefetching, 0, 1) {
+		return
+	}
+	p := cursor.table.pager
+	cursor.prefetches.Add(1)
+	go func() {
+		defer cursor.prefetches.Done()
+		defer atomic.StoreInt32(&cursor.prefetching, 0)
+		for i := 0; i < PREFETCH_DEPTH && pn > 0; i++ {
+			pn = prefetchLeaf(p, pn)
+		}
+	}()
+}
+
+// prefetchLeaf reads a leaf into the buffer pool, leaving it unpinned, and returns the page
+// number of its right sibling; -1 if it has none, or can't be read.
+func prefetchLeaf(p *pager.Pager, pn int64) int64 {
+	if p.Prefetch(pn) != nil {
+		return -1
+	}
+	page, err := p.GetPage(pn)
+	if err != nil {
+		return -1
+	}
+	defer page.Put()
+	page.RLock()
+	defer page.RUnlock()
+	if pageToNodeHeader(page).nodeType != LEAF_NODE {
+		return -1
+	}
+	return pageToLeafNode(page).rightSiblingPN
+}
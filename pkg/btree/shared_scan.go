@@ -0,0 +1,145 @@
+package btree
+
+import (
+	"errors"
+	"sync"
+
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
+// SharedScan coordinates cursors scanning the same table, so that cursors on the same leaf
+// share one pin and read lock on it instead of each getting the page from the pager.
+type SharedScan struct {
+	table *BTreeIndex
+	mtx   sync.Mutex
+	pins  map[int64]*sharedPin // Leaves pinned by the scan, by page number.
+}
+
+// A leaf pinned and read-locked on behalf of the cursors on it.
+type sharedPin struct {
+	node *LeafNode
+	refs int // Number of cursors on the leaf.
+}
+
+// A cursor whose leaves are pinned through a SharedScan.
+type SharedCursor struct {
+	scan    *SharedScan
+	cellnum int64     // The cell number within the leaf.
+	curNode *LeafNode // Current leaf; nil once the cursor is closed.
+	isEnd   bool      // Set once the cursor has run off the end of the table.
+}
+
+// NewSharedScan returns a coordinator for cursors over the table.
+func (table *BTreeIndex) NewSharedScan() *SharedScan {
+	return &SharedScan{table: table, pins: make(map[int64]*sharedPin)}
+}
+
+// acquire pins and read-locks a leaf, unless another cursor on it already has.
+func (scan *SharedScan) acquire(pn int64) (*LeafNode, error) {
+	scan.mtx.Lock()
+	defer scan.mtx.Unlock()
+	if pin, found := scan.pins[pn]; found {
+		pin.refs++
+		return pin.node, nil
+	}
+	page, err := scan.table.pager.GetPage(pn)
+	if err != nil {
+		return nil, err
+	}
+	page.RLock()
+	node := pageToLeafNode(page)
+	scan.pins[pn] = &sharedPin{node: node, refs: 1}
+	return node, nil
+}
+
+// release drops a cursor's hold on a leaf, unlocking and unpinning it once no cursor is on it.
+func (scan *SharedScan) release(node *LeafNode) {
+	scan.mtx.Lock()
+	defer scan.mtx.Unlock()
+	pn := node.page.GetPageNum()
+	pin := scan.pins[pn]
+	pin.refs--
+	if pin.refs == 0 {
+		delete(scan.pins, pn)
+		node.page.RUnlock()
+		node.page.Put()
+	}
+}
+
+// Cursor returns a cursor on the first entry with a key >= startKey. Close it once done.
+func (scan *SharedScan) Cursor(startKey int64) (*SharedCursor, error) {
+	// The cursor read-locks the table until it is closed, like a BTreeCursor.
+	scan.table.rwlock.RLock()
+	rootPage, err := scan.table.pager.GetPage(scan.table.rootPN)
+	if err != nil {
+		scan.table.rwlock.RUnlock()
+		return nil, err
+	}
+	leaf, cellnum, err := pageToNode(rootPage).keyToNodeEntry(startKey)
+	rootPage.Put()
+	if err != nil {
+		scan.table.rwlock.RUnlock()
+		return nil, err
+	}
+	node, err := scan.acquire(leaf.page.GetPageNum())
+	if err != nil {
+		scan.table.rwlock.RUnlock()
+		return nil, err
+	}
+	cursor := &SharedCursor{scan: scan, cellnum: cellnum, curNode: node}
+	// The leaf that may hold the key can end just before it does.
+	cursor.skipExhausted()
+	return cursor, nil
+}
+
+// StepForward moves the cursor ahead by one entry. Returns true at the end of the table.
+func (cursor *SharedCursor) StepForward() (atEnd bool) {
+	if cursor.isEnd || cursor.curNode == nil {
+		return true
+	}
+	cursor.cellnum++
+	cursor.skipExhausted()
+	return cursor.isEnd
+}
+
+// skipExhausted moves the cursor along the leaves until it is on an entry, or at the end.
+func (cursor *SharedCursor) skipExhausted() {
+	for cursor.cellnum >= cursor.curNode.numKeys {
+		nextPN := cursor.curNode.rightSiblingPN
+		if nextPN < 0 {
+			cursor.isEnd = true
+			return
+		}
+		nextNode, err := cursor.scan.acquire(nextPN)
+		if err != nil {
+			cursor.isEnd = true
+			return
+		}
+		cursor.scan.release(cursor.curNode)
+		cursor.curNode = nextNode
+		cursor.cellnum = 0
+	}
+}
+
+// IsEnd returns true if at end.
+func (cursor *SharedCursor) IsEnd() bool {
+	return cursor.isEnd
+}
+
+// GetEntry returns the entry the cursor points to.
+func (cursor *SharedCursor) GetEntry() (utils.Entry, error) {
+	if cursor.isEnd || cursor.curNode == nil {
+		return BTreeEntry{}, errors.New("getEntry: entry is non-existent")
+	}
+	return cursor.curNode.getEntry(cursor.cellnum), nil
+}
+
+// Close releases the cursor's hold on its leaf.
+func (cursor *SharedCursor) Close() {
+	if cursor.curNode != nil {
+		cursor.scan.release(cursor.curNode)
+		cursor.curNode = nil
+		cursor.isEnd = true
+		cursor.scan.table.rwlock.RUnlock()
+	}
+}
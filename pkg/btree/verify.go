@@ -2,36 +2,53 @@ package btree
 
 import (
 	"errors"
+	"fmt"
+
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 func IsBTree(index *BTreeIndex) (l int64, r int64, isbtree bool, err error) {
+	l, r, violation, err := verifyTree(index)
+	return l, r, violation == nil && err == nil, err
+}
+
+// Verify checks that the tree's keys are ordered within each leaf and fall between the
+// separators around them, returning the first violation found, or nil if there is none.
+func Verify(index *BTreeIndex) (*utils.Violation, error) {
+	_, _, violation, err := verifyTree(index)
+	return violation, err
+}
+
+func verifyTree(index *BTreeIndex) (l int64, r int64, violation *utils.Violation, err error) {
 	// Get the node from the page
 	rootPage, err := index.pager.GetPage(index.rootPN)
 	if err != nil {
-		return 0, 0, false, err
+		return 0, 0, nil, err
 	}
+	defer rootPage.Put()
 	n := pageToNode(rootPage)
-	return isBTree(n)
+	return verifyNode(n)
 }
 
-func isBTree(n Node) (l int64, r int64, isbtree bool, err error) {
+// Verify the subtree under a node, returning the bounds of its keys if it holds.
+func verifyNode(n Node) (l int64, r int64, violation *utils.Violation, err error) {
 	// Depending on the node type...
 	switch n := n.(type) {
 	case *InternalNode:
+		pn := n.page.GetPageNum()
 		// Check that each key is less than the bounds of the node it goes around.
 		var lowest, highest int64
 		for i := int64(0); i < n.numKeys+1; i++ {
 			// Get child
 			c, err := n.getChildAt(i)
 			if err != nil {
-				return -1, -1, false, err
+				return -1, -1, nil, err
 			}
 			// Check if child is BTree
-			cl, cr, cisbtree, err := isBTree(c)
-			if err != nil {
-				return -1, -1, false, err
-			} else if !cisbtree {
-				return -1, -1, false, nil
+			cl, cr, violation, err := verifyNode(c)
+			c.getPage().Put()
+			if err != nil || violation != nil {
+				return -1, -1, violation, err
 			}
 			// Set conditions.
 			if i == 0 {
@@ -44,28 +61,31 @@ func isBTree(n Node) (l int64, r int64, isbtree bool, err error) {
 			if i-1 >= 0 {
 				k := n.getKeyAt(i - 1)
 				if k > cl {
-					return -1, -1, false, nil
+					reason := fmt.Sprintf("separator %d is greater than key %d of child %d", k, cl, i)
+					return -1, -1, &utils.Violation{PageNum: pn, Reason: reason}, nil
 				}
 			}
 			if i < n.numKeys {
 				k := n.getKeyAt(i)
 				if k < cr {
-					return -1, -1, false, nil
+					reason := fmt.Sprintf("separator %d is less than key %d of child %d", k, cr, i)
+					return -1, -1, &utils.Violation{PageNum: pn, Reason: reason}, nil
 				}
 			}
 		}
 		// Return bounds.
-		return lowest, highest, true, nil
+		return lowest, highest, nil, nil
 	case *LeafNode:
 		// Check that each key is less than the one after it.
 		for i := int64(0); i < n.numKeys-1; i++ {
 			if n.getKeyAt(i) > n.getKeyAt(i+1) {
-				return -1, -1, false, nil
+				reason := fmt.Sprintf("key %d in cell %d is greater than the next key %d", n.getKeyAt(i), i, n.getKeyAt(i+1))
+				return -1, -1, &utils.Violation{PageNum: n.page.GetPageNum(), Reason: reason}, nil
 			}
 		}
 		// If good, return bounds.
-		return n.getKeyAt(0), n.getKeyAt(n.numKeys - 1), true, nil
+		return n.getKeyAt(0), n.getKeyAt(n.numKeys - 1), nil, nil
 	default:
-		return -1, -1, false, errors.New("should not have gotten here")
+		return -1, -1, nil, errors.New("should not have gotten here")
 	}
 }
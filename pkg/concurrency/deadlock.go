@@ -1,14 +1,22 @@
 package concurrency
 
 import (
-	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Graph.
+// Graph. Alongside its edges, the graph keeps a topological order of its transactions so
+// that TryAddEdge can spot a cycle by only searching the part of the order an edge affects.
 type Graph struct {
-	edges []Edge
-	lock  sync.RWMutex
+	edges    []Edge
+	out      map[*Transaction]map[*Transaction]int // Number of copies of each edge, by source.
+	in       map[*Transaction]map[*Transaction]int // Number of copies of each edge, by target.
+	ord      map[*Transaction]int                  // Position of each transaction in the order.
+	nextOrd  int                                   // Position for the next transaction added.
+	ordValid bool                                  // False once AddEdge has closed a cycle.
+	lock     sync.RWMutex
 }
 
 // Edge.
@@ -39,14 +47,157 @@ func (g *Graph) RUnlock() {
 
 // Construct a new graph.
 func NewGraph() *Graph {
-	return &Graph{edges: make([]Edge, 0)}
+	return &Graph{
+		edges:    make([]Edge, 0),
+		out:      make(map[*Transaction]map[*Transaction]int),
+		in:       make(map[*Transaction]map[*Transaction]int),
+		ord:      make(map[*Transaction]int),
+		ordValid: true,
+	}
 }
 
 // Add an edge from `from` to `to`. Logically, `from` waits for `to`.
 func (g *Graph) AddEdge(from *Transaction, to *Transaction) {
 	g.WLock()
 	defer g.WUnlock()
+	if g.ordValid && !g.reorder(from, to) {
+		g.ordValid = false
+	}
+	g.insertEdge(from, to)
+}
+
+// Add an edge from `from` to `to` unless it would close a cycle, reporting whether it was added.
+func (g *Graph) TryAddEdge(from *Transaction, to *Transaction) bool {
+	g.WLock()
+	defer g.WUnlock()
+	if !g.ordValid && !g.rebuildOrder() {
+		// The graph already has a cycle; any edge is allowed, as with AddEdge.
+		g.insertEdge(from, to)
+		return true
+	}
+	if !g.reorder(from, to) {
+		return false
+	}
+	g.insertEdge(from, to)
+	return true
+}
+
+// Record an edge. Expects the graph to be write-locked.
+func (g *Graph) insertEdge(from *Transaction, to *Transaction) {
 	g.edges = append(g.edges, Edge{from: from, to: to})
+	if g.out[from] == nil {
+		g.out[from] = make(map[*Transaction]int)
+	}
+	if g.in[to] == nil {
+		g.in[to] = make(map[*Transaction]int)
+	}
+	g.out[from][to]++
+	g.in[to][from]++
+}
+
+// Give a transaction a place at the end of the order if it doesn't have one.
+func (g *Graph) place(t *Transaction) int {
+	if pos, found := g.ord[t]; found {
+		return pos
+	}
+	g.ord[t] = g.nextOrd
+	g.nextOrd++
+	return g.ord[t]
+}
+
+// Update the order for a new edge from `from` to `to`, or report false if the edge would close
+// a cycle, leaving the order as it was. Only transactions positioned between `to` and `from`
+// are searched and moved (Pearce and Kelly's algorithm). Expects the graph to be write-locked.
+func (g *Graph) reorder(from *Transaction, to *Transaction) bool {
+	lb, ub := g.place(to), g.place(from)
+	if from == to {
+		return false
+	}
+	if lb > ub {
+		return true
+	}
+	// Find everything `to` reaches that sits before `from`; reaching `from` means a cycle.
+	forward := make([]*Transaction, 0)
+	seen := map[*Transaction]bool{to: true}
+	stack := []*Transaction{to}
+	for len(stack) > 0 {
+		t := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		forward = append(forward, t)
+		for next := range g.out[t] {
+			if next == from {
+				return false
+			}
+			if !seen[next] && g.ord[next] < ub {
+				seen[next] = true
+				stack = append(stack, next)
+			}
+		}
+	}
+	// Find everything that reaches `from` and sits after `to`.
+	backward := make([]*Transaction, 0)
+	seen = map[*Transaction]bool{from: true}
+	stack = []*Transaction{from}
+	for len(stack) > 0 {
+		t := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		backward = append(backward, t)
+		for prev := range g.in[t] {
+			if !seen[prev] && g.ord[prev] > lb {
+				seen[prev] = true
+				stack = append(stack, prev)
+			}
+		}
+	}
+	// Move the backward set ahead of the forward set, reusing their positions.
+	byOrd := func(ts []*Transaction) {
+		sort.Slice(ts, func(i, j int) bool { return g.ord[ts[i]] < g.ord[ts[j]] })
+	}
+	byOrd(forward)
+	byOrd(backward)
+	moved := append(backward, forward...)
+	positions := make([]int, len(moved))
+	for i, t := range moved {
+		positions[i] = g.ord[t]
+	}
+	sort.Ints(positions)
+	for i, t := range moved {
+		g.ord[t] = positions[i]
+	}
+	return true
+}
+
+// Recompute the order from scratch, reporting false if the graph has a cycle.
+// Expects the graph to be write-locked.
+func (g *Graph) rebuildOrder() bool {
+	indegree := make(map[*Transaction]int)
+	for _, e := range g.edges {
+		indegree[e.from] += 0
+		indegree[e.to]++
+	}
+	ready := make([]*Transaction, 0)
+	for t, n := range indegree {
+		if n == 0 {
+			ready = append(ready, t)
+		}
+	}
+	ord := make(map[*Transaction]int)
+	for len(ready) > 0 {
+		t := ready[0]
+		ready = ready[1:]
+		ord[t] = len(ord)
+		for next, copies := range g.out[t] {
+			indegree[next] -= copies
+			if indegree[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+	if len(ord) < len(indegree) {
+		return false
+	}
+	g.ord, g.nextOrd, g.ordValid = ord, len(ord), true
+	return true
 }
 
 // Remove an edge. Only removes one of these edges if multiple copies exist.
@@ -57,63 +208,174 @@ func (g *Graph) RemoveEdge(from *Transaction, to *Transaction) error {
 	for i, e := range g.edges {
 		if e == toRemove {
 			g.edges = removeEdge(g.edges, i)
+			g.dropEdge(from, to)
 			return nil
 		}
 	}
-	return errors.New("edge not found")
+	return ErrEdgeNotFound
 }
 
-/*
-  - We want to create the graph to detect the deadlocks. This function will be used for
-    checking the lock in Transaction Manager.
+// Forget one copy of an edge, and any transaction left without edges. Removing edges never
+// invalidates the order. Expects the graph to be write-locked.
+func (g *Graph) dropEdge(from *Transaction, to *Transaction) {
+	if g.out[from][to]--; g.out[from][to] == 0 {
+		delete(g.out[from], to)
+		delete(g.in[to], from)
+	} else {
+		g.in[to][from]--
+	}
+	for _, t := range []*Transaction{from, to} {
+		if len(g.out[t]) == 0 && len(g.in[t]) == 0 {
+			delete(g.out, t)
+			delete(g.in, t)
+			delete(g.ord, t)
+		}
+	}
+}
 
-    1. Get all the transaction to the graph
-    2. Construct union-find array
-    3. Iterate through edges, applying DFS
+// DetectCycle scans the whole graph for a cycle. TryAddEdge finds cycles incrementally as
+// edges are added; this full scan remains as a check on it.
+func (g *Graph) DetectCycle() bool {
+	return g.FindCycle() != nil
+}
 
-    Return : true if a cycle exists; false otherwise.
+// Remove the element at index `i` from `l`.
+func removeEdge(l []Edge, i int) []Edge {
+	l[i] = l[len(l)-1]
+	return l[:len(l)-1]
+}
 
-*
-*/
-func (g *Graph) DetectCycle() bool {
+// FindCycle returns the transactions on some cycle of the graph, in order, or nil if the
+// graph has no cycle.
+func (g *Graph) FindCycle() []*Transaction {
 	g.RLock()
 	defer g.RUnlock()
-	// Get all the transactions.
-	transactions := make([]*Transaction, 0)
+	adjacent := make(map[*Transaction][]*Transaction)
 	for _, e := range g.edges {
-		transactions = append(transactions, e.from, e.to)
-	}
-	// run DFS on each node, keep which node has been visited
-	// seen := make([]*Transaction, 0)
-	for _, t := range transactions {
-		seen := make([]*Transaction, 0)
-		if dfs(g, t, seen) {
-			return true
+		adjacent[e.from] = append(adjacent[e.from], e.to)
+	}
+	// Depth-first search, tracking the transactions on the current path.
+	onPath := make(map[*Transaction]int)
+	done := make(map[*Transaction]bool)
+	path := make([]*Transaction, 0)
+	var visit func(t *Transaction) []*Transaction
+	visit = func(t *Transaction) []*Transaction {
+		onPath[t] = len(path)
+		path = append(path, t)
+		for _, next := range adjacent[t] {
+			if i, found := onPath[next]; found {
+				return append([]*Transaction{}, path[i:]...)
+			}
+			if !done[next] {
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		delete(onPath, t)
+		done[t] = true
+		return nil
+	}
+	for _, e := range g.edges {
+		if !done[e.from] {
+			if cycle := visit(e.from); cycle != nil {
+				return cycle
+			}
 		}
 	}
-	return false
+	return nil
 }
 
-func dfs(g *Graph, from *Transaction, seen []*Transaction) bool {
-	// Go through each edge.
-	for _, e := range g.edges {
-		// If there is an edge from here to elsewhere,
-		if e.from == from {
-			// Check if it creates a cycle.
-			for _, s := range seen {
-				if e.to == s {
-					return true
-				}
+// FindPath returns the transactions on some path of edges from `from` to `to`, in order and
+// including both, or nil if `to` can't be reached.
+func (g *Graph) FindPath(from *Transaction, to *Transaction) []*Transaction {
+	g.RLock()
+	defer g.RUnlock()
+	// Breadth-first search, remembering how each transaction was reached.
+	prev := map[*Transaction]*Transaction{from: nil}
+	queue := []*Transaction{from}
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		if t == to {
+			path := make([]*Transaction, 0)
+			for ; t != nil; t = prev[t] {
+				path = append([]*Transaction{t}, path...)
+			}
+			return path
+		}
+		for next := range g.out[t] {
+			if _, seen := prev[next]; !seen {
+				prev[next] = t
+				queue = append(queue, next)
 			}
-			// Otherwise, run dfs on it.
-			return dfs(g, e.to, append(seen, e.from))
 		}
 	}
-	return false
+	return nil
 }
 
-// Remove the element at index `i` from `l`.
-func removeEdge(l []Edge, i int) []Edge {
-	l[i] = l[len(l)-1]
-	return l[:len(l)-1]
+// Check for deadlocks on a background timer with the given interval, instead of on every
+// lock request. A detected deadlock is broken by refusing the lock request of the youngest
+// transaction on the cycle with ErrDeadlock. An interval of 0 goes back to checking on every
+// lock request.
+func (tm *TransactionManager) SetDeadlockDetectionInterval(interval time.Duration) {
+	tm.detectorMtx.Lock()
+	defer tm.detectorMtx.Unlock()
+	if tm.stopDetector != nil {
+		close(tm.stopDetector)
+		tm.stopDetector = nil
+	}
+	if interval < 0 {
+		interval = 0
+	}
+	atomic.StoreInt64(&tm.detectEvery, int64(interval))
+	if interval == 0 {
+		return
+	}
+	stop := make(chan struct{})
+	tm.stopDetector = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				tm.breakDeadlock()
+			}
+		}
+	}()
+}
+
+// Check whether deadlocks are detected by the background detector.
+func (tm *TransactionManager) detectingPeriodically() bool {
+	return atomic.LoadInt64(&tm.detectEvery) > 0
+}
+
+// Find a cycle in the precedence graph, if any, and cancel the youngest waiting transaction's lock request.
+func (tm *TransactionManager) breakDeadlock() {
+	cycle := tm.pGraph.FindCycle()
+	var victim *Transaction
+	victimAt := 0
+	for i, t := range cycle {
+		t.RLock()
+		waiting := t.cancelWait != nil
+		t.RUnlock()
+		if waiting && (victim == nil || t.startSeq >= victim.startSeq) {
+			victim, victimAt = t, i
+		}
+	}
+	if victim == nil {
+		return
+	}
+	victim.WLock()
+	defer victim.WUnlock()
+	if victim.cancelWait != nil {
+		close(victim.cancelWait)
+		victim.cancelWait = nil
+		// Report the cycle starting from the victim.
+		victim.deadlockCycle = append(append([]*Transaction{}, cycle[victimAt:]...), cycle[:victimAt]...)
+	}
 }
@@ -0,0 +1,57 @@
+package concurrency
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	uuid "github.com/google/uuid"
+)
+
+// Errors returned by the lock and transaction managers; match them with errors.Is.
+var (
+	ErrTxAlreadyBegun     = errors.New("transaction already began")
+	ErrTxNotFound         = errors.New("transaction not found")
+	ErrNoRightsToResource = errors.New("transaction does not have rights to the resource")
+	ErrDeadlock           = errors.New("deadlock detected")
+	ErrResourceNotLocked  = errors.New("resource not locked")
+	ErrLockTypeMismatch   = errors.New("lock type does not match")
+	ErrEdgeNotFound       = errors.New("edge not found")
+	ErrValidationFailed   = errors.New("transaction read a resource written by a later commit")
+	ErrWriteConflict      = errors.New("transaction wrote a resource written by a later commit")
+	ErrNestedTxRunning    = errors.New("transaction has a nested transaction running")
+	ErrQuiesceTimeout     = errors.New("timed out waiting for transactions to end")
+)
+
+// DeadlockError describes a lock request refused to break a deadlock; get it with errors.As.
+// It matches ErrDeadlock with errors.Is.
+type DeadlockError struct {
+	// The transactions on the cycle, starting with the one refused; each waits for the next,
+	// and the last waits for the first.
+	Cycle    []uuid.UUID
+	Resource Resource // The resource the refused transaction asked for.
+}
+
+// Build a deadlock error for a cycle of transactions, starting with the one refused.
+func newDeadlockError(cycle []*Transaction, r Resource) *DeadlockError {
+	ids := make([]uuid.UUID, len(cycle))
+	for i, t := range cycle {
+		ids[i] = t.clientId
+	}
+	return &DeadlockError{Cycle: ids, Resource: r}
+}
+
+func (e *DeadlockError) Error() string {
+	ids := make([]string, len(e.Cycle))
+	for i, id := range e.Cycle {
+		ids[i] = id.String()
+	}
+	if len(ids) > 0 {
+		ids = append(ids, ids[0])
+	}
+	return fmt.Sprintf("%v on %s %d: %s", ErrDeadlock, e.Resource.tableName, e.Resource.resourceKey, strings.Join(ids, " -> "))
+}
+
+func (e *DeadlockError) Unwrap() error {
+	return ErrDeadlock
+}
@@ -0,0 +1,90 @@
+package concurrency
+
+import (
+	"sync/atomic"
+	"time"
+
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+	uuid "github.com/google/uuid"
+)
+
+// Number of times per maximum duration the sweeper checks for expired transactions.
+const SWEEPS_PER_DURATION = 4
+
+// Abort transactions that have been running for longer than the given duration, freeing their
+// locks. A background sweeper checks for them a few times per duration, ending each with the
+// handler set by SetExpiryHandler. A duration of 0 removes the limit.
+func (tm *TransactionManager) SetMaxTransactionDuration(max time.Duration) {
+	tm.sweeperMtx.Lock()
+	defer tm.sweeperMtx.Unlock()
+	if tm.stopSweeper != nil {
+		close(tm.stopSweeper)
+		tm.stopSweeper = nil
+	}
+	if max < 0 {
+		max = 0
+	}
+	atomic.StoreInt64(&tm.maxDuration, int64(max))
+	if max == 0 {
+		return
+	}
+	interval := max / SWEEPS_PER_DURATION
+	if interval <= 0 {
+		interval = max
+	}
+	stop := make(chan struct{})
+	tm.stopSweeper = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				tm.abortExpired(max)
+			}
+		}
+	}()
+}
+
+// Get the age past which transactions are aborted, or 0 if there is no limit.
+func (tm *TransactionManager) GetMaxTransactionDuration() time.Duration {
+	return time.Duration(atomic.LoadInt64(&tm.maxDuration))
+}
+
+// Set how the sweeper ends an expired transaction, such as a recovery manager's rollback, so
+// that the transaction's writes are undone too. A nil handler just aborts the transaction.
+func (tm *TransactionManager) SetExpiryHandler(handler func(uuid.UUID)) {
+	tm.sweeperMtx.Lock()
+	defer tm.sweeperMtx.Unlock()
+	tm.onExpire = handler
+}
+
+// Abort every top-level transaction older than max; nested transactions end with their root.
+func (tm *TransactionManager) abortExpired(max time.Duration) {
+	tm.sweeperMtx.Lock()
+	onExpire := tm.onExpire
+	tm.sweeperMtx.Unlock()
+	now := time.Now()
+	for clientId, t := range tm.GetTransactions() {
+		age := now.Sub(t.startTime)
+		if t.parent != nil || age <= max {
+			continue
+		}
+		// Withdraw any lock request the transaction is waiting on, so it can't be granted later.
+		t.WLock()
+		if t.cancelWait != nil {
+			close(t.cancelWait)
+			t.cancelWait = nil
+		}
+		t.WUnlock()
+		utils.GetLogger().Info("aborting expired transaction", "client", clientId, "age", age.Round(time.Millisecond), "limit", max)
+		atomic.AddInt64(&tm.metrics.expired, 1)
+		if onExpire != nil {
+			onExpire(clientId)
+		} else {
+			tm.Abort(clientId)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package concurrency
+
+import (
+	uuid "github.com/google/uuid"
+)
+
+// Register a callback to run with the client's id each time a transaction commits, e.g. to
+// invalidate a cache of what it wrote. Hooks run in the order they were registered, after the
+// transaction's locks are released and it is removed, and outside the transaction manager's
+// lock, so they may begin transactions of their own. Commits of nested transactions, and
+// commits that fail, don't run them.
+func (tm *TransactionManager) OnCommit(fn func(clientId uuid.UUID)) {
+	tm.hooksMtx.Lock()
+	defer tm.hooksMtx.Unlock()
+	tm.commitHooks = append(tm.commitHooks, fn)
+}
+
+// Run the commit hooks for a transaction that committed.
+func (tm *TransactionManager) runCommitHooks(clientId uuid.UUID) {
+	tm.hooksMtx.Lock()
+	hooks := tm.commitHooks
+	tm.hooksMtx.Unlock()
+	for _, hook := range hooks {
+		hook(clientId)
+	}
+}
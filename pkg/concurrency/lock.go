@@ -1,7 +1,7 @@
 package concurrency
 
 import (
-	"errors"
+	"fmt"
 	"sync"
 )
 
@@ -11,8 +11,32 @@ type LockType int
 const (
 	R_LOCK LockType = 0
 	W_LOCK LockType = 1
+	// A read lock taken with the intent to write later, upgraded by asking for a W_LOCK. It
+	// shares the resource with readers, but not with other update or write locks, so that at
+	// most one transaction at a time is in line to upgrade, instead of two readers deadlocking
+	// as each waits for the other to let go.
+	UPDATE_LOCK LockType = 2
 )
 
+// Check whether holding a lock of this type gives every right a lock of the other type does.
+func (lType LockType) covers(other LockType) bool {
+	switch lType {
+	case W_LOCK:
+		return true
+	case UPDATE_LOCK:
+		return other != W_LOCK
+	}
+	return other == R_LOCK
+}
+
+// Check whether locks of the two types can't be held on a resource at once.
+func conflicts(a LockType, b LockType) bool {
+	if a == W_LOCK || b == W_LOCK {
+		return true
+	}
+	return a == UPDATE_LOCK && b == UPDATE_LOCK
+}
+
 // A resource.
 type Resource struct {
 	tableName   string
@@ -29,54 +53,265 @@ func (r *Resource) GetResourceKey() int64 {
 	return r.resourceKey
 }
 
+// A range of keys [lo, hi] in a table, locked by predicate (range) scans.
+type KeyRange struct {
+	tableName string
+	lo        int64
+	hi        int64
+}
+
+// Construct a key range.
+func NewKeyRange(tableName string, lo int64, hi int64) KeyRange {
+	return KeyRange{tableName: tableName, lo: lo, hi: hi}
+}
+
+// Check whether the range covers the given resource.
+func (kr KeyRange) Contains(r Resource) bool {
+	return kr.tableName == r.tableName && kr.lo <= r.resourceKey && r.resourceKey <= kr.hi
+}
+
+// Decides the order in which waiting lock requests are granted.
+type FairnessPolicy int
+
+const (
+	// Grant requests in arrival order; readers queue behind a waiting writer.
+	FIFO_FAIRNESS FairnessPolicy = 0
+	// Let readers share a read-held lock even while writers wait.
+	READER_PREFERENCE FairnessPolicy = 1
+)
+
+// A request waiting for a resource lock.
+type lockRequest struct {
+	lType   LockType
+	upgrade bool // Whether the request upgrades an update lock to a write lock.
+	granted chan struct{}
+}
+
+// The state of a single resource lock.
+type resourceLock struct {
+	readers int            // Number of read locks held.
+	updater bool           // Whether the update lock is held.
+	writer  bool           // Whether the write lock is held.
+	waiters []*lockRequest // Waiting requests, in arrival order; upgrades go first.
+}
+
 // Lock manager handles transaction-level locks over database resources.
 type LockManager struct {
-	lmMtx sync.Mutex
-	locks map[Resource]*sync.RWMutex
+	lmMtx  sync.Mutex
+	locks  map[Resource]*resourceLock
+	policy FairnessPolicy
 }
 
 // Construct a new lock manager.
 func NewLockManager() *LockManager {
 	return &LockManager{
-		locks: make(map[Resource]*sync.RWMutex),
+		locks:  make(map[Resource]*resourceLock),
+		policy: FIFO_FAIRNESS,
 	}
 }
 
-// Lock a resource.
+// Construct a resource.
+func NewResource(tableName string, resourceKey int64) Resource {
+	return Resource{tableName: tableName, resourceKey: resourceKey}
+}
+
+// Set the policy used to order waiting requests.
+func (lm *LockManager) SetFairnessPolicy(policy FairnessPolicy) {
+	lm.lmMtx.Lock()
+	defer lm.lmMtx.Unlock()
+	lm.policy = policy
+}
+
+// Get the policy used to order waiting requests.
+func (lm *LockManager) GetFairnessPolicy() FairnessPolicy {
+	lm.lmMtx.Lock()
+	defer lm.lmMtx.Unlock()
+	return lm.policy
+}
+
+// Lock a resource, blocking until the request is granted.
 func (lm *LockManager) Lock(r Resource, lType LockType) error {
+	return lm.lock(r, lType, nil, nil)
+}
+
+// Upgrade a held update lock on a resource to a write lock, blocking until its readers are gone.
+func (lm *LockManager) Upgrade(r Resource) error {
+	return lm.upgrade(r, nil, nil)
+}
+
+// Lock a resource, calling onWait, if given, before blocking on another holder. If cancel is
+// closed while the request waits, the request is withdrawn and ErrDeadlock returned.
+func (lm *LockManager) lock(r Resource, lType LockType, onWait func(), cancel <-chan struct{}) error {
 	// Safely acquire the lock itself, initializing it if needed.
 	lm.lmMtx.Lock()
 	lock, found := lm.locks[r]
 	if !found {
-		lm.locks[r] = &sync.RWMutex{}
-		lock = lm.locks[r]
+		lock = &resourceLock{}
+		lm.locks[r] = lock
 	}
+	// Grant immediately if nothing stands in the way; otherwise, queue up.
+	if lm.canGrant(lock, lType) {
+		lock.grant(lType)
+		lm.lmMtx.Unlock()
+		return nil
+	}
+	request := &lockRequest{lType: lType, granted: make(chan struct{})}
+	lock.waiters = append(lock.waiters, request)
 	lm.lmMtx.Unlock()
-	// Lock accordingly.
-	switch lType {
-	case R_LOCK:
-		lock.RLock()
-	case W_LOCK:
-		lock.Lock()
+	return lm.wait(r, lock, request, onWait, cancel)
+}
+
+// Upgrade a held update lock to a write lock, as lock does. The upgrade waits ahead of every
+// other request, since none of them can be granted before it anyway. If the wait is cancelled,
+// the update lock is kept.
+func (lm *LockManager) upgrade(r Resource, onWait func(), cancel <-chan struct{}) error {
+	lm.lmMtx.Lock()
+	lock, found := lm.locks[r]
+	if !found || !lock.updater {
+		lm.lmMtx.Unlock()
+		return fmt.Errorf("upgrade %s %d: %w", r.tableName, r.resourceKey, ErrResourceNotLocked)
+	}
+	request := &lockRequest{lType: W_LOCK, upgrade: true, granted: make(chan struct{})}
+	if lock.readers == 0 {
+		lock.grantRequest(request)
+		lm.lmMtx.Unlock()
+		return nil
+	}
+	lock.waiters = append([]*lockRequest{request}, lock.waiters...)
+	lm.lmMtx.Unlock()
+	return lm.wait(r, lock, request, onWait, cancel)
+}
+
+// Wait for a queued request to be granted, or withdraw it if cancel is closed first.
+func (lm *LockManager) wait(r Resource, lock *resourceLock, request *lockRequest, onWait func(), cancel <-chan struct{}) error {
+	if onWait != nil {
+		onWait()
+	}
+	select {
+	case <-request.granted:
+		return nil
+	case <-cancel:
 	}
+	lm.lmMtx.Lock()
+	defer lm.lmMtx.Unlock()
+	for i, waiting := range lock.waiters {
+		if waiting == request {
+			lock.waiters = append(lock.waiters[:i], lock.waiters[i+1:]...)
+			// Requests queued behind this one may now go ahead.
+			lm.grantWaiters(lock)
+			if lock.free() {
+				delete(lm.locks, r)
+			}
+			return ErrDeadlock
+		}
+	}
+	// The request was granted before it could be withdrawn.
 	return nil
 }
 
-// Unlock a resource.
+// Unlock a resource, granting it to waiting requests if possible.
 func (lm *LockManager) Unlock(r Resource, lType LockType) error {
 	// Safely acquire the lock itself.
 	lm.lmMtx.Lock()
+	defer lm.lmMtx.Unlock()
 	lock, found := lm.locks[r]
 	if !found {
-		return errors.New("tried to unlock nonexistent resource")
+		return fmt.Errorf("unlock %s %d: %w", r.tableName, r.resourceKey, ErrResourceNotLocked)
 	}
-	lm.lmMtx.Unlock()
 	// Unlock accordingly.
 	switch lType {
 	case R_LOCK:
-		lock.RUnlock()
+		if lock.readers == 0 {
+			return fmt.Errorf("read unlock %s %d: %w", r.tableName, r.resourceKey, ErrResourceNotLocked)
+		}
+		lock.readers--
+	case UPDATE_LOCK:
+		if !lock.updater {
+			return fmt.Errorf("update unlock %s %d: %w", r.tableName, r.resourceKey, ErrResourceNotLocked)
+		}
+		lock.updater = false
 	case W_LOCK:
-		lock.Unlock()
+		if !lock.writer {
+			return fmt.Errorf("write unlock %s %d: %w", r.tableName, r.resourceKey, ErrResourceNotLocked)
+		}
+		lock.writer = false
+	}
+	lm.grantWaiters(lock)
+	if lock.free() {
+		delete(lm.locks, r)
 	}
 	return nil
 }
+
+// Check whether nothing holds or waits for the lock.
+func (lock *resourceLock) free() bool {
+	return lock.readers == 0 && !lock.updater && !lock.writer && len(lock.waiters) == 0
+}
+
+// Check whether a request could be granted alongside the lock's current holders.
+func (lock *resourceLock) compatible(request *lockRequest) bool {
+	if request.upgrade {
+		return lock.readers == 0
+	}
+	switch request.lType {
+	case R_LOCK:
+		return !lock.writer
+	case UPDATE_LOCK:
+		return !lock.writer && !lock.updater
+	}
+	return !lock.writer && !lock.updater && lock.readers == 0
+}
+
+// Check whether a newly-arrived request can be granted right away. Expects lm.lmMtx to be locked.
+func (lm *LockManager) canGrant(lock *resourceLock, lType LockType) bool {
+	if lType == R_LOCK && lm.policy == READER_PREFERENCE {
+		return !lock.writer
+	}
+	return lock.compatible(&lockRequest{lType: lType}) && len(lock.waiters) == 0
+}
+
+// Grant as many waiting requests as the policy allows. Expects lm.lmMtx to be locked.
+func (lm *LockManager) grantWaiters(lock *resourceLock) {
+	if lm.policy == READER_PREFERENCE && !lock.writer {
+		// Let every waiting reader in, wherever it is in the queue.
+		remaining := lock.waiters[:0]
+		for _, request := range lock.waiters {
+			if request.lType == R_LOCK {
+				lock.grantRequest(request)
+			} else {
+				remaining = append(remaining, request)
+			}
+		}
+		lock.waiters = remaining
+	}
+	// Grant from the head of the queue until a request must keep waiting.
+	for len(lock.waiters) > 0 {
+		request := lock.waiters[0]
+		if !lock.compatible(request) {
+			return
+		}
+		lock.waiters = lock.waiters[1:]
+		lock.grantRequest(request)
+	}
+}
+
+// Mark a request of the given type as holding this lock.
+func (lock *resourceLock) grant(lType LockType) {
+	switch lType {
+	case R_LOCK:
+		lock.readers++
+	case UPDATE_LOCK:
+		lock.updater = true
+	case W_LOCK:
+		lock.writer = true
+	}
+}
+
+// Mark a waiting request as holding this lock, and wake it.
+func (lock *resourceLock) grantRequest(request *lockRequest) {
+	if request.upgrade {
+		lock.updater = false
+	}
+	lock.grant(request.lType)
+	close(request.granted)
+}
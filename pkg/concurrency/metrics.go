@@ -0,0 +1,55 @@
+package concurrency
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// Metrics counts transaction manager events. Counters are updated atomically, so they are
+// cheap to bump on hot paths and safe to read while transactions run.
+type Metrics struct {
+	begins    int64
+	commits   int64
+	aborts    int64
+	deadlocks int64
+	lockWaits int64
+	expired   int64
+}
+
+// A point-in-time copy of a transaction manager's metrics.
+type MetricsSnapshot struct {
+	Begins    int64 // Transactions begun.
+	Commits   int64 // Transactions committed.
+	Aborts    int64 // Transactions aborted, including optimistic ones that failed validation.
+	Deadlocks int64 // Lock requests refused because they would deadlock.
+	LockWaits int64 // Lock requests that had to wait for another transaction.
+	Expired   int64 // Transactions aborted for running past the maximum duration.
+}
+
+// Snapshot returns the current value of each counter.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		Begins:    atomic.LoadInt64(&m.begins),
+		Commits:   atomic.LoadInt64(&m.commits),
+		Aborts:    atomic.LoadInt64(&m.aborts),
+		Deadlocks: atomic.LoadInt64(&m.deadlocks),
+		LockWaits: atomic.LoadInt64(&m.lockWaits),
+		Expired:   atomic.LoadInt64(&m.expired),
+	}
+}
+
+// Print the snapshot, one counter per line.
+func (s MetricsSnapshot) Print(w io.Writer) {
+	io.WriteString(w, fmt.Sprintf("begins: %d\n", s.Begins))
+	io.WriteString(w, fmt.Sprintf("commits: %d\n", s.Commits))
+	io.WriteString(w, fmt.Sprintf("aborts: %d\n", s.Aborts))
+	io.WriteString(w, fmt.Sprintf("deadlocks: %d\n", s.Deadlocks))
+	io.WriteString(w, fmt.Sprintf("lock waits: %d\n", s.LockWaits))
+	io.WriteString(w, fmt.Sprintf("expired: %d\n", s.Expired))
+}
+
+// Get the transaction manager's metrics.
+func (tm *TransactionManager) GetMetrics() *Metrics {
+	return &tm.metrics
+}
@@ -0,0 +1,221 @@
+package concurrency
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
+// A committed version of a key written by an MVCC transaction.
+type Version struct {
+	Seq     int64 // Commit sequence number of the transaction that wrote it; 0 for the value it replaced.
+	Deleted bool  // Whether the key was deleted.
+	Value   int64 // The key's value, unless deleted.
+}
+
+// Get the committed versions of a key, oldest first; empty if no MVCC transaction wrote it.
+func (tm *TransactionManager) GetVersions(tableName string, key int64) []Version {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	chain := tm.versions[Resource{tableName: tableName, resourceKey: key}]
+	versions := make([]Version, len(chain))
+	copy(versions, chain)
+	return versions
+}
+
+// Entry for the given version of a key.
+func (v Version) entry(key int64) utils.Entry {
+	return utils.KeyValue{Key: key, Value: v.Value}
+}
+
+// Get the version of a key a snapshot taken at startSeq sees: the newest committed before it.
+// Expects tm.tmMtx to be locked.
+func (tm *TransactionManager) visibleVersion(r Resource, startSeq int64) (Version, bool) {
+	chain := tm.versions[r]
+	for i := len(chain) - 1; i >= 0; i-- {
+		if chain[i].Seq <= startSeq {
+			return chain[i], true
+		}
+	}
+	return Version{}, false
+}
+
+// Reads a key as of when the snapshot began; keys no MVCC transaction wrote since are read from
+// the table. Holds tm.tmMtx so that no commit is half-applied meanwhile.
+func (tm *TransactionManager) readSnapshot(table db.Index, r Resource, startSeq int64) (utils.Entry, error) {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	version, found := tm.visibleVersion(r, startSeq)
+	if !found {
+		return table.Find(r.resourceKey)
+	}
+	if version.Deleted {
+		return nil, errors.New("not found")
+	}
+	return version.entry(r.resourceKey), nil
+}
+
+// Selects the entries of a table as of when the transaction's snapshot began, overlaid with its
+// own buffered writes.
+func (tm *TransactionManager) selectSnapshot(t *Transaction, table db.Index) ([]utils.Entry, error) {
+	tm.tmMtx.RLock()
+	entries, err := table.Select()
+	if err != nil {
+		tm.tmMtx.RUnlock()
+		return nil, err
+	}
+	visible := make(map[int64]utils.Entry, len(entries))
+	for _, entry := range entries {
+		visible[entry.GetKey()] = entry
+	}
+	for r := range tm.versions {
+		if r.tableName != table.GetName() {
+			continue
+		}
+		if version, found := tm.visibleVersion(r, t.startSeq); found && version.Deleted {
+			delete(visible, r.resourceKey)
+		} else if found {
+			visible[r.resourceKey] = version.entry(r.resourceKey)
+		}
+	}
+	tm.tmMtx.RUnlock()
+	t.RLock()
+	for r, write := range t.workspace {
+		if r.tableName != table.GetName() {
+			continue
+		}
+		if write.deleted {
+			delete(visible, r.resourceKey)
+		} else {
+			visible[r.resourceKey] = Version{Value: write.value}.entry(r.resourceKey)
+		}
+	}
+	t.RUnlock()
+	results := make([]utils.Entry, 0, len(visible))
+	for _, entry := range visible {
+		results = append(results, entry)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return utils.CompareEntries(results[i], results[j]) < 0
+	})
+	return results, nil
+}
+
+// Fails with ErrWriteConflict if a key the transaction buffered a write to was written by a
+// transaction that committed after it began, so that of two concurrent writers the first to
+// commit wins. Expects tm.tmMtx to be write-locked.
+func (tm *TransactionManager) validateWrites(t *Transaction) error {
+	for _, commit := range tm.commitLog {
+		if commit.seq <= t.startSeq {
+			continue
+		}
+		for r := range t.workspace {
+			if commit.writes[r] {
+				return fmt.Errorf("validate %s %d: %w", r.tableName, r.resourceKey, ErrWriteConflict)
+			}
+		}
+	}
+	return nil
+}
+
+// Adds the version a committing transaction wrote to a key's chain, starting the chain with the
+// value it replaced. Expects tm.tmMtx to be write-locked.
+func (tm *TransactionManager) addVersion(r Resource, old utils.Entry, existed bool, write bufferedWrite) {
+	chain := tm.versions[r]
+	if len(chain) == 0 {
+		base := Version{Deleted: !existed}
+		if existed {
+			base.Value = old.GetValue()
+		}
+		chain = append(chain, base)
+	}
+	// logCommit numbers the commit once its writes are applied.
+	tm.versions[r] = append(chain, Version{Seq: tm.commitSeq + 1, Deleted: write.deleted, Value: write.value})
+}
+
+// Get the commit sequence number of the oldest snapshot a running transaction may read: the
+// sequence number it began at, or the latest commit's if none is running.
+func (tm *TransactionManager) OldestActiveSeq() int64 {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	oldest := tm.commitSeq
+	for _, t := range tm.transactions {
+		if t.startSeq < oldest {
+			oldest = t.startSeq
+		}
+	}
+	return oldest
+}
+
+// Prune the versions no running transaction can see: each running transaction sees only the
+// newest version committed before it began, and transactions yet to begin see the newest. A key
+// left with only its newest version, which is what the table holds, loses its chain. Returns the
+// number of versions removed.
+func (tm *TransactionManager) CollectVersions() (pruned int) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	snapshots := []int64{tm.commitSeq}
+	for _, t := range tm.transactions {
+		snapshots = append(snapshots, t.startSeq)
+	}
+	for r, chain := range tm.versions {
+		visible := make(map[int]bool)
+		for _, startSeq := range snapshots {
+			for i := len(chain) - 1; i >= 0; i-- {
+				if chain[i].Seq <= startSeq {
+					visible[i] = true
+					break
+				}
+			}
+		}
+		if len(visible) == len(chain) {
+			continue
+		}
+		if len(visible) == 1 && visible[len(chain)-1] {
+			delete(tm.versions, r)
+			pruned += len(chain)
+			continue
+		}
+		kept := make([]Version, 0, len(visible))
+		for i, version := range chain {
+			if visible[i] {
+				kept = append(kept, version)
+			}
+		}
+		tm.versions[r] = kept
+		pruned += len(chain) - len(kept)
+	}
+	return pruned
+}
+
+// Prune versions no running transaction can see on a background timer with the given interval;
+// see CollectVersions. An interval of 0 stops collecting.
+func (tm *TransactionManager) SetVersionCollectionInterval(interval time.Duration) {
+	tm.collectMtx.Lock()
+	defer tm.collectMtx.Unlock()
+	if tm.stopCollect != nil {
+		close(tm.stopCollect)
+		tm.stopCollect = nil
+	}
+	if interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	tm.stopCollect = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				tm.CollectVersions()
+			}
+		}
+	}()
+}
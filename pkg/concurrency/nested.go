@@ -0,0 +1,118 @@
+package concurrency
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+// Begins a transaction nested in the given one, returning the child's id. The child can use
+// every lock its ancestors hold; on commit, its locks and read and write sets pass to the parent
+// instead of being released, and on abort only its own locks are released. Undoing its edits is
+// left to the recovery manager. A transaction can have one child running at a time, and can't
+// lock, commit or begin another child until that child ends.
+func (tm *TransactionManager) BeginNested(parentId uuid.UUID) (uuid.UUID, error) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	parent, found := tm.transactions[parentId]
+	if !found {
+		return uuid.Nil, fmt.Errorf("begin nested: %w", ErrTxNotFound)
+	}
+	parent.WLock()
+	defer parent.WUnlock()
+	if parent.mode != TWO_PHASE_LOCKING {
+		return uuid.Nil, errors.New("begin nested: optimistic and MVCC transactions can't be nested")
+	}
+	if parent.child != nil {
+		return uuid.Nil, fmt.Errorf("begin nested: %w", ErrNestedTxRunning)
+	}
+	childId := uuid.New()
+	child := &Transaction{
+		clientId:  childId,
+		resources: make(map[Resource]LockType),
+		ranges:    make(map[KeyRange]bool),
+		pending:   make(map[Resource]pendingWrite),
+		startSeq:  parent.startSeq,
+		startTime: time.Now(),
+		readSet:   make(map[Resource]bool),
+		writeSet:  make(map[Resource]bool),
+		mode:      parent.mode,
+		workspace: make(map[Resource]bufferedWrite),
+		parent:    parent,
+	}
+	parent.child = child
+	tm.transactions[childId] = child
+	return childId, nil
+}
+
+// Get the transaction's parent, or nil if it isn't nested.
+func (t *Transaction) GetParent() *Transaction {
+	return t.parent
+}
+
+// Check whether other is one of the transaction's ancestors.
+func (t *Transaction) hasAncestor(other *Transaction) bool {
+	for ancestor := t.parent; ancestor != nil; ancestor = ancestor.parent {
+		if ancestor == other {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the transaction or one of its ancestors holds a lock on the resource,
+// returning the strongest such lock.
+func (t *Transaction) inheritedLock(r Resource) (LockType, bool) {
+	found := false
+	strongest := R_LOCK
+	for ancestor := t; ancestor != nil; ancestor = ancestor.parent {
+		ancestor.RLock()
+		lType, ok := ancestor.resources[r]
+		ancestor.RUnlock()
+		if ok && lType.covers(strongest) {
+			strongest = lType
+		}
+		found = found || ok
+	}
+	return strongest, found
+}
+
+// Check whether any of the transaction's ancestors has a pending write to the resource.
+func (t *Transaction) ancestorPending(r Resource) bool {
+	for ancestor := t.parent; ancestor != nil; ancestor = ancestor.parent {
+		ancestor.RLock()
+		_, found := ancestor.pending[r]
+		ancestor.RUnlock()
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+// Pass a committing child's locks, ranges, pending writes and read and write sets to its parent.
+// Expects tm.tmMtx to be write-locked and the child to be locked.
+func (t *Transaction) mergeIntoParent() {
+	parent := t.parent
+	parent.WLock()
+	defer parent.WUnlock()
+	for r, lType := range t.resources {
+		parent.resources[r] = lType
+	}
+	for kr := range t.ranges {
+		parent.ranges[kr] = true
+	}
+	for r, write := range t.pending {
+		if _, found := parent.pending[r]; !found {
+			parent.pending[r] = write
+		}
+	}
+	for r := range t.readSet {
+		parent.readSet[r] = true
+	}
+	for r := range t.writeSet {
+		parent.writeSet[r] = true
+	}
+}
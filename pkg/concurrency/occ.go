@@ -0,0 +1,227 @@
+package concurrency
+
+import (
+	"errors"
+	"fmt"
+
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+	uuid "github.com/google/uuid"
+)
+
+// Decides how the transaction manager keeps transactions serializable.
+type ConcurrencyMode int
+
+const (
+	// Lock resources as they are used, holding them until commit (two-phase locking).
+	TWO_PHASE_LOCKING ConcurrencyMode = 0
+	// Read without locks and buffer writes, then validate the read set and apply the
+	// writes at commit, aborting on a conflict.
+	OPTIMISTIC ConcurrencyMode = 1
+	// Read a snapshot of the committed state as of when the transaction began, so that reads
+	// never wait for writers, and buffer writes, applying them at commit unless another
+	// transaction committed a write to the same key since (snapshot isolation). Keys written
+	// in place by transactions in other modes aren't versioned, so run every writer in MVCC mode.
+	MVCC ConcurrencyMode = 2
+)
+
+// A write buffered in an optimistic transaction's workspace.
+type bufferedWrite struct {
+	table   db.Index
+	deleted bool
+	value   int64
+}
+
+// A buffered write as applied at commit.
+type appliedWrite struct {
+	resource Resource
+	write    bufferedWrite
+	op       db.EditOp
+	old      utils.Entry // What the key held before, or nil if it didn't exist.
+}
+
+// The edit that reverses each kind of edit.
+var reverseOps = map[db.EditOp]db.EditOp{
+	db.INSERT_OP: db.DELETE_OP,
+	db.UPDATE_OP: db.UPDATE_OP,
+	db.DELETE_OP: db.INSERT_OP,
+}
+
+// Wraps each write a committing optimistic or MVCC transaction applies to a table, e.g. to log it
+// for recovery. It must call apply to make the write, and return its error.
+type ApplyLogger func(clientId uuid.UUID, table db.Index, op db.EditOp, key int64, oldval int64, newval int64, apply func() error) error
+
+// Set the logger that writes applied by committing optimistic and MVCC transactions go through;
+// nil applies them directly.
+func (tm *TransactionManager) SetApplyLogger(logger ApplyLogger) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	tm.applyLogger = logger
+}
+
+// Set how transactions are kept serializable. Only affects transactions that begin afterwards.
+func (tm *TransactionManager) SetMode(mode ConcurrencyMode) {
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	tm.mode = mode
+}
+
+// Get how transactions are kept serializable.
+func (tm *TransactionManager) GetMode() ConcurrencyMode {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	return tm.mode
+}
+
+// Check whether the given client is running a transaction that buffers its writes, i.e. an
+// optimistic or MVCC one.
+func (tm *TransactionManager) IsBuffered(clientId uuid.UUID) bool {
+	t, found := tm.GetTransaction(clientId)
+	return found && t.mode != TWO_PHASE_LOCKING
+}
+
+// Get the given client's transaction, checking that it buffers its writes.
+func (tm *TransactionManager) getBuffered(clientId uuid.UUID) (*Transaction, error) {
+	t, found := tm.GetTransaction(clientId)
+	if !found {
+		return nil, ErrTxNotFound
+	}
+	if t.mode == TWO_PHASE_LOCKING {
+		return nil, errors.New("transaction is not optimistic or MVCC")
+	}
+	return t, nil
+}
+
+// Reads a key without locking it, adding it to the transaction's read set. Sees the
+// transaction's own buffered writes; an MVCC transaction otherwise sees its snapshot.
+func (tm *TransactionManager) Read(clientId uuid.UUID, table db.Index, key int64) (utils.Entry, error) {
+	t, err := tm.getBuffered(clientId)
+	if err != nil {
+		return nil, err
+	}
+	resource := Resource{tableName: table.GetName(), resourceKey: key}
+	t.WLock()
+	t.readSet[resource] = true
+	write, found := t.workspace[resource]
+	t.WUnlock()
+	if !found && t.mode == MVCC {
+		return tm.readSnapshot(table, resource, t.startSeq)
+	}
+	if !found {
+		return table.Find(key)
+	}
+	if write.deleted {
+		return nil, errors.New("not found")
+	}
+	return utils.KeyValue{Key: key, Value: write.value}, nil
+}
+
+// Buffers setting a key to the given value, inserting it if need be, until commit.
+func (tm *TransactionManager) Write(clientId uuid.UUID, table db.Index, key int64, value int64) error {
+	return tm.buffer(clientId, table, key, bufferedWrite{table: table, value: value})
+}
+
+// Buffers deleting a key until commit.
+func (tm *TransactionManager) Remove(clientId uuid.UUID, table db.Index, key int64) error {
+	return tm.buffer(clientId, table, key, bufferedWrite{table: table, deleted: true})
+}
+
+// Add a write to the transaction's workspace, replacing any earlier write to the key.
+func (tm *TransactionManager) buffer(clientId uuid.UUID, table db.Index, key int64, write bufferedWrite) error {
+	t, err := tm.getBuffered(clientId)
+	if err != nil {
+		return err
+	}
+	t.WLock()
+	defer t.WUnlock()
+	t.workspace[Resource{tableName: table.GetName(), resourceKey: key}] = write
+	return nil
+}
+
+// Validates an optimistic transaction's read set, or an MVCC transaction's write set, then
+// applies its buffered writes, versioning them for MVCC. The writes are applied all or none: if
+// one fails, those applied before it are reverted. Expects tm.tmMtx to be write-locked, so that
+// no other transaction commits in between.
+func (tm *TransactionManager) commitOptimistic(t *Transaction) error {
+	t.WLock()
+	defer t.WUnlock()
+	validate := tm.validate
+	if t.mode == MVCC {
+		validate = tm.validateWrites
+	}
+	if err := validate(t); err != nil {
+		return err
+	}
+	applied := make([]appliedWrite, 0, len(t.workspace))
+	for r, write := range t.workspace {
+		a := appliedWrite{resource: r, write: write, op: db.INSERT_OP}
+		old, findErr := write.table.Find(r.resourceKey)
+		if findErr == nil {
+			a.old, a.op = old, db.UPDATE_OP
+			if write.deleted {
+				a.op = db.DELETE_OP
+			}
+		} else if write.deleted {
+			continue
+		}
+		if err := tm.applyEdit(t.clientId, write.table, a.op, r.resourceKey, a.oldval(), write.value); err != nil {
+			err = fmt.Errorf("apply %s %d: %w", r.tableName, r.resourceKey, err)
+			if revertErr := tm.revert(t.clientId, applied); revertErr != nil {
+				return fmt.Errorf("%v; revert: %w", err, revertErr)
+			}
+			return err
+		}
+		applied = append(applied, a)
+	}
+	for _, a := range applied {
+		if t.mode == MVCC {
+			tm.addVersion(a.resource, a.old, a.old != nil, a.write)
+		}
+		t.writeSet[a.resource] = true
+	}
+	return nil
+}
+
+// The value the key held before the write, or 0 if it didn't exist.
+func (a appliedWrite) oldval() int64 {
+	if a.old == nil {
+		return 0
+	}
+	return a.old.GetValue()
+}
+
+// Make an edit to a table through the apply logger, if there is one. Expects tm.tmMtx to be
+// write-locked.
+func (tm *TransactionManager) applyEdit(clientId uuid.UUID, table db.Index, op db.EditOp, key int64, oldval int64, newval int64) error {
+	apply := func() error {
+		switch op {
+		case db.INSERT_OP:
+			return table.Insert(key, newval)
+		case db.UPDATE_OP:
+			return table.Update(key, newval)
+		default:
+			return table.Delete(key)
+		}
+	}
+	if tm.applyLogger == nil {
+		return apply()
+	}
+	return tm.applyLogger(clientId, table, op, key, oldval, newval, apply)
+}
+
+// Revert writes applied by a commit that failed partway, newest first, returning the first error.
+// Expects tm.tmMtx to be write-locked.
+func (tm *TransactionManager) revert(clientId uuid.UUID, applied []appliedWrite) (err error) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		a := applied[i]
+		newval := a.write.value
+		if a.op == db.DELETE_OP {
+			newval = 0
+		}
+		curErr := tm.applyEdit(clientId, a.write.table, reverseOps[a.op], a.resource.resourceKey, newval, a.oldval())
+		if err == nil {
+			err = curErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,35 @@
+package concurrency
+
+import (
+	"time"
+)
+
+// Get the number of running transactions, counting nested ones.
+func (tm *TransactionManager) ActiveCount() int {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	return len(tm.transactions)
+}
+
+// Block until no transactions are running, e.g. before shutting down or taking a snapshot.
+// Transactions may begin again as soon as it returns; hold them off beforehand if need be.
+// Returns ErrQuiesceTimeout if transactions are still running once the timeout elapses.
+func (tm *TransactionManager) WaitForQuiescence(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	// Wake the waiter at the deadline, as no transaction may end by then.
+	timer := time.AfterFunc(timeout, func() {
+		tm.tmMtx.Lock()
+		tm.idleCond.Broadcast()
+		tm.tmMtx.Unlock()
+	})
+	defer timer.Stop()
+	tm.tmMtx.Lock()
+	defer tm.tmMtx.Unlock()
+	for len(tm.transactions) > 0 {
+		if !time.Now().Before(deadline) {
+			return ErrQuiesceTimeout
+		}
+		tm.idleCond.Wait()
+	}
+	return nil
+}
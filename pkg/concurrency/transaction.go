@@ -1,18 +1,46 @@
 package concurrency
 
 import (
-	"errors"
+	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 	uuid "github.com/google/uuid"
 )
 
 // Each client can have a transaction running. Each transaction has a list of locked resources.
 type Transaction struct {
-	clientId  uuid.UUID
-	resources map[Resource]LockType
-	lock      sync.RWMutex
+	clientId      uuid.UUID
+	resources     map[Resource]LockType
+	ranges        map[KeyRange]bool
+	pending       map[Resource]pendingWrite
+	startSeq      int64             // The manager's commit sequence number when the transaction began.
+	startTime     time.Time         // When the transaction began.
+	readSet       map[Resource]bool // Every resource the transaction has read-locked, even if since unlocked.
+	writeSet      map[Resource]bool // Every resource the transaction has write-locked.
+	mode          ConcurrencyMode
+	workspace     map[Resource]bufferedWrite // Writes buffered until commit, in OPTIMISTIC and MVCC modes.
+	cancelWait    chan struct{}              // Closed to withdraw the lock request the transaction waits on.
+	deadlockCycle []*Transaction             // The cycle the background detector withdrew the request to break.
+	parent        *Transaction               // The transaction this one is nested in, if any.
+	child         *Transaction               // The nested transaction running in this one, if any.
+	lock          sync.RWMutex
+}
+
+// The resources written by a committed transaction, in commit order.
+type committedWrites struct {
+	seq    int64
+	writes map[Resource]bool
+}
+
+// The committed state of a key before a running transaction first wrote to it.
+type pendingWrite struct {
+	existed bool  // Whether the key existed before the write.
+	oldval  int64 // The value the key held, if it existed.
 }
 
 // Grab a write lock on the tx
@@ -40,22 +68,77 @@ func (t *Transaction) GetClientID() uuid.UUID {
 	return t.clientId
 }
 
+// Get when the transaction began.
+func (t *Transaction) GetStartTime() time.Time {
+	return t.startTime
+}
+
 // Get the transaction's resources.
 func (t *Transaction) GetResources() map[Resource]LockType {
 	return t.resources
 }
 
+// Get the key ranges the transaction holds predicate locks on.
+func (t *Transaction) GetRanges() map[KeyRange]bool {
+	return t.ranges
+}
+
+// ReadSet returns every resource the transaction has read-locked, sorted by table then key.
+func (t *Transaction) ReadSet() []Resource {
+	t.RLock()
+	defer t.RUnlock()
+	readSet := make([]Resource, 0, len(t.readSet))
+	for r := range t.readSet {
+		readSet = append(readSet, r)
+	}
+	sort.Slice(readSet, func(i, j int) bool {
+		if readSet[i].tableName != readSet[j].tableName {
+			return readSet[i].tableName < readSet[j].tableName
+		}
+		return readSet[i].resourceKey < readSet[j].resourceKey
+	})
+	return readSet
+}
+
 // Transaction Manager manages all of the transactions on a server.
 type TransactionManager struct {
 	lm           *LockManager
 	tmMtx        sync.RWMutex
 	pGraph       *Graph
 	transactions map[uuid.UUID]*Transaction
+	rangeMtx     sync.Mutex             // Serializes range locks against writes.
+	rangeCond    *sync.Cond             // Signalled whenever a range or write lock is released.
+	idleCond     *sync.Cond             // Signalled, under tmMtx, whenever a transaction ends.
+	commitSeq    int64                  // Number of transactions committed so far.
+	commitLog    []committedWrites      // Write sets of commits that running transactions may need to validate against.
+	versions     map[Resource][]Version // Committed versions of keys MVCC transactions wrote, oldest first.
+	mode         ConcurrencyMode
+	metrics      Metrics
+	detectEvery  int64           // Interval between background deadlock checks in nanoseconds, or 0 to check on every lock.
+	detectorMtx  sync.Mutex      // Serializes starting and stopping the background detector.
+	stopDetector chan struct{}   // Closed to stop the background detector, if running.
+	maxDuration  int64           // Age in nanoseconds past which transactions are aborted, or 0 for no limit.
+	sweeperMtx   sync.Mutex      // Serializes starting and stopping the sweeper, and guards onExpire.
+	stopSweeper  chan struct{}   // Closed to stop the sweeper aborting expired transactions, if running.
+	onExpire     func(uuid.UUID) // Ends an expired transaction; nil to just abort it.
+	collectMtx   sync.Mutex      // Serializes starting and stopping the version collector.
+	stopCollect  chan struct{}   // Closed to stop the version collector, if running.
+	hooksMtx     sync.Mutex      // Guards commitHooks.
+	commitHooks  []func(uuid.UUID)
+	applyLogger  ApplyLogger // Wraps the writes committing optimistic and MVCC transactions apply.
 }
 
 // Get a pointer to a new transaction manager.
 func NewTransactionManager(lm *LockManager) *TransactionManager {
-	return &TransactionManager{lm: lm, pGraph: NewGraph(), transactions: make(map[uuid.UUID]*Transaction)}
+	tm := &TransactionManager{
+		lm:           lm,
+		pGraph:       NewGraph(),
+		transactions: make(map[uuid.UUID]*Transaction),
+		versions:     make(map[Resource][]Version),
+	}
+	tm.rangeCond = sync.NewCond(&tm.rangeMtx)
+	tm.idleCond = sync.NewCond(&tm.tmMtx)
+	return tm
 }
 
 // Get the transactions.
@@ -63,9 +146,15 @@ func (tm *TransactionManager) GetLockManager() *LockManager {
 	return tm.lm
 }
 
-// Get the transactions.
+// Get a copy of the running transactions, safe to iterate while others begin and end.
 func (tm *TransactionManager) GetTransactions() map[uuid.UUID]*Transaction {
-	return tm.transactions
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	transactions := make(map[uuid.UUID]*Transaction, len(tm.transactions))
+	for id, t := range tm.transactions {
+		transactions[id] = t
+	}
+	return transactions
 }
 
 // Get a particular transaction.
@@ -82,68 +171,215 @@ func (tm *TransactionManager) Begin(clientId uuid.UUID) error {
 	defer tm.tmMtx.Unlock()
 	_, found := tm.transactions[clientId]
 	if found {
-		return errors.New("transaction already began")
+		return ErrTxAlreadyBegun
 	}
-	tm.transactions[clientId] = &Transaction{clientId: clientId, resources: make(map[Resource]LockType)}
+	tm.transactions[clientId] = &Transaction{
+		clientId:  clientId,
+		resources: make(map[Resource]LockType),
+		ranges:    make(map[KeyRange]bool),
+		pending:   make(map[Resource]pendingWrite),
+		startSeq:  tm.commitSeq,
+		startTime: time.Now(),
+		readSet:   make(map[Resource]bool),
+		writeSet:  make(map[Resource]bool),
+		mode:      tm.mode,
+		workspace: make(map[Resource]bufferedWrite),
+	}
+	atomic.AddInt64(&tm.metrics.begins, 1)
 	return nil
 }
 
-// Locks the given resource. Will return an error if deadlock is created.
+// Locks the given resource. Will return an error if deadlock is created. A W_LOCK on a resource
+// the transaction holds an UPDATE_LOCK on upgrades it, waiting for readers to let go.
 func (tm *TransactionManager) Lock(clientId uuid.UUID, table db.Index, resourceKey int64, lType LockType) error {
 	// fetching the Transaction by uuid
-	tm.tmMtx.RLock()
 	t, found := tm.GetTransaction(clientId)
-	tm.tmMtx.RUnlock()
 	if !found {
-		return errors.New("transaction not found")
+		return ErrTxNotFound
 	}
-	// Check if the transaction has rights to the resource
-	resource := Resource{tableName: table.GetName(), resourceKey: resourceKey}
 	t.RLock()
-	lockType, found := t.resources[resource]
+	child := t.child
 	t.RUnlock()
+	if child != nil {
+		return fmt.Errorf("lock: %w", ErrNestedTxRunning)
+	}
+	// Check if the transaction, or a transaction it is nested in, has rights to the resource
+	resource := Resource{tableName: table.GetName(), resourceKey: resourceKey}
+	lockType, found := t.inheritedLock(resource)
+	upgrade := false
 	if found {
-		if lockType == R_LOCK && lType == W_LOCK {
-			return errors.New("transaction does not have rights to the resource")
+		if lockType.covers(lType) {
+			return nil
 		}
-		return nil
+		// Only an update lock the transaction took itself can be upgraded.
+		t.RLock()
+		held := t.resources[resource]
+		t.RUnlock()
+		if lockType != UPDATE_LOCK || lType != W_LOCK || held != UPDATE_LOCK {
+			return ErrNoRightsToResource
+		}
+		upgrade = true
 	}
 	// Look for other transactions that might conflict with the current transaction
-	depTransactions := tm.discoverTransactions(resource, lType)
-	// If a conflicting transaction is found, add an edge to the precedence graph
-	for _, trans := range depTransactions {
-		tm.pGraph.AddEdge(t, trans)
-	}
-	// Check for deadlocks in the precedence graph
-	if tm.pGraph.DetectCycle() {
-		// remove edge from the precedence graph
-		for _, trans := range depTransactions {
-			tm.pGraph.RemoveEdge(t, trans)
+	depTransactions := tm.discoverTransactions(t, resource, lType)
+	// If a conflicting transaction is found, add an edge to the precedence graph, checking
+	// for deadlocks as we go unless a background detector does so.
+	periodic := tm.detectingPeriodically()
+	for i, trans := range depTransactions {
+		if periodic {
+			tm.pGraph.AddEdge(t, trans)
+		} else if !tm.pGraph.TryAddEdge(t, trans) {
+			// The edge would close a cycle through whatever trans already waits for.
+			cycle := []*Transaction{t}
+			if path := tm.pGraph.FindPath(trans, t); path != nil {
+				cycle = append(cycle, path[:len(path)-1]...)
+			} else {
+				cycle = append(cycle, trans)
+			}
+			// remove edge from the precedence graph
+			for _, added := range depTransactions[:i] {
+				tm.pGraph.RemoveEdge(t, added)
+			}
+			atomic.AddInt64(&tm.metrics.deadlocks, 1)
+			return newDeadlockError(cycle, resource)
 		}
-		return errors.New("deadlock detected")
 	}
 	// Add the resource to the trasaction's resource list and lock it
-	t.WLock()
-	t.resources[resource] = lType
-	t.WUnlock()
-	// lock the resource
-	tm.lm.Lock(resource, lType)
+	if lType == W_LOCK {
+		// Writes wait out any other transaction's range lock covering the key.
+		tm.rangeMtx.Lock()
+		for tm.rangeLocked(t, resource) {
+			tm.rangeCond.Wait()
+		}
+		t.WLock()
+		t.resources[resource] = lType
+		t.writeSet[resource] = true
+		t.WUnlock()
+		tm.rangeMtx.Unlock()
+	} else {
+		t.WLock()
+		t.resources[resource] = lType
+		t.readSet[resource] = true
+		t.WUnlock()
+	}
+	// lock the resource; the background detector may cancel the wait to break a deadlock.
+	var cancel chan struct{}
+	if periodic {
+		cancel = make(chan struct{})
+		t.WLock()
+		t.cancelWait = cancel
+		t.WUnlock()
+	}
+	onWait := func() { atomic.AddInt64(&tm.metrics.lockWaits, 1) }
+	var err error
+	if upgrade {
+		err = tm.lm.upgrade(resource, onWait, cancel)
+	} else {
+		err = tm.lm.lock(resource, lType, onWait, cancel)
+	}
+	if err != nil && upgrade {
+		// A failed upgrade keeps the update lock.
+		t.WLock()
+		t.resources[resource] = UPDATE_LOCK
+		t.WUnlock()
+	}
+	if periodic {
+		t.WLock()
+		t.cancelWait = nil
+		if err != nil {
+			if !upgrade {
+				delete(t.resources, resource)
+			}
+			if t.deadlockCycle != nil {
+				err = newDeadlockError(t.deadlockCycle, resource)
+				t.deadlockCycle = nil
+			}
+		}
+		t.WUnlock()
+	}
 	// remove the edge from the precedence graph
 	//depTransactions = tm.discoverTransactions(resource, lType)
 	for _, trans := range depTransactions {
 		tm.pGraph.RemoveEdge(t, trans)
 	}
+	if err != nil {
+		atomic.AddInt64(&tm.metrics.deadlocks, 1)
+		return err
+	}
+	return nil
+}
+
+// A lock wanted by LockAll.
+type ResourceRequest struct {
+	Table    db.Index
+	Key      int64
+	LockType LockType
+}
+
+// Locks several resources, in order of table name then key whatever the order they are passed
+// in, so that transactions locking the same resources through LockAll never deadlock with each
+// other. A resource requested more than once is locked once, with the strongest type requested.
+// Stops at the first lock that fails, leaving the ones before it held until the transaction ends.
+func (tm *TransactionManager) LockAll(clientId uuid.UUID, resources []ResourceRequest) error {
+	requests := make([]ResourceRequest, 0, len(resources))
+	seen := make(map[Resource]int)
+	for _, request := range resources {
+		r := Resource{tableName: request.Table.GetName(), resourceKey: request.Key}
+		if i, found := seen[r]; found {
+			if request.LockType.covers(requests[i].LockType) {
+				requests[i].LockType = request.LockType
+			}
+			continue
+		}
+		seen[r] = len(requests)
+		requests = append(requests, request)
+	}
+	sort.Slice(requests, func(i, j int) bool {
+		a, b := requests[i], requests[j]
+		if a.Table.GetName() != b.Table.GetName() {
+			return a.Table.GetName() < b.Table.GetName()
+		}
+		return a.Key < b.Key
+	})
+	for _, request := range requests {
+		if err := tm.Lock(clientId, request.Table, request.Key, request.LockType); err != nil {
+			return fmt.Errorf("lock %s %d: %w", request.Table.GetName(), request.Key, err)
+		}
+	}
 	return nil
 }
 
+// Report which of the requested resources other transactions currently hold, or range lock,
+// incompatibly with the lock requested, in the order requested, without locking anything. Lets
+// a transaction back off before it starts work that would block; another transaction may lock
+// them, or release them, as soon as it returns. Locks of the client's own transaction, and of
+// transactions it is nested in, never conflict; the client needn't have begun a transaction.
+func (tm *TransactionManager) WouldConflict(clientId uuid.UUID, reqs []ResourceRequest) []Resource {
+	self, found := tm.GetTransaction(clientId)
+	if !found {
+		self = &Transaction{clientId: clientId}
+	}
+	conflicting := make([]Resource, 0)
+	seen := make(map[Resource]bool)
+	for _, request := range reqs {
+		r := Resource{tableName: request.Table.GetName(), resourceKey: request.Key}
+		if seen[r] {
+			continue
+		}
+		if len(tm.discoverTransactions(self, r, request.LockType)) > 0 {
+			seen[r] = true
+			conflicting = append(conflicting, r)
+		}
+	}
+	return conflicting
+}
+
 // Unlocks the given resource.
 func (tm *TransactionManager) Unlock(clientId uuid.UUID, table db.Index, resourceKey int64, lType LockType) error {
 	// Fetching the Transaction by uuid
-	tm.tmMtx.RLock()
 	t, found := tm.GetTransaction(clientId)
-	tm.tmMtx.RUnlock()
 	if !found {
-		return errors.New("transaction to unlock not found")
+		return fmt.Errorf("unlock: %w", ErrTxNotFound)
 	}
 	// Find the resource in the transaction's resource list
 	resource := Resource{tableName: table.GetName(), resourceKey: resourceKey}
@@ -151,48 +387,347 @@ func (tm *TransactionManager) Unlock(clientId uuid.UUID, table db.Index, resourc
 	lockType, found := t.resources[resource]
 	t.RUnlock()
 	if !found {
-		return errors.New("resource to unlock not found")
+		return fmt.Errorf("unlock %s %d: %w", resource.tableName, resource.resourceKey, ErrResourceNotLocked)
 	}
 	if lockType != lType {
-		return errors.New("lock type does not match")
+		return fmt.Errorf("unlock %s %d: %w", resource.tableName, resource.resourceKey, ErrLockTypeMismatch)
 	}
 	// Remove the resource from the transaction's resource list and unlock the resource
 	t.WLock()
 	delete(t.resources, resource)
 	t.WUnlock()
+	defer tm.wakeRangeWaiters()
 	return tm.lm.Unlock(resource, lockType)
 }
 
-// Commits the given transaction and removes it from the running transactions list.
+// Locks the key range [lo, hi] of the given table, so that no other transaction can
+// write into it until this one commits. Will return an error if deadlock is created.
+func (tm *TransactionManager) LockRange(clientId uuid.UUID, table db.Index, lo int64, hi int64) error {
+	t, found := tm.GetTransaction(clientId)
+	if !found {
+		return ErrTxNotFound
+	}
+	kr := KeyRange{tableName: table.GetName(), lo: lo, hi: hi}
+	t.RLock()
+	held := t.ranges[kr]
+	t.RUnlock()
+	if held {
+		return nil
+	}
+	// Look for other transactions writing into the range.
+	depTransactions := make([]*Transaction, 0)
+	tm.tmMtx.RLock()
+	for _, other := range tm.transactions {
+		if other != t && !t.hasAncestor(other) && other.writesInRange(kr) {
+			depTransactions = append(depTransactions, other)
+		}
+	}
+	tm.tmMtx.RUnlock()
+	added := 0
+	defer func() {
+		for _, trans := range depTransactions[:added] {
+			tm.pGraph.RemoveEdge(t, trans)
+		}
+	}()
+	for _, trans := range depTransactions {
+		if !tm.pGraph.TryAddEdge(t, trans) {
+			atomic.AddInt64(&tm.metrics.deadlocks, 1)
+			return ErrDeadlock
+		}
+		added++
+	}
+	// Wait for those writers to finish, then take the range.
+	tm.rangeMtx.Lock()
+	defer tm.rangeMtx.Unlock()
+	for tm.rangeWritten(t, kr) {
+		tm.rangeCond.Wait()
+	}
+	t.WLock()
+	t.ranges[kr] = true
+	t.WUnlock()
+	return nil
+}
+
+// Check whether another transaction holds a range lock covering the resource.
+func (tm *TransactionManager) rangeLocked(t *Transaction, r Resource) bool {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	for _, other := range tm.transactions {
+		if other != t && !t.hasAncestor(other) && other.rangesContain(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether another transaction holds a write lock inside the range.
+func (tm *TransactionManager) rangeWritten(t *Transaction, kr KeyRange) bool {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	for _, other := range tm.transactions {
+		if other != t && !t.hasAncestor(other) && other.writesInRange(kr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wake transactions waiting on range or write locks to re-check for conflicts.
+func (tm *TransactionManager) wakeRangeWaiters() {
+	tm.rangeMtx.Lock()
+	tm.rangeCond.Broadcast()
+	tm.rangeMtx.Unlock()
+}
+
+// Check whether any of the transaction's range locks cover the resource.
+func (t *Transaction) rangesContain(r Resource) bool {
+	t.RLock()
+	defer t.RUnlock()
+	for kr := range t.ranges {
+		if kr.Contains(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether the transaction holds a write lock inside the range.
+func (t *Transaction) writesInRange(kr KeyRange) bool {
+	t.RLock()
+	defer t.RUnlock()
+	for r, lType := range t.resources {
+		if lType == W_LOCK && kr.Contains(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// Commits the given transaction and removes it from the running transactions list, then runs
+// the commit hooks; see OnCommit. An optimistic transaction that fails validation is aborted
+// instead, with ErrValidationFailed.
 func (tm *TransactionManager) Commit(clientId uuid.UUID) error {
+	committed, err := tm.end(clientId, true)
+	if committed {
+		tm.runCommitHooks(clientId)
+	}
+	return err
+}
+
+// Aborts the given transaction, discarding any writes it buffered, and removes it from the
+// running transactions list. Writes already made in place under locks are not undone.
+func (tm *TransactionManager) Abort(clientId uuid.UUID) error {
+	_, err := tm.end(clientId, false)
+	return err
+}
+
+// End the given transaction, applying its buffered writes if committing. Reports whether a
+// transaction that isn't nested committed.
+func (tm *TransactionManager) end(clientId uuid.UUID, commit bool) (committed bool, err error) {
+	defer tm.wakeRangeWaiters()
 	tm.tmMtx.Lock()
 	defer tm.tmMtx.Unlock()
 	// Get the transaction we want.
 	t, found := tm.transactions[clientId]
 	if !found {
-		return errors.New("no transactions running")
+		if commit {
+			return false, fmt.Errorf("commit: %w", ErrTxNotFound)
+		}
+		return false, fmt.Errorf("abort: %w", ErrTxNotFound)
+	}
+	// A transaction can't commit before its nested transaction ends; aborting aborts that too.
+	if t.child != nil {
+		if commit {
+			return false, fmt.Errorf("commit: %w", ErrNestedTxRunning)
+		}
+		for t.child != nil {
+			descendant := t.child
+			for descendant.child != nil {
+				descendant = descendant.child
+			}
+			if err := tm.endNested(descendant, false); err != nil {
+				return false, err
+			}
+		}
+	}
+	if t.parent != nil {
+		return false, tm.endNested(t, commit)
+	}
+	var applyErr error
+	if commit && t.mode != TWO_PHASE_LOCKING {
+		applyErr = tm.commitOptimistic(t)
 	}
 	// Unlock all resources.
 	t.RLock()
 	defer t.RUnlock()
 	for r, lType := range t.resources {
-		err := tm.lm.Unlock(r, lType)
-		if err != nil {
-			return err
+		if err = tm.lm.Unlock(r, lType); err != nil {
+			return false, err
 		}
 	}
 	// Remove the transaction from our transactions list.
 	delete(tm.transactions, clientId)
+	tm.idleCond.Broadcast()
+	tm.logCommit(t)
+	if applyErr != nil {
+		atomic.AddInt64(&tm.metrics.aborts, 1)
+		return false, fmt.Errorf("commit: %w", applyErr)
+	}
+	if commit {
+		atomic.AddInt64(&tm.metrics.commits, 1)
+	} else {
+		atomic.AddInt64(&tm.metrics.aborts, 1)
+	}
+	return commit, nil
+}
+
+// Records the write set of a committing transaction and forgets commits that every running
+// transaction began after. Expects tm.tmMtx to be write-locked.
+func (tm *TransactionManager) logCommit(t *Transaction) {
+	tm.commitSeq++
+	if len(t.writeSet) > 0 {
+		tm.commitLog = append(tm.commitLog, committedWrites{seq: tm.commitSeq, writes: t.writeSet})
+	}
+	oldest := tm.commitSeq
+	for _, other := range tm.transactions {
+		if other.startSeq < oldest {
+			oldest = other.startSeq
+		}
+	}
+	for len(tm.commitLog) > 0 && tm.commitLog[0].seq <= oldest {
+		tm.commitLog = tm.commitLog[1:]
+	}
+}
+
+// Validates the given transaction before it commits: fails with ErrValidationFailed if any
+// resource in its read set was written by a transaction that committed after it began.
+func (tm *TransactionManager) Validate(clientId uuid.UUID) error {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
+	t, found := tm.transactions[clientId]
+	if !found {
+		return fmt.Errorf("validate: %w", ErrTxNotFound)
+	}
+	t.RLock()
+	defer t.RUnlock()
+	return tm.validate(t)
+}
+
+// Check the transaction's read set against later commits. Expects tm.tmMtx and t to be locked.
+func (tm *TransactionManager) validate(t *Transaction) error {
+	for _, commit := range tm.commitLog {
+		if commit.seq <= t.startSeq {
+			continue
+		}
+		for r := range t.readSet {
+			if commit.writes[r] {
+				return fmt.Errorf("validate %s %d: %w", r.tableName, r.resourceKey, ErrValidationFailed)
+			}
+		}
+	}
 	return nil
 }
 
-// Returns a slice of all transactions that conflict w/ the given resource and locktype.
-func (tm *TransactionManager) discoverTransactions(r Resource, lType LockType) []*Transaction {
+// Records the committed value of a key before the given transaction first writes to it,
+// so that other transactions can be shown that value instead. Expects the key to be write-locked.
+func (tm *TransactionManager) TrackWrite(clientId uuid.UUID, table db.Index, key int64) error {
+	t, found := tm.GetTransaction(clientId)
+	if !found {
+		return ErrTxNotFound
+	}
+	resource := Resource{tableName: table.GetName(), resourceKey: key}
+	// A write an ancestor already tracks was made over the committed value it recorded.
+	if t.ancestorPending(resource) {
+		return nil
+	}
+	t.WLock()
+	defer t.WUnlock()
+	if _, found := t.pending[resource]; found {
+		return nil
+	}
+	write := pendingWrite{}
+	if entry, err := table.Find(key); err == nil {
+		write.existed = true
+		write.oldval = entry.GetValue()
+	}
+	t.pending[resource] = write
+	return nil
+}
+
+// Selects the entries of a table visible to the given client: the committed state,
+// overlaid with the client's own uncommitted writes. An MVCC transaction sees its snapshot.
+func (tm *TransactionManager) Select(clientId uuid.UUID, table db.Index) ([]utils.Entry, error) {
+	if t, found := tm.GetTransaction(clientId); found && t.mode == MVCC {
+		return tm.selectSnapshot(t, table)
+	}
+	// Scan before gathering pending writes, so that any write the scan saw is masked.
+	entries, err := table.Select()
+	if err != nil {
+		return nil, err
+	}
+	masked := make(map[int64]pendingWrite)
+	tm.tmMtx.RLock()
+	self := tm.transactions[clientId]
+	for id, t := range tm.transactions {
+		if id == clientId || (self != nil && self.hasAncestor(t)) {
+			continue
+		}
+		t.RLock()
+		for r, write := range t.pending {
+			if r.tableName == table.GetName() {
+				masked[r.resourceKey] = write
+			}
+		}
+		t.RUnlock()
+	}
+	tm.tmMtx.RUnlock()
+	if len(masked) == 0 {
+		return entries, nil
+	}
+	// Replace other transactions' writes with the values they overwrote.
+	visible := make([]utils.Entry, 0, len(entries))
+	for _, entry := range entries {
+		if _, found := masked[entry.GetKey()]; !found {
+			visible = append(visible, entry)
+		}
+	}
+	for key, write := range masked {
+		if write.existed {
+			visible = append(visible, utils.KeyValue{Key: key, Value: write.oldval})
+		}
+	}
+	sort.Slice(visible, func(i, j int) bool {
+		return utils.CompareEntries(visible[i], visible[j]) < 0
+	})
+	return visible, nil
+}
+
+// Returns a REPL disconnect handler that aborts the client's running transaction, releasing its locks.
+func (tm *TransactionManager) ReleaseOnDisconnect() func(uuid.UUID) {
+	return func(clientId uuid.UUID) {
+		if _, found := tm.GetTransaction(clientId); found {
+			tm.Abort(clientId)
+		}
+	}
+}
+
+// Returns a slice of all transactions other than `self` that conflict w/ the given resource and locktype.
+func (tm *TransactionManager) discoverTransactions(self *Transaction, r Resource, lType LockType) []*Transaction {
+	tm.tmMtx.RLock()
+	defer tm.tmMtx.RUnlock()
 	ret := make([]*Transaction, 0)
 	for _, t := range tm.transactions {
+		if t == self || self.hasAncestor(t) {
+			continue
+		}
+		// Writes also conflict with range locks covering the key.
+		if lType == W_LOCK && t.rangesContain(r) {
+			ret = append(ret, t)
+			continue
+		}
 		t.RLock()
 		for storedResource, storedType := range t.resources {
-			if storedResource == r && (storedType == W_LOCK || lType == W_LOCK) {
+			if storedResource == r && conflicts(storedType, lType) {
 				ret = append(ret, t)
 				break
 			}
@@ -201,3 +736,26 @@ func (tm *TransactionManager) discoverTransactions(r Resource, lType LockType) [
 	}
 	return ret
 }
+
+// End a nested transaction, passing its locks to its parent if committing, or releasing them if
+// aborting. Expects tm.tmMtx to be write-locked.
+func (tm *TransactionManager) endNested(t *Transaction, commit bool) error {
+	t.RLock()
+	defer t.RUnlock()
+	if commit {
+		t.mergeIntoParent()
+	} else {
+		for r, lType := range t.resources {
+			err := tm.lm.Unlock(r, lType)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	delete(tm.transactions, t.clientId)
+	tm.idleCond.Broadcast()
+	t.parent.WLock()
+	t.parent.child = nil
+	t.parent.WUnlock()
+	return nil
+}
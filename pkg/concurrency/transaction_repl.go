@@ -4,12 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
 
 	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
 	query "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/query"
 	repl "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/repl"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 
 	uuid "github.com/google/uuid"
 )
@@ -29,21 +31,27 @@ func TransactionREPL(d *db.Database, tm *TransactionManager) *repl.REPL {
 	r.AddCommand("update", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleUpdate(d, tm, payload, replConfig.GetAddr())
 	}, "Update en element. usage: update <table> <key> <value>")
+	r.AddCommand("upsert", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleUpsert(d, tm, payload, replConfig.GetAddr())
+	}, "Insert an element, or update it if it exists. usage: upsert <key> <value> into <table>")
 	r.AddCommand("delete", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleDelete(d, tm, payload, replConfig.GetAddr())
 	}, "Delete an element. usage: delete <key> from <table>")
 	r.AddCommand("select", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleSelect(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Select elements from a table. usage: select from <table>")
+	}, "Select elements from a table. usage: select from <table> [between <lo> <hi>]")
 	r.AddCommand("join", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleJoin(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Joins two tables. usage: join <table1> <key/val for table1> on <table2> <key/val for table2>")
 	r.AddCommand("transaction", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleTransaction(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Handle transactions. usage: transaction <begin|commit>")
+	}, "Handle transactions. usage: transaction <begin|commit|locks <uuid>>")
 	r.AddCommand("lock", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleLock(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Grabs a write lock on a resource. usage: lock <table> <key>")
+	r.AddCommand("metrics", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleMetrics(tm, payload, replConfig.GetWriter())
+	}, "Print transaction counters. usage: metrics")
 	r.AddCommand("pretty", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePretty(d, payload, replConfig.GetWriter())
 	}, "Print out the internal data representation. usage: pretty")
@@ -54,9 +62,12 @@ func TransactionREPL(d *db.Database, tm *TransactionManager) *repl.REPL {
 func HandleTransaction(d *db.Database, tm *TransactionManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
-	// Usage: create <type> table <table>
+	// Usage: transaction <begin|commit> or transaction locks <uuid>
+	if numFields == 3 && fields[1] == "locks" {
+		return HandleTransactionLocks(tm, fields[2], w)
+	}
 	if numFields != 2 || (fields[1] != "begin" && fields[1] != "commit") {
-		return errors.New("usage: transaction <begin|commit>")
+		return errors.New("usage: transaction <begin|commit|locks <uuid>>")
 	}
 	switch fields[1] {
 	case "begin":
@@ -68,6 +79,42 @@ func HandleTransaction(d *db.Database, tm *TransactionManager, payload string, w
 	}
 }
 
+// Print the resources a transaction holds locks on, sorted by table then key.
+func HandleTransactionLocks(tm *TransactionManager, id string, w io.Writer) (err error) {
+	clientId, err := uuid.Parse(id)
+	if err != nil {
+		return fmt.Errorf("transaction locks error: %w", err)
+	}
+	t, found := tm.GetTransaction(clientId)
+	if !found {
+		io.WriteString(w, "no such transaction\n")
+		return nil
+	}
+	t.RLock()
+	defer t.RUnlock()
+	resources := make([]Resource, 0, len(t.resources))
+	for r := range t.resources {
+		resources = append(resources, r)
+	}
+	sort.Slice(resources, func(i, j int) bool {
+		if resources[i].tableName != resources[j].tableName {
+			return resources[i].tableName < resources[j].tableName
+		}
+		return resources[i].resourceKey < resources[j].resourceKey
+	})
+	for _, r := range resources {
+		lockName := "read"
+		switch t.resources[r] {
+		case W_LOCK:
+			lockName = "write"
+		case UPDATE_LOCK:
+			lockName = "update"
+		}
+		io.WriteString(w, fmt.Sprintf("%s %d: %s lock\n", r.tableName, r.resourceKey, lockName))
+	}
+	return nil
+}
+
 // Handle create table.
 func HandleCreateTable(d *db.Database, tm *TransactionManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	return db.HandleCreateTable(d, payload, w)
@@ -84,17 +131,26 @@ func HandleFind(d *db.Database, tm *TransactionManager, payload string, w io.Wri
 		return fmt.Errorf("usage: find <key> from <table>")
 	}
 	if key, err = strconv.Atoi(fields[1]); err != nil {
-		return fmt.Errorf("find error: %v", err)
+		return fmt.Errorf("find error: %w", err)
 	}
 	if table, err = d.GetTable(fields[3]); err != nil {
-		return fmt.Errorf("find error: %v", err)
+		return fmt.Errorf("find error: %w", err)
+	}
+	// Optimistic and MVCC transactions read without locking.
+	if tm.IsBuffered(clientId) {
+		entry, err := tm.Read(clientId, table, int64(key))
+		if err != nil {
+			return fmt.Errorf("find error: %w", err)
+		}
+		io.WriteString(w, fmt.Sprintf("found entry: (%d, %d)\n", entry.GetKey(), entry.GetValue()))
+		return nil
 	}
 	// Get the transaction, run the find, release lock and rollback if error.
 	if err = tm.Lock(clientId, table, int64(key), R_LOCK); err != nil {
-		return fmt.Errorf("find error: %v", err)
+		return fmt.Errorf("find error: %w", err)
 	}
 	if err = db.HandleFind(d, payload, w); err != nil {
-		return fmt.Errorf("find error: %v", err)
+		return fmt.Errorf("find error: %w", err)
 	}
 	return nil
 }
@@ -110,17 +166,34 @@ func HandleInsert(d *db.Database, tm *TransactionManager, payload string, client
 		return fmt.Errorf("usage: insert <key> <value> into <table>")
 	}
 	if key, err = strconv.Atoi(fields[1]); err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	if table, err = d.GetTable(fields[4]); err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
+	}
+	// Optimistic and MVCC transactions buffer the insert until commit.
+	if tm.IsBuffered(clientId) {
+		value, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return fmt.Errorf("insert error: %w", err)
+		}
+		if _, err = tm.Read(clientId, table, int64(key)); err == nil {
+			return errors.New("insert error: key already in table")
+		}
+		if err = tm.Write(clientId, table, int64(key), int64(value)); err != nil {
+			return fmt.Errorf("insert error: %w", err)
+		}
+		return nil
 	}
 	// Get the transaction, run the find, release lock and rollback if error.
 	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
+	}
+	if err = tm.TrackWrite(clientId, table, int64(key)); err != nil {
+		return fmt.Errorf("insert error: %w", err)
 	}
 	if err = db.HandleInsert(d, payload); err != nil {
-		return fmt.Errorf("insert error: %v", err)
+		return fmt.Errorf("insert error: %w", err)
 	}
 	return nil
 }
@@ -136,21 +209,82 @@ func HandleUpdate(d *db.Database, tm *TransactionManager, payload string, client
 		return fmt.Errorf("usage: update <table> <key> <value>")
 	}
 	if key, err = strconv.Atoi(fields[2]); err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	if table, err = d.GetTable(fields[1]); err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
+	}
+	// Optimistic and MVCC transactions buffer the update until commit.
+	if tm.IsBuffered(clientId) {
+		value, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return fmt.Errorf("update error: %w", err)
+		}
+		if _, err = tm.Read(clientId, table, int64(key)); err != nil {
+			return fmt.Errorf("update error: %w", err)
+		}
+		if err = tm.Write(clientId, table, int64(key), int64(value)); err != nil {
+			return fmt.Errorf("update error: %w", err)
+		}
+		return nil
 	}
 	// Get the transaction, run the find, release lock and rollback if error.
 	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
+	}
+	if err = tm.TrackWrite(clientId, table, int64(key)); err != nil {
+		return fmt.Errorf("update error: %w", err)
 	}
 	if err = db.HandleUpdate(d, payload); err != nil {
-		return fmt.Errorf("update error: %v", err)
+		return fmt.Errorf("update error: %w", err)
 	}
 	return nil
 }
 
+// Handle upsert.
+func HandleUpsert(d *db.Database, tm *TransactionManager, payload string, clientId uuid.UUID) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: upsert <key> <value> into <table>
+	var key, value int
+	var table db.Index
+	if numFields != 5 || fields[3] != "into" {
+		return fmt.Errorf("usage: upsert <key> <value> into <table>")
+	}
+	if key, err = strconv.Atoi(fields[1]); err != nil {
+		return fmt.Errorf("upsert error: %w", err)
+	}
+	if value, err = strconv.Atoi(fields[2]); err != nil {
+		return fmt.Errorf("upsert error: %w", err)
+	}
+	if table, err = d.GetTable(fields[4]); err != nil {
+		return fmt.Errorf("upsert error: %w", err)
+	}
+	if _, _, err = UpsertEntry(tm, table, int64(key), int64(value), clientId); err != nil {
+		return fmt.Errorf("upsert error: %w", err)
+	}
+	return nil
+}
+
+// Set a key to the given value within the client's transaction, inserting it if need be.
+// Reports the value the key had, if it existed.
+func UpsertEntry(tm *TransactionManager, table db.Index, key int64, value int64, clientId uuid.UUID) (oldval int64, existed bool, err error) {
+	// Optimistic and MVCC transactions buffer the write until commit.
+	if tm.IsBuffered(clientId) {
+		if old, err := tm.Read(clientId, table, key); err == nil {
+			oldval, existed = old.GetValue(), true
+		}
+		return oldval, existed, tm.Write(clientId, table, key, value)
+	}
+	if err = tm.Lock(clientId, table, key, W_LOCK); err != nil {
+		return 0, false, err
+	}
+	if err = tm.TrackWrite(clientId, table, key); err != nil {
+		return 0, false, err
+	}
+	return db.Upsert(table, key, value)
+}
+
 // Handle delete.
 func HandleDelete(d *db.Database, tm *TransactionManager, payload string, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
@@ -162,17 +296,30 @@ func HandleDelete(d *db.Database, tm *TransactionManager, payload string, client
 		return fmt.Errorf("usage: delete <key> from <table>")
 	}
 	if key, err = strconv.Atoi(fields[1]); err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
 	}
 	if table, err = d.GetTable(fields[3]); err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
+	}
+	// Optimistic and MVCC transactions buffer the delete until commit.
+	if tm.IsBuffered(clientId) {
+		if _, err = tm.Read(clientId, table, int64(key)); err != nil {
+			return fmt.Errorf("delete error: %w", err)
+		}
+		if err = tm.Remove(clientId, table, int64(key)); err != nil {
+			return fmt.Errorf("delete error: %w", err)
+		}
+		return nil
 	}
 	// Get the transaction, run the find, release lock and rollback if error.
 	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
+	}
+	if err = tm.TrackWrite(clientId, table, int64(key)); err != nil {
+		return fmt.Errorf("delete error: %w", err)
 	}
 	if err = db.HandleDelete(d, payload); err != nil {
-		return fmt.Errorf("delete error: %v", err)
+		return fmt.Errorf("delete error: %w", err)
 	}
 	return nil
 }
@@ -181,14 +328,42 @@ func HandleDelete(d *db.Database, tm *TransactionManager, payload string, client
 func HandleSelect(d *db.Database, tm *TransactionManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
-	// Usage: select from <table>
-	if numFields != 3 || fields[1] != "from" {
-		return fmt.Errorf("usage: select from <table>")
+	// Usage: select from <table> [between <lo> <hi>]
+	if (numFields != 3 && (numFields != 6 || fields[3] != "between")) || fields[1] != "from" {
+		return fmt.Errorf("usage: select from <table> [between <lo> <hi>]")
+	}
+	table, err := d.GetTable(fields[2])
+	if err != nil {
+		return fmt.Errorf("select error: %w", err)
+	}
+	// Lock the scanned range so that no phantoms can be inserted into it.
+	var lo, hi int
+	if numFields == 6 {
+		if lo, err = strconv.Atoi(fields[4]); err != nil {
+			return fmt.Errorf("select error: %w", err)
+		}
+		if hi, err = strconv.Atoi(fields[5]); err != nil {
+			return fmt.Errorf("select error: %w", err)
+		}
+		if err = tm.LockRange(clientId, table, int64(lo), int64(hi)); err != nil {
+			return fmt.Errorf("select error: %w", err)
+		}
 	}
-	// NOTE: Select is unsafe; not locking anything. May provide an inconsistent view of the database.
-	if err = db.HandleSelect(d, payload, w); err != nil {
-		return fmt.Errorf("select error: %v", err)
+	// NOTE: Select takes no locks; other transactions' uncommitted writes are masked instead.
+	results, err := tm.Select(clientId, table)
+	if err != nil {
+		return fmt.Errorf("select error: %w", err)
 	}
+	if numFields == 6 {
+		inRange := make([]utils.Entry, 0, len(results))
+		for _, entry := range results {
+			if utils.KeyInRange(entry, int64(lo), int64(hi), true) {
+				inRange = append(inRange, entry)
+			}
+		}
+		results = inRange
+	}
+	db.PrintResults(results, w)
 	return nil
 }
 
@@ -216,14 +391,24 @@ func HandleLock(d *db.Database, tm *TransactionManager, payload string, w io.Wri
 		return fmt.Errorf("usage: lock <table> <key>")
 	}
 	if table, err = d.GetTable(fields[1]); err != nil {
-		return fmt.Errorf("lock error: %v", err)
+		return fmt.Errorf("lock error: %w", err)
 	}
 	if key, err = strconv.Atoi(fields[2]); err != nil {
-		return fmt.Errorf("lock error: %v", err)
+		return fmt.Errorf("lock error: %w", err)
 	}
 	if err = tm.Lock(clientId, table, int64(key), W_LOCK); err != nil {
-		return fmt.Errorf("lock error: %v", err)
+		return fmt.Errorf("lock error: %w", err)
+	}
+	return nil
+}
+
+// Handle metrics.
+func HandleMetrics(tm *TransactionManager, payload string, w io.Writer) (err error) {
+	// Usage: metrics
+	if len(strings.Fields(payload)) != 1 {
+		return errors.New("usage: metrics")
 	}
+	tm.GetMetrics().Snapshot().Print(w)
 	return nil
 }
 
@@ -0,0 +1,79 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Handle bench.
+func HandleBench(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: bench insert <table> <n> | bench scan <table>
+	switch {
+	case numFields == 4 && fields[1] == "insert":
+		var n int
+		if n, err = strconv.Atoi(fields[3]); err != nil || n <= 0 {
+			return errors.New("bench error: number of rows must be a positive integer")
+		}
+		return benchInsert(d, fields[2], int64(n), w)
+	case numFields == 3 && fields[1] == "scan":
+		return benchScan(d, fields[2], w)
+	default:
+		return errors.New("usage: bench insert <table> <n> | bench scan <table>")
+	}
+}
+
+// Put n synthetic rows into a table through the key-value API, printing the throughput. The
+// rows' keys follow the table's largest key, so that existing rows are left alone.
+func benchInsert(d *Database, tableName string, n int64, w io.Writer) error {
+	if _, err := d.GetTable(tableName); err != nil {
+		return fmt.Errorf("bench error: %v", err)
+	}
+	entries, err := d.selectTable(tableName)
+	if err != nil {
+		return fmt.Errorf("bench error: %v", err)
+	}
+	first := int64(0)
+	for _, entry := range entries {
+		if entry.GetKey() >= first {
+			first = entry.GetKey() + 1
+		}
+	}
+	start := time.Now()
+	for key := first; key < first+n; key++ {
+		if err = d.Put(tableName, key, key); err != nil {
+			return fmt.Errorf("bench error: %v", err)
+		}
+	}
+	printThroughput(w, "inserted", n, time.Since(start))
+	return nil
+}
+
+// Select every row of a table, printing the throughput.
+func benchScan(d *Database, tableName string, w io.Writer) error {
+	if _, err := d.GetTable(tableName); err != nil {
+		return fmt.Errorf("bench error: %v", err)
+	}
+	start := time.Now()
+	entries, err := d.selectTable(tableName)
+	if err != nil {
+		return fmt.Errorf("bench error: %v", err)
+	}
+	printThroughput(w, "scanned", int64(len(entries)), time.Since(start))
+	return nil
+}
+
+// Print how many rows were handled, in how long, and how many per second.
+func printThroughput(w io.Writer, verb string, rows int64, elapsed time.Duration) {
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(rows) / elapsed.Seconds()
+	}
+	io.WriteString(w, fmt.Sprintf("%s %d rows in %.1fms (%.0f rows/sec)\n",
+		verb, rows, float64(elapsed)/float64(time.Millisecond), rate))
+}
@@ -0,0 +1,118 @@
+package db
+
+import (
+	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+)
+
+// Counters per key a table's negative cache is sized for, which keeps false positives near 1%.
+const BLOOM_COUNTERS_PER_KEY = 10
+
+// Number of keys a negative cache is sized for at least.
+const BLOOM_MIN_KEYS = 1024
+
+// A counting bloom filter of the keys in a table, so that Get and Contains can tell a key is
+// absent without reading any page. Each key bumps two counters, so deleting it can decrement
+// them without clearing a counter another key shares.
+type countingBloom struct {
+	counts  []uint8
+	numKeys int64 // Keys in the filter.
+	maxKeys int64 // Keys the filter is sized for; past it, false positives grow.
+}
+
+// Build a filter holding every key in the table.
+func buildCountingBloom(table Index) (*countingBloom, error) {
+	entries, err := table.Select()
+	if err != nil {
+		return nil, err
+	}
+	maxKeys := 2 * int64(len(entries))
+	if maxKeys < BLOOM_MIN_KEYS {
+		maxKeys = BLOOM_MIN_KEYS
+	}
+	filter := &countingBloom{counts: make([]uint8, maxKeys*BLOOM_COUNTERS_PER_KEY), maxKeys: maxKeys}
+	for _, entry := range entries {
+		filter.insert(entry.GetKey())
+	}
+	return filter, nil
+}
+
+// The counters a key maps to.
+func (filter *countingBloom) slots(key int64) (uint, uint) {
+	size := int64(len(filter.counts))
+	return hash.XxHasher(key, size), hash.MurmurHasher(key, size)
+}
+
+// Add a key. A counter that would overflow sticks at its maximum, so it is never decremented
+// back to zero while a key still maps to it.
+func (filter *countingBloom) insert(key int64) {
+	h1, h2 := filter.slots(key)
+	for _, h := range []uint{h1, h2} {
+		if filter.counts[h] < 255 {
+			filter.counts[h]++
+		}
+	}
+	filter.numKeys++
+}
+
+// Remove a key that was added.
+func (filter *countingBloom) remove(key int64) {
+	h1, h2 := filter.slots(key)
+	for _, h := range []uint{h1, h2} {
+		if filter.counts[h] > 0 && filter.counts[h] < 255 {
+			filter.counts[h]--
+		}
+	}
+	filter.numKeys--
+}
+
+// Check whether a key may be in the filter; false means it definitely isn't.
+func (filter *countingBloom) mayContain(key int64) bool {
+	h1, h2 := filter.slots(key)
+	return filter.counts[h1] > 0 && filter.counts[h2] > 0
+}
+
+// Get a table's negative cache, building it if need be. Expects db.filterMtx to be locked.
+func (db *Database) negativeCache(name string, table Index) (*countingBloom, error) {
+	if filter, found := db.filters[name]; found {
+		return filter, nil
+	}
+	filter, err := buildCountingBloom(table)
+	if err != nil {
+		return nil, err
+	}
+	db.filters[name] = filter
+	return filter, nil
+}
+
+// Record a key inserted into the table in its negative cache, if it has one; it is the table's
+// insert hook. A filter that outgrew its size is dropped, to be rebuilt larger by the next lookup.
+func (db *Database) cacheInsert(name string, key int64) {
+	db.filterMtx.Lock()
+	defer db.filterMtx.Unlock()
+	if filter, found := db.filters[name]; found {
+		filter.insert(key)
+		if filter.numKeys > filter.maxKeys {
+			delete(db.filters, name)
+		}
+	}
+}
+
+// Record a key deleted through the key-value API in the table's negative cache, if it has one.
+func (db *Database) cacheRemove(name string, key int64) {
+	db.filterMtx.Lock()
+	defer db.filterMtx.Unlock()
+	if filter, found := db.filters[name]; found {
+		filter.remove(key)
+	}
+}
+
+// Drop negative caches, e.g. as their table is created or dropped: every table's if name is empty.
+func (db *Database) dropNegativeCache(name string) {
+	db.filterMtx.Lock()
+	defer db.filterMtx.Unlock()
+	if name == "" {
+		db.filters = make(map[string]*countingBloom)
+		return
+	}
+	delete(db.filters, name)
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
+	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+)
+
+// Name of the file in a database's folder marking that the converted copies of its tables are
+// all written, and only have to be renamed into place; see convertLegacyTables.
+const CONVERT_FILE = ".dbconvert"
+
+// Suffix of the file a table is converted into, next to the table's own.
+const CONVERT_SUFFIX = ".convert"
+
+// Converts the tables of a database written before it had a META_FILE, whose pages have no
+// trailers (page layout 0), to the current page layout, then writes the database's metadata.
+// Each table is copied into a file next to it in the current layout. Once every copy is written,
+// CONVERT_FILE is created and the copies are renamed over the tables, so that a conversion cut
+// short is started over, or finished if the copies were all written.
+func convertLegacyTables(folder string, m meta) error {
+	marker := filepath.Join(folder, CONVERT_FILE)
+	if _, err := os.Stat(marker); os.IsNotExist(err) {
+		names, err := tableNames(folder)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err = convertTable(filepath.Join(folder, name), m.PageSize); err != nil {
+				return fmt.Errorf("convert %s: %w", name, err)
+			}
+		}
+		if err = ioutil.WriteFile(marker, nil, 0666); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasSuffix(name, CONVERT_SUFFIX) && !strings.HasSuffix(name, CONVERT_SUFFIX+".meta") {
+			continue
+		}
+		original := strings.Replace(name, CONVERT_SUFFIX, "", 1)
+		if err = os.Rename(filepath.Join(folder, name), filepath.Join(folder, original)); err != nil {
+			return err
+		}
+	}
+	if err = writeMeta(folder, m); err != nil {
+		return err
+	}
+	return os.Remove(marker)
+}
+
+// List the tables in a database's folder. Table names are alphanumeric; anything else is
+// metadata or a log.
+func tableNames(folder string) ([]string, error) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() && !strings.Contains(file.Name(), ".") {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
+// Copy the entries of a table in page layout 0 into a new table in the current layout, at the
+// table's path plus CONVERT_SUFFIX. Tables with a .meta file are hash tables, whose legacy
+// buckets are read in hash.FLAT_BUCKET_LAYOUT.
+func convertTable(path string, pageSize int64) error {
+	copyPath := path + CONVERT_SUFFIX
+	os.Remove(copyPath)
+	os.Remove(copyPath + ".meta")
+	if _, err := os.Stat(path + ".meta"); err != nil {
+		legacy, err := btree.OpenTableWithOptions(path, btree.TableOptions{PageSize: pageSize, LegacyPageLayout: true})
+		if err != nil {
+			return err
+		}
+		entries, err := legacy.Select()
+		if closeErr := legacy.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		converted, err := btree.BulkLoad(copyPath, entries, btree.TableOptions{PageSize: pageSize})
+		if err != nil {
+			return err
+		}
+		return converted.Close()
+	}
+	legacy, err := hash.OpenTableWithOptions(path, hash.TableOptions{PageSize: pageSize, LegacyPageLayout: true})
+	if err != nil {
+		return err
+	}
+	entries, err := legacy.Select()
+	if closeErr := legacy.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	converted, err := hash.OpenTableWithOptions(copyPath, hash.TableOptions{PageSize: pageSize})
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = converted.Insert(entry.GetKey(), entry.GetValue()); err != nil {
+			converted.Close()
+			return err
+		}
+	}
+	return converted.Close()
+}
@@ -1,12 +1,18 @@
 package db
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
 	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
@@ -18,6 +24,47 @@ import (
 type Database struct {
 	basepath string
 	tables   map[string]Index
+	readOnly bool  // Set for snapshots; see OpenSnapshotAt.
+	pageSize int64 // Page size of the database's tables.
+	// Page layout of the database's tables; only snapshots of old databases have layout 0.
+	pageLayout int
+	// Codecs of the tables not using the default codec, by name; kept in META_FILE.
+	codecs map[string]string
+	// Writes made through Put and Delete go through this, if set; see SetEditLogger.
+	editLogger EditLogger
+	// Negative caches of tables used through the key-value API, by name; see Get.
+	filters   map[string]*countingBloom
+	filterMtx sync.Mutex
+	// Locks guarding each table's structure against schema operations; see LockTable.
+	tableLocks   map[string]*sync.RWMutex
+	tableLockMtx sync.Mutex
+	// Keys marked as deleted and when, by table; see SetTombstoneGracePeriod.
+	tombstones     map[string]map[int64]time.Time
+	tombstoneGrace time.Duration
+	tombstoneMtx   sync.Mutex
+}
+
+// Options for opening a database.
+type Options struct {
+	// Page size of the database's tables, kept in META_FILE. 0 uses the size the database was
+	// created with, or pager.DEFAULT_PAGESIZE for a new database; any other size must match an
+	// existing database's. Databases of different page sizes can be open at once.
+	PageSize int64
+	// Logger for the engine's internal diagnostics, if set. The logger is process-wide, so it is
+	// installed with utils.SetLogger and stays in place for every database.
+	Logger utils.Logger
+}
+
+// Name of the file in a database's folder that holds its metadata. It isn't alphanumeric,
+// so it can't clash with a table.
+const META_FILE = ".dbmeta"
+
+// Database-wide settings, stored in META_FILE.
+type meta struct {
+	PageSize   int64 `json:"page_size"`
+	PageLayout int   `json:"page_layout"` // The pager.PAGE_LAYOUT_VERSION the tables were written with.
+	// Names of the codecs tables were created with, for those not using the default codec.
+	Codecs map[string]string `json:"codecs,omitempty"`
 }
 
 // Index interface.
@@ -45,6 +92,15 @@ const (
 
 // Opens a database given a data folder.
 func Open(folder string) (*Database, error) {
+	return OpenWithOptions(folder, Options{})
+}
+
+// Opens a database given a data folder and options, creating it if need be. Fails if the
+// options' page size doesn't match the database's.
+func OpenWithOptions(folder string, options Options) (*Database, error) {
+	if options.Logger != nil {
+		utils.SetLogger(options.Logger)
+	}
 	// Ensure folder is of the form */
 	if !strings.HasSuffix(folder, "/") {
 		folder += "/"
@@ -54,15 +110,100 @@ func Open(folder string) (*Database, error) {
 	if err != nil {
 		return nil, err
 	}
+	m, found, err := readMeta(folder)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		m.PageSize = options.PageSize
+		if m.PageSize == 0 {
+			m.PageSize = pager.DEFAULT_PAGESIZE
+		}
+		m.PageLayout = pager.PAGE_LAYOUT_VERSION
+		// Tables from before the metadata was stored use the default page size and have no
+		// page trailers, so they are converted to the current layout.
+		names, err := tableNames(folder)
+		if err != nil {
+			return nil, err
+		}
+		_, convertErr := os.Stat(filepath.Join(folder, CONVERT_FILE))
+		if len(names) > 0 || convertErr == nil {
+			if m.PageSize != pager.DEFAULT_PAGESIZE {
+				return nil, fmt.Errorf("open: database has page size %d, not %d", pager.DEFAULT_PAGESIZE, m.PageSize)
+			}
+			if err = convertLegacyTables(folder, m); err != nil {
+				return nil, fmt.Errorf("open: %w", err)
+			}
+			found = true
+		}
+	} else if options.PageSize != 0 && options.PageSize != m.PageSize {
+		return nil, fmt.Errorf("open: database has page size %d, not %d", m.PageSize, options.PageSize)
+	}
+	if m.PageLayout != pager.PAGE_LAYOUT_VERSION {
+		return nil, fmt.Errorf("open: database has page layout %d, not %d", m.PageLayout, pager.PAGE_LAYOUT_VERSION)
+	}
+	if err = pager.CheckPageSize(m.PageSize); err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+	if !found {
+		if err = writeMeta(folder, m); err != nil {
+			return nil, err
+		}
+	}
+	if m.Codecs == nil {
+		m.Codecs = make(map[string]string)
+	}
 	// Return an empty database.
 	return &Database{
-		basepath: folder,
-		tables:   make(map[string]Index),
+		basepath:   folder,
+		tables:     make(map[string]Index),
+		pageSize:   m.PageSize,
+		pageLayout: m.PageLayout,
+		codecs:     m.Codecs,
+		filters:    make(map[string]*countingBloom),
 	}, nil
 }
 
+// Read a database's metadata, reporting whether it has any.
+func readMeta(folder string) (m meta, found bool, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(folder, META_FILE))
+	if os.IsNotExist(err) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, err
+	}
+	if err = json.Unmarshal(data, &m); err != nil {
+		return m, false, fmt.Errorf("read %s: %w", META_FILE, err)
+	}
+	return m, true, nil
+}
+
+// Write the database's metadata, e.g. after a table's codec changes.
+func (db *Database) saveMeta() error {
+	return writeMeta(db.basepath, meta{PageSize: db.pageSize, PageLayout: pager.PAGE_LAYOUT_VERSION, Codecs: db.codecs})
+}
+
+// Write a database's metadata.
+func writeMeta(folder string, m meta) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(folder, META_FILE), data, 0666)
+}
+
+// Get the page size of the database's tables.
+func (db *Database) GetPageSize() int64 {
+	return db.pageSize
+}
+
 // Close each table in the database, then close the database.
 func (db *Database) Close() (err error) {
+	if _, curErr := db.reapTombstones(time.Time{}); curErr != nil {
+		err = curErr
+	}
+	db.dropNegativeCache("")
 	for _, table := range db.tables {
 		curErr := table.Close()
 		if err == nil {
@@ -72,6 +213,61 @@ func (db *Database) Close() (err error) {
 	return err
 }
 
+// Flush writes every table's dirty pages to disk and fsyncs them,
+// returning the first error encountered.
+func (db *Database) Flush() (err error) {
+	for _, table := range db.tables {
+		pager := table.GetPager()
+		pager.LockAllUpdates()
+		_, curErr := pager.FlushAllPages()
+		if curErr == nil {
+			curErr = pager.Sync()
+		}
+		pager.UnlockAllUpdates()
+		if curErr == nil {
+			curErr = flushMeta(table)
+		}
+		if err == nil && curErr != nil {
+			err = fmt.Errorf("flush %s: %v", table.GetName(), curErr)
+		}
+	}
+	return err
+}
+
+// StartBackgroundWriter starts a background writer for each open table, which trickles its
+// dirty pages to disk between checkpoints; see pager.StartBackgroundWriter. Tables opened
+// later don't get one. Call stop to end them all.
+func (db *Database) StartBackgroundWriter(interval time.Duration) (stop func()) {
+	stops := make([]func(), 0, len(db.tables))
+	for _, table := range db.tables {
+		stops = append(stops, table.GetPager().StartBackgroundWriter(interval))
+	}
+	return func() {
+		for _, stop := range stops {
+			stop()
+		}
+	}
+}
+
+// FlushMeta writes out the metadata that tables keep outside of their pages, such as hash
+// directories, so that a copy of the database folder can be reopened.
+func (db *Database) FlushMeta() (err error) {
+	for _, table := range db.tables {
+		if curErr := flushMeta(table); err == nil && curErr != nil {
+			err = fmt.Errorf("flush %s: %v", table.GetName(), curErr)
+		}
+	}
+	return err
+}
+
+// Write out the metadata an index keeps outside of its pages, if any.
+func flushMeta(index Index) error {
+	if index, ok := index.(*hash.HashIndex); ok {
+		return index.FlushMeta()
+	}
+	return nil
+}
+
 // Create a log file for the database.
 func (db *Database) CreateLogFile(filename string) error {
 	if _, err := os.Stat(filename); err == nil {
@@ -84,8 +280,18 @@ func (db *Database) CreateLogFile(filename string) error {
 	return file.Close()
 }
 
-// Create a table with the given type.
+// Create a table with the given type, storing its entries with the default codec.
 func (db *Database) createTable(name string, indexType IndexType) (index Index, err error) {
+	return db.CreateTableWithCodec(name, indexType, "")
+}
+
+// Create a table with the given type, storing its entries with the codec registered under the
+// given name (see utils.RegisterCodec), or the default codec if it is empty. The choice is
+// recorded in the database's metadata, so the table is reopened with the same codec.
+func (db *Database) CreateTableWithCodec(name string, indexType IndexType, codec string) (index Index, err error) {
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
 	// Ensure the db name is alphanumeric.
 	alphanumeric, _ := regexp.Compile(`\W`)
 	if alphanumeric.MatchString(name) {
@@ -97,21 +303,17 @@ func (db *Database) createTable(name string, indexType IndexType) (index Index,
 		return nil, errors.New("table already exists")
 	}
 	// Open the right type of index.
-	switch indexType {
-	case BTreeIndexType:
-		index, err = btree.OpenTable(path)
-		if err != nil {
-			return nil, err
-		}
-	case HashIndexType:
-		index, err = hash.OpenTable(path)
-		if err != nil {
+	if index, err = db.openIndex(path, indexType, codec); err != nil {
+		return nil, err
+	}
+	db.tables[name] = index
+	db.dropNegativeCache(name)
+	if codec != "" && codec != utils.DEFAULT_CODEC {
+		db.codecs[name] = codec
+		if err = db.saveMeta(); err != nil {
 			return nil, err
 		}
-	default:
-		return nil, errors.New("invalid index type")
 	}
-	db.tables[name] = index
 	return index, nil
 }
 
@@ -121,6 +323,10 @@ func (db *Database) GetTable(name string) (index Index, err error) {
 	if idx, ok := db.tables[name]; ok {
 		return idx, nil
 	}
+	// Snapshots open all of their tables up front.
+	if db.readOnly {
+		return nil, errors.New("table not found")
+	}
 	// Check if file exists; if not, error.
 	path := filepath.Join(db.basepath, name)
 	if _, err := os.Stat(path); err != nil {
@@ -135,7 +341,7 @@ func (db *Database) GetTable(name string) (index Index, err error) {
 	// 		return nil, err
 	// 	}
 	// } else {
-	index, err = btree.OpenTable(path)
+	index, err = db.openIndex(path, BTreeIndexType, db.codecs[name])
 	if err != nil {
 		return nil, err
 	}
@@ -144,6 +350,117 @@ func (db *Database) GetTable(name string) (index Index, err error) {
 	return index, nil
 }
 
+// Open the index in a table's file with the database's page size and the given codec.
+func (db *Database) openIndex(path string, indexType IndexType, codec string) (index Index, err error) {
+	switch indexType {
+	case BTreeIndexType:
+		index, err = btree.OpenTableWithOptions(path, btree.TableOptions{
+			Codec: codec, PageSize: db.pageSize, LegacyPageLayout: db.pageLayout == 0})
+	case HashIndexType:
+		index, err = hash.OpenTableWithOptions(path, hash.TableOptions{
+			Codec: codec, PageSize: db.pageSize, LegacyPageLayout: db.pageLayout == 0})
+	default:
+		return nil, errors.New("invalid index type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Keep the table's negative cache up to date with whatever inserts into it.
+	name := filepath.Base(path)
+	index.(InsertNotifier).SetInsertHook(func(key int64) {
+		db.cacheInsert(name, key)
+	})
+	return index, nil
+}
+
+// Rebuilds a table's index from the entries it stores, e.g. after IsBTree or IsHash finds its
+// structure damaged.
+func (db *Database) Reindex(tableName string) error {
+	defer db.LockTable(tableName)()
+	index, err := db.GetTable(tableName)
+	if err != nil {
+		return err
+	}
+	switch index := index.(type) {
+	case *btree.BTreeIndex:
+		return index.Reindex()
+	case *hash.HashIndex:
+		return index.Reindex()
+	default:
+		return errors.New("index type does not support reindexing")
+	}
+}
+
+// Checks a table's structure, returning the first invariant it breaks, or nil if it is sound.
+func (db *Database) Verify(tableName string) (*utils.Violation, error) {
+	defer db.RLockTable(tableName)()
+	index, err := db.GetTable(tableName)
+	if err != nil {
+		return nil, err
+	}
+	switch index := index.(type) {
+	case *btree.BTreeIndex:
+		return btree.Verify(index)
+	case *hash.HashIndex:
+		return hash.Verify(index)
+	default:
+		return nil, errors.New("index type does not support verification")
+	}
+}
+
+// Calls fn on every entry of every table, table by table in order of name, stopping at the
+// first error fn returns. Each table is read under RLockTable, but fn is called after the lock
+// is released, so it may write to the database; it sees each table as it was when read. Tables
+// dropped before they are reached are skipped, as are tombstoned keys.
+func (db *Database) ForEachEntry(fn func(tableName string, e utils.Entry) error) error {
+	names := make([]string, 0, len(db.tables))
+	for name := range db.tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entries, err := db.selectTable(name)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = fn(name, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Select every entry of a table under RLockTable; none if it has been dropped.
+func (db *Database) selectTable(name string) ([]utils.Entry, error) {
+	defer db.RLockTable(name)()
+	table, found := db.tables[name]
+	if !found {
+		return nil, nil
+	}
+	entries, err := table.Select()
+	if err != nil {
+		return nil, err
+	}
+	return db.skipTombstones(name, entries), nil
+}
+
+// Merges a hash table's sparse buckets and shrinks its directory, e.g. after deleting most of
+// its keys.
+func (db *Database) Compact(tableName string) error {
+	defer db.LockTable(tableName)()
+	index, err := db.GetTable(tableName)
+	if err != nil {
+		return err
+	}
+	hashIndex, ok := index.(*hash.HashIndex)
+	if !ok {
+		return errors.New("only hash tables can be compacted")
+	}
+	return hashIndex.Compact()
+}
+
 // Get a database's tables.
 func (db *Database) GetTables() map[string]Index {
 	return db.tables
@@ -4,9 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
 	"strconv"
 	"strings"
 
+	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
 	repl "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/repl"
 	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
@@ -17,21 +19,74 @@ func DatabaseRepl(db *Database) *repl.REPL {
 	r.AddCommand("create", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCreateTable(db, payload, replConfig.GetWriter())
 	}, "Create a table. usage: create table <table>")
-	r.AddCommand("find", func(payload string, replConfig *repl.REPLConfig) error {
-		return HandleFind(db, payload, replConfig.GetWriter())
+	r.AddTypedCommand("find", []repl.ArgType{repl.INT64_ARG, "from", repl.STRING_ARG}, func(args []interface{}, replConfig *repl.REPLConfig) error {
+		return findEntry(db, args[1].(string), args[0].(int64), replConfig.GetWriter())
 	}, "Find an element. usage: find <key> from <table>")
+	r.AddCommand("drop", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleDropTable(db, payload, replConfig.GetWriter())
+	}, "Delete a table once nothing is using it. usage: drop table <table>")
 	r.AddCommand("insert", func(payload string, replConfig *repl.REPLConfig) error { return HandleInsert(db, payload) }, "Insert an element. usage: insert <key> <value> into <table>")
-	r.AddCommand("update", func(payload string, replConfig *repl.REPLConfig) error { return HandleUpdate(db, payload) }, "Update en element. usage: update <table> <key> <value>")
+	r.AddTypedCommand("update", []repl.ArgType{repl.STRING_ARG, repl.INT64_ARG, repl.INT64_ARG}, func(args []interface{}, replConfig *repl.REPLConfig) error {
+		return updateEntry(db, args[0].(string), args[1].(int64), args[2].(int64))
+	}, "Update en element. usage: update <table> <key> <value>")
+	r.AddCommand("upsert", func(payload string, replConfig *repl.REPLConfig) error { return HandleUpsert(db, payload) }, "Insert an element, or update it if it exists. usage: upsert <key> <value> into <table>")
 	r.AddCommand("delete", func(payload string, replConfig *repl.REPLConfig) error { return HandleDelete(db, payload) }, "Delete an element. usage: delete <key> from <table>")
 	r.AddCommand("select", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleSelect(db, payload, replConfig.GetWriter())
 	}, "Select elements from a table. usage: select from <table>")
+	r.AddTypedCommand("hash_stats", []repl.ArgType{repl.STRING_ARG}, func(args []interface{}, replConfig *repl.REPLConfig) error {
+		return printHashStats(db, args[0].(string), replConfig.GetWriter())
+	}, "Print each bucket's depth, size and overflow chain length, and the load factor of a hash table. usage: hash_stats <table>")
+	r.AddCommand("verify", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleVerify(db, payload, replConfig.GetWriter())
+	}, "Check a table's structure, or every open table's, printing OK or the first problem found. usage: verify <table|all>")
+	r.AddCommand("bench", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleBench(db, payload, replConfig.GetWriter())
+	}, "Time inserting n synthetic rows into a table, or scanning it, printing the rows per second. usage: bench insert <table> <n> | bench scan <table>")
 	r.AddCommand("pretty", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePretty(db, payload, replConfig.GetWriter())
 	}, "Print out the internal data representation. usage: pretty")
 	return r
 }
 
+// Handle verify.
+func HandleVerify(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: verify <table|all>
+	if numFields != 2 {
+		return fmt.Errorf("usage: verify <table|all>")
+	}
+	if fields[1] != "all" {
+		return verifyTable(d, fields[1], "", w)
+	}
+	names := make([]string, 0)
+	for name := range d.GetTables() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err = verifyTable(d, name, name+": ", w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify a table, printing OK or the violation found after the given prefix.
+func verifyTable(d *Database, tableName string, prefix string, w io.Writer) error {
+	violation, err := d.Verify(tableName)
+	if err != nil {
+		return fmt.Errorf("verify error: %v", err)
+	}
+	if violation != nil {
+		io.WriteString(w, fmt.Sprintf("%s%v\n", prefix, violation))
+	} else {
+		io.WriteString(w, prefix+"OK\n")
+	}
+	return nil
+}
+
 // Handle create table.
 func HandleCreateTable(d *Database, payload string, w io.Writer) (err error) {
 	fields := strings.Fields(payload)
@@ -58,6 +113,21 @@ func HandleCreateTable(d *Database, payload string, w io.Writer) (err error) {
 	return nil
 }
 
+// Handle drop table.
+func HandleDropTable(d *Database, payload string, w io.Writer) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: drop table <table>
+	if numFields != 3 || fields[1] != "table" {
+		return fmt.Errorf("usage: drop table <table>")
+	}
+	if err = d.DropTable(fields[2]); err != nil {
+		return fmt.Errorf("drop error: %v", err)
+	}
+	io.WriteString(w, fmt.Sprintf("table %s dropped.\n", fields[2]))
+	return nil
+}
+
 // Handle find.
 func HandleFind(d *Database, payload string, w io.Writer) (err error) {
 	fields := strings.Fields(payload)
@@ -70,15 +140,23 @@ func HandleFind(d *Database, payload string, w io.Writer) (err error) {
 	if key, err = strconv.Atoi(fields[1]); err != nil {
 		return fmt.Errorf("find error: %v", err)
 	}
-	tableName := fields[3]
+	return findEntry(d, fields[3], int64(key), w)
+}
+
+// Find a key in a table, printing the entry.
+func findEntry(d *Database, tableName string, key int64, w io.Writer) error {
+	defer d.RLockTable(tableName)()
 	table, err := d.GetTable(tableName)
 	if err != nil {
 		return fmt.Errorf("find error: %v", err)
 	}
-	entry, err := table.Find(int64(key))
+	entry, err := table.Find(key)
 	if err != nil || entry == nil {
 		return fmt.Errorf("find error: %v", err)
 	}
+	if d.isTombstoned(tableName, key) {
+		return errors.New("find error: key not in table")
+	}
 	io.WriteString(w, fmt.Sprintf("found entry: (%d, %d)\n",
 		entry.GetKey(), entry.GetValue()))
 	return nil
@@ -100,6 +178,7 @@ func HandleInsert(d *Database, payload string) (err error) {
 		return fmt.Errorf("insert error: %v", err)
 	}
 	tableName := fields[4]
+	defer d.RLockTable(tableName)()
 	table, err := d.GetTable(tableName)
 	if err != nil {
 		return fmt.Errorf("insert error: %v", err)
@@ -130,18 +209,49 @@ func HandleUpdate(d *Database, payload string) (err error) {
 	if value, err = strconv.Atoi(fields[3]); err != nil {
 		return fmt.Errorf("update error: %v", err)
 	}
-	tableName := fields[1]
+	return updateEntry(d, fields[1], int64(key), int64(value))
+}
+
+// Update a key in a table.
+func updateEntry(d *Database, tableName string, key int64, value int64) error {
+	defer d.RLockTable(tableName)()
 	table, err := d.GetTable(tableName)
 	if err != nil {
 		return fmt.Errorf("update error: %v", err)
 	}
-	err = table.Update(int64(key), int64(value))
+	err = table.Update(key, value)
 	if err != nil {
 		return fmt.Errorf("update error: %v", err)
 	}
 	return nil
 }
 
+// Handle upsert.
+func HandleUpsert(d *Database, payload string) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: upsert <key> <value> into <table>
+	var key, value int
+	if numFields != 5 || fields[3] != "into" {
+		return fmt.Errorf("usage: upsert <key> <value> into <table>")
+	}
+	if key, err = strconv.Atoi(fields[1]); err != nil {
+		return fmt.Errorf("upsert error: %v", err)
+	}
+	if value, err = strconv.Atoi(fields[2]); err != nil {
+		return fmt.Errorf("upsert error: %v", err)
+	}
+	defer d.RLockTable(fields[4])()
+	table, err := d.GetTable(fields[4])
+	if err != nil {
+		return fmt.Errorf("upsert error: %v", err)
+	}
+	if _, _, err = Upsert(table, int64(key), int64(value)); err != nil {
+		return fmt.Errorf("upsert error: %v", err)
+	}
+	return nil
+}
+
 // Handle delete.
 func HandleDelete(d *Database, payload string) (err error) {
 	fields := strings.Fields(payload)
@@ -155,10 +265,17 @@ func HandleDelete(d *Database, payload string) (err error) {
 		return fmt.Errorf("delete error: %v", err)
 	}
 	tableName := fields[3]
+	defer d.RLockTable(tableName)()
 	table, err := d.GetTable(tableName)
 	if err != nil {
 		return fmt.Errorf("delete error: %v", err)
 	}
+	if d.getTombstoneGracePeriod() > 0 {
+		if _, err = table.Find(int64(key)); err != nil || !d.markTombstone(tableName, int64(key)) {
+			return errors.New("delete error: key not in table")
+		}
+		return nil
+	}
 	err = table.Delete(int64(key))
 	if err != nil {
 		return fmt.Errorf("delete error: %v", err)
@@ -175,6 +292,7 @@ func HandleSelect(d *Database, payload string, w io.Writer) (err error) {
 		return fmt.Errorf("usage: select from <table>")
 	}
 	tableName := fields[2]
+	defer d.RLockTable(tableName)()
 	table, err := d.GetTable(tableName)
 	if err != nil {
 		return fmt.Errorf("select error: %v", err)
@@ -183,7 +301,33 @@ func HandleSelect(d *Database, payload string, w io.Writer) (err error) {
 	if results, err = table.Select(); err != nil {
 		return err
 	}
-	printResults(results, w)
+	PrintResults(d.skipTombstones(tableName, results), w)
+	return nil
+}
+
+// Print the bucket statistics and load factor of a hash table.
+func printHashStats(d *Database, tableName string, w io.Writer) error {
+	table, err := d.GetTable(tableName)
+	if err != nil {
+		return fmt.Errorf("hash_stats error: %v", err)
+	}
+	index, ok := table.(*hash.HashIndex)
+	if !ok {
+		return fmt.Errorf("hash_stats error: %s is not a hash table", tableName)
+	}
+	stats, err := index.BucketStats()
+	if err != nil {
+		return fmt.Errorf("hash_stats error: %v", err)
+	}
+	loadFactor, err := index.LoadFactor()
+	if err != nil {
+		return fmt.Errorf("hash_stats error: %v", err)
+	}
+	for _, stat := range stats {
+		io.WriteString(w, fmt.Sprintf("bucket %d: local depth %d, %d entries, %d overflow pages\n",
+			stat.PN, stat.LocalDepth, stat.NumKeys, stat.OverflowPages))
+	}
+	io.WriteString(w, fmt.Sprintf("load factor: %.2f\n", loadFactor))
 	return nil
 }
 
@@ -216,8 +360,8 @@ func HandlePretty(d *Database, payload string, w io.Writer) (err error) {
 	return nil
 }
 
-// printResults prints all given entries in a standard format.
-func printResults(entries []utils.Entry, w io.Writer) {
+// PrintResults prints all given entries in a standard format.
+func PrintResults(entries []utils.Entry, w io.Writer) {
 	for _, entry := range entries {
 		io.WriteString(w, fmt.Sprintf("(%v, %v)\n",
 			entry.GetKey(), entry.GetValue()))
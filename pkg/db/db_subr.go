@@ -2,11 +2,46 @@ package db
 
 import (
 	"io/ioutil"
+	"os"
+	"sync"
 )
 
+// Environment variable naming the directory for temporary db files, if SetTempDir isn't called.
+const TMPDIR_ENV = "HORNET_TMPDIR"
+
+// Directory for temporary db files; empty falls back to TMPDIR_ENV, then the working directory.
+var tempDir struct {
+	mtx  sync.Mutex
+	path string
+}
+
+// Set the directory that temporary db files are created in. It is created if missing.
+func SetTempDir(path string) {
+	tempDir.mtx.Lock()
+	defer tempDir.mtx.Unlock()
+	tempDir.path = path
+}
+
+// Get the directory that temporary db files are created in.
+func GetTempDir() string {
+	tempDir.mtx.Lock()
+	defer tempDir.mtx.Unlock()
+	if tempDir.path != "" {
+		return tempDir.path
+	}
+	if path := os.Getenv(TMPDIR_ENV); path != "" {
+		return path
+	}
+	return "."
+}
+
 // Get a temporary db file.
 func GetTempDB() (string, error) {
-	tmpfile, err := ioutil.TempFile(".", "db-*")
+	dir := GetTempDir()
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return "", err
+	}
+	tmpfile, err := ioutil.TempFile(dir, "db-*")
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,153 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+// The kind of write made through the key-value API.
+type EditOp int
+
+const (
+	INSERT_OP EditOp = 0
+	UPDATE_OP EditOp = 1
+	DELETE_OP EditOp = 2
+)
+
+// Wraps each write made through Put and Delete, e.g. to log it for recovery. It must call
+// apply to make the write, and return its error.
+type EditLogger func(table Index, op EditOp, key int64, oldval int64, newval int64, apply func() error) error
+
+// Implemented by indexes that can insert or update a key in one traversal.
+type Upserter interface {
+	Upsert(key int64, value int64) (oldval int64, existed bool, err error)
+}
+
+// Implemented by indexes that report each key an insert adds to them, once the insert is done.
+// Only their tables have negative caches.
+type InsertNotifier interface {
+	SetInsertHook(hook func(key int64))
+}
+
+// Upsert sets a key in a table to the given value, inserting it if need be. Reports the value
+// the key had, if it existed. Indexes that aren't Upserters are searched, then updated or inserted into.
+func Upsert(table Index, key int64, value int64) (oldval int64, existed bool, err error) {
+	if upserter, ok := table.(Upserter); ok {
+		return upserter.Upsert(key, value)
+	}
+	if old, err := table.Find(key); err == nil {
+		return old.GetValue(), true, table.Update(key, value)
+	}
+	return 0, false, table.Insert(key, value)
+}
+
+// Set the logger that writes made through Put and Delete go through; nil applies them directly.
+func (db *Database) SetEditLogger(logger EditLogger) {
+	db.editLogger = logger
+}
+
+// Apply a write through the edit logger, if there is one.
+func (db *Database) logEdit(table Index, op EditOp, key int64, oldval int64, newval int64, apply func() error) error {
+	if db.editLogger == nil {
+		return apply()
+	}
+	return db.editLogger(table, op, key, oldval, newval, apply)
+}
+
+// Check the table's negative cache, building it if need be, for whether the key may be present.
+// A false answer is definite and reads no page.
+func (db *Database) mayContain(tableName string, table Index, key int64) bool {
+	if _, ok := table.(InsertNotifier); !ok {
+		return true
+	}
+	db.filterMtx.Lock()
+	defer db.filterMtx.Unlock()
+	filter, err := db.negativeCache(tableName, table)
+	return err != nil || filter.mayContain(key)
+}
+
+// Put sets a key in a table to the given value, inserting it if need be.
+func (db *Database) Put(tableName string, key int64, value int64) error {
+	defer db.RLockTable(tableName)()
+	table, err := db.GetTable(tableName)
+	if err != nil {
+		return fmt.Errorf("put error: %w", err)
+	}
+	db.clearTombstone(tableName, key)
+	// Only search for a key that may be there.
+	if db.mayContain(tableName, table, key) {
+		if old, err := table.Find(key); err == nil {
+			err = db.logEdit(table, UPDATE_OP, key, old.GetValue(), value, func() error {
+				return table.Update(key, value)
+			})
+			if err != nil {
+				return fmt.Errorf("put error: %w", err)
+			}
+			return nil
+		}
+	}
+	err = db.logEdit(table, INSERT_OP, key, 0, value, func() error {
+		return table.Insert(key, value)
+	})
+	if err != nil {
+		return fmt.Errorf("put error: %w", err)
+	}
+	return nil
+}
+
+// Get looks up a key in a table, reporting whether it was found. The table keeps a counting bloom
+// filter of its keys, built on first use, so that most lookups of absent keys read no page. The
+// table adds each key inserted into it, however it is written to, and Delete removes keys; keys
+// deleted other ways only cost a wasted lookup.
+func (db *Database) Get(tableName string, key int64) (value int64, found bool, err error) {
+	defer db.RLockTable(tableName)()
+	table, err := db.GetTable(tableName)
+	if err != nil {
+		return 0, false, fmt.Errorf("get error: %w", err)
+	}
+	if !db.mayContain(tableName, table, key) || db.isTombstoned(tableName, key) {
+		return 0, false, nil
+	}
+	entry, err := table.Find(key)
+	if err != nil {
+		return 0, false, nil
+	}
+	return entry.GetValue(), true, nil
+}
+
+// Contains checks whether a key is in a table; see Get.
+func (db *Database) Contains(tableName string, key int64) (bool, error) {
+	_, found, err := db.Get(tableName, key)
+	if err != nil {
+		return false, fmt.Errorf("contains error: %w", err)
+	}
+	return found, nil
+}
+
+// Delete removes a key from a table, erroring if it isn't there. It only tombstones the key
+// if there is a grace period; see SetTombstoneGracePeriod.
+func (db *Database) Delete(tableName string, key int64) error {
+	defer db.RLockTable(tableName)()
+	table, err := db.GetTable(tableName)
+	if err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	old, err := table.Find(key)
+	if err != nil {
+		return errors.New("delete error: key not in table")
+	}
+	if db.getTombstoneGracePeriod() > 0 {
+		if !db.markTombstone(tableName, key) {
+			return errors.New("delete error: key not in table")
+		}
+		return nil
+	}
+	err = db.logEdit(table, DELETE_OP, key, old.GetValue(), 0, func() error {
+		return table.Delete(key)
+	})
+	if err != nil {
+		return fmt.Errorf("delete error: %w", err)
+	}
+	db.cacheRemove(tableName, key)
+	return nil
+}
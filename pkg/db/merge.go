@@ -0,0 +1,143 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
+	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+)
+
+// TableTypes returns the type of every table in the database's folder, open or not. Tables
+// that aren't open are hash tables if they have a .meta file.
+func (db *Database) TableTypes() (map[string]IndexType, error) {
+	files, err := ioutil.ReadDir(db.basepath)
+	if err != nil {
+		return nil, err
+	}
+	nonAlphanumeric := regexp.MustCompile(`\W`)
+	types := make(map[string]IndexType)
+	for _, file := range files {
+		// Table names are alphanumeric; anything else is metadata or a log.
+		name := file.Name()
+		if file.IsDir() || nonAlphanumeric.MatchString(name) {
+			continue
+		}
+		types[name] = BTreeIndexType
+		if index, found := db.tables[name]; found {
+			if _, isHash := index.(*hash.HashIndex); isHash {
+				types[name] = HashIndexType
+			}
+		} else if _, err := os.Stat(filepath.Join(db.basepath, name+".meta")); err == nil {
+			types[name] = HashIndexType
+		}
+	}
+	return types, nil
+}
+
+// Merge moves every table of other into the database: each is closed in other, its files are
+// copied into the database's folder and opened here, then removed from other. Fails before
+// moving anything if other has a table whose name is taken here, or a different page size.
+// Closing a table flushes it under its pager's lock, so nothing else may use other meanwhile.
+func (db *Database) Merge(other *Database) error {
+	if db.readOnly || other.readOnly {
+		return ErrReadOnly
+	}
+	if filepath.Clean(db.basepath) == filepath.Clean(other.basepath) {
+		return errors.New("merge: can't merge a database into itself")
+	}
+	if db.pageSize != other.pageSize {
+		return fmt.Errorf("merge: database has page size %d, not %d", other.pageSize, db.pageSize)
+	}
+	types, err := other.TableTypes()
+	if err != nil {
+		return fmt.Errorf("merge: %w", err)
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		if _, found := db.tables[name]; found {
+			return fmt.Errorf("merge: table %s already exists", name)
+		}
+		if _, err := os.Stat(filepath.Join(db.basepath, name)); err == nil {
+			return fmt.Errorf("merge: table %s already exists", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := db.moveTable(other, name, types[name]); err != nil {
+			return fmt.Errorf("merge %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Move a table from other into the database.
+func (db *Database) moveTable(other *Database, name string, indexType IndexType) error {
+	if index, found := other.tables[name]; found {
+		if err := index.Close(); err != nil {
+			return err
+		}
+		delete(other.tables, name)
+	}
+	src, dst := filepath.Join(other.basepath, name), filepath.Join(db.basepath, name)
+	suffixes := []string{""}
+	if indexType == HashIndexType {
+		suffixes = append(suffixes, ".meta")
+	} else if _, err := os.Stat(src + btree.CODEC_FILE_SUFFIX); err == nil {
+		suffixes = append(suffixes, btree.CODEC_FILE_SUFFIX)
+	}
+	for _, suffix := range suffixes {
+		if err := copyFile(src+suffix, dst+suffix); err != nil {
+			return err
+		}
+	}
+	codec := other.codecs[name]
+	index, err := db.openIndex(dst, indexType, codec)
+	if err != nil {
+		return err
+	}
+	db.tables[name] = index
+	if codec != "" {
+		db.codecs[name] = codec
+		delete(other.codecs, name)
+		if err = db.saveMeta(); err != nil {
+			return err
+		}
+		if err = other.saveMeta(); err != nil {
+			return err
+		}
+	}
+	for _, suffix := range suffixes {
+		if err := os.Remove(src + suffix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy a file, syncing the copy before returning.
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+)
+
+// ErrReadOnly is returned when modifying a snapshot.
+var ErrReadOnly = errors.New("database is read-only")
+
+// An index in a snapshot, which rejects writes.
+type snapshotIndex struct {
+	Index
+}
+
+// Insert is not allowed on a snapshot.
+func (index snapshotIndex) Insert(int64, int64) error {
+	return ErrReadOnly
+}
+
+// Update is not allowed on a snapshot.
+func (index snapshotIndex) Update(int64, int64) error {
+	return ErrReadOnly
+}
+
+// Delete is not allowed on a snapshot.
+func (index snapshotIndex) Delete(int64) error {
+	return ErrReadOnly
+}
+
+// Close releases the index's file without writing anything back.
+func (index snapshotIndex) Close() error {
+	return index.GetPager().Close()
+}
+
+// OpenSnapshotAt opens the checkpointed copy of a database in recoveryFolder (as written by
+// the recovery manager's Delta) as a read-only database. It has its own files and no locks,
+// so it never touches the live database. Every table is opened up front; a later checkpoint
+// replaces the folder, and the snapshot must be reopened to see it.
+func OpenSnapshotAt(recoveryFolder string) (*Database, error) {
+	if !strings.HasSuffix(recoveryFolder, "/") {
+		recoveryFolder += "/"
+	}
+	files, err := ioutil.ReadDir(recoveryFolder)
+	if err != nil {
+		return nil, err
+	}
+	m, found, err := readMeta(recoveryFolder)
+	if err != nil {
+		return nil, err
+	}
+	// Copies of databases from before the metadata was stored are read in page layout 0, as
+	// they were written; a snapshot is read-only, so they aren't converted.
+	if !found {
+		m.PageSize = pager.DEFAULT_PAGESIZE
+		m.PageLayout = 0
+	}
+	if m.PageLayout != 0 && m.PageLayout != pager.PAGE_LAYOUT_VERSION {
+		return nil, fmt.Errorf("open snapshot: database has page layout %d, not %d", m.PageLayout, pager.PAGE_LAYOUT_VERSION)
+	}
+	if err = pager.CheckPageSize(m.PageSize); err != nil {
+		return nil, err
+	}
+	snapshot := &Database{
+		basepath:   recoveryFolder,
+		tables:     make(map[string]Index),
+		readOnly:   true,
+		pageSize:   m.PageSize,
+		pageLayout: m.PageLayout,
+		codecs:     m.Codecs,
+		filters:    make(map[string]*countingBloom),
+	}
+	for _, file := range files {
+		// Table names are alphanumeric; anything else is metadata or a log.
+		name := file.Name()
+		if file.IsDir() || strings.Contains(name, ".") {
+			continue
+		}
+		path := filepath.Join(recoveryFolder, name)
+		indexType := BTreeIndexType
+		if _, err = os.Stat(path + ".meta"); err == nil {
+			indexType = HashIndexType
+		}
+		index, err := snapshot.openIndex(path, indexType, m.Codecs[name])
+		if err != nil {
+			snapshot.Close()
+			return nil, err
+		}
+		snapshot.tables[name] = snapshotIndex{index}
+	}
+	return snapshot, nil
+}
+
+// Folder holding a numbered generation of the checkpointed copies of the database in base, as
+// kept by the recovery manager's Delta.
+func GenerationFolder(base string, gen int) string {
+	return fmt.Sprintf("%s-recovery.%d/", strings.TrimSuffix(base, "/"), gen)
+}
+
+// Lists the generations of checkpointed copies of the database in base, oldest first.
+func Generations(base string) ([]int, error) {
+	prefix := strings.TrimSuffix(base, "/") + "-recovery."
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	gens := make([]int, 0, len(matches))
+	for _, match := range matches {
+		// Skip anything else next to the snapshot, e.g. a half-built one.
+		suffix := strings.TrimPrefix(filepath.Base(match), filepath.Base(prefix))
+		if gen, err := strconv.Atoi(suffix); err == nil && gen > 0 {
+			gens = append(gens, gen)
+		}
+	}
+	sort.Ints(gens)
+	return gens, nil
+}
+
+// OpenGeneration opens a numbered generation of the checkpointed copies of the database in base
+// as a read-only database; see OpenSnapshotAt.
+func OpenGeneration(base string, gen int) (*Database, error) {
+	folder := GenerationFolder(base, gen)
+	if _, err := os.Stat(folder); err != nil {
+		return nil, fmt.Errorf("open generation %d: %w", gen, err)
+	}
+	return OpenSnapshotAt(folder)
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
+)
+
+// Get the lock guarding a table's structure, creating it if need be.
+func (db *Database) tableLock(name string) *sync.RWMutex {
+	db.tableLockMtx.Lock()
+	defer db.tableLockMtx.Unlock()
+	if db.tableLocks == nil {
+		db.tableLocks = make(map[string]*sync.RWMutex)
+	}
+	lock, found := db.tableLocks[name]
+	if !found {
+		lock = &sync.RWMutex{}
+		db.tableLocks[name] = lock
+	}
+	return lock
+}
+
+// RLockTable keeps schema operations, like DropTable, Reindex and Compact, off a table until the
+// returned function is called. Reads and writes through the database and its REPL take it; take
+// it around scans and other work on a table got from GetTable.
+func (db *Database) RLockTable(name string) (unlock func()) {
+	lock := db.tableLock(name)
+	lock.RLock()
+	return lock.RUnlock
+}
+
+// LockTable waits for everything holding the table through RLockTable to finish, and keeps out
+// anything new, until the returned function is called. Schema operations take it.
+func (db *Database) LockTable(name string) (unlock func()) {
+	lock := db.tableLock(name)
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Closes a table and deletes its files, once nothing holds it through RLockTable.
+func (db *Database) DropTable(name string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	defer db.LockTable(name)()
+	table, err := db.GetTable(name)
+	if err != nil {
+		return err
+	}
+	db.dropNegativeCache(name)
+	db.takeTombstones(name, time.Time{})
+	delete(db.tables, name)
+	if err = table.Close(); err != nil {
+		return err
+	}
+	path := filepath.Join(db.basepath, name)
+	if err = os.Remove(path); err != nil {
+		return err
+	}
+	// Hash tables keep their directory next to their pages, and B+trees their codec.
+	for _, suffix := range []string{".meta", btree.CODEC_FILE_SUFFIX} {
+		if err = os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if _, found := db.codecs[name]; found {
+		delete(db.codecs, name)
+		return db.saveMeta()
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+package db
+
+import (
+	"sync"
+	"time"
+
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
+// Sets how long deleted keys are kept as tombstones. While it is positive, Delete and the delete
+// command only mark a key as deleted, leaving its entry in the table; Get, ForEachEntry and the
+// find and select commands skip it, and Put brings it back with the new value. ReapTombstones,
+// or a reaper started with StartTombstoneReaper, removes entries whose tombstones are older than
+// the grace period. Tombstones are kept in memory: Close removes every entry still marked, but a
+// crash before then brings them back. 0, the default, deletes keys right away.
+func (db *Database) SetTombstoneGracePeriod(grace time.Duration) {
+	db.tombstoneMtx.Lock()
+	defer db.tombstoneMtx.Unlock()
+	db.tombstoneGrace = grace
+}
+
+// Get how long deleted keys are kept as tombstones; see SetTombstoneGracePeriod.
+func (db *Database) getTombstoneGracePeriod() time.Duration {
+	db.tombstoneMtx.Lock()
+	defer db.tombstoneMtx.Unlock()
+	return db.tombstoneGrace
+}
+
+// Mark a key as deleted at the current time, returning false if it already was.
+func (db *Database) markTombstone(tableName string, key int64) bool {
+	db.tombstoneMtx.Lock()
+	defer db.tombstoneMtx.Unlock()
+	if db.tombstones == nil {
+		db.tombstones = make(map[string]map[int64]time.Time)
+	}
+	marked, found := db.tombstones[tableName]
+	if !found {
+		marked = make(map[int64]time.Time)
+		db.tombstones[tableName] = marked
+	}
+	if _, found = marked[key]; found {
+		return false
+	}
+	marked[key] = time.Now()
+	return true
+}
+
+// Check whether a key is marked as deleted.
+func (db *Database) isTombstoned(tableName string, key int64) bool {
+	db.tombstoneMtx.Lock()
+	defer db.tombstoneMtx.Unlock()
+	_, found := db.tombstones[tableName][key]
+	return found
+}
+
+// Unmark a key, returning whether it was marked.
+func (db *Database) clearTombstone(tableName string, key int64) bool {
+	db.tombstoneMtx.Lock()
+	defer db.tombstoneMtx.Unlock()
+	if _, found := db.tombstones[tableName][key]; !found {
+		return false
+	}
+	delete(db.tombstones[tableName], key)
+	return true
+}
+
+// Drop a table's tombstones, or every table's if tableName is empty, returning the keys that were
+// marked older than cutoff, by table. A zero cutoff takes every key.
+func (db *Database) takeTombstones(tableName string, cutoff time.Time) map[string][]int64 {
+	db.tombstoneMtx.Lock()
+	defer db.tombstoneMtx.Unlock()
+	taken := make(map[string][]int64)
+	for name, marked := range db.tombstones {
+		if tableName != "" && name != tableName {
+			continue
+		}
+		for key, deletedAt := range marked {
+			if cutoff.IsZero() || deletedAt.Before(cutoff) {
+				taken[name] = append(taken[name], key)
+				delete(marked, key)
+			}
+		}
+	}
+	return taken
+}
+
+// Filter tombstoned entries out of a table's entries, in place.
+func (db *Database) skipTombstones(tableName string, entries []utils.Entry) []utils.Entry {
+	db.tombstoneMtx.Lock()
+	defer db.tombstoneMtx.Unlock()
+	marked := db.tombstones[tableName]
+	if len(marked) == 0 {
+		return entries
+	}
+	live := entries[:0]
+	for _, entry := range entries {
+		if _, found := marked[entry.GetKey()]; !found {
+			live = append(live, entry)
+		}
+	}
+	return live
+}
+
+// Removes the entries of keys that have been tombstoned for longer than the grace period,
+// returning how many were removed and the first error met. Each table is held with LockTable
+// while its entries are removed, so that no write brings a key back midway.
+func (db *Database) ReapTombstones() (int, error) {
+	return db.reapTombstones(time.Now().Add(-db.getTombstoneGracePeriod()))
+}
+
+// Remove the entries of keys tombstoned before cutoff, or of every tombstoned key if it is zero.
+func (db *Database) reapTombstones(cutoff time.Time) (reaped int, err error) {
+	for tableName, keys := range db.takeTombstones("", cutoff) {
+		n, curErr := db.reapTable(tableName, keys)
+		reaped += n
+		if err == nil && curErr != nil {
+			err = curErr
+		}
+	}
+	return reaped, err
+}
+
+// Remove a table's tombstoned entries.
+func (db *Database) reapTable(tableName string, keys []int64) (int, error) {
+	defer db.LockTable(tableName)()
+	table, found := db.tables[tableName]
+	if !found {
+		return 0, nil
+	}
+	reaped := 0
+	for _, key := range keys {
+		old, err := table.Find(key)
+		if err != nil {
+			continue
+		}
+		err = db.logEdit(table, DELETE_OP, key, old.GetValue(), 0, func() error {
+			return table.Delete(key)
+		})
+		if err != nil {
+			return reaped, err
+		}
+		db.cacheRemove(tableName, key)
+		reaped++
+	}
+	return reaped, nil
+}
+
+// StartTombstoneReaper calls ReapTombstones every interval, logging any error, until stop is
+// called.
+func (db *Database) StartTombstoneReaper(interval time.Duration) (stop func()) {
+	quit := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				if _, err := db.ReapTombstones(); err != nil {
+					utils.GetLogger().Error("tombstone reaper failed", "err", err)
+				}
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+			<-exited
+		})
+	}
+}
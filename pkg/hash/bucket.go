@@ -9,11 +9,14 @@ import (
 	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
-// HashBucket.
+// HashBucket. A bucket is a page of entries, optionally followed by a chain of overflow
+// pages; the lock on the bucket's own page guards the whole chain.
 type HashBucket struct {
-	depth   int64
-	numKeys int64
-	page    *pager.Page
+	depth      int64
+	numKeys    int64 // Number of keys on this page, not counting overflow pages
+	next       int64 // Page number of the next overflow page, or 0 if none
+	headerSize int64 // Size of the page's header, which the table's bucket layout decides
+	page       *pager.Page
 }
 
 // Construct a new HashBucket.
@@ -23,7 +26,7 @@ func NewHashBucket(pager *pager.Pager, depth int64) (*HashBucket, error) {
 	if err != nil {
 		return nil, err
 	}
-	bucket := &HashBucket{depth: depth, numKeys: 0, page: newPage}
+	bucket := &HashBucket{depth: depth, numKeys: 0, headerSize: bucketHeaderSize(pager), page: newPage}
 	bucket.updateDepth(depth)
 	return bucket, nil
 }
@@ -38,39 +41,77 @@ func (bucket *HashBucket) GetPage() *pager.Page {
 	return bucket.page
 }
 
+// Get number of keys.
+func (bucket *HashBucket) GetNumKeys() int64 {
+	return bucket.numKeys
+}
+
 // Finds the entry with the given key.
 func (bucket *HashBucket) Find(key int64) (utils.Entry, bool) {
-	for i := int64(0); i < bucket.numKeys; i++ {
-		if bucket.getKeyAt(i) == key {
-			return bucket.getEntry(i), true
+	var entry utils.Entry
+	found := false
+	bucket.walkChain(READ_LOCK, func(page *HashBucket) bool {
+		for i := int64(0); i < page.numKeys; i++ {
+			if page.getKeyAt(i) == key {
+				entry, found = page.getEntry(i), true
+				return false
+			}
 		}
-	}
-	return nil, false
+		return true
+	})
+	return entry, found
 }
 
-// Inserts the given key-value pair, splits if necessary.
+// Inserts the given key-value pair into this page, reporting whether it filled and should split.
 func (bucket *HashBucket) Insert(key int64, value int64) (bool, error) {
 	/* SOLUTION {{{ */
 	bucket.modifyEntry(bucket.numKeys, HashEntry{key, value})
 	bucket.updateNumKeys(bucket.numKeys + 1)
-	return bucket.numKeys >= BUCKETSIZE, nil
+	return bucket.numKeys >= BucketSize(bucket.page.GetPager()), nil
 	/* SOLUTION }}} */
 }
 
 // Update the given key-value pair, should never split.
 // Find the bucket we want based on key, then update the entry using updateValueAt.
 func (bucket *HashBucket) Update(key int64, value int64) error {
-	for i := int64(0); i < bucket.numKeys; i++ {
-		if bucket.getKeyAt(i) == key {
-			bucket.updateValueAt(i, value)
-			return nil
+	found := false
+	err := bucket.walkChain(WRITE_LOCK, func(page *HashBucket) bool {
+		for i := int64(0); i < page.numKeys; i++ {
+			if page.getKeyAt(i) == key {
+				page.updateValueAt(i, value)
+				found = true
+				return false
+			}
 		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("key not found, update aborted")
 	}
-	return errors.New("key not found, update aborted")
+	return nil
 }
 
 // Delete the given key-value pair, does not coalesce.
 func (bucket *HashBucket) Delete(key int64) error {
+	found := false
+	err := bucket.walkChain(WRITE_LOCK, func(page *HashBucket) bool {
+		found = page.deleteFromPage(key)
+		return !found
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("key not found, delete aborted")
+	}
+	return nil
+}
+
+// Delete the given key from this page alone, reporting whether it was found.
+func (bucket *HashBucket) deleteFromPage(key int64) bool {
 	index := int64(-1)
 	for i := int64(0); i < bucket.numKeys; i++ {
 		if bucket.getKeyAt(i) == key {
@@ -79,32 +120,159 @@ func (bucket *HashBucket) Delete(key int64) error {
 		}
 	}
 	if index == -1 {
-		return errors.New("key not found, delete aborted")
+		return false
 	}
 	// Move all other keys left by one.
 	for i := index; i < bucket.numKeys; i++ {
 		bucket.modifyEntry(i, bucket.getEntry(i+1))
 	}
 	bucket.updateNumKeys(bucket.numKeys - 1)
-	return nil
+	return true
 }
 
-// Select all entries in this bucket.
+// Select all entries in this bucket, including its overflow pages.
 func (bucket *HashBucket) Select() (entries []utils.Entry, err error) {
 	entries = make([]utils.Entry, 0)
-	for i := int64(0); i < bucket.numKeys; i++ {
-		entries = append(entries, bucket.getEntry(i))
+	err = bucket.walkChain(READ_LOCK, func(page *HashBucket) bool {
+		entries = append(entries, page.pageEntries()...)
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 	return entries, nil
 }
 
+// Select the entries on this page alone.
+func (bucket *HashBucket) pageEntries() []utils.Entry {
+	entries := make([]utils.Entry, bucket.numKeys)
+	for i := int64(0); i < bucket.numKeys; i++ {
+		entries[i] = bucket.getEntry(i)
+	}
+	return entries
+}
+
+// ChainLength returns the number of overflow pages chained after this bucket.
+func (bucket *HashBucket) ChainLength() (int64, error) {
+	length := int64(-1)
+	err := bucket.walkChain(READ_LOCK, func(page *HashBucket) bool {
+		length++
+		return true
+	})
+	return length, err
+}
+
+// Calls fn on this bucket's page, then on each of its overflow pages in turn, locking each
+// overflow page with the given lock while fn runs. Stops early if fn returns false.
+func (bucket *HashBucket) walkChain(lock BucketLockType, fn func(page *HashBucket) bool) error {
+	if !fn(bucket) {
+		return nil
+	}
+	for pn := bucket.next; pn != 0; {
+		page, err := getAndLockBucketByPN(bucket.page.GetPager(), pn, lock)
+		if err != nil {
+			return err
+		}
+		more := fn(page)
+		pn = page.next
+		page.release(lock)
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+// Returns this bucket's overflow pages in chain order, write-locked and pinned.
+// Release them with releaseAll.
+func (bucket *HashBucket) overflowPages() ([]*HashBucket, error) {
+	pages := make([]*HashBucket, 0)
+	for pn := bucket.next; pn != 0; {
+		page, err := getAndLockBucketByPN(bucket.page.GetPager(), pn, WRITE_LOCK)
+		if err != nil {
+			releaseAll(pages, WRITE_LOCK)
+			return nil, err
+		}
+		pages = append(pages, page)
+		pn = page.next
+	}
+	return pages, nil
+}
+
+// Release the given lock on each of the given buckets' pages and unpin them.
+func releaseAll(buckets []*HashBucket, lock BucketLockType) {
+	for _, bucket := range buckets {
+		bucket.release(lock)
+	}
+}
+
+// Release the given lock on this bucket's page and unpin it.
+func (bucket *HashBucket) release(lock BucketLockType) {
+	if lock == READ_LOCK {
+		bucket.RUnlock()
+	}
+	if lock == WRITE_LOCK {
+		bucket.WUnlock()
+	}
+	bucket.page.Put()
+}
+
+// BucketIterator lazily yields the entries of a bucket one at a time,
+// rather than materializing them all like Select.
+type BucketIterator struct {
+	bucket  *HashBucket
+	cellnum int64
+	closed  bool
+}
+
+// Iterator returns an iterator over this bucket's entries. The iterator holds
+// its own pin on the bucket's page, which is released by Close.
+func (bucket *HashBucket) Iterator() *BucketIterator {
+	bucket.page.Get()
+	return &BucketIterator{bucket: bucket}
+}
+
+// Next returns the next entry in the bucket, or false once all entries have been visited.
+// The iterator moves its pin along the bucket's overflow pages as it reaches them.
+func (it *BucketIterator) Next() (utils.Entry, bool) {
+	if it.closed {
+		return nil, false
+	}
+	for it.cellnum >= it.bucket.numKeys {
+		if it.bucket.next == 0 {
+			return nil, false
+		}
+		page, err := it.bucket.page.GetPager().GetPage(it.bucket.next)
+		if err != nil {
+			return nil, false
+		}
+		it.bucket.page.Put()
+		it.bucket, it.cellnum = pageToBucket(page), 0
+	}
+	entry := it.bucket.getEntry(it.cellnum)
+	it.cellnum++
+	return entry, true
+}
+
+// Close releases the iterator's pin on the bucket's page. Safe to call more than once.
+func (it *BucketIterator) Close() {
+	if it.closed {
+		return
+	}
+	it.closed = true
+	it.bucket.page.Put()
+}
+
 // Pretty-print this bucket.
 func (bucket *HashBucket) Print(w io.Writer) {
 	io.WriteString(w, fmt.Sprintf("bucket depth: %d\n", bucket.depth))
 	io.WriteString(w, "entries:")
-	for i := int64(0); i < bucket.numKeys; i++ {
-		bucket.getEntry(i).Print(w)
-	}
+	bucket.walkChain(READ_LOCK, func(page *HashBucket) bool {
+		for i := int64(0); i < page.numKeys; i++ {
+			page.getEntry(i).Print(w)
+		}
+		return true
+	})
 	io.WriteString(w, "\n")
 }
 
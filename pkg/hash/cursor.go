@@ -65,6 +65,9 @@ func (cursor *HashCursor) IsEnd() bool {
 	return cursor.isEnd
 }
 
+// Close does nothing; hash cursors hold no locks.
+func (cursor *HashCursor) Close() {}
+
 // GetEntry returns the entry currently pointed to by the cursor.
 func (cursor *HashCursor) GetEntry() (utils.Entry, error) {
 	if cursor.isEnd {
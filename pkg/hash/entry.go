@@ -1,9 +1,11 @@
 package hash
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
+
+	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 // HashEntry is a single entry in a hashtable. Implements utils.Entry.
@@ -32,26 +34,34 @@ func (entry *HashEntry) SetValue(value int64) {
 	entry.value = value
 }
 
-// marshal serializes a given entry into a byte array.
+// Marshal serializes a given entry into a byte array with the default codec.
 func (entry HashEntry) Marshal() []byte {
-	// Marshall the key field.
-	var newdata []byte
-	bin := make([]byte, binary.MaxVarintLen64)
-	binary.PutVarint(bin, entry.GetKey())
-	newdata = bin
-	// Marshall the value field.
-	bin = make([]byte, binary.MaxVarintLen64)
-	binary.PutVarint(bin, entry.GetValue())
-	newdata = append(newdata, bin...)
-	// Return the combined byte array.
-	return newdata
-}
-
-// unmarshalEntry deserializes a byte array into an entry.
-func unmarshalEntry(data []byte) (entry HashEntry) {
-	k, _ := binary.Varint(data[:len(data)/2])
-	v, _ := binary.Varint(data[len(data)/2:])
-	return HashEntry{key: k, value: v}
+	return utils.VarintCodec{}.Encode(entry)
+}
+
+// checkEntry fails if the pager's codec can't fit an entry in a slot. New entries are checked
+// before they are stored, as a failure part way through a write would leave it half done.
+func checkEntry(p *pager.Pager, entry HashEntry) error {
+	_, err := utils.EncodeEntry(p.GetEntryCodec(), entry)
+	return err
+}
+
+// encodeEntry serializes an entry with the page's codec, padded to a whole slot. The entry was
+// checked with checkEntry when it was stored, so it fits; if the codec changed its mind since,
+// the slot is left empty rather than truncated, and the failure is logged.
+func encodeEntry(page *pager.Page, entry HashEntry) []byte {
+	data, err := utils.EncodeEntry(page.GetPager().GetEntryCodec(), entry)
+	if err != nil {
+		utils.GetLogger().Error("entry not stored", "file", page.GetPager().GetFileName(), "page", page.GetPageNum(), "err", err)
+		return make([]byte, ENTRYSIZE)
+	}
+	return data
+}
+
+// decodeEntry deserializes a slot of a page into an entry with the page's codec.
+func decodeEntry(page *pager.Page, data []byte) HashEntry {
+	decoded, _ := page.GetPager().GetEntryCodec().Decode(data)
+	return HashEntry{key: decoded.GetKey(), value: decoded.GetValue()}
 }
 
 // Print this entry.
@@ -1,7 +1,10 @@
 package hash
 
 import (
+	"errors"
+	"fmt"
 	"io"
+	"os"
 
 	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
 	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
@@ -9,31 +12,136 @@ import (
 
 // HashIndex is an index that uses a HashTable as its datastructure. Implements db.Index.
 type HashIndex struct {
-	table *HashTable
-	pager *pager.Pager
+	table    *HashTable
+	pager    *pager.Pager
+	onInsert func(int64) // Called with each key an insert adds; see SetInsertHook.
 }
 
+// Options for opening a hash index.
+type TableOptions struct {
+	// Name of the registered hash function used to place keys, e.g. XXHASH_HASHER,
+	// MURMUR_HASHER or MODULO_HASHER (see RegisterHasher). Like Codec, it is recorded in the
+	// table's .meta file: empty uses the recorded hasher, or XxHasher for a new table, and any
+	// other hasher must match the recorded one.
+	Hasher string
+	// Number of overflow pages a full bucket may chain before an insert splits it instead.
+	// 0 splits as soon as a bucket fills. This isn't persisted.
+	MaxOverflowPages int64
+	// Name of the registered codec entries are stored with (see utils.RegisterCodec). It is
+	// recorded in the table's .meta file: empty uses the recorded codec, or the default codec
+	// for a new table, and any other codec must match the recorded one.
+	Codec string
+	// Size of the table's pages, which its bucket layout follows; pager.DEFAULT_PAGESIZE if 0.
+	// Like MaxOverflowPages, this isn't persisted.
+	PageSize int64
+	// Read and write the table and its .meta file in page layout 0, as written before pages had
+	// trailers, e.g. to convert it; see pager.SetPageLayout. Its buckets are in FLAT_BUCKET_LAYOUT,
+	// so MaxOverflowPages must be 0.
+	LegacyPageLayout bool
+	// Entries a bucket page holds before it overflows or splits, between MIN_BUCKET_CAPACITY
+	// and BucketSize, which the page size allows. Fewer means emptier buckets but more splits.
+	// It is recorded in the table's .meta file: 0 uses the recorded capacity, or BucketSize
+	// for a new table, and any other capacity must match the recorded one.
+	BucketCapacity int64
+}
+
+// The smallest bucket capacity a table can be created with.
+const MIN_BUCKET_CAPACITY = 4
+
 // Opens the pager with the given table name.
 func OpenTable(filename string) (*HashIndex, error) {
+	return OpenTableWithOptions(filename, TableOptions{})
+}
+
+// Opens the pager with the given table name and options.
+func OpenTableWithOptions(filename string, options TableOptions) (*HashIndex, error) {
 	// Create a pager for the table.
-	pager := pager.NewPager()
-	err := pager.Open(filename)
+	pageSize := options.PageSize
+	if pageSize == 0 {
+		pageSize = pager.DEFAULT_PAGESIZE
+	}
+	pager, err := pager.NewPagerWithSize(pageSize)
+	if err != nil {
+		return nil, err
+	}
+	if options.LegacyPageLayout {
+		pager.SetPageLayout(0)
+	}
+	err = pager.Open(filename)
 	if err != nil {
 		return nil, err
 	}
 	// Return index.
 	var table *HashTable
 	if pager.GetNumPages() == 0 {
+		if err = checkBucketCapacity(pager, options.BucketCapacity); err != nil {
+			pager.Close()
+			return nil, err
+		}
 		table, err = NewHashTable(pager)
+		if err == nil {
+			table.capacity = options.BucketCapacity
+			if options.Hasher != XXHASH_HASHER {
+				table.hasherName = options.Hasher
+			}
+		}
 	} else {
 		table, err = ReadHashTable(pager)
+		if err == nil && options.BucketCapacity != 0 && options.BucketCapacity != table.bucketCapacity() {
+			err = fmt.Errorf("table has a bucket capacity of %d, not %d", table.bucketCapacity(), options.BucketCapacity)
+		}
+		if err == nil {
+			err = checkBucketCapacity(pager, table.capacity)
+		}
+		if err == nil {
+			table.hasherName, err = resolveHasher(table.hasherName, options.Hasher)
+		}
+	}
+	if err == nil {
+		table.codec, err = utils.ResolveCodec(table.codec, options.Codec)
+	}
+	var codec utils.EntryCodec
+	if err == nil {
+		codec, err = utils.GetCodec(table.codec)
+	}
+	if err == nil {
+		table.hasher, err = GetHasher(table.hasherName)
 	}
 	if err != nil {
+		pager.Close()
 		return nil, err
 	}
+	pager.SetEntryCodec(codec)
+	if options.MaxOverflowPages > 0 && bucketLayout(pager) == FLAT_BUCKET_LAYOUT {
+		pager.Close()
+		return nil, errors.New("buckets in page layout 0 can't have overflow pages")
+	}
+	if options.MaxOverflowPages > 0 {
+		table.maxOverflow = options.MaxOverflowPages
+	}
 	return &HashIndex{table: table, pager: pager}, nil
 }
 
+// The options the index was opened with.
+func (index *HashIndex) options() TableOptions {
+	return TableOptions{Hasher: index.table.hasherName, MaxOverflowPages: index.table.maxOverflow, Codec: index.table.codec,
+		BucketCapacity: index.table.capacity, PageSize: index.pager.GetPageSize(),
+		LegacyPageLayout: index.pager.GetPageLayout() == 0}
+}
+
+// Check that a bucket capacity fits in the pager's pages; 0 stands for BucketSize.
+func checkBucketCapacity(p *pager.Pager, capacity int64) error {
+	if capacity != 0 && (capacity < MIN_BUCKET_CAPACITY || capacity > BucketSize(p)) {
+		return fmt.Errorf("bucket capacity must be between %d and %d, got %d", MIN_BUCKET_CAPACITY, BucketSize(p), capacity)
+	}
+	return nil
+}
+
+// Get the number of entries a bucket page holds before it overflows or splits.
+func (index *HashIndex) GetBucketCapacity() int64 {
+	return index.table.bucketCapacity()
+}
+
 // Get name.
 func (table *HashIndex) GetName() string {
 	return table.pager.GetFileName()
@@ -49,11 +157,100 @@ func (index *HashIndex) GetTable() *HashTable {
 	return index.table
 }
 
+// Get the collision rate of the index's hash function; see HashTable.CollisionRate.
+func (index *HashIndex) CollisionRate() (float64, error) {
+	return index.table.CollisionRate()
+}
+
+// Get statistics for each bucket; see HashTable.BucketStats.
+func (index *HashIndex) BucketStats() ([]BucketStat, error) {
+	return index.table.BucketStats()
+}
+
+// Get the fraction of entry slots in use; see HashTable.LoadFactor.
+func (index *HashIndex) LoadFactor() (float64, error) {
+	return index.table.LoadFactor()
+}
+
 // Closes the table by closing the pager.
 func (index *HashIndex) Close() error {
 	return WriteHashTable(index.pager, index.table)
 }
 
+// Writes the table's directory to its .meta file, so that a copy of the table's files
+// (e.g. a checkpoint) can be reopened without closing the table.
+func (index *HashIndex) FlushMeta() error {
+	index.table.RLock()
+	defer index.table.RUnlock()
+	return writeHashMeta(index.pager, index.table)
+}
+
+// Closes the table and reloads it from disk, keeping its hash function.
+func (index *HashIndex) Reopen() error {
+	filename := index.pager.GetFilePath()
+	options := index.options()
+	if err := index.Close(); err != nil {
+		return err
+	}
+	reopened, err := OpenTableWithOptions(filename, options)
+	if err != nil {
+		return err
+	}
+	index.table, index.pager = reopened.table, reopened.pager
+	return nil
+}
+
+// Rebuilds the table by rehashing every entry into a fresh directory, replacing its files.
+// Entries are read bucket page by bucket page, so a damaged directory isn't consulted.
+func (index *HashIndex) Reindex() error {
+	entries, err := index.Select()
+	if err != nil {
+		return err
+	}
+	filename := index.pager.GetFilePath()
+	tmpname := filename + ".reindex"
+	os.Remove(tmpname)
+	os.Remove(tmpname + ".meta")
+	options := index.options()
+	rebuilt, err := OpenTableWithOptions(tmpname, options)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err = rebuilt.Insert(entry.GetKey(), entry.GetValue()); err != nil {
+			break
+		}
+	}
+	if closeErr := rebuilt.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = index.Close()
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		os.Remove(tmpname + ".meta")
+		return err
+	}
+	if err = os.Rename(tmpname+".meta", filename+".meta"); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpname, filename); err != nil {
+		return err
+	}
+	reopened, err := OpenTableWithOptions(filename, options)
+	if err != nil {
+		return err
+	}
+	index.table, index.pager = reopened.table, reopened.pager
+	return nil
+}
+
+// Merges sparse buckets and shrinks the directory to the smallest depth that addresses them.
+func (index *HashIndex) Compact() error {
+	return index.table.Compact()
+}
+
 // Find element by key.
 func (index *HashIndex) Find(key int64) (utils.Entry, error) {
 	return index.table.Find(key)
@@ -61,7 +258,17 @@ func (index *HashIndex) Find(key int64) (utils.Entry, error) {
 
 // Insert given element.
 func (index *HashIndex) Insert(key int64, value int64) error {
-	return index.table.Insert(key, value)
+	err := index.table.Insert(key, value)
+	if err == nil && index.onInsert != nil {
+		index.onInsert(key)
+	}
+	return err
+}
+
+// Set a function to call with each key Insert adds to the table, once the write is done and the
+// table unlocked. Set it before the table is shared.
+func (index *HashIndex) SetInsertHook(hook func(key int64)) {
+	index.onInsert = hook
 }
 
 // Update given element.
@@ -79,6 +286,23 @@ func (index *HashIndex) Select() ([]utils.Entry, error) {
 	return index.table.Select()
 }
 
+// Select the elements with keys in [lo, hi), in no particular order, like a B+Tree's
+// TableFindRange. Hashing scatters neighbouring keys across buckets, so this scans every entry
+// and filters them: O(n) in the size of the table, however narrow the range.
+func (index *HashIndex) SelectRange(lo int64, hi int64) ([]utils.Entry, error) {
+	entries, err := index.table.Select()
+	if err != nil {
+		return nil, err
+	}
+	inRange := make([]utils.Entry, 0)
+	for _, entry := range entries {
+		if utils.KeyInRange(entry, lo, hi, false) {
+			inRange = append(inRange, entry)
+		}
+	}
+	return inRange, nil
+}
+
 // Print all elements.
 func (index *HashIndex) Print(w io.Writer) {
 	index.table.Print(w)
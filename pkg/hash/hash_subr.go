@@ -1,24 +1,62 @@
 package hash
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
+	"sync"
 
 	xxhash "github.com/cespare/xxhash"
 	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 	murmur3 "github.com/spaolacci/murmur3"
 )
 
 // Hash table variables
 var ROOT_PN int64 = 0
-var PAGESIZE int64 = pager.PAGESIZE
 var DIRECTORY_HEADER_SIZE int64 = binary.MaxVarintLen64 * 2 // Must store global depth and next pointer
 var DEPTH_OFFSET int64 = 0
 var DEPTH_SIZE int64 = binary.MaxVarintLen64
 var NUM_KEYS_OFFSET int64 = DEPTH_OFFSET + DEPTH_SIZE
 var NUM_KEYS_SIZE int64 = binary.MaxVarintLen64
-var BUCKET_HEADER_SIZE int64 = DEPTH_SIZE + NUM_KEYS_SIZE
-var ENTRYSIZE int64 = binary.MaxVarintLen64 * 2                    // int64 key, int64 value
-var BUCKETSIZE int64 = (PAGESIZE-BUCKET_HEADER_SIZE)/ENTRYSIZE - 1 // num entries
+var NEXT_PN_OFFSET int64 = NUM_KEYS_OFFSET + NUM_KEYS_SIZE
+var NEXT_PN_SIZE int64 = binary.MaxVarintLen64
+var BUCKET_HEADER_SIZE int64 = DEPTH_SIZE + NUM_KEYS_SIZE + NEXT_PN_SIZE
+var FLAT_BUCKET_HEADER_SIZE int64 = DEPTH_SIZE + NUM_KEYS_SIZE
+var CAPACITY_SIZE int64 = binary.MaxVarintLen64
+var CODEC_NAME_SIZE int64 = utils.MAX_CODEC_NAME_SIZE
+var BUCKET_LAYOUT_SIZE int64 = binary.MaxVarintLen64
+var HASHER_NAME_SIZE int64 = MAX_HASHER_NAME_SIZE
+var ENTRYSIZE int64 = utils.ENCODED_ENTRY_SIZE // int64 key, int64 value
+
+// Bucket page layouts, recorded in a table's .meta file.
+const (
+	FLAT_BUCKET_LAYOUT    int64 = 1 // A header of the depth and key count; buckets can't overflow.
+	CHAINED_BUCKET_LAYOUT int64 = 2 // The header also holds the page number of the next overflow page.
+)
+
+// bucketLayout returns the layout of the buckets on the given pager's pages. Tables in page
+// layout 0 were written before buckets had overflow pages.
+func bucketLayout(p *pager.Pager) int64 {
+	if p.GetPageLayout() == 0 {
+		return FLAT_BUCKET_LAYOUT
+	}
+	return CHAINED_BUCKET_LAYOUT
+}
+
+// bucketHeaderSize returns the size of the header of the buckets on the given pager's pages.
+func bucketHeaderSize(p *pager.Pager) int64 {
+	if bucketLayout(p) == FLAT_BUCKET_LAYOUT {
+		return FLAT_BUCKET_HEADER_SIZE
+	}
+	return BUCKET_HEADER_SIZE
+}
+
+// BucketSize returns the number of entries a bucket page holds on the given pager's pages,
+// which stop short of the pager's page trailer.
+func BucketSize(p *pager.Pager) int64 {
+	return (p.GetUsableSize()-bucketHeaderSize(p))/ENTRYSIZE - 1
+}
 
 // Lock Types
 type BucketLockType int
@@ -29,15 +67,16 @@ const (
 	READ_LOCK  BucketLockType = 2
 )
 
-// getHash returns the hash of a key, given a hashing function.
+// getHash returns the hash of a key, given a hashing function, in [0, size). The hash is read
+// as an int64 and its absolute value is taken in uint64, so that math.MinInt64 doesn't overflow.
 func getHash(hasher func(b []byte) uint64, key int64, size int64) uint {
 	buf := make([]byte, binary.MaxVarintLen64)
 	binary.PutVarint(buf, key)
-	hash := int64(hasher(buf))
-	if hash < 0 {
-		hash *= -1
+	hash := hasher(buf)
+	if int64(hash) < 0 {
+		hash = -hash
 	}
-	return uint(hash % size)
+	return uint(hash % uint64(size))
 }
 
 // XxHasher returns the xxHash hash of the given key, bounded by size.
@@ -50,27 +89,98 @@ func MurmurHasher(key int64, size int64) uint {
 	return getHash(murmur3.Sum64, key, size)
 }
 
+// ModuloHasher returns the key itself, bounded by size. It is the cheapest hash and spreads
+// dense, sequential keys perfectly, but clusters keys that share their low bits.
+func ModuloHasher(key int64, size int64) uint {
+	mod := key % size
+	if mod < 0 {
+		mod += size
+	}
+	return uint(mod)
+}
+
+// Names of the built-in hashers, which tables record in their .meta file.
+const (
+	XXHASH_HASHER = "xxhash"
+	MURMUR_HASHER = "murmur3"
+	MODULO_HASHER = "modulo"
+)
+
+// The longest name a hasher can be registered under.
+const MAX_HASHER_NAME_SIZE = 32
+
+// Hashers tables can be created with, by name.
+var hashers = map[string]func(key int64, size int64) uint{
+	XXHASH_HASHER: XxHasher,
+	MURMUR_HASHER: MurmurHasher,
+	MODULO_HASHER: ModuloHasher,
+}
+var hasherMtx sync.RWMutex
+
+// Register a hasher under a name, so that tables can be created with it and reopened later.
+// Register it before opening any table that uses it, and never change what a name refers to.
+func RegisterHasher(name string, hasher func(key int64, size int64) uint) error {
+	if name == "" || len(name) > MAX_HASHER_NAME_SIZE {
+		return fmt.Errorf("hasher name must be 1 to %d bytes, got %q", MAX_HASHER_NAME_SIZE, name)
+	}
+	hasherMtx.Lock()
+	defer hasherMtx.Unlock()
+	if _, found := hashers[name]; found {
+		return fmt.Errorf("hasher %s already registered", name)
+	}
+	hashers[name] = hasher
+	return nil
+}
+
+// Get the hasher registered under a name; "" names XxHasher.
+func GetHasher(name string) (func(key int64, size int64) uint, error) {
+	if name == "" {
+		name = XXHASH_HASHER
+	}
+	hasherMtx.RLock()
+	defer hasherMtx.RUnlock()
+	hasher, found := hashers[name]
+	if !found {
+		return nil, fmt.Errorf("hasher %s not registered", name)
+	}
+	return hasher, nil
+}
+
+// Get the name of the hasher a table places its keys with, given the name the table recorded
+// and the name it is being opened with. Tables record "" for XxHasher, as do tables from before
+// hashers were recorded; the name returned is in that form too.
+func resolveHasher(recorded string, requested string) (string, error) {
+	name := recorded
+	if name == "" {
+		name = XXHASH_HASHER
+	}
+	if requested != "" && requested != name {
+		return "", fmt.Errorf("table places its keys with hasher %s, not %s", name, requested)
+	}
+	return recorded, nil
+}
+
 // Hasher returns the hash of a key, modded by 2^depth.
 func Hasher(key int64, depth int64) int64 {
 	return int64(XxHasher(key, powInt(2, depth)))
 }
 
 // Get the byte-position of the cell with the given index.
-func entryPos(index int64) int64 {
-	return BUCKET_HEADER_SIZE + index*ENTRYSIZE
+func (bucket *HashBucket) entryPos(index int64) int64 {
+	return bucket.headerSize + index*ENTRYSIZE
 }
 
 // Write the given entry into the given index.
 func (bucket *HashBucket) modifyEntry(index int64, entry HashEntry) {
-	newdata := entry.Marshal()
-	startPos := entryPos(index)
+	newdata := encodeEntry(bucket.page, entry)
+	startPos := bucket.entryPos(index)
 	bucket.page.Update(newdata, startPos, ENTRYSIZE)
 }
 
 // Get the entry at the given index.
 func (bucket *HashBucket) getEntry(index int64) HashEntry {
-	startPos := entryPos(index)
-	entry := unmarshalEntry((*bucket.page.GetData())[startPos : startPos+ENTRYSIZE])
+	startPos := bucket.entryPos(index)
+	entry := decodeEntry(bucket.page, (*bucket.page.GetData())[startPos:startPos+ENTRYSIZE])
 	return entry
 }
 
@@ -114,6 +224,18 @@ func (bucket *HashBucket) updateNumKeys(nKeys int64) {
 	bucket.page.Update(nKeysData, NUM_KEYS_OFFSET, NUM_KEYS_SIZE)
 }
 
+// Update the page number of this bucket's next overflow page; 0 ends the chain. Flat buckets
+// have no overflow pages, so only ever end the chain.
+func (bucket *HashBucket) updateNext(pn int64) {
+	bucket.next = pn
+	if bucket.headerSize == FLAT_BUCKET_HEADER_SIZE {
+		return
+	}
+	nextData := make([]byte, NEXT_PN_SIZE)
+	binary.PutVarint(nextData, pn)
+	bucket.page.Update(nextData, NEXT_PN_OFFSET, NEXT_PN_SIZE)
+}
+
 // Convert a page into a bucket.
 func pageToBucket(page *pager.Page) *HashBucket {
 	depth, _ := binary.Varint(
@@ -122,10 +244,19 @@ func pageToBucket(page *pager.Page) *HashBucket {
 	numKeys, _ := binary.Varint(
 		(*page.GetData())[NUM_KEYS_OFFSET : NUM_KEYS_OFFSET+NUM_KEYS_SIZE],
 	)
+	headerSize := bucketHeaderSize(page.GetPager())
+	next := int64(0)
+	if headerSize == BUCKET_HEADER_SIZE {
+		next, _ = binary.Varint(
+			(*page.GetData())[NEXT_PN_OFFSET : NEXT_PN_OFFSET+NEXT_PN_SIZE],
+		)
+	}
 	return &HashBucket{
-		depth:   depth,
-		numKeys: numKeys,
-		page:    page,
+		depth:      depth,
+		numKeys:    numKeys,
+		next:       next,
+		headerSize: headerSize,
+		page:       page,
 	}
 }
 
@@ -140,7 +271,12 @@ func (table *HashTable) GetBucketByPN(pn int64) (*HashBucket, error) {
 
 // Returns the bucket in the hash table using its page number, and increments the bucket ref count.
 func (table *HashTable) GetAndLockBucketByPN(pn int64, lock BucketLockType) (*HashBucket, error) {
-	page, err := table.pager.GetPage(pn)
+	return getAndLockBucketByPN(table.pager, pn, lock)
+}
+
+// Returns the bucket on the given page of the pager, locked, and increments its ref count.
+func getAndLockBucketByPN(pager *pager.Pager, pn int64, lock BucketLockType) (*HashBucket, error) {
+	page, err := pager.GetPage(pn)
 	if err != nil {
 		return nil, err
 	}
@@ -175,8 +311,12 @@ func (table *HashTable) GetAndLockBucket(hash int64, lock BucketLockType) (*Hash
 
 // Read hash table in from memory.
 func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
-	indexPager := pager.NewPager()
-	err := indexPager.Open(bucketPager.GetFileName() + ".meta")
+	indexPager, err := pager.NewPagerWithSize(bucketPager.GetPageSize())
+	if err != nil {
+		return nil, err
+	}
+	indexPager.SetPageLayout(bucketPager.GetPageLayout())
+	err = indexPager.Open(bucketPager.GetFilePath() + ".meta")
 	if err != nil {
 		return nil, err
 	}
@@ -193,7 +333,7 @@ func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
 	numHashes := powInt(2, depth)
 	buckets := make([]int64, numHashes)
 	for i := int64(0); i < numHashes; i++ {
-		if bytesRead+pnSize > PAGESIZE {
+		if bytesRead+pnSize > indexPager.GetUsableSize() {
 			page.Put()
 			metaPN++
 			page, err = indexPager.GetPage(metaPN)
@@ -206,50 +346,120 @@ func ReadHashTable(bucketPager *pager.Pager) (*HashTable, error) {
 		bytesRead += pnSize
 		buckets[i] = pn
 	}
+	// The bucket capacity, codec name, bucket layout and hasher name follow the directory;
+	// tables written before they were recorded read zeroes.
+	fields := [][]byte{make([]byte, CAPACITY_SIZE), make([]byte, CODEC_NAME_SIZE), make([]byte, BUCKET_LAYOUT_SIZE),
+		make([]byte, HASHER_NAME_SIZE)}
+	for _, field := range fields {
+		size := int64(len(field))
+		if bytesRead+size > indexPager.GetUsableSize() {
+			if metaPN+1 >= indexPager.GetNumPages() {
+				break
+			}
+			page.Put()
+			metaPN++
+			page, err = indexPager.GetPage(metaPN)
+			if err != nil {
+				return nil, err
+			}
+			bytesRead = 0
+		}
+		copy(field, (*page.GetData())[bytesRead:bytesRead+size])
+		bytesRead += size
+	}
 	page.Put()
 	indexPager.Close()
-	return &HashTable{depth: depth, buckets: buckets, pager: bucketPager}, nil
+	capacity, _ := binary.Varint(fields[0])
+	codec := string(bytes.TrimRight(fields[1], "\x00"))
+	layout, _ := binary.Varint(fields[2])
+	hasherName := string(bytes.TrimRight(fields[3], "\x00"))
+	if layout == 0 {
+		layout = bucketLayout(bucketPager)
+	}
+	if layout != bucketLayout(bucketPager) {
+		return nil, fmt.Errorf("table has bucket layout %d, which page layout %d can't hold",
+			layout, bucketPager.GetPageLayout())
+	}
+	return &HashTable{depth: depth, buckets: buckets, pager: bucketPager, capacity: capacity, codec: codec,
+		hasherName: hasherName}, nil
 }
 
 // Write hash table out to memory.
 func WriteHashTable(bucketPager *pager.Pager, table *HashTable) error {
 	if bucketPager.HasFile() {
-		indexPager := pager.NewPager()
-		err := indexPager.Open(bucketPager.GetFileName() + ".meta")
-		if err != nil {
+		if err := writeHashMeta(bucketPager, table); err != nil {
 			return err
 		}
-		metaPN := indexPager.GetFreePN()
-		page, err := indexPager.GetPage(metaPN)
-		if err != nil {
-			return err
+	}
+	return bucketPager.Close()
+}
+
+// Write the hash table's global depth, directory, bucket capacity, codec name, bucket layout and
+// hasher name out to its .meta file.
+func writeHashMeta(bucketPager *pager.Pager, table *HashTable) error {
+	indexPager, err := pager.NewPagerWithSize(bucketPager.GetPageSize())
+	if err != nil {
+		return err
+	}
+	indexPager.SetPageLayout(bucketPager.GetPageLayout())
+	err = indexPager.Open(bucketPager.GetFilePath() + ".meta")
+	if err != nil {
+		return err
+	}
+	// Overwrite the meta file from the start, so that reads see the latest directory.
+	metaPN := int64(0)
+	page, err := indexPager.GetPage(metaPN)
+	if err != nil {
+		return err
+	}
+	page.SetDirty(true)
+	// Write global depth to meta file
+	depthData := make([]byte, DEPTH_SIZE)
+	binary.PutVarint(depthData, table.depth)
+	page.Update(depthData, DEPTH_OFFSET, DEPTH_SIZE)
+	bytesWritten := DEPTH_SIZE
+	// Write bucket index to meta file
+	pnSize := int64(binary.MaxVarintLen64)
+	pnData := make([]byte, pnSize)
+	for _, pn := range table.buckets {
+		if bytesWritten+pnSize > indexPager.GetUsableSize() {
+			page.Put()
+			metaPN++
+			page, err = indexPager.GetPage(metaPN)
+			if err != nil {
+				return err
+			}
+			page.SetDirty(true)
+			bytesWritten = 0
 		}
-		page.SetDirty(true)
-		// Write global depth to meta file
-		depthData := make([]byte, DEPTH_SIZE)
-		binary.PutVarint(depthData, table.depth)
-		page.Update(depthData, DEPTH_OFFSET, DEPTH_SIZE)
-		bytesWritten := DEPTH_SIZE
-		// Write bucket index to meta file
-		pnSize := int64(binary.MaxVarintLen64)
-		pnData := make([]byte, pnSize)
-		for _, pn := range table.buckets {
-			if bytesWritten+pnSize > PAGESIZE {
-				page.Put()
-				metaPN = indexPager.GetFreePN()
-				page, err = indexPager.GetPage(metaPN)
-				if err != nil {
-					return err
-				}
-				page.SetDirty(true)
-				bytesWritten = 0
+		binary.PutVarint(pnData, pn)
+		page.Update(pnData, bytesWritten, pnSize)
+		bytesWritten += pnSize
+	}
+	// Write the bucket capacity, codec name, bucket layout and hasher name after the directory.
+	capacityData := make([]byte, CAPACITY_SIZE)
+	binary.PutVarint(capacityData, table.capacity)
+	codecData := make([]byte, CODEC_NAME_SIZE)
+	copy(codecData, table.codec)
+	layoutData := make([]byte, BUCKET_LAYOUT_SIZE)
+	binary.PutVarint(layoutData, bucketLayout(bucketPager))
+	hasherData := make([]byte, HASHER_NAME_SIZE)
+	copy(hasherData, table.hasherName)
+	for _, field := range [][]byte{capacityData, codecData, layoutData, hasherData} {
+		size := int64(len(field))
+		if bytesWritten+size > indexPager.GetUsableSize() {
+			page.Put()
+			metaPN++
+			page, err = indexPager.GetPage(metaPN)
+			if err != nil {
+				return err
 			}
-			binary.PutVarint(pnData, pn)
-			page.Update(pnData, bytesWritten, pnSize)
-			bytesWritten += pnSize
+			page.SetDirty(true)
+			bytesWritten = 0
 		}
-		page.Put()
-		indexPager.Close()
+		page.Update(field, bytesWritten, size)
+		bytesWritten += size
 	}
-	return bucketPager.Close()
+	page.Put()
+	return indexPager.Close()
 }
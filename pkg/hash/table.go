@@ -13,10 +13,15 @@ import (
 
 // HashTable definitions.
 type HashTable struct {
-	depth   int64
-	buckets []int64 // Array of bucket page numbers
-	pager   *pager.Pager
-	rwlock  sync.RWMutex // Lock on the hash table index
+	depth       int64
+	buckets     []int64 // Array of bucket page numbers
+	pager       *pager.Pager
+	rwlock      sync.RWMutex                     // Lock on the hash table index
+	hasher      func(key int64, size int64) uint // Hash function; XxHasher if nil
+	maxOverflow int64                            // Overflow pages a bucket may chain before it splits
+	capacity    int64                            // Entries a page holds; BucketSize if 0
+	codec       string                           // Name of the codec entries are stored with
+	hasherName  string                           // Name of the hasher; "" for XxHasher
 }
 
 // Returns a new HashTable.
@@ -34,6 +39,105 @@ func NewHashTable(pager *pager.Pager) (*HashTable, error) {
 	return &HashTable{depth: depth, buckets: buckets, pager: pager}, nil
 }
 
+// hash returns the hash of a key under this table's hash function, modded by 2^depth.
+func (table *HashTable) hash(key int64, depth int64) int64 {
+	if table.hasher == nil {
+		return Hasher(key, depth)
+	}
+	return int64(table.hasher(key, powInt(2, depth)))
+}
+
+// CollisionRate returns the average number of entries per nonempty bucket, relative to
+// the average if entries were spread evenly over all buckets. 1 is ideal; higher means
+// the hash function is clustering keys.
+func (table *HashTable) CollisionRate() (float64, error) {
+	table.RLock()
+	defer table.RUnlock()
+	seen := make(map[int64]bool)
+	numKeys, nonempty := int64(0), int64(0)
+	for _, pn := range table.buckets {
+		if seen[pn] {
+			continue
+		}
+		seen[pn] = true
+		bucket, err := table.GetAndLockBucketByPN(pn, READ_LOCK)
+		if err != nil {
+			return 0, err
+		}
+		entries, err := bucket.Select()
+		bucket.RUnlock()
+		bucket.page.Put()
+		if err != nil {
+			return 0, err
+		}
+		if len(entries) > 0 {
+			numKeys += int64(len(entries))
+			nonempty++
+		}
+	}
+	if numKeys == 0 {
+		return 0, nil
+	}
+	return float64(len(seen)) / float64(nonempty), nil
+}
+
+// Statistics about a bucket, for diagnosing skew.
+type BucketStat struct {
+	PN            int64 // Page number of the bucket's first page.
+	LocalDepth    int64 // Number of hash bits its keys share.
+	NumKeys       int64 // Number of entries, counting overflow pages.
+	OverflowPages int64 // Length of its overflow chain.
+}
+
+// BucketStats returns statistics for each bucket, in directory order. Buckets that several
+// directory slots point to are reported once.
+func (table *HashTable) BucketStats() ([]BucketStat, error) {
+	table.RLock()
+	defer table.RUnlock()
+	stats := make([]BucketStat, 0)
+	seen := make(map[int64]bool)
+	for _, pn := range table.buckets {
+		if seen[pn] {
+			continue
+		}
+		seen[pn] = true
+		bucket, err := table.GetAndLockBucketByPN(pn, READ_LOCK)
+		if err != nil {
+			return nil, err
+		}
+		stat := BucketStat{PN: pn, LocalDepth: bucket.depth, OverflowPages: -1}
+		err = bucket.walkChain(READ_LOCK, func(page *HashBucket) bool {
+			stat.NumKeys += page.numKeys
+			stat.OverflowPages++
+			return true
+		})
+		bucket.release(READ_LOCK)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+// LoadFactor returns the fraction of the entry slots in the table's pages, overflow pages
+// included, that are in use.
+func (table *HashTable) LoadFactor() (float64, error) {
+	stats, err := table.BucketStats()
+	if err != nil {
+		return 0, err
+	}
+	numKeys, numPages := int64(0), int64(0)
+	for _, stat := range stats {
+		numKeys += stat.NumKeys
+		numPages += 1 + stat.OverflowPages
+	}
+	if numPages == 0 {
+		return 0, nil
+	}
+	return float64(numKeys) / float64(numPages*table.bucketCapacity()), nil
+}
+
 // [CONCURRENCY] Grab a write lock on the hash table index
 func (table *HashTable) WLock() {
 	table.rwlock.Lock()
@@ -73,7 +177,7 @@ func (table *HashTable) GetPager() *pager.Pager {
 func (table *HashTable) Find(key int64) (utils.Entry, error) {
 	table.RLock()
 	// Hash the key.
-	hash := Hasher(key, table.depth)
+	hash := table.hash(key, table.depth)
 	if hash < 0 || int(hash) >= len(table.buckets) {
 		table.RUnlock()
 		return nil, errors.New("not found")
@@ -123,25 +227,38 @@ func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 	defer newBucket.WUnlock()
 	defer newBucket.page.Put()
 
-	// Move entries over to it.
-	tmpEntries := make([]HashEntry, bucket.numKeys)
-	for i := int64(0); i < bucket.numKeys; i++ {
-		tmpEntries[i] = bucket.getEntry(i)
-	}
-	oldNKeys := int64(0)
-	newNKeys := int64(0)
-	for _, entry := range tmpEntries {
-		if Hasher(entry.GetKey(), bucket.depth) == newHash {
-			newBucket.modifyEntry(newNKeys, entry)
-			newNKeys++
-		} else {
-			bucket.modifyEntry(oldNKeys, entry)
-			oldNKeys++
+	// Move entries over to it, reusing the old overflow pages for either chain.
+	chain, err := bucket.overflowPages()
+	if err != nil {
+		return err
+	}
+	oldEntries, newEntries := make([]HashEntry, 0), make([]HashEntry, 0)
+	for _, page := range append([]*HashBucket{bucket}, chain...) {
+		for i := int64(0); i < page.numKeys; i++ {
+			entry := page.getEntry(i)
+			if table.hash(entry.GetKey(), bucket.depth) == newHash {
+				newEntries = append(newEntries, entry)
+			} else {
+				oldEntries = append(oldEntries, entry)
+			}
+		}
+	}
+	spare, err := table.fillChain(bucket, oldEntries, chain)
+	if err == nil {
+		spare, err = table.fillChain(newBucket, newEntries, spare)
+	}
+	if err == nil {
+		// Leftover pages are emptied and dropped from any chain.
+		for _, page := range spare {
+			page.updateNumKeys(0)
+			page.updateNext(0)
 		}
 	}
-	// Initialize bucket attributes.
-	bucket.updateNumKeys(oldNKeys)
-	newBucket.updateNumKeys(newNKeys)
+	// Unlock the chains before any recursive split locks them again.
+	releaseAll(chain, WRITE_LOCK)
+	if err != nil {
+		return err
+	}
 	power := bucket.depth
 	// Point the rest of the buckets to the new page.
 	for i := newHash; i < powInt(2, table.depth); {
@@ -149,22 +266,192 @@ func (table *HashTable) Split(bucket *HashBucket, hash int64) error {
 		i += powInt(2, power)
 	}
 	// Check if recursive splitting is required
-	if oldNKeys >= BUCKETSIZE {
+	if int64(len(oldEntries)) > table.chainCapacity() {
 		return table.Split(bucket, oldHash)
 	}
-	if newNKeys >= BUCKETSIZE {
+	if int64(len(newEntries)) > table.chainCapacity() {
 		return table.Split(newBucket, newHash)
 	}
 	return nil
 	/* SOLUTION }}} */
 }
 
+// The number of entries a bucket page holds before it overflows or splits.
+func (table *HashTable) bucketCapacity() int64 {
+	if table.capacity == 0 {
+		return BucketSize(table.pager)
+	}
+	return table.capacity
+}
+
+// The most entries a bucket and its overflow pages hold before the bucket has to split.
+func (table *HashTable) chainCapacity() int64 {
+	return (table.maxOverflow + 1) * (table.bucketCapacity() - 1)
+}
+
+// Write the given entries into the bucket, followed by as many overflow pages as they need,
+// drawn from spare before allocating new ones. Returns the spare pages left unused.
+func (table *HashTable) fillChain(bucket *HashBucket, entries []HashEntry, spare []*HashBucket) ([]*HashBucket, error) {
+	allocated := make([]*HashBucket, 0)
+	defer func() { releaseAll(allocated, WRITE_LOCK) }()
+	page := bucket
+	for {
+		// A page holds one extra entry if that saves an overflow page; a bucket that full
+		// is about to be split again anyway.
+		limit := table.bucketCapacity() - 1
+		if int64(len(entries)) == table.bucketCapacity() {
+			limit = table.bucketCapacity()
+		}
+		n := int64(0)
+		for ; n < limit && len(entries) > 0; n++ {
+			page.modifyEntry(n, entries[0])
+			entries = entries[1:]
+		}
+		page.updateNumKeys(n)
+		if len(entries) == 0 {
+			page.updateNext(0)
+			return spare, nil
+		}
+		var next *HashBucket
+		if len(spare) > 0 {
+			next, spare = spare[0], spare[1:]
+		} else {
+			overflow, err := NewHashBucket(table.pager, bucket.depth)
+			if err != nil {
+				return nil, err
+			}
+			overflow.WLock()
+			allocated = append(allocated, overflow)
+			next = overflow
+		}
+		next.updateDepth(bucket.depth)
+		page.updateNext(next.page.GetPageNum())
+		page = next
+	}
+}
+
+// Compact merges each pair of buddy buckets whose entries fit in one bucket, then halves the
+// directory for as long as its halves match, leaving the smallest global depth the buckets'
+// local depths allow. Pages freed by merging are left empty.
+func (table *HashTable) Compact() error {
+	table.WLock()
+	defer table.WUnlock()
+	for merged := true; merged; {
+		merged = false
+		for hash := int64(0); hash < int64(len(table.buckets)); hash++ {
+			ok, err := table.mergeBuddy(hash)
+			if err != nil {
+				return err
+			}
+			merged = merged || ok
+		}
+	}
+	for table.depth > 0 {
+		half := powInt(2, table.depth-1)
+		for i := int64(0); i < half; i++ {
+			if table.buckets[i] != table.buckets[i+half] {
+				return nil
+			}
+		}
+		table.buckets = table.buckets[:half]
+		table.depth--
+	}
+	return nil
+}
+
+// Merge the bucket at the given directory index with its buddy, the bucket that split off it,
+// if the index is the bucket's lower half and their entries fit together. Reports whether
+// the buckets were merged.
+func (table *HashTable) mergeBuddy(hash int64) (bool, error) {
+	bucket, err := table.GetAndLockBucket(hash, WRITE_LOCK)
+	if err != nil {
+		return false, err
+	}
+	defer bucket.release(WRITE_LOCK)
+	if bucket.depth == 0 || hash >= powInt(2, bucket.depth-1) {
+		return false, nil
+	}
+	buddyHash := hash + powInt(2, bucket.depth-1)
+	buddyPN := table.buckets[buddyHash]
+	buddy, err := table.GetAndLockBucketByPN(buddyPN, WRITE_LOCK)
+	if err != nil {
+		return false, err
+	}
+	defer buddy.release(WRITE_LOCK)
+	if buddy.depth != bucket.depth {
+		return false, nil
+	}
+	chain, err := bucket.overflowPages()
+	if err != nil {
+		return false, err
+	}
+	defer releaseAll(chain, WRITE_LOCK)
+	buddyChain, err := buddy.overflowPages()
+	if err != nil {
+		return false, err
+	}
+	defer releaseAll(buddyChain, WRITE_LOCK)
+	pages := append(append([]*HashBucket{bucket}, chain...), buddy)
+	pages = append(pages, buddyChain...)
+	entries := make([]HashEntry, 0)
+	for _, page := range pages {
+		for i := int64(0); i < page.numKeys; i++ {
+			entries = append(entries, page.getEntry(i))
+		}
+	}
+	if int64(len(entries)) > table.chainCapacity() {
+		return false, nil
+	}
+	spare, err := table.fillChain(bucket, entries, pages[1:])
+	if err != nil {
+		return false, err
+	}
+	for _, page := range spare {
+		page.updateNumKeys(0)
+		page.updateNext(0)
+	}
+	bucket.updateDepth(bucket.depth - 1)
+	for i, pn := range table.buckets {
+		if pn == buddyPN {
+			table.buckets[i] = bucket.page.GetPageNum()
+		}
+	}
+	return true, nil
+}
+
+// Insert the given key-value pair. Inserts that fit in their bucket only read-lock the
+// directory, so they run alongside operations on other buckets; an insert that would split
+// its bucket retries holding the directory write lock. Locks are always taken directory first,
+// then the bucket, then any bucket created by a split.
 func (table *HashTable) Insert(key int64, value int64) error {
+	if err := checkEntry(table.pager, HashEntry{key, value}); err != nil {
+		return err
+	}
+	table.RLock()
+	hash := table.hash(key, table.depth)
+	bucket, err := table.GetAndLockBucket(hash, WRITE_LOCK)
+	table.RUnlock()
+	if err != nil {
+		return err
+	}
+	if bucket.numKeys+1 < table.bucketCapacity() {
+		defer bucket.page.Put()
+		defer bucket.WUnlock()
+		_, err = bucket.Insert(key, value)
+		return err
+	}
+	bucket.WUnlock()
+	bucket.page.Put()
+	return table.insertAndSplit(key, value)
+}
+
+// Insert the given key-value pair holding the directory write lock, splitting if necessary.
+func (table *HashTable) insertAndSplit(key int64, value int64) error {
 	/* SOLUTION {{{ */
 	table.WLock()
 	defer table.WUnlock()
 
-	hash := Hasher(key, table.depth)
+	hash := table.hash(key, table.depth)
 	bucket, err := table.GetAndLockBucket(hash, WRITE_LOCK)
 	if err != nil {
 		return err
@@ -172,21 +459,48 @@ func (table *HashTable) Insert(key int64, value int64) error {
 	defer bucket.WUnlock()
 	defer bucket.page.Put()
 
-	split, err := bucket.Insert(key, value)
+	// Insert into the first page of the chain with room, then try growing the chain.
+	chain, err := bucket.overflowPages()
 	if err != nil {
 		return err
 	}
-	if !split {
-		return nil
+	defer func() { releaseAll(chain, WRITE_LOCK) }()
+	pages := append([]*HashBucket{bucket}, chain...)
+	for _, page := range pages {
+		if page.numKeys+1 < table.bucketCapacity() {
+			_, err = page.Insert(key, value)
+			return err
+		}
+	}
+	last := pages[len(pages)-1]
+	if int64(len(chain)) < table.maxOverflow {
+		overflow, err := NewHashBucket(table.pager, bucket.depth)
+		if err != nil {
+			return err
+		}
+		defer overflow.page.Put()
+		last.updateNext(overflow.page.GetPageNum())
+		_, err = overflow.Insert(key, value)
+		return err
+	}
+	// The chain is as long as allowed, so split the bucket once its last page fills.
+	if _, err = last.Insert(key, value); err != nil || last.numKeys < table.bucketCapacity() {
+		return err
 	}
+	// Unlock the chain before the split locks it again.
+	releaseAll(chain, WRITE_LOCK)
+	chain = nil
 	return table.Split(bucket, hash)
 	/* SOLUTION }}} */
 }
 
 // Update the given key-value pair.
 func (table *HashTable) Update(key int64, value int64) error {
+	if err := checkEntry(table.pager, HashEntry{key, value}); err != nil {
+		return err
+	}
 	table.RLock()
-	hash := Hasher(key, table.depth)
+	hash := table.hash(key, table.depth)
 	bucket, err := table.GetAndLockBucket(hash, WRITE_LOCK)
 	if err != nil {
 		table.RUnlock()
@@ -202,7 +516,7 @@ func (table *HashTable) Update(key int64, value int64) error {
 // Delete the given key-value pair, does not coalesce.
 func (table *HashTable) Delete(key int64) error {
 	table.RLock()
-	hash := Hasher(key, table.depth)
+	hash := table.hash(key, table.depth)
 	bucket, err := table.GetAndLockBucket(hash, WRITE_LOCK)
 	if err != nil {
 		table.RUnlock()
@@ -225,16 +539,12 @@ func (table *HashTable) Select() ([]utils.Entry, error) {
 		//bucket, err := table.GetBucketByPN(i)
 		bucket, err := table.GetAndLockBucketByPN(i, READ_LOCK)
 		if err != nil {
-			bucket.RUnlock()
 			return nil, err
 		}
-		entries, err := bucket.Select()
+		// Overflow pages are visited on their own, so read each page alone.
+		ret = append(ret, bucket.pageEntries()...)
 		bucket.GetPage().Put()
 		bucket.RUnlock()
-		if err != nil {
-			return nil, err
-		}
-		ret = append(ret, entries...)
 	}
 	return ret, nil
 	/* SOLUTION }}} */
@@ -264,7 +574,7 @@ func (table *HashTable) PrintPN(pn int, w io.Writer) {
 	table.RLock()
 	defer table.RUnlock()
 	if int64(pn) >= table.pager.GetNumPages() {
-		fmt.Println("out of bounds")
+		io.WriteString(w, "out of bounds\n")
 		return
 	}
 	bucket, err := table.GetAndLockBucketByPN(int64(pn), READ_LOCK)
@@ -1,28 +1,43 @@
 package hash
 
+import (
+	"fmt"
+
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
 func IsHash(index *HashIndex) (bool, error) {
+	violation, err := Verify(index)
+	return violation == nil && err == nil, err
+}
+
+// Verify checks that every entry is in the bucket its key hashes to, returning the first
+// violation found, or nil if there is none.
+func Verify(index *HashIndex) (*utils.Violation, error) {
 	table := index.GetTable()
 	buckets := table.GetBuckets()
 	for _, pn := range buckets {
 		// Get bucket
 		bucket, err := table.GetBucketByPN(pn)
-		d := bucket.GetDepth()
 		if err != nil {
-			return false, err
+			return nil, err
 		}
+		d := bucket.GetDepth()
 		// Get all entries
 		entries, err := bucket.Select()
+		bucket.GetPage().Put()
 		if err != nil {
-			return false, err
+			return nil, err
 		}
 		// Check that all entries should hash to this bucket.
 		for _, e := range entries {
 			key := e.GetKey()
-			hash := Hasher(key, d)
+			hash := table.hash(key, d)
 			if pn != table.buckets[hash] {
-				return false, nil
+				reason := fmt.Sprintf("key %d belongs in the bucket on page %d", key, table.buckets[hash])
+				return &utils.Violation{PageNum: pn, Reason: reason}, nil
 			}
 		}
 	}
-	return true, nil
+	return nil, nil
 }
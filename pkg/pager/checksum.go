@@ -0,0 +1,75 @@
+package pager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Version of the on-disk page layout. Version 1 ends each page with a PAGE_TRAILER_SIZE
+// trailer holding the layout version and a checksum of the rest of the page; version 0
+// pages had no trailer.
+const PAGE_LAYOUT_VERSION = 1
+
+// Size of the trailer at the end of each page. Node layouts only use the bytes before it.
+const PAGE_TRAILER_SIZE = int64(8)
+
+// Set the page layout the pager reads and writes: PAGE_LAYOUT_VERSION, or 0 for the files of
+// tables written before pages had trailers, whose pages are used whole and have no checksums to
+// check. Set it before the pager is opened.
+func (pager *Pager) SetPageLayout(layout int) error {
+	if layout != 0 && layout != PAGE_LAYOUT_VERSION {
+		return fmt.Errorf("unknown page layout %d", layout)
+	}
+	pager.layout = layout
+	return nil
+}
+
+// Get the page layout the pager reads and writes.
+func (pager *Pager) GetPageLayout() int {
+	return pager.layout
+}
+
+// Check whether the pager's pages end with a trailer.
+func (pager *Pager) sealed() bool {
+	return pager.layout != 0
+}
+
+// Returned when a page read from disk doesn't match its checksum.
+var ErrPageChecksumMismatch = errors.New("page checksum mismatch")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// sealPage writes the trailer for the page's current contents.
+func sealPage(data []byte) {
+	body, trailer := splitPage(data)
+	binary.LittleEndian.PutUint32(trailer[:4], PAGE_LAYOUT_VERSION)
+	binary.LittleEndian.PutUint32(trailer[4:], crc32.Checksum(body, castagnoli))
+}
+
+// checkPage reports whether a page read from disk matches its trailer. An all-zero page
+// was never written, so has nothing to check.
+func checkPage(data []byte) bool {
+	body, trailer := splitPage(data)
+	if binary.LittleEndian.Uint32(trailer[:4]) != PAGE_LAYOUT_VERSION {
+		return isZero(data)
+	}
+	return binary.LittleEndian.Uint32(trailer[4:]) == crc32.Checksum(body, castagnoli)
+}
+
+// Split a page into the part node layouts use and its trailer.
+func splitPage(data []byte) (body []byte, trailer []byte) {
+	end := int64(len(data)) - PAGE_TRAILER_SIZE
+	return data[:end], data[end:]
+}
+
+// Check whether every byte is zero.
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,26 @@
+package pager
+
+import "sync/atomic"
+
+// Decides whether writes are forced to stable storage with fsync.
+type Durability int32
+
+const (
+	// Sync files wherever durability calls for it. The default.
+	SYNC Durability = 0
+	// Skip fsync, leaving the operating system to write data out when it sees fit. This is much
+	// faster, but a machine crash or power loss (not just a process crash) can then lose writes
+	// that were reported durable, or tear them, so the database may not recover. Only use it for
+	// tests and for bulk loads that can be redone from scratch.
+	NO_SYNC Durability = 1
+)
+
+// Set whether Sync forces the pager's file to stable storage.
+func (pager *Pager) SetDurability(durability Durability) {
+	atomic.StoreInt32(&pager.durability, int32(durability))
+}
+
+// Get whether Sync forces the pager's file to stable storage.
+func (pager *Pager) GetDurability() Durability {
+	return Durability(atomic.LoadInt32(&pager.durability))
+}
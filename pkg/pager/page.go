@@ -1,9 +1,10 @@
 package pager
 
 import (
-	"fmt"
 	"sync"
 	"sync/atomic"
+
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 // pagenum for when there is no page being held
@@ -64,7 +65,7 @@ func (page *Page) Put() {
 	}
 	page.pager.ptMtx.Unlock()
 	if ret < 0 {
-		fmt.Println("ERROR: pinCount for page is < 0")
+		utils.GetLogger().Error("pinCount for page is < 0", "page", page.pagenum)
 	}
 }
 
@@ -6,42 +6,77 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 
 	config "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/config"
 	list "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/list"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 
 	directio "github.com/ncw/directio"
 )
 
-// Page size - defaults to 4kb.
-const PAGESIZE = int64(directio.BlockSize)
+// Default page size - 4kb, the direct I/O block size.
+const DEFAULT_PAGESIZE = int64(directio.BlockSize)
 
 // Maximum number of pages.
 const MAXPAGES = config.NumPages
 
+// File is the subset of *os.File that a pager reads and writes through.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+	Name() string
+}
+
 // Pagers manage pages of data read from a file.
 type Pager struct {
-	file         *os.File             // File descriptor.
+	file         File                 // File descriptor.
 	maxPageNum   int64                // The number of pages used by this database.
 	ptMtx        sync.Mutex           // Page table mutex.
 	freeList     *list.List           // Free page list.
 	unpinnedList *list.List           // Unpinned page list.
 	pinnedList   *list.List           // Pinned page list.
 	pageTable    map[int64]*list.Link // Page table.
+	pageSize     int64                // Size of each page, fixed when the pager is constructed.
+	layout       int                  // Page layout version; see SetPageLayout.
+	open         bool                 // Whether the pager is open.
+	stats        PagerStats           // Counts of page requests, guarded by ptMtx.
+	durability   int32                // Whether Sync calls fsync; see SetDurability.
+	codec        utils.EntryCodec     // Serializes the entries in the pages; see SetEntryCodec.
+	prefetching  map[int64]bool       // Pages being read by Prefetch, guarded by ptMtx.
 }
 
-// Construct a new Pager.
+// Counts of the pages a pager has been asked for.
+type PagerStats struct {
+	PageGets  int64 // Calls to GetPage, whether or not the page was buffered.
+	DiskReads int64 // Pages read in from disk.
+	// Pages written by the background writer; see StartBackgroundWriter.
+	BackgroundWrites int64
+	Prefetches       int64 // Pages read in before being asked for; see Prefetch.
+}
+
+// Construct a new Pager with pages of DEFAULT_PAGESIZE; see NewPagerWithSize.
 func NewPager() (pager *Pager) {
-	pager = &Pager{}
+	return newPager(DEFAULT_PAGESIZE)
+}
+
+// Construct a new Pager with pages of the given size.
+func newPager(pageSize int64) (pager *Pager) {
+	pager = &Pager{pageSize: pageSize, layout: PAGE_LAYOUT_VERSION, codec: utils.VarintCodec{}}
 	pager.pageTable = make(map[int64]*list.Link)
 	pager.freeList = list.NewList()
 	pager.unpinnedList = list.NewList()
 	pager.pinnedList = list.NewList()
-	frames := directio.AlignedBlock(int(PAGESIZE * MAXPAGES))
+	frames := directio.AlignedBlock(int(pager.pageSize * MAXPAGES))
 	for i := 0; i < MAXPAGES; i++ {
-		frame := frames[i*int(PAGESIZE) : (i+1)*int(PAGESIZE)]
+		frame := frames[i*int(pager.pageSize) : (i+1)*int(pager.pageSize)]
 		page := Page{
 			pager:    pager,
 			pagenum:  NOPAGE,
@@ -64,6 +99,23 @@ func (pager *Pager) GetFileName() string {
 	return filepath.Base(pager.file.Name())
 }
 
+// GetFilePath returns the path the file was opened with.
+func (pager *Pager) GetFilePath() string {
+	return pager.file.Name()
+}
+
+// GetPageSize returns the size of the pager's pages.
+func (pager *Pager) GetPageSize() int64 {
+	return pager.pageSize
+}
+
+// GetStats returns counts of the pages the pager has been asked for.
+func (pager *Pager) GetStats() PagerStats {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	return pager.stats
+}
+
 // GetNumPages returns the number of pages.
 func (pager *Pager) GetNumPages() (numPages int64) {
 	return pager.maxPageNum
@@ -85,21 +137,23 @@ func (pager *Pager) Open(filename string) (err error) {
 		}
 	}
 	// Open or create the db file.
-	pager.file, err = directio.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	file, err := directio.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		return err
 	}
+	pager.file = file
+	pager.open = true
 	// Get info about the size of the pager.
 	var info os.FileInfo
 	var len int64
 	if info, err = pager.file.Stat(); err == nil {
 		len = info.Size()
-		if len%PAGESIZE != 0 {
+		if len%pager.pageSize != 0 {
 			return errors.New("open: DB file has been corrupted")
 		}
 	}
 	// Set the number of pages and hand off initialization to someone else.
-	pager.maxPageNum = len / PAGESIZE
+	pager.maxPageNum = len / pager.pageSize
 	return nil
 }
 
@@ -110,25 +164,60 @@ func (pager *Pager) Close() (err error) {
 	// Check if all refcounts are 0.
 	curLink := pager.pinnedList.PeekHead()
 	if curLink != nil {
-		fmt.Println("ERROR: pages are still pinned on close")
+		utils.GetLogger().Error("pages are still pinned on close", "file", pager.GetFileName())
 	}
 	// Cleanup.
-	pager.FlushAllPages()
+	_, err = pager.FlushAllPages()
 	if pager.file != nil {
-		err = pager.file.Close()
+		if closeErr := pager.file.Close(); err == nil {
+			err = closeErr
+		}
 	}
+	pager.open = false
 	pager.ptMtx.Unlock()
 	return err
 }
 
-// Populate a page's data field, given a pagenumber.
+// WrapFile replaces the pager's file with wrap(file), e.g. to instrument disk access.
+func (pager *Pager) WrapFile(wrap func(File) File) {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if pager.file != nil {
+		pager.file = wrap(pager.file)
+	}
+}
+
+// Set the codec the indexes built on the pager store their entries with. Set it before the
+// pager's pages are used; it must match the codec the pages were written with.
+func (pager *Pager) SetEntryCodec(codec utils.EntryCodec) {
+	pager.codec = codec
+}
+
+// Get the codec the pager's entries are stored with.
+func (pager *Pager) GetEntryCodec() utils.EntryCodec {
+	return pager.codec
+}
+
+// Sync commits the pager's file to stable storage, unless its durability is NO_SYNC.
+func (pager *Pager) Sync() error {
+	if !pager.HasFile() || pager.GetDurability() == NO_SYNC {
+		return nil
+	}
+	return pager.file.Sync()
+}
+
+// Populate a page's data field, given a pagenumber. Fails with ErrPageChecksumMismatch if
+// the page doesn't match the checksum it was written with.
 func (pager *Pager) ReadPageFromDisk(page *Page, pagenum int64) (err error) {
-	if _, err := pager.file.Seek(pagenum*PAGESIZE, 0); err != nil {
+	if _, err := pager.file.Seek(pagenum*pager.pageSize, 0); err != nil {
 		return err
 	}
 	if _, err := pager.file.Read(*page.data); err != nil && err != io.EOF {
 		return err
 	}
+	if pager.sealed() && !checkPage(*page.data) {
+		return fmt.Errorf("read page %d of %s: %w", pagenum, pager.GetFileName(), ErrPageChecksumMismatch)
+	}
 	return nil
 }
 
@@ -145,7 +234,11 @@ func (pager *Pager) NewPage(pagenum int64) (newPage *Page, err error) {
 		// But skip this if our pager isn't backed by disk.
 		unpinLink.PopSelf()
 		newPage = unpinLink.GetKey().(*Page)
-		pager.FlushPage(newPage)
+		// Keep a page that can't be written in the pool, rather than losing its changes.
+		if _, err = pager.FlushPage(newPage); err != nil {
+			pager.pageTable[newPage.pagenum] = pager.unpinnedList.PushHead(newPage)
+			return nil, err
+		}
 		delete(pager.pageTable, newPage.pagenum)
 	} else {
 		// If still no page is found, error.
@@ -169,6 +262,7 @@ func (pager *Pager) GetPage(pagenum int64) (page *Page, err error) {
 	var newLink *list.Link
 	pager.ptMtx.Lock()
 	defer pager.ptMtx.Unlock()
+	pager.stats.PageGets++
 	link, ok := pager.pageTable[pagenum]
 	if ok {
 		page = link.GetKey().(*Page)
@@ -181,7 +275,8 @@ func (pager *Pager) GetPage(pagenum int64) (page *Page, err error) {
 		page.Get()
 		return page, nil
 	}
-	// Else, create a buffer to hold the new page in.
+	// Else, create a buffer to hold the new page in. A prefetch of it can't be trusted anymore.
+	delete(pager.prefetching, pagenum)
 	page, err = pager.NewPage(pagenum)
 	if err != nil {
 		return nil, err
@@ -194,6 +289,7 @@ func (pager *Pager) GetPage(pagenum int64) (page *Page, err error) {
 	} else {
 		// Read an existing page in.
 		page.dirty = false
+		pager.stats.DiskReads++
 		err = pager.ReadPageFromDisk(page, pagenum)
 		if err != nil {
 			pager.freeList.PushTail(page)
@@ -207,28 +303,65 @@ func (pager *Pager) GetPage(pagenum int64) (page *Page, err error) {
 	/* SOLUTION }}} */
 }
 
-// Flush a particular page to disk.
-func (pager *Pager) FlushPage(page *Page) {
+// Flush a particular page to disk, reporting whether it had to be written. A page that fails
+// to write stays dirty, so that the next flush tries again.
+func (pager *Pager) FlushPage(page *Page) (flushed bool, err error) {
 	/* SOLUTION {{{ */
 	if pager.HasFile() && page.IsDirty() {
-		pager.file.WriteAt(
-			*page.data,
-			page.pagenum*PAGESIZE,
+		data := *page.data
+		// The trailer is written to a copy, as the page can be updated while it is flushed;
+		// sealing it in place could leave a checksum on disk that doesn't match its page.
+		if pager.sealed() {
+			data = make([]byte, len(*page.data))
+			copy(data, *page.data)
+			sealPage(data)
+		}
+		_, err = pager.file.WriteAt(
+			data,
+			page.pagenum*pager.pageSize,
 		)
+		if err != nil {
+			utils.GetLogger().Warn("page flush failed", "file", pager.GetFileName(), "page", page.pagenum, "err", err)
+			return false, fmt.Errorf("flush page %d of %s: %w", page.pagenum, pager.GetFileName(), err)
+		}
 		page.SetDirty(false)
+		return true, nil
 	}
+	return false, nil
 	/* SOLUTION }}} */
 }
 
-// Flushes all dirty pages.
-func (pager *Pager) FlushAllPages() {
+// Flushes all dirty pages, returning how many were written. Pages are written highest page
+// number first. Page numbers are never reused, so a page only points to a page that wasn't on
+// disk at its last write if that page was allocated since, and so has a higher number. Writing
+// those first means that a flush cut short by a crash leaves every page on disk pointing at
+// pages that are on disk too, so indexes stay well-formed, if out of date. Pages evicted between
+// flushes are written on their own, outside this ordering. For the same reason, the flush stops
+// at the first page that fails to write, returning its error.
+func (pager *Pager) FlushAllPages() (flushed int, err error) {
 	/* SOLUTION {{{ */
-	writer := func(link *list.Link) {
+	dirty := make([]*Page, 0)
+	collect := func(link *list.Link) {
 		page := link.GetKey().(*Page)
-		pager.FlushPage(page)
+		if page.IsDirty() {
+			dirty = append(dirty, page)
+		}
+	}
+	pager.pinnedList.Map(collect)
+	pager.unpinnedList.Map(collect)
+	sort.Slice(dirty, func(i, j int) bool {
+		return dirty[i].pagenum > dirty[j].pagenum
+	})
+	for _, page := range dirty {
+		written, err := pager.FlushPage(page)
+		if err != nil {
+			return flushed, err
+		}
+		if written {
+			flushed++
+		}
 	}
-	pager.pinnedList.Map(writer)
-	pager.unpinnedList.Map(writer)
+	return flushed, nil
 	/* SOLUTION }}} */
 }
 
@@ -243,8 +243,8 @@ func HandlePagerFlush(p *Pager, payload string, w io.Writer) (err error) {
 	}
 	// Flush.
 	page := link.GetKey().(*Page)
-	p.FlushPage(page)
-	return nil
+	_, err = p.FlushPage(page)
+	return err
 }
 
 // Function to flush all pages.
@@ -256,6 +256,6 @@ func HandlePagerFlushAll(p *Pager, payload string, w io.Writer) (err error) {
 		return fmt.Errorf("usage: pager_flushall")
 	}
 	// Flush all.
-	p.FlushAllPages()
-	return nil
+	_, err = p.FlushAllPages()
+	return err
 }
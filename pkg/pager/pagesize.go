@@ -0,0 +1,30 @@
+package pager
+
+import "fmt"
+
+// CheckPageSize checks that a page size can be used: it must be a positive multiple of
+// DEFAULT_PAGESIZE, for direct I/O.
+func CheckPageSize(size int64) error {
+	if size <= 0 || size%DEFAULT_PAGESIZE != 0 {
+		return fmt.Errorf("page size must be a positive multiple of %d, got %d", DEFAULT_PAGESIZE, size)
+	}
+	return nil
+}
+
+// Construct a new Pager with pages of the given size. The node layouts of the indexes built on
+// it follow its page size, so a file must always be opened with the size it was written with.
+func NewPagerWithSize(size int64) (*Pager, error) {
+	if err := CheckPageSize(size); err != nil {
+		return nil, err
+	}
+	return newPager(size), nil
+}
+
+// GetUsableSize returns the number of bytes at the start of each page that the indexes built on
+// the pager lay out their nodes in, before the page's trailer, if it has one.
+func (pager *Pager) GetUsableSize() int64 {
+	if !pager.sealed() {
+		return pager.pageSize
+	}
+	return pager.pageSize - PAGE_TRAILER_SIZE
+}
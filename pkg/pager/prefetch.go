@@ -0,0 +1,51 @@
+package pager
+
+import (
+	"fmt"
+	"io"
+
+	directio "github.com/ncw/directio"
+)
+
+// Read a page into the buffer pool before it is asked for, leaving it unpinned. Unlike GetPage,
+// the read happens without holding the page table, so that other pages can be got meanwhile; if
+// this page is got before the read is done, the read is dropped. Does nothing for pages already
+// buffered or past the end of the file.
+func (pager *Pager) Prefetch(pagenum int64) error {
+	pager.ptMtx.Lock()
+	if _, buffered := pager.pageTable[pagenum]; buffered || !pager.HasFile() ||
+		pagenum < 0 || pagenum >= pager.maxPageNum {
+		pager.ptMtx.Unlock()
+		return nil
+	}
+	if pager.prefetching == nil {
+		pager.prefetching = make(map[int64]bool)
+	}
+	pager.prefetching[pagenum] = true
+	pager.ptMtx.Unlock()
+	data := directio.AlignedBlock(int(pager.pageSize))
+	_, err := pager.file.ReadAt(data, pagenum*pager.pageSize)
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	// GetPage read the page in itself, and it may have changed since.
+	if !pager.prefetching[pagenum] {
+		return nil
+	}
+	delete(pager.prefetching, pagenum)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if pager.sealed() && !checkPage(data) {
+		return fmt.Errorf("prefetch page %d of %s: %w", pagenum, pager.GetFileName(), ErrPageChecksumMismatch)
+	}
+	page, err := pager.NewPage(pagenum)
+	if err != nil {
+		return err
+	}
+	copy(*page.data, data)
+	page.pinCount = 0
+	pager.stats.DiskReads++
+	pager.stats.Prefetches++
+	pager.pageTable[pagenum] = pager.unpinnedList.PushTail(page)
+	return nil
+}
@@ -0,0 +1,75 @@
+package pager
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	list "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/list"
+)
+
+// Maximum number of pages the background writer writes each round.
+const BACKGROUND_WRITER_BATCH = 16
+
+// StartBackgroundWriter starts a goroutine that, every interval, writes up to
+// BACKGROUND_WRITER_BATCH dirty pages to disk, so that fewer are left for the next
+// checkpoint to write. Only unpinned pages are written, since a pinned page may be in the
+// middle of a change; the page table stays locked while each is written, so none can be
+// pinned meanwhile. Like evictions, these writes fall outside FlushAllPages' ordering.
+// Call stop to end the goroutine; it returns once the goroutine has exited.
+func (pager *Pager) StartBackgroundWriter(interval time.Duration) (stop func()) {
+	quit := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+				pager.writeUnpinned(BACKGROUND_WRITER_BATCH)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(quit)
+			<-exited
+		})
+	}
+}
+
+// Write up to limit of the dirty, unpinned pages, highest page number first, returning how
+// many were written.
+func (pager *Pager) writeUnpinned(limit int) (written int) {
+	pager.ptMtx.Lock()
+	defer pager.ptMtx.Unlock()
+	if !pager.open {
+		return 0
+	}
+	dirty := make([]*Page, 0)
+	pager.unpinnedList.Map(func(link *list.Link) {
+		if page := link.GetKey().(*Page); page.IsDirty() {
+			dirty = append(dirty, page)
+		}
+	})
+	sort.Slice(dirty, func(i, j int) bool {
+		return dirty[i].pagenum > dirty[j].pagenum
+	})
+	for _, page := range dirty {
+		if written == limit {
+			break
+		}
+		page.LockUpdates()
+		// A failed write is logged by FlushPage; the page stays dirty for the next round.
+		if flushed, _ := pager.FlushPage(page); flushed {
+			written++
+		}
+		page.UnlockUpdates()
+	}
+	pager.stats.BackgroundWrites += int64(written)
+	return written
+}
@@ -0,0 +1,108 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"math/bits"
+
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+)
+
+// The kind of aggregate to fold join results into.
+type AggKind int
+
+const (
+	COUNT_AGG     AggKind = 0 // Number of matching pairs.
+	SUM_LEFT_AGG  AggKind = 1 // Sum of the left entries' values.
+	SUM_RIGHT_AGG AggKind = 2 // Sum of the right entries' values.
+)
+
+// Returned by AggregateJoin when a sum doesn't fit in an int64.
+var ErrSumOverflow = errors.New("sum overflows int64")
+
+// A 128-bit two's complement sum, which can't overflow on any realistic number of int64s.
+// Only the final total has to fit in an int64, whatever order the values arrive in.
+type wideSum struct {
+	hi uint64
+	lo uint64
+}
+
+// Add a value to the sum.
+func (s *wideSum) add(value int64) {
+	var carry uint64
+	s.lo, carry = bits.Add64(s.lo, uint64(value), 0)
+	// Sign-extend the value into the high word.
+	ext := uint64(0)
+	if value < 0 {
+		ext = ^uint64(0)
+	}
+	s.hi, _ = bits.Add64(s.hi, ext, carry)
+}
+
+// Get the sum as an int64, or ErrSumOverflow if it doesn't fit.
+func (s *wideSum) int64() (int64, error) {
+	if s.hi != uint64(int64(s.lo)>>63) {
+		return 0, ErrSumOverflow
+	}
+	return int64(s.lo), nil
+}
+
+// AggregateJoin joins leftTable on rightTable and folds the matching pairs into a single
+// aggregate without buffering them. It stops early if ctx is cancelled, and always waits
+// for the join to finish and cleans up after it. Sums that don't fit in an int64 fail with
+// ErrSumOverflow rather than wrapping.
+func AggregateJoin(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	agg AggKind,
+) (int64, error) {
+	resultsChan, _, group, cleanupCallback, err := Join(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		return 0, err
+	}
+	// Close the results once every bucket has been probed.
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- group.Wait()
+		close(resultsChan)
+	}()
+	// Fold results until they run out or we are cancelled.
+	var aggregate int64
+	var sum wideSum
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case pair, valid := <-resultsChan:
+			if !valid {
+				done = true
+				break
+			}
+			switch agg {
+			case COUNT_AGG:
+				aggregate++
+			case SUM_LEFT_AGG:
+				sum.add(pair.l.GetValue())
+			case SUM_RIGHT_AGG:
+				sum.add(pair.r.GetValue())
+			}
+		}
+	}
+	// The probes stop on cancellation, so this won't block for long.
+	if err = <-waitErr; err != nil {
+		return 0, err
+	}
+	if err = ctx.Err(); err != nil {
+		return 0, err
+	}
+	if agg != COUNT_AGG {
+		return sum.int64()
+	}
+	return aggregate, nil
+}
@@ -1,40 +1,94 @@
 package query
 
 import (
+	"math"
+
 	bitset "github.com/bits-and-blooms/bitset"
 	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
-	// hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
 )
 
+// False positive rate filters sized to a table aim for; see FilterSize.
+var DEFAULT_FILTER_FPR = 0.01
+
 type BloomFilter struct {
-	size int64
-	bits *bitset.BitSet
+	size   int64
+	hashes int64 // Number of bits set per key.
+	bits   *bitset.BitSet
 }
 
-// CreateFilter initializes a BloomFilter with the given size.
+// CreateFilter initializes a BloomFilter with the given size, setting two bits per key.
 func CreateFilter(size int64) *BloomFilter {
+	return createFilter(size, 2)
+}
+
+// CreateFilterFor initializes a BloomFilter sized by FilterSize to hold n keys with a false
+// positive rate of about p, setting the number of bits per key that minimizes it.
+func CreateFilterFor(n int64, p float64) *BloomFilter {
+	size := FilterSize(n, p)
+	if n <= 0 {
+		return createFilter(size, 2)
+	}
+	hashes := int64(math.Round(float64(size) / float64(n) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return createFilter(size, hashes)
+}
+
+// createFilter initializes a BloomFilter with the given size and number of bits per key.
+func createFilter(size int64, hashes int64) *BloomFilter {
 	// first use the bitset pakcage to create a bitset
 	newBitset := bitset.New(uint(size))
 	// then create a BloomFilter struct
-	newBloomFilter := BloomFilter{size: size, bits: newBitset}
+	newBloomFilter := BloomFilter{size: size, hashes: hashes, bits: newBitset}
 	return &newBloomFilter
 }
 
+// FilterSize returns the number of bits a filter needs to hold n keys with a false positive
+// rate of p, m = -n ln p / (ln 2)^2, when it sets the optimal number of bits per key. Falls
+// back to DEFAULT_FILTER_SIZE when n isn't known (n <= 0) or p isn't in (0, 1).
+func FilterSize(n int64, p float64) int64 {
+	if n <= 0 || p <= 0 || p >= 1 {
+		return DEFAULT_FILTER_SIZE
+	}
+	return int64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+}
+
+// positions calls f with each bit a key maps to, derived from two hashes of the key as
+// h1 + i*h2 for i in [0, hashes).
+func (filter *BloomFilter) positions(key int64, f func(pos uint) bool) bool {
+	// hash the key twice with hash.XxHasher and hash.MurmurHasher
+	h1 := uint64(hash.XxHasher(key, filter.size))
+	h2 := uint64(hash.MurmurHasher(key, filter.size))
+	pos := h1
+	for i := int64(0); i < filter.hashes; i++ {
+		if !f(uint(pos)) {
+			return false
+		}
+		// Both are below size, which fits in an int64, so the sum can't overflow.
+		pos = (pos + h2) % uint64(filter.size)
+	}
+	return true
+}
+
 // Insert adds an element into the bloom filter.
 func (filter *BloomFilter) Insert(key int64) {
-	// hash the key twice with hash.XxHasher and hash.MurmurHasher
-	h1 := hash.XxHasher(key, filter.size)
-	h2 := hash.MurmurHasher(key, filter.size)
-	// use the bitset package to set the bits at the two hash values
-	filter.bits.Set(uint(h1))
-	filter.bits.Set(uint(h2))
+	// use the bitset package to set the bits at the hash values
+	filter.positions(key, func(pos uint) bool {
+		filter.bits.Set(pos)
+		return true
+	})
 }
 
 // Contains checks if the given key can be found in the bloom filter/
 func (filter *BloomFilter) Contains(key int64) bool {
-	h1 := hash.XxHasher(key, filter.size)
-	h2 := hash.MurmurHasher(key, filter.size)
+	// use the bitset package to check if the bits at the hash values are set
+	return filter.positions(key, func(pos uint) bool {
+		return filter.bits.Test(pos)
+	})
+}
 
-	// use the bitset package to check if the bits at the two hash values are set
-	return filter.bits.Test(uint(h1)) && filter.bits.Test(uint(h2))
+// Clear empties the bloom filter in place so that it can be reused.
+func (filter *BloomFilter) Clear() {
+	filter.bits.ClearAll()
 }
@@ -0,0 +1,117 @@
+package query
+
+import (
+	"context"
+	"math"
+
+	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+
+	errgroup "golang.org/x/sync/errgroup"
+)
+
+// Distinct scans table and sends the first entry with each distinct key, or each distinct
+// value if onKey is false, on the returned channel. Keys come out of a B+Tree in sorted order,
+// so they are deduplicated by comparing each with the one before it, without a set; values,
+// and keys of hash tables, are deduplicated with a set of those seen so far.
+// As with Join, wait on the group before closing the channel.
+func Distinct(
+	ctx context.Context,
+	table db.Index,
+	onKey bool,
+) (chan utils.Entry, context.Context, *errgroup.Group, error) {
+	cursor, closeCursor, err := scanTable(table)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	_, sorted := table.(*btree.BTreeIndex)
+	resultsChan := make(chan utils.Entry, DEFAULT_JOIN_BUFFER_SIZE)
+	group, ctx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		defer closeCursor()
+		if onKey && sorted {
+			return distinctSorted(ctx, cursor, resultsChan)
+		}
+		return distinctHashed(ctx, cursor, onKey, resultsChan)
+	})
+	return resultsChan, ctx, group, nil
+}
+
+// scanTable returns a cursor on the first entry of the table, and a function to release it
+// with, even part way through the scan.
+func scanTable(table db.Index) (utils.Cursor, func(), error) {
+	if tree, ok := table.(*btree.BTreeIndex); ok {
+		cursor, err := tree.NewSharedScan().Cursor(math.MinInt64)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cursor, cursor.Close, nil
+	}
+	cursor, err := table.TableStart()
+	if err != nil {
+		return nil, nil, err
+	}
+	return cursor, cursor.Close, nil
+}
+
+// nextEntry gets the entry under the cursor, moving it past exhausted buckets first.
+// Returns nil once the table runs out.
+func nextEntry(cursor utils.Cursor) (utils.Entry, error) {
+	if cursor.IsEnd() && cursor.StepForward() {
+		return nil, nil
+	}
+	return cursor.GetEntry()
+}
+
+// sendEntry sends an entry as long as ctx hasn't been cancelled.
+func sendEntry(ctx context.Context, resultsChan chan utils.Entry, entry utils.Entry) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case resultsChan <- entry:
+		return nil
+	}
+}
+
+// distinctSorted sends the first entry of each run of equal keys from a cursor over sorted keys.
+func distinctSorted(ctx context.Context, cursor utils.Cursor, resultsChan chan utils.Entry) error {
+	first := true
+	var lastKey int64
+	for {
+		entry, err := nextEntry(cursor)
+		if err != nil || entry == nil {
+			return err
+		}
+		if first || entry.GetKey() != lastKey {
+			if err = sendEntry(ctx, resultsChan, entry); err != nil {
+				return err
+			}
+			first = false
+			lastKey = entry.GetKey()
+		}
+		cursor.StepForward()
+	}
+}
+
+// distinctHashed sends the first entry with each key or value, remembering those seen in a set.
+func distinctHashed(ctx context.Context, cursor utils.Cursor, onKey bool, resultsChan chan utils.Entry) error {
+	seen := make(map[int64]bool)
+	for {
+		entry, err := nextEntry(cursor)
+		if err != nil || entry == nil {
+			return err
+		}
+		column := entry.GetValue()
+		if onKey {
+			column = entry.GetKey()
+		}
+		if !seen[column] {
+			seen[column] = true
+			if err = sendEntry(ctx, resultsChan, entry); err != nil {
+				return err
+			}
+		}
+		cursor.StepForward()
+	}
+}
@@ -0,0 +1,220 @@
+package query
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
+// Bytes an entry takes in ExternalSort's in-memory buffer: a key and a value.
+const SORT_ENTRY_SIZE = 16
+
+// Number of sorted runs external sorts have spilled to temporary files so far.
+var runsSpilled int64
+
+// RunsSpilled returns how many sorted runs external sorts have spilled to temporary files.
+func RunsSpilled() int64 {
+	return atomic.LoadInt64(&runsSpilled)
+}
+
+// ExternalSort sends the entries read from in on the returned channel, sorted by key, with
+// entries of equal keys in the order they were read. Once in is closed, the entries are sorted
+// in memory if they take up at most memLimit bytes, at SORT_ENTRY_SIZE bytes each. Otherwise,
+// each time the buffer fills up it is sorted and spilled to a temporary db file as a run, and
+// the runs are merged once in is closed. The returned channel is closed once every entry has
+// been sent, or early if ctx is cancelled or a run can't be written or read back, which is
+// logged. The temporary files are removed before it is closed.
+func ExternalSort(ctx context.Context, in chan utils.Entry, memLimit int64) (chan utils.Entry, error) {
+	if memLimit < SORT_ENTRY_SIZE {
+		return nil, errors.New("memory limit must fit at least one entry")
+	}
+	capacity := int(memLimit / SORT_ENTRY_SIZE)
+	out := make(chan utils.Entry, DEFAULT_JOIN_BUFFER_SIZE)
+	go func() {
+		defer close(out)
+		runs := make([]string, 0)
+		defer func() {
+			for _, run := range runs {
+				os.Remove(run)
+			}
+		}()
+		if err := externalSort(ctx, in, out, capacity, &runs); err != nil && ctx.Err() == nil {
+			utils.GetLogger().Error("external sort failed", "err", err)
+		}
+	}()
+	return out, nil
+}
+
+// externalSort reads in, spilling a sorted run whenever capacity entries are buffered, then
+// sends the entries on out in order. The runs' file names are added to runs as they are made.
+func externalSort(ctx context.Context, in chan utils.Entry, out chan utils.Entry, capacity int, runs *[]string) error {
+	buffer := make([]utils.Entry, 0, capacity)
+	for reading := true; reading; {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case entry, ok := <-in:
+			if !ok {
+				reading = false
+				break
+			}
+			buffer = append(buffer, entry)
+			if len(buffer) < capacity {
+				continue
+			}
+			run, err := spillRun(buffer)
+			if run != "" {
+				*runs = append(*runs, run)
+			}
+			if err != nil {
+				return err
+			}
+			buffer = buffer[:0]
+		}
+	}
+	sortEntries(buffer)
+	if len(*runs) == 0 {
+		for _, entry := range buffer {
+			if err := sendEntry(ctx, out, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return mergeRuns(ctx, *runs, buffer, out)
+}
+
+// sortEntries sorts entries by key, keeping entries of equal keys in order.
+func sortEntries(entries []utils.Entry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return utils.CompareEntries(entries[i], entries[j]) < 0
+	})
+}
+
+// spillRun sorts the entries and writes them to a new temporary db file, returning its name.
+func spillRun(entries []utils.Entry) (string, error) {
+	sortEntries(entries)
+	run, err := db.GetTempDB()
+	if err != nil {
+		return "", err
+	}
+	file, err := os.OpenFile(run, os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return run, err
+	}
+	writer := bufio.NewWriter(file)
+	for _, entry := range entries {
+		if _, err = writer.Write(utils.VarintCodec{}.Encode(entry)); err != nil {
+			file.Close()
+			return run, err
+		}
+	}
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return run, err
+	}
+	atomic.AddInt64(&runsSpilled, 1)
+	return run, file.Close()
+}
+
+// Reads back the entries of a spilled run, or of the entries left in memory.
+type runReader struct {
+	index   int           // Position among the runs, to keep entries of equal keys in order.
+	reader  *bufio.Reader // nil for the in-memory entries.
+	entries []utils.Entry // The in-memory entries not yet read.
+	head    utils.Entry   // The next entry of the run.
+}
+
+// next moves on to the run's next entry, returning false once it runs out.
+func (r *runReader) next() (bool, error) {
+	if r.reader == nil {
+		if len(r.entries) == 0 {
+			return false, nil
+		}
+		r.head, r.entries = r.entries[0], r.entries[1:]
+		return true, nil
+	}
+	data := make([]byte, utils.ENCODED_ENTRY_SIZE)
+	if _, err := io.ReadFull(r.reader, data); err == io.EOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	r.head, _ = utils.VarintCodec{}.Decode(data)
+	return true, nil
+}
+
+// A min-heap of runs by their next entry.
+type runHeap []*runReader
+
+func (h runHeap) Len() int { return len(h) }
+
+func (h runHeap) Less(i, j int) bool {
+	if cmp := utils.CompareEntries(h[i].head, h[j].head); cmp != 0 {
+		return cmp < 0
+	}
+	return h[i].index < h[j].index
+}
+
+func (h runHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*runReader)) }
+
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// mergeRuns merges the spilled runs, and the sorted entries left in memory, which came after
+// them, onto out.
+func mergeRuns(ctx context.Context, runs []string, remaining []utils.Entry, out chan utils.Entry) error {
+	h := make(runHeap, 0, len(runs)+1)
+	for i, run := range runs {
+		file, err := os.Open(run)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		h = append(h, &runReader{index: i, reader: bufio.NewReader(file)})
+	}
+	h = append(h, &runReader{index: len(runs), entries: remaining})
+	// Drop runs that are already exhausted.
+	readers := h[:0]
+	for _, r := range h {
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			readers = append(readers, r)
+		}
+	}
+	h = readers
+	heap.Init(&h)
+	for h.Len() > 0 {
+		r := h[0]
+		if err := sendEntry(ctx, out, r.head); err != nil {
+			return err
+		}
+		ok, err := r.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+	return nil
+}
@@ -2,7 +2,10 @@ package query
 
 import (
 	"context"
-	"os"
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
 
 	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
 	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
@@ -13,12 +16,97 @@ import (
 
 var DEFAULT_FILTER_SIZE int64 = 1024
 
+// Number of pairs a join's results channel buffers by default; see JoinOptions.BufferSize.
+var DEFAULT_JOIN_BUFFER_SIZE = 1024
+
+// Number of bucket pairs an adaptive join samples before deciding whether to pre-filter.
+var ADAPTIVE_FILTER_SAMPLE_BUCKETS = 4
+
+// Fraction of sampled entries with a match below which an adaptive join pre-filters the rest
+// of its probes; see JoinOptions.AdaptiveFilter.
+var ADAPTIVE_FILTER_THRESHOLD = 0.5
+
 // Entry pair struct - output of a join.
 type EntryPair struct {
 	l utils.Entry
 	r utils.Entry
 }
 
+// Get the entry from the left table.
+func (p EntryPair) GetLeft() utils.Entry {
+	return p.l
+}
+
+// Get the entry from the right table.
+func (p EntryPair) GetRight() utils.Entry {
+	return p.r
+}
+
+// Decides whether a pair of entries match. Each entry's key is the field its side is joined on:
+// its value, if joining on values. The pairs sent on are the entries as stored.
+type JoinCondition func(l utils.Entry, r utils.Entry) bool
+
+// The condition joins use by default: the joined fields are equal.
+func KeysEqual(l utils.Entry, r utils.Entry) bool {
+	return utils.CompareEntries(l, r) == 0
+}
+
+// Options for a join.
+type JoinOptions struct {
+	// Emit pairs sorted by join key rather than as buckets are probed. Every pair is held
+	// in memory until the last bucket finishes, so memory grows with the size of the result.
+	Sorted bool
+	// Number of pairs the results channel buffers before probes block on the reader; 0 uses
+	// DEFAULT_JOIN_BUFFER_SIZE. A pair takes 32 bytes in the buffer plus its two entries, 16
+	// bytes each, so a full buffer holds about 64 bytes per pair: 64KB at the default. Small
+	// buffers hand each pair over sooner, large ones block the probes less on big joins.
+	BufferSize int
+	// Stop after sending this many pairs; 0 sends them all. Unsorted joins stop probing
+	// buckets as soon as the limit is reached, while sorted ones still probe every bucket.
+	Limit int
+	// Build a bloom filter over each table's join keys, sized to the table, and skip entries
+	// the other table's filter rules out when probing. Pays off when few entries match.
+	Filter bool
+	// Build the filters, but probe the first ADAPTIVE_FILTER_SAMPLE_BUCKETS bucket pairs
+	// directly, and only pre-filter the rest if fewer than ADAPTIVE_FILTER_THRESHOLD of the
+	// sampled entries had a match. Overrides Filter.
+	AdaptiveFilter bool
+	// Match pairs with this condition, e.g. to join on keys within a band of each other, rather
+	// than on equal keys. Matching entries can then be in any bucket of the other side, so every
+	// bucket of one side is compared against every bucket of the other, and the bloom filters,
+	// which only rule out equal keys, aren't used.
+	Condition JoinCondition
+}
+
+// How the probes of a join run.
+type probeOptions struct {
+	limit     int           // Stop once this many pairs have been emitted; 0 for no limit.
+	filter    bool          // Pre-filter probes with bloom filters over the tables' join keys.
+	adaptive  bool          // Decide whether to pre-filter from a sample of the buckets.
+	condition JoinCondition // Compare every pair of buckets with this condition; nil for KeysEqual.
+}
+
+// Returned by a probe's emitter once the join has sent as many pairs as it was limited to.
+var errLimitReached = errors.New("join limit reached")
+
+// Number of bucket pairs joins have probed all the way through so far.
+var bucketsProbed int64
+
+// BucketsProbed returns how many pairs of buckets joins have probed all the way through,
+// leaving out probes stopped early by a limit or an error.
+func BucketsProbed() int64 {
+	return atomic.LoadInt64(&bucketsProbed)
+}
+
+// Number of entries joins have skipped comparing because a bloom filter ruled them out.
+var probesFiltered int64
+
+// ProbesFiltered returns how many streamed entries joins have skipped comparing because the
+// other table's bloom filter ruled them out.
+func ProbesFiltered() int64 {
+	return atomic.LoadInt64(&probesFiltered)
+}
+
 // Int pair struct - to keep track of seen bucket pairs.
 type pair struct {
 	l int64
@@ -26,26 +114,29 @@ type pair struct {
 }
 
 // buildHashIndex constructs a temporary hash table for all the entries in the given sourceTable.
+// If withFilter is set, it also builds a bloom filter over the join keys, sized to the number of
+// entries for a false positive rate of DEFAULT_FILTER_FPR.
 func buildHashIndex(
 	sourceTable db.Index,
 	useKey bool,
-) (tempIndex *hash.HashIndex, dbName string, err error) {
-	// Get a temporary db file.
-	dbName, err = db.GetTempDB()
+	withFilter bool,
+) (temp pooledIndex, filter *BloomFilter, err error) {
+	// Get an empty temporary hash table.
+	temp, err = getTempIndex()
 	if err != nil {
-		return nil, "", err
-	}
-	// Init the temporary hash table.
-	tempIndex, err = hash.OpenTable(dbName)
-	if err != nil {
-		return nil, "", err
+		return pooledIndex{}, nil, err
 	}
+	tempIndex := temp.index
 	// Build the hash index.
 	// use cursor to get all the values
 	cursor, err := sourceTable.TableStart()
 	if err != nil {
-		return nil, "", err
+		putTempIndex(temp)
+		return pooledIndex{}, nil, err
 	}
+	defer cursor.Close()
+	// The filter can only be sized once the entries have been counted.
+	keys := make([]int64, 0)
 	for {
 		if cursor.IsEnd() {
 			end := cursor.StepForward()
@@ -55,17 +146,36 @@ func buildHashIndex(
 		}
 		entry, err := cursor.GetEntry()
 		if err != nil {
-			return nil, "", err
+			putTempIndex(temp)
+			return pooledIndex{}, nil, err
 		}
-		// Insert the entry into the hash table.
+		// Insert the entry into the hash table, swapping its key and value if joining on the
+		// value; matchPair swaps them back.
 		if useKey {
 			tempIndex.Insert(entry.GetKey(), entry.GetValue())
 		} else {
-			tempIndex.Insert(entry.GetValue(), entry.GetValue())
+			tempIndex.Insert(entry.GetValue(), entry.GetKey())
+		}
+		if withFilter {
+			keys = append(keys, joinKey(entry, useKey))
 		}
 		cursor.StepForward()
 	}
-	return tempIndex, dbName, nil
+	if withFilter {
+		filter = CreateFilterFor(int64(len(keys)), DEFAULT_FILTER_FPR)
+		for _, key := range keys {
+			filter.Insert(key)
+		}
+	}
+	return temp, filter, nil
+}
+
+// joinKey returns the key an entry is joined on.
+func joinKey(entry utils.Entry, useKey bool) int64 {
+	if useKey {
+		return entry.GetKey()
+	}
+	return entry.GetValue()
 }
 
 // sendResult attempts to send a single join result to the resultsChan channel as long as the errgroup hasn't been cancelled.
@@ -82,65 +192,55 @@ func sendResult(
 	}
 }
 
+// A function that a probe hands each matching pair to.
+type emitFunc func(EntryPair) error
+
 // See which entries in rBucket have a match in lBucket.
+// The smaller bucket is materialized while the larger one is streamed through a
+// BucketIterator, keeping peak memory proportional to the smaller side. If the tables have
+// bloom filters over their join keys, streamed entries the smaller side's table can't match
+// skip the comparisons. Pairs match if they meet the condition.
 func probeBuckets(
-	ctx context.Context,
-	resultsChan chan EntryPair,
+	emit emitFunc,
 	lBucket *hash.HashBucket,
 	rBucket *hash.HashBucket,
+	lFilter *BloomFilter,
+	rFilter *BloomFilter,
+	condition JoinCondition,
 	joinOnLeftKey bool,
 	joinOnRightKey bool,
 ) error {
 	defer lBucket.GetPage().Put()
 	defer rBucket.GetPage().Put()
-	// Probe buckets.
-	lBucketEntries, err := lBucket.Select()
-	if err != nil {
-		return err
+	// Pick which side to stream.
+	leftIsSmaller := lBucket.GetNumKeys() <= rBucket.GetNumKeys()
+	smallBucket, largeBucket := lBucket, rBucket
+	smallFilter := lFilter
+	if !leftIsSmaller {
+		smallBucket, largeBucket = rBucket, lBucket
+		smallFilter = rFilter
 	}
-	rBucketEntries, err := rBucket.Select()
+	// Probe buckets.
+	smallEntries, err := smallBucket.Select()
 	if err != nil {
 		return err
 	}
-	for _, lEntry := range lBucketEntries {
-		for _, rEntry := range rBucketEntries {
-			if lEntry.GetKey() == rEntry.GetKey() {
-				if joinOnLeftKey && joinOnRightKey {
-					err = sendResult(ctx, resultsChan, EntryPair{l: lEntry, r: rEntry})
-					if err != nil {
-						return err
-					}
-				} else if joinOnLeftKey && !joinOnRightKey {
-					swappedRight := hash.HashEntry{}
-					swappedRight.SetKey(rEntry.GetValue())
-					swappedRight.SetValue(rEntry.GetKey())
-
-					err = sendResult(ctx, resultsChan, EntryPair{l: lEntry, r: swappedRight})
-					if err != nil {
-						return err
-					}
-				} else if !joinOnLeftKey && joinOnRightKey {
-					swappedLeft := hash.HashEntry{}
-					swappedLeft.SetKey(lEntry.GetValue())
-					swappedLeft.SetValue(lEntry.GetKey())
-
-					err = sendResult(ctx, resultsChan, EntryPair{l: swappedLeft, r: rEntry})
-					if err != nil {
-						return err
-					}
-				} else {
-					swappedLeft := hash.HashEntry{}
-					swappedLeft.SetKey(lEntry.GetValue())
-					swappedLeft.SetValue(lEntry.GetKey())
-
-					swappedRight := hash.HashEntry{}
-					swappedRight.SetKey(rEntry.GetValue())
-					swappedRight.SetValue(rEntry.GetKey())
-
-					err = sendResult(ctx, resultsChan, EntryPair{l: swappedLeft, r: swappedRight})
-					if err != nil {
-						return err
-					}
+	iterator := largeBucket.Iterator()
+	defer iterator.Close()
+	for largeEntry, ok := iterator.Next(); ok; largeEntry, ok = iterator.Next() {
+		if smallFilter != nil && !smallFilter.Contains(largeEntry.GetKey()) {
+			atomic.AddInt64(&probesFiltered, 1)
+			continue
+		}
+		for _, smallEntry := range smallEntries {
+			lEntry, rEntry := smallEntry, largeEntry
+			if !leftIsSmaller {
+				lEntry, rEntry = largeEntry, smallEntry
+			}
+			if condition(lEntry, rEntry) {
+				err = emit(matchPair(lEntry, rEntry, joinOnLeftKey, joinOnRightKey))
+				if err != nil {
+					return err
 				}
 			}
 		}
@@ -148,6 +248,57 @@ func probeBuckets(
 	return nil
 }
 
+// sampleDensity counts how many entries of the larger of two buckets have a match in the
+// smaller, as probing them would, without emitting any pairs.
+func sampleDensity(lBucket *hash.HashBucket, rBucket *hash.HashBucket) (streamed int, matched int, err error) {
+	defer lBucket.GetPage().Put()
+	defer rBucket.GetPage().Put()
+	smallBucket, largeBucket := lBucket, rBucket
+	if lBucket.GetNumKeys() > rBucket.GetNumKeys() {
+		smallBucket, largeBucket = rBucket, lBucket
+	}
+	smallEntries, err := smallBucket.Select()
+	if err != nil {
+		return 0, 0, err
+	}
+	smallKeys := make(map[int64]bool, len(smallEntries))
+	for _, entry := range smallEntries {
+		smallKeys[entry.GetKey()] = true
+	}
+	iterator := largeBucket.Iterator()
+	defer iterator.Close()
+	for largeEntry, ok := iterator.Next(); ok; largeEntry, ok = iterator.Next() {
+		streamed++
+		if smallKeys[largeEntry.GetKey()] {
+			matched++
+		}
+	}
+	return streamed, matched, nil
+}
+
+// matchPair builds the result for a matching pair of entries, swapping each side's key
+// and value back if that side was joined on its value.
+func matchPair(
+	lEntry utils.Entry,
+	rEntry utils.Entry,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+) EntryPair {
+	if !joinOnLeftKey {
+		swappedLeft := hash.HashEntry{}
+		swappedLeft.SetKey(lEntry.GetValue())
+		swappedLeft.SetValue(lEntry.GetKey())
+		lEntry = swappedLeft
+	}
+	if !joinOnRightKey {
+		swappedRight := hash.HashEntry{}
+		swappedRight.SetKey(rEntry.GetValue())
+		swappedRight.SetValue(rEntry.GetKey())
+		rEntry = swappedRight
+	}
+	return EntryPair{l: lEntry, r: rEntry}
+}
+
 // Join leftTable on rightTable using Grace Hash Join.
 func Join(
 	ctx context.Context,
@@ -156,25 +307,188 @@ func Join(
 	joinOnLeftKey bool,
 	joinOnRightKey bool,
 ) (chan EntryPair, context.Context, *errgroup.Group, func(), error) {
-	leftHashIndex, leftDbName, err := buildHashIndex(leftTable, joinOnLeftKey)
+	return JoinWithOptions(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey, JoinOptions{})
+}
+
+// JoinWithOptions joins like Join, configured by the given options.
+func JoinWithOptions(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	options JoinOptions,
+) (chan EntryPair, context.Context, *errgroup.Group, func(), error) {
+	if options.BufferSize < 0 {
+		return nil, nil, nil, nil, errors.New("buffer size must not be negative")
+	}
+	if options.Limit < 0 {
+		return nil, nil, nil, nil, errors.New("limit must not be negative")
+	}
+	if options.BufferSize == 0 {
+		options.BufferSize = DEFAULT_JOIN_BUFFER_SIZE
+	}
+	resultsChan := make(chan EntryPair, options.BufferSize)
+	var mtx sync.Mutex
+	buffered := make([]EntryPair, 0)
+	newEmitter := func(ctx context.Context) (emitFunc, func() error) {
+		emit := func(result EntryPair) error {
+			return sendResult(ctx, resultsChan, result)
+		}
+		if options.Sorted {
+			emit = func(result EntryPair) error {
+				mtx.Lock()
+				defer mtx.Unlock()
+				buffered = append(buffered, result)
+				return nil
+			}
+		}
+		return emit, func() error { return nil }
+	}
+	// Sorted joins can't tell which pairs come first until every bucket has been probed.
+	probes := probeOptions{limit: options.Limit, filter: options.Filter, adaptive: options.AdaptiveFilter, condition: options.Condition}
+	if probes.condition != nil {
+		probes.filter, probes.adaptive = false, false
+	}
+	if options.Sorted {
+		probes.limit = 0
+	}
+	probeCtx, group, cleanupCallback, err := startJoin(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey, probes, newEmitter)
 	if err != nil {
-		return nil, nil, nil, nil, err
+		return nil, nil, nil, cleanupCallback, err
 	}
-	rightHashIndex, rightDbName, err := buildHashIndex(rightTable, joinOnRightKey)
+	if !options.Sorted {
+		return resultsChan, probeCtx, group, cleanupCallback, nil
+	}
+	// Once every probe is done, sort the buffered pairs and send them on. The probes' context
+	// is cancelled when they finish, so sending uses one derived from the caller's instead.
+	sortGroup, ctx := errgroup.WithContext(ctx)
+	sortGroup.Go(func() error {
+		if err := group.Wait(); err != nil {
+			return err
+		}
+		sortPairs(buffered, joinOnLeftKey)
+		if options.Limit > 0 && len(buffered) > options.Limit {
+			buffered = buffered[:options.Limit]
+		}
+		for _, result := range buffered {
+			if err := sendResult(ctx, resultsChan, result); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return resultsChan, ctx, sortGroup, cleanupCallback, nil
+}
+
+// sortPairs sorts join results by join key, breaking ties by the rest of each pair.
+func sortPairs(pairs []EntryPair, joinOnLeftKey bool) {
+	order := func(p EntryPair) [5]int64 {
+		joinKey := p.l.GetKey()
+		if !joinOnLeftKey {
+			joinKey = p.l.GetValue()
+		}
+		return [5]int64{joinKey, p.l.GetKey(), p.l.GetValue(), p.r.GetKey(), p.r.GetValue()}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		a, b := order(pairs[i]), order(pairs[j])
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+}
+
+// JoinBatched joins like Join, but sends matching pairs in chunks of up to batchSize, which
+// cuts the per-pair channel overhead on joins with many matches.
+func JoinBatched(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	batchSize int,
+) (chan []EntryPair, context.Context, *errgroup.Group, func(), error) {
+	if batchSize < 1 {
+		return nil, nil, nil, nil, errors.New("batch size must be positive")
+	}
+	// Buffer about as many pairs as Join does.
+	resultsChan := make(chan []EntryPair, DEFAULT_JOIN_BUFFER_SIZE/batchSize+1)
+	newEmitter := func(ctx context.Context) (emitFunc, func() error) {
+		batch := make([]EntryPair, 0, batchSize)
+		flush := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			chunk := batch
+			batch = make([]EntryPair, 0, batchSize)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case resultsChan <- chunk:
+				return nil
+			}
+		}
+		emit := func(result EntryPair) error {
+			batch = append(batch, result)
+			if len(batch) < batchSize {
+				return nil
+			}
+			return flush()
+		}
+		return emit, flush
+	}
+	ctx, group, cleanupCallback, err := startJoin(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey, probeOptions{}, newEmitter)
+	if err != nil {
+		return nil, nil, nil, cleanupCallback, err
+	}
+	return resultsChan, ctx, group, cleanupCallback, nil
+}
+
+// startJoin builds a temporary hash index for each table, then probes each pair of matching
+// buckets in its own goroutine. Each probe gets its own emitter from newEmitter, and flushes
+// it once the probe is done. If there is a limit, the probes stop once they have emitted that
+// many pairs, and probes that haven't started yet are skipped. An adaptive join probes the
+// first few bucket pairs without its filters, and only uses them on the rest if few of the
+// sampled entries matched.
+func startJoin(
+	ctx context.Context,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+	options probeOptions,
+	newEmitter func(ctx context.Context) (emit emitFunc, flush func() error),
+) (context.Context, *errgroup.Group, func(), error) {
+	withFilter := options.filter || options.adaptive
+	leftTemp, leftFilter, err := buildHashIndex(leftTable, joinOnLeftKey, withFilter)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rightTemp, rightFilter, err := buildHashIndex(rightTable, joinOnRightKey, withFilter)
 	if err != nil {
-		os.Remove(leftDbName)
-		os.Remove(leftDbName + ".meta")
-		return nil, nil, nil, nil, err
+		putTempIndex(leftTemp)
+		return nil, nil, nil, err
 	}
+	// Probe phase: match buckets to buckets and emit entries that match. The probes run
+	// under a context of their own, so that reaching the limit stops them without failing
+	// the group.
+	group, probeCtx := errgroup.WithContext(ctx)
+	limitCtx, stopProbes := context.WithCancel(probeCtx)
+	// Hand the temporary indices back to the pool once the caller is done. Probes may still be
+	// running if the caller stopped reading early, so they are stopped and waited for first;
+	// once pooled, the indices can be reused by another join.
 	cleanupCallback := func() {
-		os.Remove(leftDbName)
-		os.Remove(leftDbName + ".meta")
-		os.Remove(rightDbName)
-		os.Remove(rightDbName + ".meta")
+		stopProbes()
+		group.Wait()
+		putTempIndex(leftTemp)
+		putTempIndex(rightTemp)
 	}
 	// Make both hash indices the same global size.
-	leftHashTable := leftHashIndex.GetTable()
-	rightHashTable := rightHashIndex.GetTable()
+	leftHashTable := leftTemp.index.GetTable()
+	rightHashTable := rightTemp.index.GetTable()
 	for leftHashTable.GetDepth() != rightHashTable.GetDepth() {
 		if leftHashTable.GetDepth() < rightHashTable.GetDepth() {
 			// Split the left table
@@ -184,33 +498,154 @@ func Join(
 			rightHashTable.ExtendTable()
 		}
 	}
-	// Probe phase: match buckets to buckets and emit entries that match.
-	group, ctx := errgroup.WithContext(ctx)
-	resultsChan := make(chan EntryPair, 1024)
+	capped := &joinLimit{limit: int64(options.limit), stop: stopProbes}
+	// The probes' own context is only cancelled if the caller's is, or a probe failed.
+	limited := func(err error) bool {
+		return probeCtx.Err() == nil && capped.reached(err)
+	}
 	// Iterate through hash buckets, keeping track of pairs we've seen before.
 	leftBuckets := leftHashTable.GetBuckets()
 	rightBuckets := rightHashTable.GetBuckets()
 	seenList := make(map[pair]bool)
+	bucketPairs := make([]pair, 0)
 	for i, lBucketPN := range leftBuckets {
-		rBucketPN := rightBuckets[i]
-		bucketPair := pair{l: lBucketPN, r: rBucketPN}
+		bucketPair := pair{l: lBucketPN, r: rightBuckets[i]}
 		if _, seen := seenList[bucketPair]; seen {
 			continue
 		}
 		seenList[bucketPair] = true
-
-		lBucket, err := leftHashTable.GetBucketByPN(lBucketPN)
+		bucketPairs = append(bucketPairs, bucketPair)
+	}
+	condition := options.condition
+	if condition == nil {
+		condition = KeysEqual
+	} else {
+		bucketPairs = allBucketPairs(leftBuckets, rightBuckets)
+	}
+	// Sample the first bucket pairs to decide whether the filters are worth it.
+	sampled := 0
+	if options.adaptive {
+		streamed, matched := 0, 0
+		for sampled < len(bucketPairs) && sampled < ADAPTIVE_FILTER_SAMPLE_BUCKETS {
+			lBucket, err := leftHashTable.GetBucketByPN(bucketPairs[sampled].l)
+			if err != nil {
+				return nil, nil, cleanupCallback, err
+			}
+			rBucket, err := rightHashTable.GetBucketByPN(bucketPairs[sampled].r)
+			if err != nil {
+				lBucket.GetPage().Put()
+				return nil, nil, cleanupCallback, err
+			}
+			s, m, err := sampleDensity(lBucket, rBucket)
+			if err != nil {
+				return nil, nil, cleanupCallback, err
+			}
+			streamed, matched = streamed+s, matched+m
+			sampled++
+		}
+		if streamed > 0 && float64(matched)/float64(streamed) >= ADAPTIVE_FILTER_THRESHOLD {
+			leftFilter, rightFilter = nil, nil
+		}
+	}
+	// Stops the probes already started and waits for them, before failing with err.
+	fail := func(err error) (context.Context, *errgroup.Group, func(), error) {
+		stopProbes()
+		group.Wait()
+		return nil, nil, cleanupCallback, err
+	}
+	for i, bucketPair := range bucketPairs {
+		lFilter, rFilter := leftFilter, rightFilter
+		if i < sampled {
+			// Sampled buckets are probed directly.
+			lFilter, rFilter = nil, nil
+		}
+		lBucket, err := leftHashTable.GetBucketByPN(bucketPair.l)
 		if err != nil {
-			return nil, nil, nil, cleanupCallback, err
+			return fail(err)
 		}
-		rBucket, err := rightHashTable.GetBucketByPN(rBucketPN)
+		rBucket, err := rightHashTable.GetBucketByPN(bucketPair.r)
 		if err != nil {
 			lBucket.GetPage().Put()
-			return nil, nil, nil, cleanupCallback, err
+			return fail(err)
 		}
 		group.Go(func() error {
-			return probeBuckets(ctx, resultsChan, lBucket, rBucket, joinOnLeftKey, joinOnRightKey)
+			if err := limitCtx.Err(); err != nil {
+				lBucket.GetPage().Put()
+				rBucket.GetPage().Put()
+				if limited(err) {
+					return nil
+				}
+				return err
+			}
+			emit, flush := newEmitter(limitCtx)
+			if options.limit > 0 {
+				emit = capped.wrap(emit)
+			}
+			err := probeBuckets(emit, lBucket, rBucket, lFilter, rFilter, condition, joinOnLeftKey, joinOnRightKey)
+			if err == nil {
+				err = flush()
+			}
+			if err == nil {
+				atomic.AddInt64(&bucketsProbed, 1)
+			}
+			if err != nil && limited(err) {
+				return nil
+			}
+			return err
 		})
 	}
-	return resultsChan, ctx, group, cleanupCallback, nil
+	return probeCtx, group, cleanupCallback, nil
+}
+
+// allBucketPairs pairs each distinct bucket on the left with each distinct bucket on the right.
+func allBucketPairs(leftBuckets []int64, rightBuckets []int64) []pair {
+	distinct := func(buckets []int64) []int64 {
+		seen := make(map[int64]bool)
+		pns := make([]int64, 0)
+		for _, pn := range buckets {
+			if !seen[pn] {
+				seen[pn] = true
+				pns = append(pns, pn)
+			}
+		}
+		return pns
+	}
+	pairs := make([]pair, 0)
+	for _, l := range distinct(leftBuckets) {
+		for _, r := range distinct(rightBuckets) {
+			pairs = append(pairs, pair{l: l, r: r})
+		}
+	}
+	return pairs
+}
+
+// Caps how many pairs the probes of a join emit between them.
+type joinLimit struct {
+	limit    int64
+	reserved int64  // Pairs the probes have started to emit, including any past the limit.
+	sent     int64  // Pairs emitted.
+	stop     func() // Stops the probes.
+}
+
+// wrap returns an emitter that emits through emit until the limit is reached, stopping the
+// probes once the last pair has been emitted.
+func (l *joinLimit) wrap(emit emitFunc) emitFunc {
+	return func(result EntryPair) error {
+		if atomic.AddInt64(&l.reserved, 1) > l.limit {
+			return errLimitReached
+		}
+		if err := emit(result); err != nil {
+			return err
+		}
+		if atomic.AddInt64(&l.sent, 1) == l.limit {
+			l.stop()
+		}
+		return nil
+	}
+}
+
+// reached checks whether a probe failed with err only because the limit was reached.
+func (l *joinLimit) reached(err error) bool {
+	return l.limit > 0 && atomic.LoadInt64(&l.reserved) >= l.limit &&
+		(err == errLimitReached || err == context.Canceled)
 }
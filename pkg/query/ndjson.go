@@ -0,0 +1,93 @@
+package query
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+)
+
+// Number of pairs written between flushes of a streamed export.
+const NDJSON_FLUSH_EVERY = 256
+
+// An entry of a join result, as exported to JSON.
+type JSONEntry struct {
+	Key   int64 `json:"key"`
+	Value int64 `json:"value"`
+}
+
+// A join result, as exported to JSON.
+type JSONPair struct {
+	Left  JSONEntry `json:"left"`
+	Right JSONEntry `json:"right"`
+}
+
+// StreamJoinNDJSON joins leftTable on rightTable and writes each matching pair to w as
+// newline-delimited JSON, one JSONPair object per line, flushing every NDJSON_FLUSH_EVERY
+// pairs. It stops early if ctx is cancelled or a write fails, and always waits for the join
+// to finish and cleans up after it.
+func StreamJoinNDJSON(
+	ctx context.Context,
+	w io.Writer,
+	leftTable db.Index,
+	rightTable db.Index,
+	joinOnLeftKey bool,
+	joinOnRightKey bool,
+) error {
+	// Stop the probes if a write fails.
+	ctx, cancelCtx := context.WithCancel(ctx)
+	defer cancelCtx()
+	resultsChan, _, group, cleanupCallback, err := Join(ctx, leftTable, rightTable, joinOnLeftKey, joinOnRightKey)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		return err
+	}
+	// Close the results once every bucket has been probed.
+	waitErr := make(chan error, 1)
+	go func() {
+		waitErr <- group.Wait()
+		close(resultsChan)
+	}()
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	var writeErr error
+	written := 0
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case pair, valid := <-resultsChan:
+			if !valid {
+				done = true
+				break
+			}
+			writeErr = encoder.Encode(JSONPair{
+				Left:  JSONEntry{Key: pair.l.GetKey(), Value: pair.l.GetValue()},
+				Right: JSONEntry{Key: pair.r.GetKey(), Value: pair.r.GetValue()},
+			})
+			if written++; writeErr == nil && written%NDJSON_FLUSH_EVERY == 0 {
+				writeErr = buffered.Flush()
+			}
+			if writeErr != nil {
+				cancelCtx()
+				done = true
+			}
+		}
+	}
+	// The probes stop on cancellation, so this won't block for long.
+	err = <-waitErr
+	if writeErr != nil {
+		return writeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return buffered.Flush()
+}
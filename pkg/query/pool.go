@@ -0,0 +1,98 @@
+package query
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+)
+
+// Maximum number of cleared temporary hash indices kept for reuse across joins; 0 disables pooling.
+var MAX_POOLED_INDICES = 8
+
+// A temporary hash index, along with the file backing it.
+type pooledIndex struct {
+	index  *hash.HashIndex
+	dbName string
+}
+
+// Pool of cleared temporary hash indices.
+var tempIndexPool struct {
+	mtx     sync.Mutex
+	indices []pooledIndex
+}
+
+// Number of temporary hash index files created so far.
+var tempIndicesCreated int64
+
+// TempIndicesCreated returns how many temporary hash index files have been created.
+func TempIndicesCreated() int64 {
+	return atomic.LoadInt64(&tempIndicesCreated)
+}
+
+// getTempIndex takes an empty temporary hash index from the pool, or creates a new one.
+func getTempIndex() (pooledIndex, error) {
+	tempIndexPool.mtx.Lock()
+	if n := len(tempIndexPool.indices); n > 0 {
+		temp := tempIndexPool.indices[n-1]
+		tempIndexPool.indices = tempIndexPool.indices[:n-1]
+		tempIndexPool.mtx.Unlock()
+		return temp, nil
+	}
+	tempIndexPool.mtx.Unlock()
+	// Get a temporary db file.
+	dbName, err := db.GetTempDB()
+	if err != nil {
+		return pooledIndex{}, err
+	}
+	atomic.AddInt64(&tempIndicesCreated, 1)
+	// Init the temporary hash table.
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		os.Remove(dbName)
+		return pooledIndex{}, err
+	}
+	return pooledIndex{index: index, dbName: dbName}, nil
+}
+
+// putTempIndex clears a temporary hash index and returns it to the pool,
+// or removes it if the pool is full.
+func putTempIndex(temp pooledIndex) {
+	temp.index.Close()
+	tempIndexPool.mtx.Lock()
+	defer tempIndexPool.mtx.Unlock()
+	if len(tempIndexPool.indices) >= MAX_POOLED_INDICES {
+		removeTempFiles(temp.dbName)
+		return
+	}
+	// Truncate the files rather than recreating them.
+	if os.Truncate(temp.dbName, 0) != nil || os.Truncate(temp.dbName+".meta", 0) != nil {
+		removeTempFiles(temp.dbName)
+		return
+	}
+	index, err := hash.OpenTable(temp.dbName)
+	if err != nil {
+		removeTempFiles(temp.dbName)
+		return
+	}
+	tempIndexPool.indices = append(tempIndexPool.indices, pooledIndex{index: index, dbName: temp.dbName})
+}
+
+// DrainPool closes and removes every pooled temporary hash index.
+func DrainPool() {
+	tempIndexPool.mtx.Lock()
+	defer tempIndexPool.mtx.Unlock()
+	for _, temp := range tempIndexPool.indices {
+		temp.index.Close()
+		removeTempFiles(temp.dbName)
+	}
+	tempIndexPool.indices = nil
+}
+
+// Remove a temporary hash index's files.
+func removeTempFiles(dbName string) {
+	os.Remove(dbName)
+	os.Remove(dbName + ".meta")
+}
@@ -2,6 +2,7 @@ package query
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -10,38 +11,59 @@ import (
 	repl "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/repl"
 )
 
+// Usage of the join command.
+const JOIN_USAGE = "usage: join <table1> <table2> [on key|value] [on key|value], or join <table1> <key/val for table1> on <table2> <key/val for table2>"
+
 // Query REPL.
 func QueryRepl(d *db.Database) *repl.REPL {
 	r := repl.NewRepl()
 	r.AddCommand("join", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleJoin(d, payload, replConfig.GetWriter())
-	}, "Create a table. usage: create table <table>")
+	}, "Join two tables, printing matching pairs by join key. "+JOIN_USAGE)
 	return r
 }
 
+// Parse a join command into the tables to join and which side of each to join on.
+func parseJoin(fields []string) (table1Name string, table2Name string, joinOnLeftKey bool, joinOnRightKey bool, err error) {
+	isColumn := func(s string) bool { return s == "key" || s == "val" || s == "value" }
+	// Usage: join <table1> <key/val for table1> on <table2> <key/val for table2>
+	if len(fields) == 6 && fields[3] == "on" {
+		if !isColumn(fields[2]) || !isColumn(fields[5]) {
+			return "", "", false, false, errors.New(JOIN_USAGE)
+		}
+		return fields[1], fields[4], fields[2] == "key", fields[5] == "key", nil
+	}
+	// Usage: join <table1> <table2> [on key|value] [on key|value]
+	if len(fields) < 3 || len(fields) > 7 || len(fields)%2 == 0 {
+		return "", "", false, false, errors.New(JOIN_USAGE)
+	}
+	onKey := []bool{true, true}
+	for i := 3; i < len(fields); i += 2 {
+		if fields[i] != "on" || !isColumn(fields[i+1]) {
+			return "", "", false, false, errors.New(JOIN_USAGE)
+		}
+		onKey[(i-3)/2] = fields[i+1] == "key"
+	}
+	return fields[1], fields[2], onKey[0], onKey[1], nil
+}
+
 // Handle join.
 func HandleJoin(d *db.Database, payload string, w io.Writer) (err error) {
-	fields := strings.Fields(payload)
-	numFields := len(fields)
-	// Usage: join <table1> <key/val for table1> on <table2> <key/val for table2>
-	if numFields != 6 || fields[3] != "on" || (fields[2] != "key" && fields[2] != "val") || (fields[5] != "key" && fields[5] != "val") {
-		return fmt.Errorf("usage: join <table1> <key/val for table1> on <table2> <key/val for table2>")
+	table1Name, table2Name, joinOnLeftKey, joinOnRightKey, err := parseJoin(strings.Fields(payload))
+	if err != nil {
+		return err
 	}
-	table1Name := fields[1]
 	table1, err := d.GetTable(table1Name)
 	if err != nil {
 		return fmt.Errorf("find error: %v", err)
 	}
-	table2Name := fields[4]
 	table2, err := d.GetTable(table2Name)
 	if err != nil {
 		return fmt.Errorf("find error: %v", err)
 	}
-	joinOnLeftKey := fields[2] == "key"
-	joinOnRightKey := fields[5] == "key"
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	defer cancelCtx()
-	resultsChan, _, group, cleanupCallback, err := Join(ctx, table1, table2, joinOnLeftKey, joinOnRightKey)
+	resultsChan, _, group, cleanupCallback, err := JoinWithOptions(ctx, table1, table2, joinOnLeftKey, joinOnRightKey, JoinOptions{Sorted: true})
 	if cleanupCallback != nil {
 		defer cleanupCallback()
 	}
@@ -0,0 +1,151 @@
+package recovery
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	concurrency "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/concurrency"
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+
+	uuid "github.com/google/uuid"
+)
+
+// Name of the file in a follower's folder that holds its applied LSN, see AppliedLSN. It isn't
+// alphanumeric, so it can't clash with a table.
+const APPLIED_LSN_FILE = ".applied_lsn"
+
+// Get the LSN of the primary's log through which ApplyLogStream has applied and flushed every
+// transaction to a follower database; 0 if it never applied any. Streams to the follower must
+// start at the record after it.
+func AppliedLSN(d *db.Database) (int64, error) {
+	data, err := ioutil.ReadFile(filepath.Join(d.GetBasePath(), APPLIED_LSN_FILE))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// Record the LSN through which a follower is applied.
+func writeAppliedLSN(d *db.Database, lsn int64) error {
+	path := filepath.Join(d.GetBasePath(), APPLIED_LSN_FILE)
+	if err := ioutil.WriteFile(path+".tmp", []byte(strconv.FormatInt(lsn, 10)), 0666); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// ApplyLogStream keeps a follower database in sync with a primary by applying the log records
+// read from r, e.g. as shipped by a LogSink, until r runs out. The stream must start at the
+// record after AppliedLSN. Each transaction is applied when its commit record arrives, as a
+// transaction of its own in tm so that readers locking through tm never see part of it; tm may
+// be nil if nothing does. The follower is flushed at each checkpoint record and when the stream
+// ends, and AppliedLSN advanced to just before the oldest transaction still uncommitted, so that
+// after an interruption the stream can resume from there; a record cut off by the interruption
+// is ignored. Like recovery, applying doesn't insist that the follower matches the log, so that
+// transactions applied before an interruption can be applied again.
+func ApplyLogStream(d *db.Database, tm *concurrency.TransactionManager, r io.Reader) (err error) {
+	lsn, err := AppliedLSN(d)
+	if err != nil {
+		return err
+	}
+	pending := make(map[uuid.UUID][]*editLog)
+	starts := make(map[uuid.UUID]int64) // LSN of the first record of each pending transaction.
+	save := func() error {
+		applied := lsn
+		for _, start := range starts {
+			if start-1 < applied {
+				applied = start - 1
+			}
+		}
+		if err := d.Flush(); err != nil {
+			return err
+		}
+		return writeAppliedLSN(d, applied)
+	}
+	defer func() {
+		if saveErr := save(); err == nil && saveErr != nil {
+			err = fmt.Errorf("apply log stream: %w", saveErr)
+		}
+	}()
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("apply log stream after LSN %d: %w", lsn, err)
+		}
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		log, err := FromString(line)
+		if err != nil {
+			return fmt.Errorf("apply LSN %d: %w", lsn+1, err)
+		}
+		lsn++
+		switch log := log.(type) {
+		case *tableLog:
+			if _, err := os.Stat(filepath.Join(d.GetBasePath(), log.tblName)); err == nil {
+				continue
+			}
+			if err := redo(d, log, false, ioutil.Discard); err != nil {
+				return fmt.Errorf("apply LSN %d: %w", lsn, err)
+			}
+		case *startLog:
+			starts[log.id] = lsn
+		case *editLog:
+			if _, found := starts[log.id]; !found {
+				starts[log.id] = lsn
+			}
+			pending[log.id] = append(pending[log.id], log)
+		case *commitLog:
+			err := applyCommitted(d, tm, log.id, pending[log.id])
+			delete(pending, log.id)
+			delete(starts, log.id)
+			if err != nil {
+				return fmt.Errorf("apply LSN %d: %w", lsn, err)
+			}
+		case *checkpointLog:
+			if err := save(); err != nil {
+				return fmt.Errorf("apply LSN %d: %w", lsn, err)
+			}
+		}
+	}
+}
+
+// Apply a committed transaction's edits to a follower, write-locking each key through tm if set.
+func applyCommitted(d *db.Database, tm *concurrency.TransactionManager, clientId uuid.UUID, edits []*editLog) error {
+	if len(edits) == 0 {
+		return nil
+	}
+	if tm != nil {
+		if err := tm.Begin(clientId); err != nil {
+			return err
+		}
+		defer tm.Commit(clientId)
+	}
+	for _, edit := range edits {
+		table, err := d.GetTable(edit.tablename)
+		if err != nil {
+			return err
+		}
+		if tm != nil {
+			if err := tm.Lock(clientId, table, edit.key, concurrency.W_LOCK); err != nil {
+				return err
+			}
+		}
+		// Fails only for a delete of a missing key, which an earlier application already made.
+		redo(d, edit, false, ioutil.Discard)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package recovery
+
+import (
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+
+	uuid "github.com/google/uuid"
+)
+
+// The log action for each kind of key-value API write, and the action that reverses it.
+var editActions = map[db.EditOp][2]Action{
+	db.INSERT_OP: {INSERT_ACTION, DELETE_ACTION},
+	db.UPDATE_OP: {UPDATE_ACTION, UPDATE_ACTION},
+	db.DELETE_OP: {DELETE_ACTION, INSERT_ACTION},
+}
+
+// Get an edit logger that logs each write made through a database's key-value API as a
+// transaction of its own; pass it to SetEditLogger.
+func (rm *RecoveryManager) EditLogger() db.EditLogger {
+	return func(table db.Index, op db.EditOp, key int64, oldval int64, newval int64, apply func() error) error {
+		clientId := uuid.New()
+		actions := editActions[op]
+		rm.Start(clientId)
+		rm.Edit(clientId, table, actions[0], key, oldval, newval)
+		err := apply()
+		if err != nil {
+			// The write didn't happen; log its reverse so that replaying the log is a no-op.
+			rm.Edit(clientId, table, actions[1], key, newval, oldval)
+			rm.popEdits(clientId, 2)
+		}
+		rm.Commit(clientId)
+		return err
+	}
+}
+
+// Logs each write a committing optimistic or MVCC transaction applies, before applying it, as
+// the transaction's edits are only logged once they are applied; see Edit. It is the transaction
+// manager's concurrency.ApplyLogger.
+func (rm *RecoveryManager) applyLogger(clientId uuid.UUID, table db.Index, op db.EditOp, key int64, oldval int64, newval int64, apply func() error) error {
+	actions := editActions[op]
+	rm.edit(clientId, table, actions[0], key, oldval, newval)
+	err := apply()
+	if err != nil {
+		// The write didn't happen; log its reverse so that replaying the log is a no-op.
+		rm.edit(clientId, table, actions[1], key, newval, oldval)
+	}
+	return err
+}
@@ -61,6 +61,7 @@ type editLog struct {
 	key       int64     // The key of the tuple that was edited
 	oldval    int64     // The old value before the edit
 	newval    int64     // The new value after the edit
+	lsn       int64     // The number of the record in the log, if written this run; see LastLSN
 }
 
 func (el *editLog) toString() string {
@@ -104,15 +105,25 @@ func (cl *checkpointLog) toString() string {
 // Regex pattern for a uuid
 const uuidPattern string = "[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}"
 
+// Patterns for each kind of log, matching a whole line.
+var (
+	tableExp      = regexp.MustCompile("^< create (\\w+) table (\\w+) >$")
+	editExp       = regexp.MustCompile(fmt.Sprintf("^< (%s), (\\w+), (UPDATE|INSERT|DELETE), (-?\\d+), (-?\\d+), (-?\\d+) >$", uuidPattern))
+	startExp      = regexp.MustCompile(fmt.Sprintf("^< (%s) start >$", uuidPattern))
+	commitExp     = regexp.MustCompile(fmt.Sprintf("^< (%s) commit >$", uuidPattern))
+	checkpointExp = regexp.MustCompile(fmt.Sprintf("^< (?:%s(?:, %s)* )?checkpoint >$", uuidPattern, uuidPattern))
+	uuidExp       = regexp.MustCompile(uuidPattern)
+)
+
+// Convert a log to its textual form, as written to the log file.
+func ToString(log Log) string {
+	return log.toString()
+}
+
 // Convert a textual log to its respective struct.
 // Returns an error if the string could not be parsed into a log.
 func FromString(s string) (Log, error) {
-	tableExp, _ := regexp.Compile(fmt.Sprintf("< create (?P<tblType>\\w+) table (?P<tblName>\\w+) >"))
-	editExp, _ := regexp.Compile(fmt.Sprintf("< (?P<uuid>%s), (?P<table>\\w+), (?P<action>UPDATE|INSERT|DELETE), (?P<key>\\d+), (?P<oldval>\\d+), (?P<newval>\\d+) >", uuidPattern))
-	startExp, _ := regexp.Compile(fmt.Sprintf("< (%s) start >", uuidPattern))
-	commitExp, _ := regexp.Compile(fmt.Sprintf("< (%s) commit >", uuidPattern))
-	checkpointExp, _ := regexp.Compile(fmt.Sprintf("< (%s,?\\s)*checkpoint >", uuidPattern))
-	uuidExp, _ := regexp.Compile(uuidPattern)
+	s = strings.TrimSuffix(s, "\n")
 	switch {
 	case tableExp.MatchString(s):
 		expStrs := tableExp.FindStringSubmatch(s)
@@ -125,16 +136,21 @@ func FromString(s string) (Log, error) {
 	case editExp.MatchString(s):
 		expStrs := editExp.FindStringSubmatch(s)
 		uuid := uuid.MustParse(expStrs[1])
-		key, _ := strconv.Atoi(expStrs[4])
-		oldval, _ := strconv.Atoi(expStrs[5])
-		newval, _ := strconv.Atoi(expStrs[6])
+		var vals [3]int64
+		for i := range vals {
+			val, err := strconv.ParseInt(expStrs[4+i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse log: %w", err)
+			}
+			vals[i] = val
+		}
 		return &editLog{
 			id:        uuid,
 			tablename: expStrs[2],
 			action:    Action(expStrs[3]),
-			key:       int64(key),
-			oldval:    int64(oldval),
-			newval:    int64(newval),
+			key:       vals[0],
+			oldval:    vals[1],
+			newval:    vals[2],
 		}, nil
 	case startExp.MatchString(s):
 		uuid := uuid.MustParse(uuidExp.FindString(s))
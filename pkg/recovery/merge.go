@@ -0,0 +1,42 @@
+package recovery
+
+import (
+	"sort"
+
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+)
+
+// Log type names for each index type, as written in Table logs.
+var tableLogTypes = map[db.IndexType]string{
+	db.BTreeIndexType: "btree",
+	db.HashIndexType:  "hash",
+}
+
+// Merge moves every table of other into the recovery manager's database (see db.Merge), logs a
+// Table record for each, then checkpoints, so that the recovery copy of the database has the
+// merged tables' data, which isn't in the log.
+func (rm *RecoveryManager) Merge(other *db.Database) error {
+	types, err := other.TableTypes()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// Hold the log while merging, so that no edit to a merged table is logged before its table.
+	rm.mtx.Lock()
+	if err = rm.d.Merge(other); err != nil {
+		rm.mtx.Unlock()
+		return err
+	}
+	for _, name := range names {
+		tl := tableLog{tblType: tableLogTypes[types[name]], tblName: name}
+		logError("log write failed", rm.writeToBuffer(tl.toString()))
+	}
+	logError("log sync failed", rm.syncLog())
+	rm.mtx.Unlock()
+	_, err = rm.Checkpoint()
+	return err
+}
@@ -0,0 +1,138 @@
+package recovery
+
+import (
+	"fmt"
+
+	concurrency "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/concurrency"
+	uuid "github.com/google/uuid"
+)
+
+// Where a nested transaction began: its edits are logged under, and kept on the stack of,
+// the top-level transaction root, from index mark on.
+type savepoint struct {
+	root   uuid.UUID
+	parent uuid.UUID
+	mark   int
+}
+
+// Begins a transaction nested in the given one, returning the child's id. The child's edits are
+// logged as the top-level transaction's, so a crash undoes them unless it commits; rolling the
+// child back undoes only the edits made since it began, and committing it keeps them for its parent.
+func (rm *RecoveryManager) BeginNested(parentId uuid.UUID) (uuid.UUID, error) {
+	childId, err := rm.tm.BeginNested(parentId)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	root := rm.rootOf(parentId)
+	if _, found := rm.txStack[root]; !found {
+		rm.tm.Abort(childId)
+		return uuid.Nil, fmt.Errorf("begin nested: %w", concurrency.ErrTxNotFound)
+	}
+	rm.nested[childId] = savepoint{root: root, parent: parentId, mark: len(rm.txStack[root])}
+	return childId, nil
+}
+
+// Get the top-level transaction the given one is nested in, or the transaction itself if it
+// isn't nested. Expects rm.mtx to be locked.
+func (rm *RecoveryManager) rootOf(clientId uuid.UUID) uuid.UUID {
+	if sp, found := rm.nested[clientId]; found {
+		return sp.root
+	}
+	return clientId
+}
+
+// Get the nested transaction running in the given one, if any.
+func (rm *RecoveryManager) nestedChild(clientId uuid.UUID) (uuid.UUID, bool) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	for childId, sp := range rm.nested {
+		if sp.parent == clientId {
+			return childId, true
+		}
+	}
+	return uuid.Nil, false
+}
+
+// Drop the last n edits from the transaction's stack. Edits of transactions that buffer their
+// writes were never logged; see Edit.
+func (rm *RecoveryManager) popEdits(clientId uuid.UUID, n int) {
+	if rm.tm != nil && rm.tm.IsBuffered(clientId) {
+		return
+	}
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	root := rm.rootOf(clientId)
+	stack := rm.txStack[root]
+	rm.txStack[root] = stack[:len(stack)-n]
+}
+
+// Undo the edits a nested transaction made, newest first, then abort it. The compensating
+// edits are logged, but dropped from the stack along with the undone ones.
+func (rm *RecoveryManager) rollbackNested(childId uuid.UUID) error {
+	rm.mtx.Lock()
+	sp := rm.nested[childId]
+	stack := rm.txStack[sp.root]
+	logs := make([]Log, len(stack)-sp.mark)
+	copy(logs, stack[sp.mark:])
+	rm.mtx.Unlock()
+	for i := len(logs) - 1; i >= 0; i-- {
+		if _, ok := logs[i].(*editLog); !ok {
+			continue
+		}
+		if err := rm.undoAs(logs[i], childId); err != nil {
+			return err
+		}
+	}
+	rm.mtx.Lock()
+	rm.txStack[sp.root] = rm.txStack[sp.root][:sp.mark]
+	delete(rm.nested, childId)
+	rm.mtx.Unlock()
+	return rm.tm.Abort(childId)
+}
+
+// Undo the transaction's edits logged after the record numbered targetLSN, newest first,
+// leaving earlier edits in place and the transaction running. Like rolling back a nested
+// transaction, the compensating edits are logged, but dropped from the stack along with the
+// undone ones. A nested transaction only undoes edits made since it began, and a transaction
+// with a nested transaction running can't undo.
+func (rm *RecoveryManager) UndoToLSN(clientId uuid.UUID, targetLSN int64) error {
+	if _, found := rm.nestedChild(clientId); found {
+		return fmt.Errorf("undo to lsn: %w", concurrency.ErrNestedTxRunning)
+	}
+	rm.mtx.Lock()
+	root := rm.rootOf(clientId)
+	stack, found := rm.txStack[root]
+	if !found {
+		rm.mtx.Unlock()
+		return fmt.Errorf("undo to lsn: %w", concurrency.ErrTxNotFound)
+	}
+	floor := 0
+	if sp, nested := rm.nested[clientId]; nested {
+		floor = sp.mark
+	}
+	// Find the oldest edit past the target; the stack starts with the transaction's start log.
+	mark := len(stack)
+	for mark > floor {
+		if el, ok := stack[mark-1].(*editLog); !ok || el.lsn <= targetLSN {
+			break
+		}
+		mark--
+	}
+	logs := make([]Log, len(stack)-mark)
+	copy(logs, stack[mark:])
+	rm.mtx.Unlock()
+	for i := len(logs) - 1; i >= 0; i-- {
+		if _, ok := logs[i].(*editLog); !ok {
+			continue
+		}
+		if err := rm.undoAs(logs[i], clientId); err != nil {
+			return err
+		}
+	}
+	rm.mtx.Lock()
+	rm.txStack[root] = rm.txStack[root][:mark]
+	rm.mtx.Unlock()
+	return nil
+}
@@ -1,64 +1,98 @@
 package recovery
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"os"
 
 	uuid "github.com/google/uuid"
 	backscanner "github.com/icza/backscanner"
 )
 
-// Helper method that gets all log strings and most recent checkpoint position from the log file.
+// Helper method that gets all log strings and most recent checkpoint position from the log segments.
 func (rm *RecoveryManager) getRelevantStrings() (
 	relevantStrings []string, checkpointPos int, err error) {
-	fstats, err := rm.fd.Stat()
+	rm.mtx.Lock()
+	err = rm.syncLog()
+	rm.mtx.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+	paths, err := rm.GetLogSegments()
 	if err != nil {
 		return nil, 0, err
 	}
-
-	scanner := backscanner.New(rm.fd, int(fstats.Size()))
 	checkpointTarget := []byte("checkpoint")
 	startTarget := []byte("start")
 	relevantStrings = make([]string, 0)
 	checkpointHit := false
 	txs := make(map[uuid.UUID]bool)
-	for {
-		line, _, err := scanner.LineBytes()
-		if err != nil {
-			if err == io.EOF {
-				return relevantStrings, 0, nil
-			} else {
-				return nil, 0, err
-			}
-		}
-		relevantStrings = append([]string{string(line)}, relevantStrings...)
-		checkpointPos += 1
-		if checkpointHit {
-			if bytes.Contains(line, startTarget) {
-				log, err := FromString(string(line))
-				if err != nil {
-					return nil, 0, err
-				}
-				id := log.(*startLog).id
-				delete(txs, id)
+	// Scan backwards through the segments, newest first.
+	for i := len(paths) - 1; i >= 0; i-- {
+		done, err := func() (bool, error) {
+			file, err := os.Open(paths[i])
+			if err != nil {
+				return false, err
 			}
-		}
-		if !checkpointHit && bytes.Contains(line, checkpointTarget) {
-			checkpointHit = true
-			log, err := FromString(string(line))
+			defer file.Close()
+			fstats, err := file.Stat()
 			if err != nil {
-				return nil, 0, err
+				return false, err
 			}
-			for _, tx := range log.(*checkpointLog).ids {
-				txs[tx] = true
+			scanner := backscanner.New(file, int(fstats.Size()))
+			for {
+				line, _, err := scanner.LineBytes()
+				if err != nil {
+					if err == io.EOF {
+						return false, nil
+					}
+					return false, err
+				}
+				if len(line) == 0 {
+					continue
+				}
+				relevantStrings = append([]string{string(line)}, relevantStrings...)
+				checkpointPos += 1
+				if checkpointHit {
+					if bytes.Contains(line, startTarget) {
+						log, err := FromString(string(line))
+						if err != nil {
+							return false, err
+						}
+						id := log.(*startLog).id
+						delete(txs, id)
+					}
+				}
+				if !checkpointHit && bytes.Contains(line, checkpointTarget) {
+					checkpointHit = true
+					log, err := FromString(string(line))
+					if err != nil {
+						return false, err
+					}
+					for _, tx := range log.(*checkpointLog).ids {
+						txs[tx] = true
+					}
+					checkpointPos = 0
+				}
+				if checkpointHit && len(txs) <= 0 {
+					return true, nil
+				}
 			}
-			checkpointPos = 0
+		}()
+		if err != nil {
+			return nil, 0, err
 		}
-		if checkpointHit && len(txs) <= 0 {
+		if done {
 			break
 		}
 	}
-	return relevantStrings, checkpointPos, err
+	if !checkpointHit {
+		checkpointPos = 0
+	}
+	return relevantStrings, checkpointPos, nil
 }
 
 // Reads in the logs and most recent checkpoint position from disk.
@@ -68,17 +102,73 @@ func (rm *RecoveryManager) readLogs() (
 	if err != nil {
 		return nil, 0, err
 	}
-	if len(strings) > 0 {
-		logs = make([]Log, len(strings)-1)
-		for i, s := range strings[:len(strings)-1] {
-			log, err := FromString(s)
-			if err != nil {
-				return nil, 0, err
-			}
-			logs[i] = log
+	logs = make([]Log, len(strings))
+	for i, s := range strings {
+		log, err := FromString(s)
+		if err != nil {
+			return nil, 0, err
 		}
-	} else {
-		logs = make([]Log, 0)
+		logs[i] = log
 	}
 	return logs, checkpointPos, nil
 }
+
+// Error returned when the records asked for have been deleted along with their log segment.
+var ErrLogTruncated = errors.New("log records have been truncated")
+
+// ReadLogsSince returns the records with an LSN greater than lsn, oldest first, e.g. for an
+// incremental backup to ship the records written since the last one; see LastLSN. The log is
+// synced first, and held until every segment has been read, so that none is rotated away midway.
+// Errors with ErrLogTruncated if some of the records were in segments a checkpoint has deleted.
+func (rm *RecoveryManager) ReadLogsSince(lsn int64) ([]Log, error) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	if err := rm.syncLog(); err != nil {
+		return nil, err
+	}
+	segments, err := listSegments(rm.logName)
+	if err != nil {
+		return nil, err
+	}
+	segments = append(segments, logSegment{path: rm.logName, firstRecord: rm.firstRecord})
+	if lsn+1 < segments[0].firstRecord {
+		return nil, fmt.Errorf("read logs since LSN %d: %w", lsn, ErrLogTruncated)
+	}
+	logs := make([]Log, 0)
+	for i, segment := range segments {
+		// Skip segments whose records all precede the ones asked for.
+		if i+1 < len(segments) && segments[i+1].firstRecord <= lsn+1 {
+			continue
+		}
+		if logs, err = readSegmentSince(segment, lsn, logs); err != nil {
+			return nil, err
+		}
+	}
+	return logs, nil
+}
+
+// Append the records of a segment with an LSN greater than lsn to logs.
+func readSegmentSince(segment logSegment, lsn int64, logs []Log) ([]Log, error) {
+	file, err := os.Open(segment.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	current := segment.firstRecord - 1
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(scanner.Text()) == 0 {
+			continue
+		}
+		current++
+		if current <= lsn {
+			continue
+		}
+		log, err := FromString(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("read LSN %d: %w", current, err)
+		}
+		logs = append(logs, log)
+	}
+	return logs, scanner.Err()
+}
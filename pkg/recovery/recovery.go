@@ -1,14 +1,19 @@
 package recovery
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 
 	concurrency "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/concurrency"
 	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 	"github.com/otiai10/copy"
 
 	uuid "github.com/google/uuid"
@@ -19,8 +24,33 @@ type RecoveryManager struct {
 	d       *db.Database
 	tm      *concurrency.TransactionManager
 	txStack map[uuid.UUID]([]Log)
+	nested  map[uuid.UUID]savepoint // Running nested transactions, by id.
 	fd      *os.File
+	writer  *bufio.Writer // Buffers records until the next sync boundary.
 	mtx     sync.Mutex
+
+	logName     string           // Path of the active log segment.
+	maxLogSize  int64            // Size past which the log is rotated; 0 disables rotation.
+	logSize     int64            // Size of the active log segment.
+	firstRecord int64            // Number of the first record in the active log segment.
+	numRecords  int64            // Number of records in the active log segment.
+	logWrites   int64            // Number of writes issued to the log file.
+	logSyncs    int64            // Number of times the log file was synced.
+	durability  pager.Durability // Whether sync boundaries fsync the log, see SetDurability.
+	strict      bool             // Whether redo and undo fail instead of falling back, see SetStrict.
+	sinks       []*SinkHandle    // Sinks that get a copy of every record, see AddSink.
+	generations int              // Number of numbered snapshots to keep, see SetSnapshotGenerations.
+	mode        RecoveryMode     // The algorithm Recover uses, see SetRecoveryMode.
+}
+
+// Counts the writes a recovery manager's buffer issues to its log file.
+type logFile struct {
+	rm *RecoveryManager
+}
+
+func (f logFile) Write(p []byte) (int, error) {
+	f.rm.logWrites++
+	return f.rm.fd.Write(p)
 }
 
 // Construct a recovery manager.
@@ -33,22 +63,123 @@ func NewRecoveryManager(
 	if err != nil {
 		return nil, err
 	}
-	return &RecoveryManager{
-		d:       d,
-		tm:      tm,
-		txStack: make(map[uuid.UUID][]Log),
-		fd:      fd,
-	}, nil
+	rm := &RecoveryManager{
+		d:           d,
+		tm:          tm,
+		txStack:     make(map[uuid.UUID][]Log),
+		nested:      make(map[uuid.UUID]savepoint),
+		fd:          fd,
+		logName:     logName,
+		firstRecord: 1,
+	}
+	rm.writer = bufio.NewWriter(logFile{rm: rm})
+	// Pick up record numbering where the rotated-out segments left off.
+	segments, err := listSegments(logName)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	if len(segments) > 0 {
+		last := segments[len(segments)-1]
+		count, err := countRecords(last.path)
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		rm.firstRecord = last.firstRecord + count
+	}
+	if rm.numRecords, err = countRecords(logName); err != nil {
+		fd.Close()
+		return nil, err
+	}
+	fstats, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	rm.logSize = fstats.Size()
+	if tm != nil {
+		tm.SetApplyLogger(rm.applyLogger)
+	}
+	return rm, nil
 }
 
-// Write the string `s` to the log file. Expects rm.mtx to be locked
+// Buffer the string `s` for the log file, rotating it if it has grown too large. The record
+// only reaches the disk at the next sync boundary, see syncLog. Expects rm.mtx to be locked
 func (rm *RecoveryManager) writeToBuffer(s string) error {
-	_, err := rm.fd.WriteString(s)
+	n, err := rm.writer.WriteString(s)
+	rm.logSize += int64(n)
 	if err != nil {
 		return err
 	}
-	err = rm.fd.Sync()
-	return err
+	rm.numRecords++
+	rm.sendToSinks(s)
+	if rm.maxLogSize > 0 && rm.logSize >= rm.maxLogSize {
+		return rm.rotate()
+	}
+	return nil
+}
+
+// Flush buffered records to the log file and sync it. Called at every sync boundary, i.e.
+// after table, commit and checkpoint records, so that a record is durable once its method
+// returns, along with every record before it. Expects rm.mtx to be locked
+func (rm *RecoveryManager) syncLog() error {
+	if err := rm.writer.Flush(); err != nil {
+		return err
+	}
+	if rm.durability == pager.NO_SYNC {
+		return nil
+	}
+	rm.logSyncs++
+	return rm.fd.Sync()
+}
+
+// Report an error writing the log from a method with no caller to return it to.
+func logError(msg string, err error) {
+	if err != nil {
+		utils.GetLogger().Error(msg, "err", err)
+	}
+}
+
+// Set whether sync boundaries force the log to stable storage. With pager.NO_SYNC, records
+// still reach the operating system at each boundary, so they survive the process crashing,
+// but a machine crash can lose them; see pager.NO_SYNC.
+func (rm *RecoveryManager) SetDurability(durability pager.Durability) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.durability = durability
+}
+
+// Set how many numbered generations of the checkpointed copy of the database to keep, so that
+// older checkpoints can be opened with db.OpenGeneration. Each checkpoint then copies the
+// database once more, and prunes the oldest generations past the limit. 0, the default, keeps
+// only the latest copy, in the recovery folder.
+func (rm *RecoveryManager) SetSnapshotGenerations(keep int) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.generations = keep
+}
+
+// Get the number of times the log file was synced.
+func (rm *RecoveryManager) LogSyncs() int64 {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	return rm.logSyncs
+}
+
+// Get the number of writes issued to the log file, which the buffer keeps below the number of records.
+func (rm *RecoveryManager) LogWrites() int64 {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	return rm.logWrites
+}
+
+// Get the log sequence number (LSN) of the last record written: records are numbered from 1,
+// continuing across log segments.
+func (rm *RecoveryManager) LastLSN() int64 {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	return rm.firstRecord + rm.numRecords - 1
 }
 
 // Write a Table log.
@@ -59,13 +190,25 @@ func (rm *RecoveryManager) Table(tblType string, tblName string) {
 		tblType: tblType,
 		tblName: tblName,
 	}
-	rm.writeToBuffer(tl.toString())
+	logError("log write failed", rm.writeToBuffer(tl.toString()))
+	logError("log sync failed", rm.syncLog())
 }
 
-// Write an Edit log.
+// Write an Edit log. Transactions that buffer their writes log nothing until they commit, when
+// each write is logged as it is applied; see applyLogger.
 func (rm *RecoveryManager) Edit(clientId uuid.UUID, table db.Index, action Action, key int64, oldval int64, newval int64) {
+	if rm.tm != nil && rm.tm.IsBuffered(clientId) {
+		return
+	}
+	rm.edit(clientId, table, action, key, oldval, newval)
+}
+
+// Write an Edit log, whether or not the transaction buffers its writes.
+func (rm *RecoveryManager) edit(clientId uuid.UUID, table db.Index, action Action, key int64, oldval int64, newval int64) {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
+	// A nested transaction's edits are logged as its top-level transaction's.
+	clientId = rm.rootOf(clientId)
 	el := editLog{
 		id:        clientId,
 		tablename: table.GetName(),
@@ -74,7 +217,8 @@ func (rm *RecoveryManager) Edit(clientId uuid.UUID, table db.Index, action Actio
 		oldval:    oldval,
 		newval:    newval,
 	}
-	rm.writeToBuffer(el.toString())
+	logError("log write failed", rm.writeToBuffer(el.toString()))
+	el.lsn = rm.firstRecord + rm.numRecords - 1
 	rm.txStack[clientId] = append(rm.txStack[clientId], &el)
 }
 
@@ -85,32 +229,48 @@ func (rm *RecoveryManager) Start(clientId uuid.UUID) {
 	sl := startLog{
 		id: clientId,
 	}
-	rm.writeToBuffer(sl.toString())
+	logError("log write failed", rm.writeToBuffer(sl.toString()))
 	rm.txStack[clientId] = make([]Log, 1)
 	rm.txStack[clientId] = append(rm.txStack[clientId], &sl)
 }
 
-// Write a transaction commit log.
+// Write a transaction commit log. Committing a nested transaction writes nothing, as its edits
+// become its parent's.
 func (rm *RecoveryManager) Commit(clientId uuid.UUID) {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
+	if _, found := rm.nested[clientId]; found {
+		delete(rm.nested, clientId)
+		return
+	}
 	cl := commitLog{
 		id: clientId,
 	}
-	rm.writeToBuffer(cl.toString())
+	logError("log write failed", rm.writeToBuffer(cl.toString()))
+	logError("log sync failed", rm.syncLog())
 	delete(rm.txStack, clientId)
 }
 
-// Flush all pages to disk and write a checkpoint log.
-func (rm *RecoveryManager) Checkpoint() {
+// Flush all pages to disk and write a checkpoint log. Returns the number of pages flushed.
+// If a table fails to flush, the checkpoint isn't durable, so it stops there without logging
+// the checkpoint or taking a snapshot, and returns the error. In REDO_ONLY mode, it fails with
+// ErrUncommittedCheckpoint while transactions are running.
+func (rm *RecoveryManager) Checkpoint() (flushed int, err error) {
 	rm.mtx.Lock()
 	defer rm.mtx.Unlock()
+	if rm.mode == REDO_ONLY && len(rm.txStack) > 0 {
+		return 0, ErrUncommittedCheckpoint
+	}
 	// flush all pages to disk
 	tables := rm.d.GetTables()
-	for _, table := range tables {
+	for name, table := range tables {
 		table.GetPager().LockAllUpdates()
-		table.GetPager().FlushAllPages()
+		n, err := table.GetPager().FlushAllPages()
 		table.GetPager().UnlockAllUpdates()
+		flushed += n
+		if err != nil {
+			return flushed, fmt.Errorf("checkpoint %s: %w", name, err)
+		}
 	}
 	// get keys of txStack
 	keys := make([]uuid.UUID, 0)
@@ -120,48 +280,106 @@ func (rm *RecoveryManager) Checkpoint() {
 	cl := checkpointLog{
 		ids: keys,
 	}
-	rm.writeToBuffer(cl.toString())
-	rm.Delta() // Sorta-semi-pseudo-copy-on-write (to ensure db recoverability)
+	checkpointSegment := rm.firstRecord
+	logError("log write failed", rm.writeToBuffer(cl.toString()))
+	logError("log sync failed", rm.syncLog())
+	// With no active transactions, recovery never reads past this checkpoint,
+	// so every segment before the one holding it can go.
+	if len(keys) == 0 {
+		rm.truncateBefore(checkpointSegment)
+	}
+	if err := rm.d.FlushMeta(); err != nil {
+		utils.GetLogger().Warn("checkpoint metadata flush failed", "err", err)
+	}
+	if err := rm.Delta(); err != nil { // Sorta-semi-pseudo-copy-on-write (to ensure db recoverability)
+		utils.GetLogger().Warn("checkpoint snapshot failed", "err", err)
+	}
+	return flushed, nil
+}
+
+// Set whether recovery is strict. By default, redo falls back to an update when a logged insert
+// finds its key present, and to an insert when a logged update finds it missing, and Recover
+// ignores actions that still can't be applied. In strict mode, an action that can't be applied
+// as logged is an error, which Recover returns, so that a log that disagrees with the data is
+// reported instead of papered over.
+func (rm *RecoveryManager) SetStrict(strict bool) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.strict = strict
+}
+
+// Check whether recovery is strict.
+func (rm *RecoveryManager) isStrict() bool {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	return rm.strict
 }
 
 // Redo a given log's action.
 func (rm *RecoveryManager) Redo(log Log) error {
+	return redo(rm.d, log, rm.isStrict(), os.Stdout)
+}
+
+// Returned when redoing a table's creation finds a table of another type by that name. Recover
+// fails with it even when not strict, since every later edit to the table would go astray.
+var ErrTableTypeMismatch = errors.New("table exists with a different type")
+
+// Redo a log's action on a database, reporting created tables to w. See SetStrict for strict.
+// Creating a table that already exists with the logged type, e.g. when redoing past the
+// checkpoint that created it, succeeds without doing anything.
+func redo(d *db.Database, log Log, strict bool, w io.Writer) error {
 	switch log := log.(type) {
 	case *tableLog:
+		types, err := d.TableTypes()
+		if err != nil {
+			return fmt.Errorf("redo create of table %s: %w", log.tblName, err)
+		}
+		if existing, found := types[log.tblName]; found {
+			if tableLogTypes[existing] != log.tblType {
+				return fmt.Errorf("redo create of %s table %s: %w (%s)", log.tblType, log.tblName, ErrTableTypeMismatch, tableLogTypes[existing])
+			}
+			return nil
+		}
 		payload := fmt.Sprintf("create %s table %s", log.tblType, log.tblName)
-		err := db.HandleCreateTable(rm.d, payload, os.Stdout)
+		err = db.HandleCreateTable(d, payload, w)
 		if err != nil {
-			return err
+			return fmt.Errorf("redo create of table %s: %w", log.tblName, err)
 		}
 	case *editLog:
 		switch log.action {
 		case INSERT_ACTION:
 			payload := fmt.Sprintf("insert %v %v into %s", log.key, log.newval, log.tablename)
-			err := db.HandleInsert(rm.d, payload)
+			err := db.HandleInsert(d, payload)
+			if err != nil && strict {
+				return fmt.Errorf("redo insert of key %d into %s: %w", log.key, log.tablename, err)
+			}
 			if err != nil {
 				// There is already an entry, try updating
 				payload := fmt.Sprintf("update %s %v %v", log.tablename, log.key, log.newval)
-				err = db.HandleUpdate(rm.d, payload)
+				err = db.HandleUpdate(d, payload)
 				if err != nil {
 					return err
 				}
 			}
 		case UPDATE_ACTION:
 			payload := fmt.Sprintf("update %s %v %v", log.tablename, log.key, log.newval)
-			err := db.HandleUpdate(rm.d, payload)
+			err := db.HandleUpdate(d, payload)
+			if err != nil && strict {
+				return fmt.Errorf("redo update of key %d in %s: %w", log.key, log.tablename, err)
+			}
 			if err != nil {
 				// Entry may have been deleted, try inserting
 				payload := fmt.Sprintf("insert %v %v into %s", log.key, log.newval, log.tablename)
-				err := db.HandleInsert(rm.d, payload)
+				err := db.HandleInsert(d, payload)
 				if err != nil {
 					return err
 				}
 			}
 		case DELETE_ACTION:
 			payload := fmt.Sprintf("delete %v from %s", log.key, log.tablename)
-			err := db.HandleDelete(rm.d, payload)
+			err := db.HandleDelete(d, payload)
 			if err != nil {
-				return err
+				return fmt.Errorf("redo delete of key %d from %s: %w", log.key, log.tablename, err)
 			}
 		}
 	default:
@@ -172,24 +390,32 @@ func (rm *RecoveryManager) Redo(log Log) error {
 
 // Undo a given log's action.
 func (rm *RecoveryManager) Undo(log Log) error {
+	if log, ok := log.(*editLog); ok {
+		return rm.undoAs(log, log.id)
+	}
+	return rm.undoAs(log, uuid.Nil)
+}
+
+// Undo a given log's action on behalf of the given transaction.
+func (rm *RecoveryManager) undoAs(log Log, clientId uuid.UUID) error {
 	switch log := log.(type) {
 	case *editLog:
 		switch log.action {
 		case INSERT_ACTION:
 			payload := fmt.Sprintf("delete %v from %s", log.key, log.tablename)
-			err := HandleDelete(rm.d, rm.tm, rm, payload, log.id)
+			err := HandleDelete(rm.d, rm.tm, rm, payload, clientId)
 			if err != nil {
 				return err
 			}
 		case UPDATE_ACTION:
 			payload := fmt.Sprintf("update %s %v %v", log.tablename, log.key, log.oldval)
-			err := HandleUpdate(rm.d, rm.tm, rm, payload, log.id)
+			err := HandleUpdate(rm.d, rm.tm, rm, payload, clientId)
 			if err != nil {
 				return err
 			}
 		case DELETE_ACTION:
 			payload := fmt.Sprintf("insert %v %v into %s", log.key, log.oldval, log.tablename)
-			err := HandleInsert(rm.d, rm.tm, rm, payload, log.id)
+			err := HandleInsert(rm.d, rm.tm, rm, payload, clientId)
 			if err != nil {
 				return err
 			}
@@ -206,15 +432,24 @@ func (rm *RecoveryManager) Undo(log Log) error {
 // 2. Redo all actions from the most recent checkpoint to the end of the log, keep track of active transactions.
 // 3. Undo all actions that belongs to active transactions.
 // 4. Commit the active transactions.
+// In REDO_ONLY mode, only the actions of committed transactions are redone, and nothing is
+// undone; see SetRecoveryMode.
 func (rm *RecoveryManager) Recover() error {
 	// read in logs
 	logs, checkpointPos, err := rm.readLogs()
 	if err != nil {
 		return err
 	}
+	strict := rm.isStrict()
 	// find the most recent checkpoint
 	activeTxs := make(map[uuid.UUID]bool)
 	// check if the log at checkpointPos is a checkpoint
+	if len(logs) == 0 {
+		return nil
+	}
+	if rm.getRecoveryMode() == REDO_ONLY {
+		return rm.recoverRedoOnly(logs, checkpointPos, strict)
+	}
 	if _, ok := logs[checkpointPos].(*checkpointLog); ok {
 		// store all active transactions to activeTxs
 		for _, id := range logs[checkpointPos].(*checkpointLog).ids {
@@ -242,10 +477,10 @@ func (rm *RecoveryManager) Recover() error {
 	for i := checkpointPos; i < len(logs); i++ {
 		//rm.Redo(logs[i])
 		switch log := logs[i].(type) {
-		case *tableLog:
-			rm.Redo(log)
-		case *editLog:
-			rm.Redo(log)
+		case *tableLog, *editLog:
+			if err := rm.Redo(log); err != nil && (strict || errors.Is(err, ErrTableTypeMismatch)) {
+				return fmt.Errorf("recover: %w", err)
+			}
 		case *startLog:
 			rm.tm.Begin(log.id)
 			activeTxs[log.id] = true
@@ -261,7 +496,9 @@ func (rm *RecoveryManager) Recover() error {
 		case *editLog:
 			// check if log belongs to an active transaction
 			if _, ok := activeTxs[log.id]; ok {
-				rm.Undo(logs[i])
+				if err := rm.Undo(logs[i]); err != nil && strict {
+					return fmt.Errorf("recover: undo of key %d in %s: %w", log.key, log.tablename, err)
+				}
 			}
 		case *startLog:
 			// check if log belongs to an active transaction
@@ -274,11 +511,22 @@ func (rm *RecoveryManager) Recover() error {
 	return nil
 }
 
-// Roll back a particular transaction.
+// Roll back a particular transaction, along with any transaction nested in it.
 func (rm *RecoveryManager) Rollback(clientId uuid.UUID) error {
+	if child, found := rm.nestedChild(clientId); found {
+		if err := rm.Rollback(child); err != nil {
+			return err
+		}
+	}
+	rm.mtx.Lock()
+	_, nested := rm.nested[clientId]
+	rm.mtx.Unlock()
+	if nested {
+		return rm.rollbackNested(clientId)
+	}
 	logs, found := rm.txStack[clientId]
 	if !found {
-		return errors.New("transaction not found")
+		return fmt.Errorf("rollback: %w", concurrency.ErrTxNotFound)
 	}
 	// Check if the first entry of the log is a start log
 	for i := len(logs) - 1; i >= 1; i-- {
@@ -294,10 +542,23 @@ func (rm *RecoveryManager) Rollback(clientId uuid.UUID) error {
 	}
 	// Commit to both the RecoveryManager and TransactionManager when Rollback ends so that both the logs and system know that this transaction has ended
 	rm.Commit(clientId)
-	rm.tm.Commit(clientId)
+	rm.tm.Abort(clientId)
 	return nil
 }
 
+// Returns a REPL disconnect handler that rolls back the client's running transaction, releasing its locks.
+func (rm *RecoveryManager) AbortOnDisconnect() func(uuid.UUID) {
+	return func(clientId uuid.UUID) {
+		if _, found := rm.tm.GetTransaction(clientId); !found {
+			return
+		}
+		if err := rm.Rollback(clientId); err != nil {
+			// Nothing was logged for this transaction; just release its locks.
+			rm.tm.Abort(clientId)
+		}
+	}
+}
+
 // Primes the database for recovery
 func Prime(folder string) (*db.Database, error) {
 	// Ensure folder is of the form */
@@ -328,12 +589,89 @@ func Prime(folder string) (*db.Database, error) {
 	return db.Open(dbFolder)
 }
 
-// Should be called at end of Checkpoint.
+// Should be called at end of Checkpoint. Also keeps the copy as the next numbered generation,
+// if enabled with SetSnapshotGenerations. Expects rm.mtx to be locked.
 func (rm *RecoveryManager) Delta() error {
 	folder := strings.TrimSuffix(rm.d.GetBasePath(), "/")
 	recoveryFolder := folder + "-recovery/"
 	folder += "/"
 	os.RemoveAll(recoveryFolder)
 	err := copy.Copy(folder, recoveryFolder)
-	return err
+	if err != nil || rm.generations <= 0 {
+		return err
+	}
+	return saveGeneration(folder, recoveryFolder, rm.generations)
+}
+
+// Copy the recovery folder into the next numbered generation, pruning all but the newest keep.
+func saveGeneration(base string, recoveryFolder string, keep int) error {
+	gens, err := db.Generations(base)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(gens) > 0 {
+		next = gens[len(gens)-1] + 1
+	}
+	if err = copy.Copy(recoveryFolder, db.GenerationFolder(base, next)); err != nil {
+		return err
+	}
+	gens = append(gens, next)
+	for len(gens) > keep {
+		if err = os.RemoveAll(db.GenerationFolder(base, gens[0])); err != nil {
+			return err
+		}
+		gens = gens[1:]
+	}
+	return nil
+}
+
+// Rebuild the recovery snapshot from the live database, replacing whatever is in the recovery
+// folder, e.g. after it was damaged or went stale. Holds off writers, and the log, until the
+// new snapshot is in place. Returns the number of bytes copied.
+func (rm *RecoveryManager) RebuildSnapshot() (int64, error) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	tables := rm.d.GetTables()
+	for _, table := range tables {
+		table.GetPager().LockAllUpdates()
+		defer table.GetPager().UnlockAllUpdates()
+		if _, err := table.GetPager().FlushAllPages(); err != nil {
+			return 0, err
+		}
+	}
+	if err := rm.d.FlushMeta(); err != nil {
+		return 0, err
+	}
+	if err := rm.syncLog(); err != nil {
+		return 0, err
+	}
+	// Copy next to the snapshot first, so that a failed copy leaves the old one in place.
+	base := strings.TrimSuffix(rm.d.GetBasePath(), "/")
+	recoveryFolder := base + "-recovery"
+	tmpFolder := recoveryFolder + ".tmp"
+	os.RemoveAll(tmpFolder)
+	if err := copy.Copy(base+"/", tmpFolder+"/"); err != nil {
+		os.RemoveAll(tmpFolder)
+		return 0, err
+	}
+	var copied int64
+	err := filepath.Walk(tmpFolder, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			copied += info.Size()
+		}
+		return err
+	})
+	if err != nil {
+		os.RemoveAll(tmpFolder)
+		return 0, err
+	}
+	if err = os.RemoveAll(recoveryFolder); err != nil {
+		os.RemoveAll(tmpFolder)
+		return 0, err
+	}
+	if err = os.Rename(tmpFolder, recoveryFolder); err != nil {
+		return 0, err
+	}
+	return copied, nil
 }
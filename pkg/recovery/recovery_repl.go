@@ -30,30 +30,39 @@ func RecoveryREPL(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	r.AddCommand("update", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleUpdate(d, tm, rm, payload, replConfig.GetAddr())
 	}, "Update en element. usage: update <table> <key> <value>")
+	r.AddCommand("upsert", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleUpsert(d, tm, rm, payload, replConfig.GetAddr())
+	}, "Insert an element, or update it if it exists. usage: upsert <key> <value> into <table>")
 	r.AddCommand("delete", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleDelete(d, tm, rm, payload, replConfig.GetAddr())
 	}, "Delete an element. usage: delete <key> from <table>")
 	r.AddCommand("select", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleSelect(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Select elements from a table. usage: select from <table>")
+	}, "Select elements from a table. usage: select from <table> [between <lo> <hi>]")
 	r.AddCommand("join", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleJoin(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Joins two tables together on either their keys or values. usage: join <table1> <key/val for table1> on <table2> <key/val for table2>")
 	r.AddCommand("transaction", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleTransaction(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
-	}, "Handle transactions. usage: transaction <begin|commit>")
+	}, "Handle transactions. usage: transaction <begin|commit|locks <uuid>>")
 	r.AddCommand("lock", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleLock(d, tm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Grabs a write lock on a resource. usage: lock <table> <key>")
 	r.AddCommand("checkpoint", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCheckpoint(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Saves a checkpoint of the current database state and running transactions. usage: checkpoint")
+	r.AddCommand("rebuild_snapshot", func(payload string, replConfig *repl.REPLConfig) error {
+		return HandleRebuildSnapshot(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
+	}, "Recreate the recovery snapshot from the live database. usage: rebuild_snapshot")
 	r.AddCommand("abort", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleAbort(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Simulate an abort of the current transaction. usage: abort")
 	r.AddCommand("crash", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandleCrash(d, tm, rm, payload, replConfig.GetWriter(), replConfig.GetAddr())
 	}, "Crash the database. usage: crash")
+	r.AddCommand("metrics", func(payload string, replConfig *repl.REPLConfig) error {
+		return concurrency.HandleMetrics(tm, payload, replConfig.GetWriter())
+	}, "Print transaction counters. usage: metrics")
 	r.AddCommand("pretty", func(payload string, replConfig *repl.REPLConfig) error {
 		return HandlePretty(d, payload, replConfig.GetWriter())
 	}, "Print out the internal data representation. usage: pretty")
@@ -64,15 +73,21 @@ func RecoveryREPL(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 func HandleTransaction(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
 	numFields := len(fields)
-	// Usage: transaction <begin|commit>
+	// Usage: transaction <begin|commit> or transaction locks <uuid>
+	if numFields == 3 && fields[1] == "locks" {
+		return concurrency.HandleTransactionLocks(tm, fields[2], w)
+	}
 	if numFields != 2 || (fields[1] != "begin" && fields[1] != "commit") {
-		return errors.New("usage: transaction <begin|commit>")
+		return errors.New("usage: transaction <begin|commit|locks <uuid>>")
 	}
 	switch fields[1] {
 	case "begin":
 		rm.Start(clientId)
 		err = tm.Begin(clientId)
 	case "commit":
+		if tm.IsBuffered(clientId) {
+			return commitBuffered(tm, rm, clientId)
+		}
 		rm.Commit(clientId)
 		err = tm.Commit(clientId)
 	default:
@@ -87,6 +102,22 @@ func HandleTransaction(d *db.Database, tm *concurrency.TransactionManager, rm *R
 	return err
 }
 
+// Commit a transaction that buffers its writes. It is validated and its writes applied, and
+// logged, first, so that it only gets a commit record if they were. One that fails validation is
+// aborted with nothing applied, so it is ended in the log with nothing to undo.
+func commitBuffered(tm *concurrency.TransactionManager, rm *RecoveryManager, clientId uuid.UUID) error {
+	err := tm.Commit(clientId)
+	if _, running := tm.GetTransaction(clientId); running {
+		// A nested transaction is still running; roll both back as usual.
+		if rberr := rm.Rollback(clientId); rberr != nil {
+			return rberr
+		}
+		return err
+	}
+	rm.Commit(clientId)
+	return err
+}
+
 // Handle create table.
 func HandleCreateTable(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
@@ -137,8 +168,7 @@ func HandleInsert(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 		rm.Edit(clientId, table, DELETE_ACTION, int64(key), int64(newval), int64(0))
 		// Then pop the last two actions from the transaction stack because
 		// these last two actions were no-ops.
-		stack := rm.txStack[clientId]
-		rm.txStack[clientId] = stack[:len(stack)-2]
+		rm.popEdits(clientId, 2)
 		rberr := rm.Rollback(clientId)
 		if rberr != nil {
 			return rberr
@@ -180,8 +210,7 @@ func HandleUpdate(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 		rm.Edit(clientId, table, UPDATE_ACTION, int64(key), int64(newval), oldval.GetValue())
 		// Then pop the last two actions from the transaction stack because
 		// these last two actions were no-ops.
-		stack := rm.txStack[clientId]
-		rm.txStack[clientId] = stack[:len(stack)-2]
+		rm.popEdits(clientId, 2)
 		rberr := rm.Rollback(clientId)
 		if rberr != nil {
 			return rberr
@@ -190,6 +219,43 @@ func HandleUpdate(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 	return err
 }
 
+// Handle upsert.
+func HandleUpsert(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, clientId uuid.UUID) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: upsert <key> <value> into <table>
+	var key, newval int
+	var table db.Index
+	if numFields != 5 || fields[3] != "into" {
+		return fmt.Errorf("usage: upsert <key> <value> into <table>")
+	}
+	if key, err = strconv.Atoi(fields[1]); err != nil {
+		return fmt.Errorf("upsert error: %v", err)
+	}
+	if newval, err = strconv.Atoi(fields[2]); err != nil {
+		return fmt.Errorf("upsert error: %v", err)
+	}
+	if table, err = d.GetTable(fields[4]); err != nil {
+		return fmt.Errorf("upsert error: %v", err)
+	}
+	// Upsert in one traversal, then log whichever edit it turned out to be. The key stays
+	// write-locked, and the log is only synced at commit, so logging after is just as safe.
+	oldval, existed, err := concurrency.UpsertEntry(tm, table, int64(key), int64(newval), clientId)
+	if err != nil {
+		rberr := rm.Rollback(clientId)
+		if rberr != nil {
+			return rberr
+		}
+		return fmt.Errorf("upsert error: %w", err)
+	}
+	if existed {
+		rm.Edit(clientId, table, UPDATE_ACTION, int64(key), oldval, int64(newval))
+	} else {
+		rm.Edit(clientId, table, INSERT_ACTION, int64(key), 0, int64(newval))
+	}
+	return nil
+}
+
 // Handle delete.
 func HandleDelete(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, clientId uuid.UUID) (err error) {
 	fields := strings.Fields(payload)
@@ -220,8 +286,7 @@ func HandleDelete(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 		rm.Edit(clientId, table, INSERT_ACTION, int64(key), 0, oldval.GetValue())
 		// Then pop the last two actions from the transaction stack because
 		// these last two actions were no-ops.
-		stack := rm.txStack[clientId]
-		rm.txStack[clientId] = stack[:len(stack)-2]
+		rm.popEdits(clientId, 2)
 		rberr := rm.Rollback(clientId)
 		if rberr != nil {
 			return rberr
@@ -232,15 +297,7 @@ func HandleDelete(d *db.Database, tm *concurrency.TransactionManager, rm *Recove
 
 // Handle select.
 func HandleSelect(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
-	fields := strings.Fields(payload)
-	numFields := len(fields)
-	// Usage: select from <table>
-	if numFields != 3 || fields[1] != "from" {
-		return fmt.Errorf("usage: select from <table>")
-	}
-	// NOTE: Select is unsafe; not locking anything. May provide an inconsistent view of the database.
-	err = db.HandleSelect(d, payload, w)
-	return err
+	return concurrency.HandleSelect(d, tm, payload, w, clientId)
 }
 
 // Handle join.
@@ -269,9 +326,29 @@ func HandleCheckpoint(d *db.Database, tm *concurrency.TransactionManager, rm *Re
 	if numFields != 1 {
 		return fmt.Errorf("usage: checkpoint")
 	}
-	// Get the transaction, run the find, release lock and rollback if error.
-	rm.Checkpoint()
-	return err
+	// Flush and log the checkpoint.
+	flushed, err := rm.Checkpoint()
+	if err != nil {
+		return err
+	}
+	io.WriteString(w, fmt.Sprintf("checkpoint created; %d pages flushed.\n", flushed))
+	return nil
+}
+
+// Handle rebuild_snapshot.
+func HandleRebuildSnapshot(d *db.Database, tm *concurrency.TransactionManager, rm *RecoveryManager, payload string, w io.Writer, clientId uuid.UUID) (err error) {
+	fields := strings.Fields(payload)
+	numFields := len(fields)
+	// Usage: rebuild_snapshot
+	if numFields != 1 {
+		return fmt.Errorf("usage: rebuild_snapshot")
+	}
+	copied, err := rm.RebuildSnapshot()
+	if err != nil {
+		return err
+	}
+	io.WriteString(w, fmt.Sprintf("snapshot rebuilt; %d bytes copied.\n", copied))
+	return nil
 }
 
 // Handle abort.
@@ -0,0 +1,70 @@
+package recovery
+
+import (
+	"errors"
+	"fmt"
+
+	uuid "github.com/google/uuid"
+)
+
+// The algorithm Recover uses.
+type RecoveryMode int
+
+const (
+	// Redo every logged action since the last checkpoint, then undo those of transactions that
+	// never committed. Checkpoints may snapshot uncommitted changes.
+	REDO_UNDO RecoveryMode = iota
+	// Redo only the actions of transactions that committed, and never undo. Relies on the
+	// snapshot recovery starts from holding no uncommitted changes, so checkpoints fail with
+	// ErrUncommittedCheckpoint while transactions are running.
+	REDO_ONLY
+)
+
+// Returned by Checkpoint in REDO_ONLY mode while transactions are running, as the snapshot would
+// hold their uncommitted changes.
+var ErrUncommittedCheckpoint = errors.New("can't checkpoint uncommitted changes without undo")
+
+// Set the algorithm Recover uses; REDO_UNDO by default. Use the mode the log was written in.
+func (rm *RecoveryManager) SetRecoveryMode(mode RecoveryMode) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.mode = mode
+}
+
+// Get the algorithm Recover uses.
+func (rm *RecoveryManager) getRecoveryMode() RecoveryMode {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	return rm.mode
+}
+
+// Recover by redoing the actions of the transactions that committed since the checkpoint at
+// checkpointPos. Transactions that didn't commit are left as they were: never applied, and
+// without a commit record, so that recovering again skips them as well.
+func (rm *RecoveryManager) recoverRedoOnly(logs []Log, checkpointPos int, strict bool) error {
+	if cl, ok := logs[checkpointPos].(*checkpointLog); ok && len(cl.ids) > 0 {
+		return fmt.Errorf("recover: %w", ErrUncommittedCheckpoint)
+	}
+	committed := make(map[uuid.UUID]bool)
+	for _, log := range logs[checkpointPos:] {
+		if log, ok := log.(*commitLog); ok {
+			committed[log.id] = true
+		}
+	}
+	for _, log := range logs[checkpointPos:] {
+		switch log := log.(type) {
+		case *tableLog:
+			if err := rm.Redo(log); err != nil && (strict || errors.Is(err, ErrTableTypeMismatch)) {
+				return fmt.Errorf("recover: %w", err)
+			}
+		case *editLog:
+			if !committed[log.id] {
+				continue
+			}
+			if err := rm.Redo(log); err != nil && strict {
+				return fmt.Errorf("recover: %w", err)
+			}
+		}
+	}
+	return nil
+}
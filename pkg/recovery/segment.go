@@ -0,0 +1,118 @@
+package recovery
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A rotated-out log segment, named <logName>.<number of its first record>.
+type logSegment struct {
+	path        string
+	firstRecord int64
+}
+
+// List the rotated-out segments of the given log, oldest first.
+func listSegments(logName string) ([]logSegment, error) {
+	matches, err := filepath.Glob(logName + ".*")
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]logSegment, 0, len(matches))
+	for _, match := range matches {
+		firstRecord, err := strconv.ParseInt(strings.TrimPrefix(match, logName+"."), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, logSegment{path: match, firstRecord: firstRecord})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].firstRecord < segments[j].firstRecord
+	})
+	return segments, nil
+}
+
+// Count the records in a log file.
+func countRecords(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	count := int64(0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if len(scanner.Text()) > 0 {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+// Set the size in bytes past which the log is rotated into a new segment; 0 disables rotation.
+func (rm *RecoveryManager) SetMaxLogSize(size int64) {
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.maxLogSize = size
+}
+
+// Get the paths of all log segments, oldest first; the active log is always last.
+func (rm *RecoveryManager) GetLogSegments() ([]string, error) {
+	segments, err := listSegments(rm.logName)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(segments)+1)
+	for _, segment := range segments {
+		paths = append(paths, segment.path)
+	}
+	return append(paths, rm.logName), nil
+}
+
+// Close the active log, move it aside as a numbered segment, and start a new one.
+// Expects rm.mtx to be locked.
+func (rm *RecoveryManager) rotate() error {
+	err := rm.syncLog()
+	if err != nil {
+		return err
+	}
+	err = rm.fd.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(rm.logName, fmt.Sprintf("%s.%d", rm.logName, rm.firstRecord))
+	if err != nil {
+		return err
+	}
+	rm.fd, err = os.OpenFile(rm.logName, os.O_APPEND|os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	rm.firstRecord += rm.numRecords
+	rm.numRecords = 0
+	rm.logSize = 0
+	return nil
+}
+
+// Delete every rotated-out segment that precedes the one starting at firstRecord.
+// Expects rm.mtx to be locked.
+func (rm *RecoveryManager) truncateBefore(firstRecord int64) error {
+	segments, err := listSegments(rm.logName)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if segment.firstRecord >= firstRecord {
+			break
+		}
+		err = os.Remove(segment.path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package recovery
+
+import (
+	"errors"
+	"sync"
+)
+
+// Number of records queued for a sink that hasn't written them yet, past which its policy applies.
+const SINK_BUFFER_SIZE = 1024
+
+// ErrSinkFull is a sink's error once it fell SINK_BUFFER_SIZE records behind under SINK_FAIL.
+var ErrSinkFull = errors.New("log sink fell too far behind")
+
+// LogSink receives a copy of every record written to the log, e.g. to stream it to a standby.
+type LogSink interface {
+	// Write receives one serialized record, newline included. Records arrive in log order, one
+	// call at a time, possibly before they are synced to the local log.
+	Write(record []byte) error
+}
+
+// Decides what happens to a sink that can't keep up with the log.
+type SinkPolicy int
+
+const (
+	// Drop records the sink has no room for, or fails to write, and keep sending it later ones.
+	SINK_DROP SinkPolicy = 0
+	// Stop sending records to the sink at the first one it has no room for or fails to write;
+	// its Err says why.
+	SINK_FAIL SinkPolicy = 1
+)
+
+// A sink registered with a recovery manager. Records are queued for it and written from a
+// goroutine of its own, so a slow sink never blocks the log.
+type SinkHandle struct {
+	sink    LogSink
+	policy  SinkPolicy
+	records chan []byte
+	done    chan struct{}
+	mtx     sync.Mutex
+	dropped int64
+	err     error
+}
+
+// Add a sink that gets every record written to the log from now on, until RemoveSink.
+func (rm *RecoveryManager) AddSink(sink LogSink, policy SinkPolicy) *SinkHandle {
+	h := &SinkHandle{
+		sink:    sink,
+		policy:  policy,
+		records: make(chan []byte, SINK_BUFFER_SIZE),
+		done:    make(chan struct{}),
+	}
+	go h.run()
+	rm.mtx.Lock()
+	defer rm.mtx.Unlock()
+	rm.sinks = append(rm.sinks, h)
+	return h
+}
+
+// Remove a sink, returning once it has written the records queued for it.
+func (rm *RecoveryManager) RemoveSink(h *SinkHandle) {
+	rm.mtx.Lock()
+	for i, other := range rm.sinks {
+		if other == h {
+			rm.sinks = append(rm.sinks[:i], rm.sinks[i+1:]...)
+			close(h.records)
+			break
+		}
+	}
+	rm.mtx.Unlock()
+	<-h.done
+}
+
+// Queue a record for every sink. Expects rm.mtx to be locked.
+func (rm *RecoveryManager) sendToSinks(s string) {
+	for _, h := range rm.sinks {
+		if h.Err() != nil {
+			continue
+		}
+		select {
+		case h.records <- []byte(s):
+		default:
+			h.fail(ErrSinkFull)
+		}
+	}
+}
+
+// Write queued records to the sink until the queue is closed.
+func (h *SinkHandle) run() {
+	defer close(h.done)
+	for record := range h.records {
+		if h.Err() != nil {
+			continue
+		}
+		if err := h.sink.Write(record); err != nil {
+			h.fail(err)
+		}
+	}
+}
+
+// Apply the sink's policy to a record it lost.
+func (h *SinkHandle) fail(err error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.policy == SINK_FAIL {
+		if h.err == nil {
+			h.err = err
+		}
+		return
+	}
+	h.dropped++
+}
+
+// Get the number of records the sink lost under SINK_DROP.
+func (h *SinkHandle) Dropped() int64 {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.dropped
+}
+
+// Get why the sink stopped getting records under SINK_FAIL, or nil if it hasn't.
+func (h *SinkHandle) Err() error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return h.err
+}
@@ -0,0 +1,64 @@
+package repl
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Marks where an argument goes in a prepared command.
+const PLACEHOLDER = "?"
+
+// A prepared command: its handler and its words, with placeholders to fill in.
+type statement struct {
+	command func(string, *REPLConfig) error
+	fields  []string
+	params  []int // Indices of the placeholders in fields.
+}
+
+// Prepare parses a command template whose words may be placeholders ("?"), e.g.
+// "insert ? ? into t", and saves it under the given name for Exec. The command's trigger must
+// be given, not a placeholder.
+func (r *REPL) Prepare(name string, template string) error {
+	fields := strings.Fields(template)
+	if len(fields) == 0 {
+		return errors.New("prepare: empty template")
+	}
+	command, exists := r.getCommand(cleanInput(fields[0]))
+	if !exists {
+		return fmt.Errorf("prepare: command not found: %s", fields[0])
+	}
+	stmt := &statement{command: command, fields: fields, params: make([]int, 0)}
+	for i, field := range fields {
+		if field == PLACEHOLDER {
+			stmt.params = append(stmt.params, i)
+		}
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.prepared[name] = stmt
+	return nil
+}
+
+// Exec runs the prepared command with the given name, filling its placeholders with args in order.
+func (r *REPL) Exec(name string, replConfig *REPLConfig, args ...interface{}) error {
+	r.mtx.RLock()
+	stmt, found := r.prepared[name]
+	r.mtx.RUnlock()
+	if !found {
+		return fmt.Errorf("exec: no prepared command named %s", name)
+	}
+	if len(args) != len(stmt.params) {
+		return fmt.Errorf("exec: %s takes %d arguments, got %d", name, len(stmt.params), len(args))
+	}
+	fields := make([]string, len(stmt.fields))
+	copy(fields, stmt.fields)
+	for i, arg := range args {
+		value := fmt.Sprint(arg)
+		if value == "" || len(strings.Fields(value)) != 1 || value != strings.TrimSpace(value) {
+			return fmt.Errorf("exec: argument %d must be a single word, got %q", i+1, value)
+		}
+		fields[stmt.params[i]] = value
+	}
+	return stmt.command(strings.Join(fields, " "), replConfig)
+}
@@ -0,0 +1,62 @@
+package repl
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Returned instead of running a command sent faster than the client's rate limit allows.
+var ErrRateLimitExceeded = errors.New("rate limit exceeded")
+
+// A token bucket, refilled at rate tokens per second up to burst tokens.
+type tokenBucket struct {
+	mtx    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time // When tokens was last refilled.
+}
+
+// Construct a full token bucket.
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Take a token if there is one, reporting whether there was.
+func (b *tokenBucket) allow() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Limit the client to rate commands per second, in bursts of up to burst commands. Commands
+// past the limit fail with ErrRateLimitExceeded without running. A rate of 0 lifts the limit.
+func (replConfig *REPLConfig) SetRateLimit(rate float64, burst int) {
+	if rate <= 0 {
+		replConfig.limiter = nil
+		return
+	}
+	replConfig.limiter = newTokenBucket(rate, burst)
+}
+
+// Limit each client connecting from now on to rate commands per second, in bursts of up to
+// burst commands; see REPLConfig.SetRateLimit. Clients aren't limited by default.
+func (s *Server) SetRateLimit(rate float64, burst int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.rate, s.burst = rate, burst
+}
@@ -7,7 +7,10 @@ import (
 	"io"
 	"net"
 	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	uuid "github.com/google/uuid"
 )
@@ -16,12 +19,27 @@ import (
 type REPL struct {
 	commands map[string]func(string, *REPLConfig) error
 	help     map[string]string
+	prepared map[string]*statement
+	mtx      sync.RWMutex // Guards commands, help and prepared.
 }
 
 // REPL Config struct.
 type REPLConfig struct {
-	writer   io.Writer
-	clientId uuid.UUID
+	writer       io.Writer
+	clientId     uuid.UUID
+	onDisconnect func(uuid.UUID)
+	timing       bool         // Whether to report how long each command takes.
+	limiter      *tokenBucket // Limits the rate of commands, if set; see SetRateLimit.
+}
+
+// Construct a REPL config that writes to the given writer on behalf of the given client.
+func NewREPLConfig(writer io.Writer, clientId uuid.UUID) *REPLConfig {
+	return &REPLConfig{writer: writer, clientId: clientId}
+}
+
+// Set a callback to run with the client's id once its connection closes.
+func (replConfig *REPLConfig) SetDisconnectHandler(handler func(uuid.UUID)) {
+	replConfig.onDisconnect = handler
 }
 
 // Get writer.
@@ -36,7 +54,11 @@ func (replConfig *REPLConfig) GetAddr() uuid.UUID {
 
 // Construct an empty REPL.
 func NewRepl() *REPL {
-	return &REPL{make(map[string]func(string, *REPLConfig) error), make(map[string]string)}
+	return &REPL{
+		commands: make(map[string]func(string, *REPLConfig) error),
+		help:     make(map[string]string),
+		prepared: make(map[string]*statement),
+	}
 }
 
 // Combine a slice of REPLs. If no REPLs are passed in,
@@ -77,21 +99,61 @@ func (r *REPL) GetHelp() map[string]string {
 
 // Add a command, along with its help string, to the set of commands.
 func (r *REPL) AddCommand(trigger string, action func(string, *REPLConfig) error, help string) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
 	r.commands[trigger] = action
 	r.help[trigger] = help
 }
 
-// Return all REPL usage information as a string.
+// Remove a command and its help string, returning whether it existed. Commands already
+// running, and prepared commands made from it, are unaffected.
+func (r *REPL) RemoveCommand(trigger string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	_, exists := r.commands[trigger]
+	delete(r.commands, trigger)
+	delete(r.help, trigger)
+	return exists
+}
+
+// Check whether a command is registered.
+func (r *REPL) HasCommand(trigger string) bool {
+	_, exists := r.getCommand(trigger)
+	return exists
+}
+
+// Get the command with the given trigger.
+func (r *REPL) getCommand(trigger string) (func(string, *REPLConfig) error, bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	command, exists := r.commands[trigger]
+	return command, exists
+}
+
+// Return all REPL usage information as a string, one line per command in order of trigger.
 func (r *REPL) HelpString() string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	triggers := make([]string, 0, len(r.help))
+	for k := range r.help {
+		triggers = append(triggers, k)
+	}
+	sort.Strings(triggers)
 	var sb strings.Builder
-	for k, v := range r.help {
-		sb.WriteString(fmt.Sprintf("%s: %s\n", k, v))
+	for _, k := range triggers {
+		sb.WriteString(fmt.Sprintf("%s: %s\n", k, r.help[k]))
 	}
 	return sb.String()
 }
 
 // Run the REPL.
 func (r *REPL) Run(c net.Conn, clientId uuid.UUID, prompt string) {
+	r.RunConfig(c, NewREPLConfig(nil, clientId), prompt)
+}
+
+// Run the REPL with the given config, calling its disconnect handler once input runs out.
+// The config's writer defaults to the connection.
+func (r *REPL) RunConfig(c net.Conn, replConfig *REPLConfig, prompt string) {
 	// Get reader and writer; stdin and stdout if no conn.
 	var reader io.Reader
 	var writer io.Writer
@@ -102,25 +164,60 @@ func (r *REPL) Run(c net.Conn, clientId uuid.UUID, prompt string) {
 		reader = c
 		writer = c
 	}
+	if replConfig.writer == nil {
+		replConfig.writer = writer
+	}
+	writer = replConfig.writer
+	if replConfig.onDisconnect != nil {
+		defer replConfig.onDisconnect(replConfig.clientId)
+	}
 	scanner := bufio.NewScanner((reader))
-	replConfig := &REPLConfig{writer: writer, clientId: clientId}
 	// Begin the repl loop!
-	for {
-		if !scanner.Scan() {
-			break
+	io.WriteString(writer, prompt)
+	for scanner.Scan() {
+		err := r.Execute(scanner.Text(), replConfig)
+		if err != nil {
+			io.WriteString(writer, fmt.Sprintf("%v\n", err))
 		}
 		io.WriteString(writer, prompt)
-		input := cleanInput(scanner.Text())
-		if r.commands[input] == nil {
-			io.WriteString(writer, "Invalid command.\n")
-			continue
-		}
-		parts := strings.Split(input, " ")
-		err := r.commands[parts[0]](input, replConfig)
-		if err != nil {
-			io.WriteString(writer, err.Error()+"\n")
+	}
+}
+
+// Execute a single line of input, dispatching on its first word.
+func (r *REPL) Execute(payload string, replConfig *REPLConfig) error {
+	fields := strings.Fields(payload)
+	if len(fields) == 0 {
+		return nil
+	}
+	if replConfig.limiter != nil && !replConfig.limiter.allow() {
+		return ErrRateLimitExceeded
+	}
+	trigger := cleanInput(fields[0])
+	// Check for a meta-command.
+	if trigger == ".help" {
+		io.WriteString(replConfig.writer, r.HelpString())
+		return nil
+	}
+	if trigger == ".timing" {
+		if len(fields) != 2 || (fields[1] != "on" && fields[1] != "off") {
+			return errors.New("usage: .timing <on|off>")
 		}
+		replConfig.timing = fields[1] == "on"
+		return nil
+	}
+	// Else, check user commands.
+	command, exists := r.getCommand(trigger)
+	if !exists {
+		return errors.New("command not found")
+	}
+	if !replConfig.timing {
+		return command(payload, replConfig)
 	}
+	start := time.Now()
+	err := command(payload, replConfig)
+	elapsed := time.Since(start)
+	io.WriteString(replConfig.writer, fmt.Sprintf("Time: %.1fms\n", float64(elapsed)/float64(time.Millisecond)))
+	return err
 }
 
 // Run the REPL.
@@ -133,28 +230,9 @@ func (r *REPL) RunChan(c chan string, clientId uuid.UUID, prompt string) {
 	for payload := range c {
 		// Emit the payload for debugging purposes.
 		io.WriteString(writer, payload+"\n")
-		// Parse the payload.
-		fields := strings.Fields(payload)
-		if len(fields) == 0 {
-			io.WriteString(writer, prompt)
-			continue
-		}
-		trigger := cleanInput(fields[0])
-		// Check for a meta-command.
-		if trigger == ".help" {
-			io.WriteString(writer, r.HelpString())
-			io.WriteString(writer, prompt)
-			continue
-		}
-		// Else, check user commands.
-		if command, exists := r.commands[trigger]; exists {
-			// Call a hardcoded function.
-			err := command(payload, replConfig)
-			if err != nil {
-				io.WriteString(writer, fmt.Sprintf("%v\n", err))
-			}
-		} else {
-			io.WriteString(writer, "command not found\n")
+		err := r.Execute(payload, replConfig)
+		if err != nil {
+			io.WriteString(writer, fmt.Sprintf("%v\n", err))
 		}
 		io.WriteString(writer, prompt)
 	}
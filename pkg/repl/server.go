@@ -0,0 +1,120 @@
+package repl
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	uuid "github.com/google/uuid"
+)
+
+// Server runs a REPL for each client that connects, giving each a client id of its own so that
+// clients sharing a database through a transaction manager get transactions of their own.
+type Server struct {
+	r            *REPL
+	prompt       string
+	onDisconnect func(uuid.UUID)
+	mtx          sync.Mutex
+	clients      map[uuid.UUID]net.Conn // Connected clients, by id.
+	listener     net.Listener           // Set while serving; see Serve.
+	closed       bool
+	wg           sync.WaitGroup // Counts running client connections.
+	rate         float64        // Commands per second each client is limited to; see SetRateLimit.
+	burst        int
+}
+
+// Construct a server that runs the REPL for each client. onDisconnect, if set, cleans up after
+// a client whose connection closed, e.g. ending its transaction; pass the transaction manager's
+// ReleaseOnDisconnect or the recovery manager's AbortOnDisconnect.
+func NewServer(r *REPL, onDisconnect func(uuid.UUID), prompt string) *Server {
+	return &Server{
+		r:            r,
+		prompt:       prompt,
+		onDisconnect: onDisconnect,
+		clients:      make(map[uuid.UUID]net.Conn),
+	}
+}
+
+// Accept connections on the listener, serving each from a goroutine of its own, until Close.
+func (s *Server) Serve(listener net.Listener) error {
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		listener.Close()
+		return errors.New("server closed")
+	}
+	s.listener = listener
+	s.mtx.Unlock()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mtx.Lock()
+			closed := s.closed
+			s.mtx.Unlock()
+			if closed {
+				return nil
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		go s.ServeConn(conn)
+	}
+}
+
+// Run the REPL on a connection under a new client id until it closes, then clean up after the
+// client and close the connection.
+func (s *Server) ServeConn(c net.Conn) {
+	clientId := uuid.New()
+	s.mtx.Lock()
+	if s.closed {
+		s.mtx.Unlock()
+		c.Close()
+		return
+	}
+	s.clients[clientId] = c
+	s.wg.Add(1)
+	rate, burst := s.rate, s.burst
+	s.mtx.Unlock()
+	defer s.wg.Done()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.clients, clientId)
+		s.mtx.Unlock()
+	}()
+	defer c.Close()
+	replConfig := NewREPLConfig(c, clientId)
+	replConfig.SetRateLimit(rate, burst)
+	if s.onDisconnect != nil {
+		replConfig.SetDisconnectHandler(s.onDisconnect)
+	}
+	s.r.RunConfig(c, replConfig, s.prompt)
+}
+
+// Get the ids of the connected clients.
+func (s *Server) GetClients() []uuid.UUID {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	ids := make([]uuid.UUID, 0, len(s.clients))
+	for id := range s.clients {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Stop accepting connections and close every client's, returning once they are cleaned up after.
+func (s *Server) Close() error {
+	s.mtx.Lock()
+	s.closed = true
+	var err error
+	if s.listener != nil {
+		err = s.listener.Close()
+	}
+	for _, c := range s.clients {
+		c.Close()
+	}
+	s.mtx.Unlock()
+	s.wg.Wait()
+	return err
+}
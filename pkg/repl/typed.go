@@ -0,0 +1,63 @@
+package repl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The expected type of a typed command's argument. INT64_ARG and STRING_ARG match any word and
+// are passed to the handler as an int64 or a string; any other value is a keyword that must
+// appear as is, e.g. ArgType("from"), and isn't passed to the handler.
+type ArgType string
+
+const (
+	INT64_ARG  ArgType = "<int64>"
+	STRING_ARG ArgType = "<string>"
+)
+
+// Add a command whose arguments, the words after its trigger, are parsed and checked against
+// the schema before the handler runs. The handler gets one int64 or string per typed argument.
+func (r *REPL) AddTypedCommand(trigger string, schema []ArgType, handler func(args []interface{}, replConfig *REPLConfig) error, help string) {
+	r.AddCommand(trigger, func(payload string, replConfig *REPLConfig) error {
+		args, err := parseArgs(trigger, schema, strings.Fields(payload)[1:])
+		if err != nil {
+			return err
+		}
+		return handler(args, replConfig)
+	}, help)
+}
+
+// Parse words against a schema, returning the typed arguments or an error describing the mismatch.
+func parseArgs(trigger string, schema []ArgType, words []string) ([]interface{}, error) {
+	if len(words) != len(schema) {
+		return nil, fmt.Errorf("%s: expected %d arguments, got %d; usage: %s", trigger, len(schema), len(words), schemaUsage(trigger, schema))
+	}
+	args := make([]interface{}, 0, len(schema))
+	for i, argType := range schema {
+		switch argType {
+		case INT64_ARG:
+			n, err := strconv.ParseInt(words[i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: argument %d must be an int64, got %q", trigger, i+1, words[i])
+			}
+			args = append(args, n)
+		case STRING_ARG:
+			args = append(args, words[i])
+		default:
+			if words[i] != string(argType) {
+				return nil, fmt.Errorf("%s: argument %d must be %q, got %q", trigger, i+1, argType, words[i])
+			}
+		}
+	}
+	return args, nil
+}
+
+// Describe a schema, e.g. "find <int64> from <string>".
+func schemaUsage(trigger string, schema []ArgType) string {
+	words := []string{trigger}
+	for _, argType := range schema {
+		words = append(words, string(argType))
+	}
+	return strings.Join(words, " ")
+}
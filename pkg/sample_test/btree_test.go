@@ -2,16 +2,23 @@ package test
 
 import (
 	"io/ioutil"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
 	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
+	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 // Set to some other value
 var btree_salt = int64(999999)
 
-func getTempBTreeDB(t *testing.T) string {
+func getTempBTreeDB(t testing.TB) string {
 	tmpfile, err := ioutil.TempFile(".", "db-*")
 	if err != nil {
 		t.Error(err)
@@ -352,3 +359,916 @@ func testBTreeUpdateTen(t *testing.T) {
 	}
 	index.Close()
 }
+
+func TestBTreePrefixCompression(t *testing.T) {
+	plainName := getTempBTreeDB(t)
+	defer os.Remove(plainName)
+	compressedName := getTempBTreeDB(t)
+	defer os.Remove(compressedName)
+	defer os.Remove(compressedName + btree.OPTIONS_FILE_SUFFIX)
+
+	// Init the databases
+	plain, err := btree.OpenTable(plainName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := btree.OpenTableWithOptions(compressedName, btree.TableOptions{PrefixCompression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Insert a dense key range, plus a few far-away keys that can't be delta-encoded.
+	keys := make([]int64, 0)
+	for i := int64(0); i < 5000; i++ {
+		keys = append(keys, i)
+	}
+	keys = append(keys, math.MaxInt64, math.MinInt64, math.MaxInt64/2)
+	for _, key := range keys {
+		if err = plain.Insert(key, key%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+		if err = compressed.Insert(key, key%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if compressed.GetPager().GetNumPages() >= plain.GetPager().GetNumPages() {
+		t.Errorf("compressed tree uses %d pages, plain tree uses %d",
+			compressed.GetPager().GetNumPages(), plain.GetPager().GetNumPages())
+	}
+	// Close and reopen, then check that a scan returns every entry in order.
+	compressed.Close()
+	compressed, err = btree.OpenTable(compressedName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := compressed.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(keys) {
+		t.Fatalf("expected %d entries, got %d", len(keys), len(entries))
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for i, entry := range entries {
+		if entry.GetKey() != keys[i] || entry.GetValue() != keys[i]%btree_salt {
+			t.Fatalf("entry %d: expected (%d, %d), got (%d, %d)", i,
+				keys[i], keys[i]%btree_salt, entry.GetKey(), entry.GetValue())
+		}
+	}
+	for _, key := range keys {
+		if _, err := compressed.Find(key); err != nil {
+			t.Errorf("could not find key %d", key)
+		}
+	}
+	plain.Close()
+	compressed.Close()
+}
+
+func TestBTreePrefixCompressionAfterPlainLeaf(t *testing.T) {
+	plainName := getTempBTreeDB(t)
+	defer os.Remove(plainName)
+	compressedName := getTempBTreeDB(t)
+	defer os.Remove(compressedName)
+	defer os.Remove(compressedName + btree.OPTIONS_FILE_SUFFIX)
+	plain, err := btree.OpenTable(plainName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := btree.OpenTableWithOptions(compressedName, btree.TableOptions{PrefixCompression: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := func(keys []int64) {
+		for _, key := range keys {
+			if err := plain.Insert(key, key%btree_salt); err != nil {
+				t.Fatal(err)
+			}
+			if err := compressed.Insert(key, key%btree_salt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	dense := func(from int64) []int64 {
+		keys := make([]int64, 0)
+		for i := from; i < from+5000; i++ {
+			keys = append(keys, i)
+		}
+		return keys
+	}
+	// A far-away key forces the root leaf into the plain layout before the dense keys arrive.
+	insert([]int64{math.MinInt64})
+	insert(dense(0))
+	if compressed.GetPager().GetNumPages() >= plain.GetPager().GetNumPages() {
+		t.Errorf("expected leaves split off a plain leaf to be compressed, but the compressed tree "+
+			"uses %d pages and the plain tree %d", compressed.GetPager().GetNumPages(), plain.GetPager().GetNumPages())
+	}
+	// The table keeps compressing new leaves once reopened without the option.
+	compressed.Close()
+	if compressed, err = btree.OpenTable(compressedName); err != nil {
+		t.Fatal(err)
+	}
+	defer compressed.Close()
+	defer plain.Close()
+	plainBefore, compressedBefore := plain.GetPager().GetNumPages(), compressed.GetPager().GetNumPages()
+	insert(dense(10000))
+	plainGrowth := plain.GetPager().GetNumPages() - plainBefore
+	compressedGrowth := compressed.GetPager().GetNumPages() - compressedBefore
+	// Compressed leaves hold about half as many entries again as plain ones.
+	if compressedGrowth*4 > plainGrowth*3 {
+		t.Errorf("expected the reopened table to keep compressing, but it grew by %d pages and the plain "+
+			"tree by %d", compressedGrowth, plainGrowth)
+	}
+	for _, key := range append(dense(0), dense(10000)...) {
+		if entry, err := compressed.Find(key); err != nil || entry.GetValue() != key%btree_salt {
+			t.Fatalf("expected to find %d, got %v, %v", key, entry, err)
+		}
+	}
+}
+
+func TestBTreeBulkLoad(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	os.Remove(dbName)
+	defer os.Remove(dbName)
+	// Enough entries for the tree to need two levels of internal nodes.
+	n := int64(60000)
+	entries := make([]utils.Entry, n)
+	for i := int64(0); i < n; i++ {
+		entries[i] = newEntry(i*2, i%btree_salt)
+	}
+	index, err := btree.BulkLoad(dbName, entries, btree.TableOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if _, _, ok, err := btree.IsBTree(index); !ok || err != nil {
+		t.Fatalf("bulk loaded tree fails verification (err: %v)", err)
+	}
+	selected, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(selected)) != n {
+		t.Fatalf("expected %d entries, got %d", n, len(selected))
+	}
+	for i, entry := range selected {
+		if entry.GetKey() != entries[i].GetKey() || entry.GetValue() != entries[i].GetValue() {
+			t.Fatalf("entry %d is (%d, %d), expected (%d, %d)", i, entry.GetKey(), entry.GetValue(),
+				entries[i].GetKey(), entries[i].GetValue())
+		}
+	}
+	// The tree keeps working with regular inserts between the loaded keys.
+	for i := int64(0); i < n; i += 97 {
+		if err := index.Insert(i*2+1, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < n; i += 97 {
+		if _, err := index.Find(i*2 + 1); err != nil {
+			t.Fatalf("inserted key %d not found: %v", i*2+1, err)
+		}
+		if _, err := index.Find(i * 2); err != nil {
+			t.Fatalf("loaded key %d not found: %v", i*2, err)
+		}
+	}
+	if _, _, ok, err := btree.IsBTree(index); !ok || err != nil {
+		t.Errorf("tree fails verification after inserts (err: %v)", err)
+	}
+	// Unsorted input is rejected.
+	os.Remove(dbName + ".unsorted")
+	defer os.Remove(dbName + ".unsorted")
+	if _, err := btree.BulkLoad(dbName+".unsorted", []utils.Entry{newEntry(2, 0), newEntry(1, 0)}, btree.TableOptions{}); err == nil {
+		t.Error("expected unsorted entries to be rejected")
+	}
+}
+
+func TestBTreeTableFindAll(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + btree.OPTIONS_FILE_SUFFIX)
+	index, err := btree.OpenTableWithOptions(dbName, btree.TableOptions{AllowDuplicates: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Key 150 gets more duplicates than fit in one leaf, so they span a leaf boundary.
+	const dups = 300
+	for i := int64(0); i < 300; i++ {
+		if err := index.Insert(i, -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < dups; i++ {
+		if err := index.Insert(150, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, ok, err := btree.IsBTree(index); !ok || err != nil {
+		t.Fatalf("tree with duplicates fails verification (err: %v)", err)
+	}
+	entries, err := index.TableFindAll(150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != dups+1 {
+		t.Fatalf("expected %d entries with key 150, got %d", dups+1, len(entries))
+	}
+	for i, entry := range entries {
+		if entry.GetKey() != 150 || entry.GetValue() != int64(i)-1 {
+			t.Fatalf("entry %d is (%d, %d); expected (150, %d)", i, entry.GetKey(), entry.GetValue(), i-1)
+		}
+	}
+	for _, key := range []int64{0, 149, 151, 299} {
+		if entries, err := index.TableFindAll(key); err != nil || len(entries) != 1 {
+			t.Errorf("expected a single entry with key %d, got %v (err: %v)", key, entries, err)
+		}
+	}
+	if entries, err := index.TableFindAll(1000); err != nil || len(entries) != 0 {
+		t.Errorf("expected no entries with a missing key, got %v (err: %v)", entries, err)
+	}
+	// Unique tables still reject duplicates.
+	unique, err := btree.OpenTable(dbName + ".unique")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(dbName + ".unique")
+	defer unique.Close()
+	unique.Insert(1, 1)
+	if err := unique.Insert(1, 2); err == nil {
+		t.Error("expected a unique table to reject a duplicate key")
+	}
+	// TableFind lands on the first duplicate.
+	cursor, err := index.TableFind(150)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cursor.Close()
+	entry, err := cursor.GetEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.GetKey() != 150 || entry.GetValue() != -1 {
+		t.Errorf("expected TableFind to land on the first duplicate (150, -1), got (%d, %d)", entry.GetKey(), entry.GetValue())
+	}
+}
+
+func TestBTreeAllowDuplicatesRecorded(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + btree.OPTIONS_FILE_SUFFIX)
+	index, err := btree.OpenTableWithOptions(dbName, btree.TableOptions{AllowDuplicates: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough duplicates of key 150 to span a leaf boundary.
+	for i := int64(0); i < 300; i++ {
+		if err := index.Insert(150, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A plain reopen still accepts duplicates, and can rebuild the tree around them.
+	index, err = btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if err := index.Insert(150, 300); err != nil {
+		t.Fatalf("expected a reopened table to accept a duplicate key, got %v", err)
+	}
+	if err := index.Reindex(); err != nil {
+		t.Fatalf("expected a reopened table with duplicates to reindex, got %v", err)
+	}
+	if entries, err := index.TableFindAll(150); err != nil || len(entries) != 301 {
+		t.Errorf("expected 301 entries with key 150, got %d (err: %v)", len(entries), err)
+	}
+}
+
+// Scan up to n entries from the cursor's position, stopping early at the end of the table.
+func scanCursor(t *testing.T, cursor *btree.BTreeCursor, n int) []int64 {
+	keys := make([]int64, 0, n)
+	for len(keys) < n && !cursor.IsEnd() {
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, entry.GetKey())
+		if cursor.StepForward() {
+			break
+		}
+	}
+	return keys
+}
+
+func TestBTreeCursorReset(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Space the keys out so that both scans cross several leaves.
+	const n = 2000
+	for i := int64(0); i < n; i++ {
+		if err := index.Insert(i*2, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	found, err := index.TableFind(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor := found.(*btree.BTreeCursor)
+	defer cursor.Close()
+	checkScan := func(keys []int64, first int64, length int) {
+		if len(keys) != length {
+			t.Fatalf("expected %d keys from %d, got %d", length, first, len(keys))
+		}
+		for i, key := range keys {
+			if key != first+int64(i)*2 {
+				t.Fatalf("scan from %d: key %d is %d; expected %d", first, i, key, first+int64(i)*2)
+			}
+		}
+	}
+	// Reset mid-scan, then again once the scan has run off the end.
+	checkScan(scanCursor(t, cursor, 600), 100, 600)
+	if err := cursor.Reset(3001); err != nil {
+		t.Fatal(err)
+	}
+	checkScan(scanCursor(t, cursor, n), 3002, (2*n-3002)/2)
+	if err := cursor.Reset(2 * n); err != nil {
+		t.Fatal(err)
+	}
+	if !cursor.IsEnd() {
+		t.Error("expected a cursor reset past the last key to be at the end")
+	}
+	if err := cursor.Reset(0); err != nil {
+		t.Fatal(err)
+	}
+	checkScan(scanCursor(t, cursor, n), 0, n)
+
+	// No read locks are left behind: writes to every leaf go through.
+	done := make(chan error)
+	go func() {
+		for i := int64(0); i < n; i += 50 {
+			if err := index.Update(i*2, -i); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("updates blocked on a page lock the cursor leaked")
+	}
+}
+
+func TestBTreeCursorClose(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 1000; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Read one entry from each kind of cursor, then close it before reaching the end.
+	start, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := index.TableFind(500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	end, err := index.TableEnd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, cursor := range []utils.Cursor{start, found, end} {
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []int64{0, 500, 999}[i]; entry.GetKey() != want {
+			t.Errorf("expected cursor %d on key %d, got %d", i, want, entry.GetKey())
+		}
+		cursor.Close()
+		cursor.Close()
+		if !cursor.IsEnd() {
+			t.Error("expected a closed cursor to be at the end")
+		}
+	}
+	// The leaves they were on can be written to.
+	done := make(chan error)
+	go func() {
+		for _, key := range []int64{0, 500, 999} {
+			if err := index.Update(key, -key); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("updates blocked on a page lock a closed cursor kept")
+	}
+}
+
+func TestBTreeReindexLocksTable(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	const n = 2000
+	for i := int64(0); i < n; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A reindex waits for open cursors to be closed.
+	cursor, err := index.TableFind(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- index.Reindex() }()
+	select {
+	case err := <-done:
+		t.Fatalf("expected the reindex to wait for the cursor, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cursor.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// A reindex that can't replace the file leaves the table on its original file.
+	blocker := dbName + ".old"
+	if err := os.MkdirAll(filepath.Join(blocker, "x"), 0775); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(blocker)
+	if err := index.Reindex(); err == nil {
+		t.Fatal("expected the reindex to fail")
+	}
+	if _, err := os.Stat(dbName + ".reindex"); !os.IsNotExist(err) {
+		t.Errorf("expected the rebuilt file to be removed, got %v", err)
+	}
+	for i := int64(0); i < n; i++ {
+		if entry, err := index.Find(i); err != nil || entry.GetValue() != i {
+			t.Fatalf("expected (%d, %d) after the failed reindex, got %v, %v", i, i, entry, err)
+		}
+	}
+	if err := index.Insert(n, n); err != nil {
+		t.Errorf("expected the table to take writes after the failed reindex, got %v", err)
+	}
+}
+
+// crashingFile drops every write after the first limit, as if the process died mid-flush.
+type crashingFile struct {
+	pager.File
+	limit  int
+	writes int
+}
+
+func (f *crashingFile) WriteAt(p []byte, off int64) (int, error) {
+	f.writes++
+	if f.writes > f.limit {
+		return len(p), nil
+	}
+	return f.File.WriteAt(p, off)
+}
+
+// Build a table, flush it with all but the first limit writes dropped, and return a copy of
+// what reached disk along with how many writes the flush attempted.
+func crashDuringFlush(t *testing.T, limit int) (string, int) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := rand.New(rand.NewSource(1270)).Perm(3000)
+	for _, key := range keys[:500] {
+		if err := index.Insert(int64(key), int64(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Splitting leaves all over the tree dirties old pages as well as new ones.
+	if index, err = btree.OpenTable(dbName); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys[500:] {
+		if err := index.Insert(int64(key), int64(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	crash := &crashingFile{limit: limit}
+	index.GetPager().WrapFile(func(f pager.File) pager.File {
+		crash.File = f
+		return crash
+	})
+	index.GetPager().FlushAllPages()
+	data, err := ioutil.ReadFile(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.Close()
+	crashName := getTempBTreeDB(t)
+	if err := ioutil.WriteFile(crashName, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+	return crashName, crash.writes
+}
+
+func TestBTreeFlushCrashConsistency(t *testing.T) {
+	for limit, writes := 0, 1; limit <= writes; limit++ {
+		var crashName string
+		crashName, writes = crashDuringFlush(t, limit)
+		index, err := btree.OpenTable(crashName)
+		if err != nil {
+			os.Remove(crashName)
+			t.Fatal(err)
+		}
+		_, _, ok, err := btree.IsBTree(index)
+		if err != nil || !ok {
+			t.Errorf("crash after %d of %d page writes left an invalid tree (err: %v)", limit, writes, err)
+		}
+		index.Close()
+		os.Remove(crashName)
+	}
+}
+
+func TestBTreeDeleteBatch(t *testing.T) {
+	// Fill two tables alike.
+	indices := make([]*btree.BTreeIndex, 2)
+	for i := range indices {
+		dbName := getTempBTreeDB(t)
+		defer os.Remove(dbName)
+		index, err := btree.OpenTable(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+		for _, key := range rand.New(rand.NewSource(1270)).Perm(3000) {
+			if err := index.Insert(int64(key), int64(key)%btree_salt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		indices[i] = index
+	}
+	// Delete a scattered set of keys, some of them missing, one at a time and as a batch.
+	keys := make([]int64, 0)
+	for _, key := range rand.New(rand.NewSource(1271)).Perm(4000)[:1500] {
+		keys = append(keys, int64(key))
+	}
+	expected := int64(0)
+	for _, key := range keys {
+		if _, err := indices[0].Find(key); err == nil {
+			expected++
+		}
+		if err := indices[0].Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted, err := indices[1].DeleteBatch(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != expected {
+		t.Errorf("expected the batch to delete %d keys, got %d", expected, deleted)
+	}
+	// Both tables should be left valid, holding the same entries.
+	selected := make([][]utils.Entry, 2)
+	for i, index := range indices {
+		if _, _, ok, err := btree.IsBTree(index); err != nil || !ok {
+			t.Fatalf("table %d is not a valid btree after deletes (err: %v)", i, err)
+		}
+		if selected[i], err = index.Select(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(selected[0]) != 3000-int(expected) || len(selected[1]) != len(selected[0]) {
+		t.Fatalf("expected %d entries left in both tables, got %d and %d", 3000-expected, len(selected[0]), len(selected[1]))
+	}
+	for i := range selected[0] {
+		if selected[0][i].GetKey() != selected[1][i].GetKey() || selected[0][i].GetValue() != selected[1][i].GetValue() {
+			t.Fatalf("entry %d differs: (%d, %d) deleting one at a time, (%d, %d) as a batch", i,
+				selected[0][i].GetKey(), selected[0][i].GetValue(), selected[1][i].GetKey(), selected[1][i].GetValue())
+		}
+	}
+}
+
+func TestBTreeSharedScan(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 3000; i++ {
+		if err := index.Insert(i, i%btree_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Step overlapping scans in lockstep, returning the keys each saw and the pages they got.
+	starts := []int64{0, 40, 80, 120}
+	const scanLength = 2000
+	scanAll := func(cursors []utils.Cursor) ([][]int64, int64) {
+		before := index.GetPager().GetStats().PageGets
+		keys := make([][]int64, len(cursors))
+		for step := 0; step < scanLength; step++ {
+			for i, cursor := range cursors {
+				entry, err := cursor.GetEntry()
+				if err != nil {
+					t.Fatal(err)
+				}
+				keys[i] = append(keys[i], entry.GetKey())
+				cursor.StepForward()
+			}
+		}
+		return keys, index.GetPager().GetStats().PageGets - before
+	}
+
+	// Independent cursors each get every leaf they cross.
+	independent := make([]utils.Cursor, len(starts))
+	for i, start := range starts {
+		if independent[i], err = index.TableFind(start); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, independentGets := scanAll(independent)
+	for _, cursor := range independent {
+		cursor.Close()
+	}
+
+	// Shared cursors see the same entries with fewer page gets.
+	scan := index.NewSharedScan()
+	shared := make([]utils.Cursor, len(starts))
+	for i, start := range starts {
+		cursor, err := scan.Cursor(start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cursor.Close()
+		shared[i] = cursor
+	}
+	keys, sharedGets := scanAll(shared)
+	for i, start := range starts {
+		for j, key := range keys[i] {
+			if key != start+int64(j) {
+				t.Fatalf("scan from %d: key %d is %d; expected %d", start, j, key, start+int64(j))
+			}
+		}
+	}
+	if sharedGets >= independentGets {
+		t.Errorf("expected shared scans to get fewer pages than independent ones; got %d and %d", sharedGets, independentGets)
+	}
+}
+
+func TestBTreeCursorEnd(t *testing.T) {
+	dbName := getTempBTreeDB(t)
+	defer os.Remove(dbName)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	const n = 1000
+	for i := int64(1); i <= n; i++ {
+		if err := index.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Step through every leaf until the cursor reports the end.
+	cursor, err := index.TableStart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cursor.Close()
+	count := int64(0)
+	for !cursor.IsEnd() {
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+		if entry.GetKey() != count {
+			t.Fatalf("expected key %d, got %d", count, entry.GetKey())
+		}
+		if atEnd := cursor.StepForward(); atEnd != cursor.IsEnd() {
+			t.Fatalf("StepForward reported %v at key %d, but IsEnd is %v", atEnd, count, cursor.IsEnd())
+		}
+	}
+	if count != n {
+		t.Errorf("expected %d entries, got %d", n, count)
+	}
+	// No zero entry past the end, however often the cursor steps.
+	if !cursor.StepForward() || !cursor.IsEnd() {
+		t.Error("expected the cursor to stay at the end")
+	}
+	if entry, err := cursor.GetEntry(); err == nil {
+		t.Errorf("expected GetEntry to fail at the end, got (%d, %d)", entry.GetKey(), entry.GetValue())
+	}
+	// Ranges running to the end of the table, or starting past it, stop there.
+	entries, err := index.TableFindRange(n-5, n+100)
+	if err != nil || len(entries) != 6 || entries[5].GetKey() != n {
+		t.Errorf("expected the last 6 entries, got %d (%v)", len(entries), err)
+	}
+	if entries, err := index.TableFindRange(n+1, n+100); err != nil || len(entries) != 0 {
+		t.Errorf("expected no entries past the end, got %d (%v)", len(entries), err)
+	}
+}
+
+func TestBTreeHotKeyCache(t *testing.T) {
+	plainName := getTempBTreeDB(t)
+	defer os.Remove(plainName)
+	cachedName := getTempBTreeDB(t)
+	defer os.Remove(cachedName)
+	plain, err := btree.OpenTable(plainName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	cached, err := btree.OpenTableWithOptions(cachedName, btree.TableOptions{HotKeyCacheSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cached.Close()
+	// Leave gaps between keys, to split a leaf by filling them later.
+	for i := int64(0); i < 5000; i++ {
+		for _, index := range []*btree.BTreeIndex{plain, cached} {
+			if err := index.Insert(i*10, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Count the internal nodes read finding the same key over and over; each find reads one leaf.
+	const lookups = 1000
+	key := int64(2500 * 10)
+	internalReads := func(index *btree.BTreeIndex) int64 {
+		before := index.GetPager().GetStats().PageGets
+		for i := 0; i < lookups; i++ {
+			entry, err := index.Find(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.GetValue() != key/10 {
+				t.Fatalf("found %d at key %d; expected %d", entry.GetValue(), key, key/10)
+			}
+		}
+		return index.GetPager().GetStats().PageGets - before - lookups
+	}
+	plainReads, cachedReads := internalReads(plain), internalReads(cached)
+	if plainReads < lookups {
+		t.Fatalf("expected the tree to have internal nodes; read %d for %d finds", plainReads, lookups)
+	}
+	if cachedReads*100 > plainReads {
+		t.Errorf("expected the cache to skip internal nodes; read %d with it, %d without", cachedReads, plainReads)
+	}
+	if stats := cached.HotKeyStats(); stats.Hits != lookups-1 || stats.Misses != 1 {
+		t.Errorf("expected %d hits and 1 miss, got %+v", lookups-1, stats)
+	}
+
+	// Fill the gaps around the key, splitting its leaf.
+	for i := key/10 - 100; i < key/10+100; i++ {
+		for j := int64(1); j < 10; j++ {
+			if err := cached.Insert(i*10+j, -1); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	stats := cached.HotKeyStats()
+	if stats.Invalidations == 0 {
+		t.Fatal("expected the split to invalidate the cached key")
+	}
+	for i := 0; i < 2; i++ {
+		entry, err := cached.Find(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.GetValue() != key/10 {
+			t.Fatalf("found %d at key %d after the split; expected %d", entry.GetValue(), key, key/10)
+		}
+	}
+	// The first find after the split traverses the tree and caches the key's new leaf.
+	if after := cached.HotKeyStats(); after.Misses != stats.Misses+1 || after.Hits != stats.Hits+1 {
+		t.Errorf("expected one miss then one hit after the split, got %+v then %+v", stats, after)
+	}
+}
+
+// Create a table with n entries on disk, returning its name.
+func createColdBTree(tb testing.TB, n int64) string {
+	dbName := getTempBTreeDB(tb)
+	index, err := btree.OpenTable(dbName)
+	if err != nil {
+		os.Remove(dbName)
+		tb.Fatal(err)
+	}
+	for i := int64(0); i < n; i++ {
+		if err := index.Insert(i, i%btree_salt); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	if err := index.Close(); err != nil {
+		tb.Fatal(err)
+	}
+	return dbName
+}
+
+// Scan a table from its first entry, collecting the entries.
+func scanBTree(tb testing.TB, index *btree.BTreeIndex, hint btree.ScanHint) []utils.Entry {
+	cursor, err := index.TableStart()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer cursor.Close()
+	cursor.(*btree.BTreeCursor).SetScanHint(hint)
+	entries := make([]utils.Entry, 0)
+	for !cursor.IsEnd() {
+		entry, err := cursor.GetEntry()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		entries = append(entries, entry)
+		cursor.StepForward()
+	}
+	return entries
+}
+
+func TestBTreeSequentialScanPrefetch(t *testing.T) {
+	dbName := createColdBTree(t, 5000)
+	defer os.Remove(dbName)
+	scanCold := func(hint btree.ScanHint) ([]utils.Entry, pager.PagerStats) {
+		index, err := btree.OpenTable(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+		return scanBTree(t, index, hint), index.GetPager().GetStats()
+	}
+	direct, directStats := scanCold(btree.POINT_SCAN)
+	ahead, aheadStats := scanCold(btree.SEQUENTIAL_SCAN)
+	if directStats.Prefetches != 0 || aheadStats.Prefetches == 0 {
+		t.Errorf("expected only the sequential scan to read leaves ahead, got %d and %d prefetches",
+			directStats.Prefetches, aheadStats.Prefetches)
+	}
+	if len(direct) != 5000 || len(ahead) != len(direct) {
+		t.Fatalf("expected 5000 entries both ways, got %d and %d", len(direct), len(ahead))
+	}
+	for i := range direct {
+		if direct[i].GetKey() != ahead[i].GetKey() || direct[i].GetValue() != ahead[i].GetValue() {
+			t.Fatalf("entry %d differs with read-ahead: (%d, %d) and (%d, %d)", i,
+				direct[i].GetKey(), direct[i].GetValue(), ahead[i].GetKey(), ahead[i].GetValue())
+		}
+	}
+}
+
+func benchmarkBTreeColdScan(b *testing.B, hint btree.ScanHint) {
+	dbName := createColdBTree(b, 50000)
+	defer os.Remove(dbName)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		index, err := btree.OpenTable(dbName)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		scanBTree(b, index, hint)
+		b.StopTimer()
+		index.Close()
+		b.StartTimer()
+	}
+}
+
+func BenchmarkBTreeColdScan(b *testing.B) {
+	benchmarkBTreeColdScan(b, btree.POINT_SCAN)
+}
+
+func BenchmarkBTreeColdScanPrefetch(b *testing.B) {
+	benchmarkBTreeColdScan(b, btree.SEQUENTIAL_SCAN)
+}
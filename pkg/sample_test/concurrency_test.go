@@ -0,0 +1,1347 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	concurrency "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/concurrency"
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	repl "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/repl"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+
+	uuid "github.com/google/uuid"
+)
+
+// A client of a transaction REPL that records everything written back to it.
+type replClient struct {
+	r      *repl.REPL
+	out    *bytes.Buffer
+	config *repl.REPLConfig
+}
+
+func newReplClient(r *repl.REPL) *replClient {
+	out := new(bytes.Buffer)
+	return &replClient{r: r, out: out, config: repl.NewREPLConfig(out, uuid.New())}
+}
+
+// Run a command, returning only the output it produced.
+func (c *replClient) run(t *testing.T, payload string) string {
+	c.out.Reset()
+	if err := c.r.Execute(payload, c.config); err != nil {
+		t.Fatalf("%s: %v", payload, err)
+	}
+	return c.out.String()
+}
+
+func setupTransactions(t *testing.T) (*db.Database, string, *concurrency.TransactionManager, *repl.REPL) {
+	d, folder := setupDatabase(t)
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	return d, folder, tm, concurrency.TransactionREPL(d, tm)
+}
+
+func TestTransactionReadYourOwnWrites(t *testing.T) {
+	d, folder, _, r := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	writer, reader := newReplClient(r), newReplClient(r)
+	writer.run(t, "transaction begin")
+	writer.run(t, "insert 5 50 into t")
+	writer.run(t, "insert 6 60 into t")
+	writer.run(t, "transaction commit")
+
+	// Write inside a transaction without committing.
+	writer.run(t, "transaction begin")
+	writer.run(t, "insert 1 10 into t")
+	writer.run(t, "update t 5 55")
+	writer.run(t, "delete 6 from t")
+	if got := writer.run(t, "select from t"); got != "(1, 10)\n(5, 55)\n" {
+		t.Errorf("writer should see its own writes; got %q", got)
+	}
+
+	// A concurrent transaction sees only committed state.
+	reader.run(t, "transaction begin")
+	if got := reader.run(t, "select from t"); got != "(5, 50)\n(6, 60)\n" {
+		t.Errorf("reader should not see uncommitted writes; got %q", got)
+	}
+	reader.run(t, "transaction commit")
+
+	// Once committed, the writes are visible to everyone.
+	writer.run(t, "transaction commit")
+	if got := reader.run(t, "select from t"); !strings.Contains(got, "(1, 10)") || strings.Contains(got, "(6, 60)") {
+		t.Errorf("reader should see committed writes; got %q", got)
+	}
+}
+
+func TestLockManagerWriterNotStarved(t *testing.T) {
+	lm := concurrency.NewLockManager()
+	r := concurrency.NewResource("t", 0)
+	if err := lm.Lock(r, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queue a writer behind the first reader.
+	granted := make(chan struct{})
+	go func() {
+		lm.Lock(r, concurrency.W_LOCK)
+		close(granted)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Keep a stream of overlapping readers arriving.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				lm.Lock(r, concurrency.R_LOCK)
+				time.Sleep(time.Millisecond)
+				lm.Unlock(r, concurrency.R_LOCK)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	lm.Unlock(r, concurrency.R_LOCK)
+
+	// The writer must get in ahead of readers that arrived after it.
+	select {
+	case <-granted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("writer was starved by readers")
+	}
+	close(stop)
+	lm.Unlock(r, concurrency.W_LOCK)
+	wg.Wait()
+}
+
+func TestLockManagerReaderPreference(t *testing.T) {
+	lm := concurrency.NewLockManager()
+	lm.SetFairnessPolicy(concurrency.READER_PREFERENCE)
+	r := concurrency.NewResource("t", 0)
+	if err := lm.Lock(r, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	granted := make(chan struct{})
+	go func() {
+		lm.Lock(r, concurrency.W_LOCK)
+		close(granted)
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// A new reader shares the lock even though a writer is waiting.
+	shared := make(chan struct{})
+	go func() {
+		lm.Lock(r, concurrency.R_LOCK)
+		close(shared)
+	}()
+	select {
+	case <-shared:
+	case <-time.After(2 * time.Second):
+		t.Fatal("reader was queued behind a writer under reader preference")
+	}
+	lm.Unlock(r, concurrency.R_LOCK)
+	lm.Unlock(r, concurrency.R_LOCK)
+	select {
+	case <-granted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("writer was not granted once readers left")
+	}
+	if err := lm.Unlock(r, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTransactionRangeLockPreventsPhantoms(t *testing.T) {
+	d, folder, _, r := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	scanner, writer := newReplClient(r), newReplClient(r)
+	writer.run(t, "transaction begin")
+	writer.run(t, "insert 10 10 into t")
+	writer.run(t, "insert 30 30 into t")
+	writer.run(t, "transaction commit")
+
+	// Scan a range, then have another transaction insert into and outside of it.
+	scanner.run(t, "transaction begin")
+	first := scanner.run(t, "select from t between 5 20")
+	if first != "(10, 10)\n" {
+		t.Fatalf("unexpected range scan result %q", first)
+	}
+	writer.run(t, "transaction begin")
+	writer.run(t, "insert 25 25 into t")
+	inserted := make(chan error)
+	go func() {
+		inserted <- writer.r.Execute("insert 15 15 into t", writer.config)
+	}()
+	select {
+	case err := <-inserted:
+		t.Fatalf("insert into a range-locked scan was not blocked (err: %v)", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Rescanning sees no phantom.
+	if again := scanner.run(t, "select from t between 5 20"); again != first {
+		t.Errorf("phantom read: first scan %q, second scan %q", first, again)
+	}
+
+	// Committing the scan lets the insert through.
+	scanner.run(t, "transaction commit")
+	select {
+	case err := <-inserted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("insert was never unblocked")
+	}
+	writer.run(t, "transaction commit")
+	scanner.run(t, "transaction begin")
+	if got := scanner.run(t, "select from t between 5 20"); got != "(10, 10)\n(15, 15)\n" {
+		t.Errorf("committed insert not visible: %q", got)
+	}
+	scanner.run(t, "transaction commit")
+}
+
+func TestTransactionErrorsIs(t *testing.T) {
+	d, folder, tm, r := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(what string, err error, target error) {
+		t.Helper()
+		if !errors.Is(err, target) {
+			t.Errorf("%s: expected %v, got %v", what, target, err)
+		}
+	}
+	a, b := uuid.New(), uuid.New()
+
+	// Errors from the transaction manager.
+	check("lock without transaction", tm.Lock(a, table, 1, concurrency.R_LOCK), concurrency.ErrTxNotFound)
+	check("unlock without transaction", tm.Unlock(a, table, 1, concurrency.R_LOCK), concurrency.ErrTxNotFound)
+	check("commit without transaction", tm.Commit(a), concurrency.ErrTxNotFound)
+	if err := tm.Begin(a); err != nil {
+		t.Fatal(err)
+	}
+	check("double begin", tm.Begin(a), concurrency.ErrTxAlreadyBegun)
+	if err := tm.Lock(a, table, 1, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	check("upgrade read lock", tm.Lock(a, table, 1, concurrency.W_LOCK), concurrency.ErrNoRightsToResource)
+	check("unlock with wrong type", tm.Unlock(a, table, 1, concurrency.W_LOCK), concurrency.ErrLockTypeMismatch)
+	check("unlock unheld resource", tm.Unlock(a, table, 2, concurrency.R_LOCK), concurrency.ErrResourceNotLocked)
+
+	// a waits on b while b waits on a.
+	if err := tm.Begin(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Lock(b, table, 2, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan error)
+	go func() {
+		locked <- tm.Lock(a, table, 2, concurrency.W_LOCK)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	check("deadlock", tm.Lock(b, table, 1, concurrency.W_LOCK), concurrency.ErrDeadlock)
+	if err := tm.Commit(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Commit(a); err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors from the lock manager.
+	lm := concurrency.NewLockManager()
+	check("unlock nonexistent lock", lm.Unlock(concurrency.NewResource("t", 1), concurrency.R_LOCK), concurrency.ErrResourceNotLocked)
+
+	// Errors stay matchable through the REPL handlers.
+	client := newReplClient(r)
+	check("insert without transaction", r.Execute("insert 1 1 into t", client.config), concurrency.ErrTxNotFound)
+}
+
+func TestTransactionValidateReadSet(t *testing.T) {
+	d, folder, tm, _ := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader, writer, bystander := uuid.New(), uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{reader, writer} {
+		if err := tm.Begin(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The reader reads keys 1 and 2, then releases its lock on 1 early.
+	for _, key := range []int64{2, 1} {
+		if err := tm.Lock(reader, table, key, concurrency.R_LOCK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tm.Unlock(reader, table, 1, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	rt, _ := tm.GetTransaction(reader)
+	readSet := rt.ReadSet()
+	if len(readSet) != 2 || readSet[0].GetResourceKey() != 1 || readSet[1].GetResourceKey() != 2 {
+		t.Errorf("expected the read set to hold keys 1 and 2, got %v", readSet)
+	}
+	// A write to a key the reader didn't read doesn't conflict.
+	if err := tm.Lock(writer, table, 3, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Commit(writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Validate(reader); err != nil {
+		t.Errorf("expected the reader to validate, got %v", err)
+	}
+	// The writer then overwrites key 1 and commits before the reader does.
+	if err := tm.Begin(writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Lock(writer, table, 1, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Commit(writer); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Validate(reader); !errors.Is(err, concurrency.ErrValidationFailed) {
+		t.Errorf("expected validation to fail with %v, got %v", concurrency.ErrValidationFailed, err)
+	}
+	// A transaction that began after the write commits can read key 1 safely.
+	if err := tm.Begin(bystander); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Lock(bystander, table, 1, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Validate(bystander); err != nil {
+		t.Errorf("expected a transaction that began after the write to validate, got %v", err)
+	}
+	for _, id := range []uuid.UUID{reader, bystander} {
+		if err := tm.Commit(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTransactionOptimisticCommit(t *testing.T) {
+	d, folder, tm, r := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	tm.SetMode(concurrency.OPTIMISTIC)
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	a, b := newReplClient(r), newReplClient(r)
+	a.run(t, "transaction begin")
+	a.run(t, "insert 1 10 into t")
+	a.run(t, "insert 2 20 into t")
+	a.run(t, "update t 1 11")
+	if got := a.run(t, "find 1 from t"); got != "found entry: (1, 11)\n" {
+		t.Errorf("transaction should see its own buffered writes; got %q", got)
+	}
+	// Buffered writes take no locks and stay out of the table until commit.
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Find(1); err == nil {
+		t.Error("uncommitted insert written to the table")
+	}
+	b.run(t, "transaction begin")
+	b.run(t, "insert 3 30 into t")
+	a.run(t, "transaction commit")
+	b.run(t, "transaction commit")
+	a.run(t, "transaction begin")
+	for key, want := range map[int]string{1: "(1, 11)", 2: "(2, 20)", 3: "(3, 30)"} {
+		if got := a.run(t, fmt.Sprintf("find %d from t", key)); !strings.Contains(got, want) {
+			t.Errorf("expected %s after both commits, got %q", want, got)
+		}
+	}
+	a.run(t, "delete 2 from t")
+	a.run(t, "transaction commit")
+	if _, err := table.Find(2); err == nil {
+		t.Error("committed delete not applied")
+	}
+}
+
+func TestTransactionOptimisticConflict(t *testing.T) {
+	d, folder, tm, r := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	tm.SetMode(concurrency.OPTIMISTIC)
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	setup := newReplClient(r)
+	setup.run(t, "transaction begin")
+	setup.run(t, "insert 1 100 into t")
+	setup.run(t, "transaction commit")
+	// Both transactions read key 1 and write back an increment.
+	a, b := newReplClient(r), newReplClient(r)
+	a.run(t, "transaction begin")
+	b.run(t, "transaction begin")
+	a.run(t, "find 1 from t")
+	b.run(t, "find 1 from t")
+	a.run(t, "update t 1 101")
+	b.run(t, "update t 1 101")
+	a.run(t, "transaction commit")
+	if err := r.Execute("transaction commit", b.config); !errors.Is(err, concurrency.ErrValidationFailed) {
+		t.Errorf("expected the second commit to fail with %v, got %v", concurrency.ErrValidationFailed, err)
+	}
+	if _, found := tm.GetTransaction(b.config.GetAddr()); found {
+		t.Error("aborted transaction still running")
+	}
+	// The aborted transaction can retry and see the first one's write.
+	b.run(t, "transaction begin")
+	if got := b.run(t, "find 1 from t"); got != "found entry: (1, 101)\n" {
+		t.Errorf("expected the retry to read (1, 101), got %q", got)
+	}
+	b.run(t, "update t 1 102")
+	b.run(t, "transaction commit")
+}
+
+func TestTransactionMetrics(t *testing.T) {
+	d, folder, tm, r := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := newReplClient(r), newReplClient(r), newReplClient(r)
+	a.run(t, "transaction begin")
+	b.run(t, "transaction begin")
+	a.run(t, "lock t 1")
+	b.run(t, "lock t 2")
+	// a waits on b, then b closes the cycle and is refused.
+	locked := make(chan error)
+	go func() {
+		locked <- r.Execute("lock t 2", a.config)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := r.Execute("lock t 1", b.config); !errors.Is(err, concurrency.ErrDeadlock) {
+		t.Fatalf("expected %v, got %v", concurrency.ErrDeadlock, err)
+	}
+	if err := tm.Abort(b.config.GetAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-locked; err != nil {
+		t.Fatal(err)
+	}
+	a.run(t, "transaction commit")
+	c.run(t, "transaction begin")
+	c.run(t, "transaction commit")
+
+	want := concurrency.MetricsSnapshot{Begins: 3, Commits: 2, Aborts: 1, Deadlocks: 1, LockWaits: 1}
+	if got := tm.GetMetrics().Snapshot(); got != want {
+		t.Errorf("expected metrics %+v, got %+v", want, got)
+	}
+	if got := c.run(t, "metrics"); !strings.Contains(got, "deadlocks: 1\n") || !strings.Contains(got, "commits: 2\n") {
+		t.Errorf("unexpected metrics output %q", got)
+	}
+}
+
+func TestTransactionPeriodicDeadlockDetection(t *testing.T) {
+	d, folder, tm, r := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	tm.SetDeadlockDetectionInterval(10 * time.Millisecond)
+	defer tm.SetDeadlockDetectionInterval(0)
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	a, b := newReplClient(r), newReplClient(r)
+	a.run(t, "transaction begin")
+	b.run(t, "transaction begin")
+	a.run(t, "lock t 1")
+	b.run(t, "lock t 2")
+	// Both requests block at first; the detector refuses one of them.
+	results := make(chan *replClient, 2)
+	errs := make(map[*replClient]error)
+	var mtx sync.Mutex
+	for _, step := range []struct {
+		client  *replClient
+		payload string
+	}{{a, "lock t 2"}, {b, "lock t 1"}} {
+		go func(client *replClient, payload string) {
+			err := r.Execute(payload, client.config)
+			mtx.Lock()
+			errs[client] = err
+			mtx.Unlock()
+			results <- client
+		}(step.client, step.payload)
+	}
+	var victim *replClient
+	select {
+	case victim = <-results:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock was never resolved")
+	}
+	mtx.Lock()
+	err := errs[victim]
+	mtx.Unlock()
+	if !errors.Is(err, concurrency.ErrDeadlock) {
+		t.Fatalf("expected the first request to finish to fail with %v, got %v", concurrency.ErrDeadlock, err)
+	}
+	var deadlock *concurrency.DeadlockError
+	if !errors.As(err, &deadlock) || len(deadlock.Cycle) != 2 || deadlock.Cycle[0] != victim.config.GetAddr() {
+		t.Errorf("expected a two-transaction cycle starting with the victim, got %v", err)
+	}
+	// Once the victim aborts, the survivor gets its lock.
+	if err := tm.Abort(victim.config.GetAddr()); err != nil {
+		t.Fatal(err)
+	}
+	survivor := <-results
+	mtx.Lock()
+	err = errs[survivor]
+	mtx.Unlock()
+	if err != nil {
+		t.Errorf("expected the surviving request to succeed, got %v", err)
+	}
+	survivor.run(t, "transaction commit")
+	if got := tm.GetMetrics().Snapshot().Deadlocks; got != 1 {
+		t.Errorf("expected 1 deadlock counted, got %d", got)
+	}
+}
+
+// Lock fresh keys while many other transactions wait, so the precedence graph is large.
+func benchmarkLockWithWaiters(b *testing.B, interval time.Duration) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	d, err := db.Open(folder)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		b.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		b.Fatal(err)
+	}
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	tm.SetDeadlockDetectionInterval(interval)
+	defer tm.SetDeadlockDetectionInterval(0)
+	holder := uuid.New()
+	tm.Begin(holder)
+	if err := tm.Lock(holder, table, 0, concurrency.W_LOCK); err != nil {
+		b.Fatal(err)
+	}
+	const numWaiters = 50
+	var wg sync.WaitGroup
+	waiters := make([]uuid.UUID, numWaiters)
+	for i := range waiters {
+		waiters[i] = uuid.New()
+		tm.Begin(waiters[i])
+		wg.Add(1)
+		go func(id uuid.UUID) {
+			defer wg.Done()
+			tm.Lock(id, table, 0, concurrency.R_LOCK)
+		}(waiters[i])
+	}
+	for tm.GetMetrics().Snapshot().LockWaits < numWaiters {
+		time.Sleep(time.Millisecond)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tm.Lock(holder, table, int64(i+1), concurrency.W_LOCK); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	tm.Commit(holder)
+	wg.Wait()
+	for _, id := range waiters {
+		tm.Commit(id)
+	}
+}
+
+func BenchmarkLockDetectEveryLock(b *testing.B) {
+	benchmarkLockWithWaiters(b, 0)
+}
+
+func BenchmarkLockDetectPeriodically(b *testing.B) {
+	benchmarkLockWithWaiters(b, 10*time.Millisecond)
+}
+
+func TestGraphIncrementalCycleDetection(t *testing.T) {
+	rng := rand.New(rand.NewSource(int64(hash_salt)))
+	nodes := make([]*concurrency.Transaction, 8)
+	for i := range nodes {
+		nodes[i] = new(concurrency.Transaction)
+	}
+	type edge struct{ from, to *concurrency.Transaction }
+	g := concurrency.NewGraph()
+	edges := make([]edge, 0)
+	for step := 0; step < 5000; step++ {
+		if len(edges) > 0 && rng.Intn(3) == 0 {
+			i := rng.Intn(len(edges))
+			if err := g.RemoveEdge(edges[i].from, edges[i].to); err != nil {
+				t.Fatal(err)
+			}
+			edges = append(edges[:i], edges[i+1:]...)
+			continue
+		}
+		e := edge{nodes[rng.Intn(len(nodes))], nodes[rng.Intn(len(nodes))]}
+		// Check the edge against a full scan of a copy of the graph with it added.
+		full := concurrency.NewGraph()
+		for _, other := range append(edges, e) {
+			full.AddEdge(other.from, other.to)
+		}
+		wouldCycle := full.DetectCycle()
+		if added := g.TryAddEdge(e.from, e.to); added == wouldCycle {
+			t.Fatalf("step %d: incremental detector added edge: %v; full scan found cycle: %v", step, added, wouldCycle)
+		}
+		if !wouldCycle {
+			edges = append(edges, e)
+		}
+		if g.DetectCycle() {
+			t.Fatalf("step %d: graph has a cycle after TryAddEdge", step)
+		}
+	}
+	// A cycle closed by AddEdge is tolerated until one of its edges is removed.
+	a, b, c := new(concurrency.Transaction), new(concurrency.Transaction), new(concurrency.Transaction)
+	cyclic := concurrency.NewGraph()
+	cyclic.AddEdge(a, b)
+	cyclic.AddEdge(b, a)
+	if !cyclic.TryAddEdge(b, c) {
+		t.Error("expected edges to be added freely to an already cyclic graph")
+	}
+	if err := cyclic.RemoveEdge(b, a); err != nil {
+		t.Fatal(err)
+	}
+	if cyclic.TryAddEdge(c, a) {
+		t.Error("expected the incremental detector to recover once the cycle was broken")
+	}
+}
+
+func TestTransactionGetTransactionsSnapshot(t *testing.T) {
+	d, folder, tm, _ := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	// Begin and commit transactions while another goroutine iterates the snapshots.
+	stop := make(chan bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				id := uuid.New()
+				if err := tm.Begin(id); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := tm.Commit(id); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for deadline := time.Now().Add(100 * time.Millisecond); time.Now().Before(deadline); {
+		for id, txn := range tm.GetTransactions() {
+			if txn.GetClientID() != id {
+				t.Errorf("snapshot maps %v to transaction %v", id, txn.GetClientID())
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if n := len(tm.GetTransactions()); n != 0 {
+		t.Errorf("expected no transactions left running, got %d", n)
+	}
+}
+
+func TestTransactionLocksCommand(t *testing.T) {
+	d, folder, _, r := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	a, b := newReplClient(r), newReplClient(r)
+	a.run(t, "transaction begin")
+	a.run(t, "insert 5 50 into t")
+	a.run(t, "transaction commit")
+	a.run(t, "transaction begin")
+	a.run(t, "find 5 from t")
+	a.run(t, "lock t 9")
+	want := "t 5: read lock\nt 9: write lock\n"
+	if got := b.run(t, fmt.Sprintf("transaction locks %s", a.config.GetAddr())); got != want {
+		t.Errorf("expected locks %q, got %q", want, got)
+	}
+	a.run(t, "transaction commit")
+	if got := b.run(t, fmt.Sprintf("transaction locks %s", a.config.GetAddr())); got != "no such transaction\n" {
+		t.Errorf("expected a committed transaction to be gone, got %q", got)
+	}
+}
+
+func TestTransactionMaxDuration(t *testing.T) {
+	d, folder, tm, r := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	tm.SetMaxTransactionDuration(20 * time.Millisecond)
+	defer tm.SetMaxTransactionDuration(0)
+	stale := newReplClient(r)
+	stale.run(t, "transaction begin")
+	stale.run(t, "insert 1 10 into t")
+	started := time.Now()
+	// Sleep past the limit; the sweeper should abort the transaction soon after.
+	time.Sleep(40 * time.Millisecond)
+	for {
+		if _, found := tm.GetTransaction(stale.config.GetAddr()); !found {
+			break
+		}
+		if time.Since(started) > time.Second {
+			t.Fatal("transaction was not aborted after running past the limit")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := tm.GetMetrics().Snapshot().Expired; got != 1 {
+		t.Errorf("expected 1 expired transaction, got %d", got)
+	}
+	// Its write lock should be free for another transaction.
+	other := newReplClient(r)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		other.run(t, "transaction begin")
+		other.run(t, "update t 1 11")
+		other.run(t, "transaction commit")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the aborted transaction's lock was not released")
+	}
+	// Transactions within the limit are left alone.
+	tm.SetMaxTransactionDuration(time.Minute)
+	other.run(t, "transaction begin")
+	time.Sleep(20 * time.Millisecond)
+	other.run(t, "transaction commit")
+}
+
+func TestTransactionDeadlockErrorCycle(t *testing.T) {
+	d, folder, tm, _ := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a, b and c each hold a key, then a waits on b and b waits on c.
+	a, b, c := uuid.New(), uuid.New(), uuid.New()
+	for i, id := range []uuid.UUID{a, b, c} {
+		if err := tm.Begin(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := tm.Lock(id, table, int64(i+1), concurrency.W_LOCK); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waits := make(chan error, 2)
+	go func() { waits <- tm.Lock(a, table, 2, concurrency.W_LOCK) }()
+	go func() { waits <- tm.Lock(b, table, 3, concurrency.W_LOCK) }()
+	time.Sleep(50 * time.Millisecond)
+	// c waiting on a would close the cycle c -> a -> b -> c.
+	err = tm.Lock(c, table, 1, concurrency.W_LOCK)
+	if !errors.Is(err, concurrency.ErrDeadlock) {
+		t.Fatalf("expected %v, got %v", concurrency.ErrDeadlock, err)
+	}
+	var deadlock *concurrency.DeadlockError
+	if !errors.As(err, &deadlock) {
+		t.Fatalf("expected a DeadlockError, got %T", err)
+	}
+	want := []uuid.UUID{c, a, b}
+	if len(deadlock.Cycle) != len(want) {
+		t.Fatalf("expected cycle %v, got %v", want, deadlock.Cycle)
+	}
+	for i := range want {
+		if deadlock.Cycle[i] != want[i] {
+			t.Fatalf("expected cycle %v, got %v", want, deadlock.Cycle)
+		}
+	}
+	if deadlock.Resource.GetTableName() != "t" || deadlock.Resource.GetResourceKey() != 1 {
+		t.Errorf("expected the contended resource to be t 1, got %s %d",
+			deadlock.Resource.GetTableName(), deadlock.Resource.GetResourceKey())
+	}
+	// Committing c lets b through, and committing b lets a through.
+	for _, id := range []uuid.UUID{c, b} {
+		if err := tm.Commit(id); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-waits; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tm.Commit(a); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A client connected to a server, whose commands return the output before the next prompt.
+type serverClient struct {
+	conn   net.Conn
+	output chan string
+}
+
+const SERVER_TEST_PROMPT = "> "
+
+func dialServer(t *testing.T, addr string) *serverClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &serverClient{conn: conn, output: make(chan string, 16)}
+	// Split what the server writes back at each prompt.
+	go func() {
+		defer close(c.output)
+		var sb strings.Builder
+		buf := make([]byte, 1024)
+		for {
+			n, err := conn.Read(buf)
+			sb.Write(buf[:n])
+			for strings.Contains(sb.String(), SERVER_TEST_PROMPT) {
+				parts := strings.SplitN(sb.String(), SERVER_TEST_PROMPT, 2)
+				c.output <- parts[0]
+				sb.Reset()
+				sb.WriteString(parts[1])
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	<-c.output
+	return c
+}
+
+// Send a command without waiting for its output.
+func (c *serverClient) send(t *testing.T, payload string) {
+	if _, err := c.conn.Write([]byte(payload + "\n")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Send a command and wait for its output.
+func (c *serverClient) run(t *testing.T, payload string) string {
+	c.send(t, payload)
+	return <-c.output
+}
+
+func TestTransactionServer(t *testing.T) {
+	d, folder, tm, r := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	server := repl.NewServer(r, tm.ReleaseOnDisconnect(), SERVER_TEST_PROMPT)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() { served <- server.Serve(listener) }()
+	a, b := dialServer(t, listener.Addr().String()), dialServer(t, listener.Addr().String())
+	if got := len(server.GetClients()); got != 2 {
+		t.Fatalf("expected 2 clients, got %d", got)
+	}
+	a.run(t, "create btree table t")
+	a.run(t, "transaction begin")
+	a.run(t, "insert 1 10 into t")
+	b.run(t, "transaction begin")
+	b.send(t, "find 1 from t")
+	// b's read waits for a's uncommitted write.
+	select {
+	case got := <-b.output:
+		t.Fatalf("read an uncommitted write: %q", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+	a.run(t, "transaction commit")
+	if got := <-b.output; !strings.Contains(got, "(1, 10)") {
+		t.Errorf("expected the committed write, got %q", got)
+	}
+	// A client that disconnects mid-transaction has it aborted, releasing its locks.
+	b.run(t, "transaction commit")
+	b.run(t, "transaction begin")
+	b.run(t, "update t 1 11")
+	b.conn.Close()
+	a.run(t, "transaction begin")
+	if got := a.run(t, "find 1 from t"); !strings.Contains(got, "(1, ") {
+		t.Errorf("expected key 1 to be found, got %q", got)
+	}
+	a.run(t, "transaction commit")
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if got := len(server.GetClients()); got != 0 {
+		t.Errorf("expected no clients after close, got %d", got)
+	}
+}
+
+func TestTransactionLockAll(t *testing.T) {
+	d, folder, tm, _ := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := concurrency.ResourceRequest{Table: table, Key: 1, LockType: concurrency.W_LOCK}
+	y := concurrency.ResourceRequest{Table: table, Key: 2, LockType: concurrency.W_LOCK}
+	// Opposite caller orders would deadlock with Lock; LockAll takes both in the same order.
+	for i := 0; i < 50; i++ {
+		start := make(chan struct{})
+		errs := make(chan error, 2)
+		for _, order := range [][]concurrency.ResourceRequest{{x, y}, {y, x}} {
+			go func(order []concurrency.ResourceRequest) {
+				clientId := uuid.New()
+				if err := tm.Begin(clientId); err != nil {
+					errs <- err
+					return
+				}
+				<-start
+				err := tm.LockAll(clientId, order)
+				tm.Commit(clientId)
+				errs <- err
+			}(order)
+		}
+		close(start)
+		for j := 0; j < 2; j++ {
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// A resource requested with both lock types is write-locked once.
+	clientId := uuid.New()
+	if err := tm.Begin(clientId); err != nil {
+		t.Fatal(err)
+	}
+	read := concurrency.ResourceRequest{Table: table, Key: 1, LockType: concurrency.R_LOCK}
+	if err := tm.LockAll(clientId, []concurrency.ResourceRequest{read, x}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Unlock(clientId, table, 1, concurrency.W_LOCK); err != nil {
+		t.Errorf("expected a write lock on key 1: %v", err)
+	}
+	tm.Commit(clientId)
+}
+
+func TestTransactionMVCCSnapshot(t *testing.T) {
+	d, folder, tm, r := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	tm.SetMode(concurrency.MVCC)
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	writer, reader := newReplClient(r), newReplClient(r)
+	writer.run(t, "transaction begin")
+	writer.run(t, "insert 1 10 into t")
+	writer.run(t, "insert 2 20 into t")
+	writer.run(t, "transaction commit")
+
+	// The reader's snapshot stays put while newer versions commit.
+	reader.run(t, "transaction begin")
+	if got := reader.run(t, "find 1 from t"); got != "found entry: (1, 10)\n" {
+		t.Fatalf("expected (1, 10), got %q", got)
+	}
+	writer.run(t, "transaction begin")
+	writer.run(t, "update t 1 11")
+	writer.run(t, "update t 2 21")
+	writer.run(t, "transaction commit")
+	writer.run(t, "transaction begin")
+	writer.run(t, "delete 1 from t")
+	writer.run(t, "insert 3 30 into t")
+	writer.run(t, "transaction commit")
+	for key, want := range map[int]string{1: "(1, 10)", 2: "(2, 20)"} {
+		if got := reader.run(t, fmt.Sprintf("find %d from t", key)); !strings.Contains(got, want) {
+			t.Errorf("expected the snapshot's %s, got %q", want, got)
+		}
+	}
+	if got := reader.run(t, "select from t"); got != "(1, 10)\n(2, 20)\n" {
+		t.Errorf("expected the snapshot's entries, got %q", got)
+	}
+	reader.run(t, "transaction commit")
+	reader.run(t, "transaction begin")
+	if got := reader.run(t, "select from t"); got != "(2, 21)\n(3, 30)\n" {
+		t.Errorf("expected the latest entries in a new snapshot, got %q", got)
+	}
+	reader.run(t, "transaction commit")
+	versions := tm.GetVersions("t", 1)
+	// Before the first commit, the key didn't exist.
+	if len(versions) != 4 || !versions[0].Deleted || versions[1].Value != 10 || versions[2].Value != 11 || !versions[3].Deleted {
+		t.Errorf("expected key 1 to be missing, then 10, then 11, then deleted; got %v", versions)
+	}
+
+	// Of two transactions writing the same key, the first to commit wins.
+	a, b := newReplClient(r), newReplClient(r)
+	a.run(t, "transaction begin")
+	b.run(t, "transaction begin")
+	a.run(t, "update t 2 22")
+	b.run(t, "update t 2 23")
+	a.run(t, "transaction commit")
+	if err := r.Execute("transaction commit", b.config); !errors.Is(err, concurrency.ErrWriteConflict) {
+		t.Errorf("expected %v, got %v", concurrency.ErrWriteConflict, err)
+	}
+	reader.run(t, "transaction begin")
+	if got := reader.run(t, "find 2 from t"); got != "found entry: (2, 22)\n" {
+		t.Errorf("expected the first commit's (2, 22), got %q", got)
+	}
+	reader.run(t, "transaction commit")
+}
+
+func TestTransactionMVCCCollectVersions(t *testing.T) {
+	d, folder, tm, r := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	tm.SetMode(concurrency.MVCC)
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	writer, old, newer := newReplClient(r), newReplClient(r), newReplClient(r)
+	write := func(payload string) {
+		writer.run(t, "transaction begin")
+		writer.run(t, payload)
+		writer.run(t, "transaction commit")
+	}
+	write("insert 1 10 into t")
+	old.run(t, "transaction begin")
+	write("update t 1 11")
+	write("update t 1 12")
+	newer.run(t, "transaction begin")
+	write("update t 1 13")
+	if got := len(tm.GetVersions("t", 1)); got != 5 {
+		t.Fatalf("expected 5 versions before collecting, got %d", got)
+	}
+	if got := tm.OldestActiveSeq(); got != 1 {
+		t.Errorf("expected the oldest snapshot to be at commit 1, got %d", got)
+	}
+	// Only the versions the two readers and later transactions see are needed.
+	if pruned := tm.CollectVersions(); pruned != 2 {
+		t.Errorf("expected 2 versions pruned, got %d", pruned)
+	}
+	versions := tm.GetVersions("t", 1)
+	if len(versions) != 3 || versions[0].Value != 10 || versions[1].Value != 12 || versions[2].Value != 13 {
+		t.Errorf("expected versions 10, 12 and 13 to remain, got %v", versions)
+	}
+	if got := old.run(t, "find 1 from t"); got != "found entry: (1, 10)\n" {
+		t.Errorf("expected the old snapshot's (1, 10), got %q", got)
+	}
+	if got := newer.run(t, "find 1 from t"); got != "found entry: (1, 12)\n" {
+		t.Errorf("expected the newer snapshot's (1, 12), got %q", got)
+	}
+	old.run(t, "transaction commit")
+	newer.run(t, "transaction commit")
+
+	// Once no snapshot needs an older version, the background collector drops the chain.
+	tm.SetVersionCollectionInterval(5 * time.Millisecond)
+	defer tm.SetVersionCollectionInterval(0)
+	deadline := time.Now().Add(time.Second)
+	for len(tm.GetVersions("t", 1)) > 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if versions := tm.GetVersions("t", 1); len(versions) != 0 {
+		t.Fatalf("expected no versions left, got %v", versions)
+	}
+	newer.run(t, "transaction begin")
+	if got := newer.run(t, "find 1 from t"); got != "found entry: (1, 13)\n" {
+		t.Errorf("expected (1, 13) from the table, got %q", got)
+	}
+	newer.run(t, "transaction commit")
+}
+
+func TestTransactionUpdateLock(t *testing.T) {
+	d, folder, tm, _ := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Insert(1, 0); err != nil {
+		t.Fatal(err)
+	}
+	// Update locks share the key with readers.
+	updater, reader := uuid.New(), uuid.New()
+	for _, clientId := range []uuid.UUID{updater, reader} {
+		if err := tm.Begin(clientId); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tm.Lock(updater, table, 1, concurrency.UPDATE_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Lock(reader, table, 1, concurrency.R_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	// The upgrade waits for the reader to finish.
+	upgraded := make(chan error, 1)
+	go func() { upgraded <- tm.Lock(updater, table, 1, concurrency.W_LOCK) }()
+	select {
+	case err := <-upgraded:
+		t.Fatalf("expected the upgrade to wait for the reader, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	tm.Commit(reader)
+	if err := <-upgraded; err != nil {
+		t.Fatal(err)
+	}
+	tm.Commit(updater)
+	// Concurrent read-modify-writes queue up on the update lock instead of deadlocking.
+	const rounds = 20
+	errs := make(chan error, 2)
+	for w := 0; w < 2; w++ {
+		go func() {
+			for i := 0; i < rounds; i++ {
+				clientId := uuid.New()
+				if err := tm.Begin(clientId); err != nil {
+					errs <- err
+					return
+				}
+				err := tm.Lock(clientId, table, 1, concurrency.UPDATE_LOCK)
+				var entry utils.Entry
+				if err == nil {
+					entry, err = table.Find(1)
+				}
+				if err == nil {
+					err = tm.Lock(clientId, table, 1, concurrency.W_LOCK)
+				}
+				if err == nil {
+					err = table.Update(1, entry.GetValue()+1)
+				}
+				tm.Commit(clientId)
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	for w := 0; w < 2; w++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	entry, err := table.Find(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.GetValue() != 2*rounds {
+		t.Errorf("expected %d increments, got %d", 2*rounds, entry.GetValue())
+	}
+}
+
+func TestTransactionWaitForQuiescence(t *testing.T) {
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	if err := tm.WaitForQuiescence(time.Second); err != nil {
+		t.Fatalf("expected an idle manager to be quiescent, got %v", err)
+	}
+	ids := make([]uuid.UUID, 3)
+	for i := range ids {
+		ids[i] = uuid.New()
+		if err := tm.Begin(ids[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := tm.ActiveCount(); n != len(ids) {
+		t.Fatalf("expected %d active transactions, got %d", len(ids), n)
+	}
+	// Nothing ends, so the wait times out.
+	if err := tm.WaitForQuiescence(20 * time.Millisecond); !errors.Is(err, concurrency.ErrQuiesceTimeout) {
+		t.Fatalf("expected a quiescence timeout, got %v", err)
+	}
+	// Commit the transactions one by one on a timer.
+	for i, id := range ids {
+		id := id
+		time.AfterFunc(time.Duration(i+1)*20*time.Millisecond, func() {
+			if err := tm.Commit(id); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	start := time.Now()
+	if err := tm.WaitForQuiescence(5 * time.Second); err != nil {
+		t.Fatalf("expected the transactions to finish, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("returned after %v, before the last commit", elapsed)
+	}
+	if n := tm.ActiveCount(); n != 0 {
+		t.Errorf("expected no active transactions, got %d", n)
+	}
+}
+
+func TestTransactionOnCommit(t *testing.T) {
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	first := make([]uuid.UUID, 0)
+	second := make([]uuid.UUID, 0)
+	tm.OnCommit(func(clientId uuid.UUID) {
+		first = append(first, clientId)
+		// The hook runs outside the manager's lock, and after the transaction is gone.
+		if _, running := tm.GetTransactions()[clientId]; running {
+			t.Error("expected the transaction to be removed before the hook runs")
+		}
+	})
+	tm.OnCommit(func(clientId uuid.UUID) {
+		second = append(second, clientId)
+	})
+	committer, aborter := uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{committer, aborter} {
+		if err := tm.Begin(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tm.Abort(aborter); err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Commit(committer); err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 1 || first[0] != committer || len(second) != 1 || second[0] != committer {
+		t.Errorf("expected both hooks to fire once for %v, got %v and %v", committer, first, second)
+	}
+	// Failed commits don't fire the hooks.
+	if err := tm.Commit(committer); err == nil {
+		t.Fatal("expected committing twice to fail")
+	}
+	if len(first) != 1 || len(second) != 1 {
+		t.Errorf("expected no hooks for a failed commit, got %v and %v", first, second)
+	}
+	// Nor do nested commits, only the commit of the outermost transaction.
+	if err := tm.Begin(committer); err != nil {
+		t.Fatal(err)
+	}
+	child, err := tm.BeginNested(committer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tm.Commit(child); err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 1 {
+		t.Errorf("expected no hooks for a nested commit, got %v", first)
+	}
+	if err := tm.Commit(committer); err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 || first[1] != committer {
+		t.Errorf("expected the hooks to fire for the outer commit, got %v", first)
+	}
+}
+
+func TestTransactionWouldConflict(t *testing.T) {
+	d, folder, tm, _ := setupTransactions(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	holder, asker := uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{holder, asker} {
+		if err := tm.Begin(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	held := []concurrency.ResourceRequest{
+		{Table: table, Key: 1, LockType: concurrency.W_LOCK},
+		{Table: table, Key: 2, LockType: concurrency.R_LOCK},
+	}
+	if err := tm.LockAll(holder, held); err != nil {
+		t.Fatal(err)
+	}
+	// The asker holds key 5 itself, which never conflicts.
+	if err := tm.Lock(asker, table, 5, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	requests := []concurrency.ResourceRequest{
+		{Table: table, Key: 1, LockType: concurrency.R_LOCK}, // Written by the holder.
+		{Table: table, Key: 2, LockType: concurrency.R_LOCK}, // Shared with the holder.
+		{Table: table, Key: 2, LockType: concurrency.W_LOCK}, // Read by the holder.
+		{Table: table, Key: 3, LockType: concurrency.W_LOCK}, // Free.
+		{Table: table, Key: 5, LockType: concurrency.W_LOCK}, // The asker's own.
+	}
+	conflicts := tm.WouldConflict(asker, requests)
+	if len(conflicts) != 2 || conflicts[0].GetResourceKey() != 1 || conflicts[1].GetResourceKey() != 2 ||
+		conflicts[0].GetTableName() != "t" {
+		t.Fatalf("expected keys 1 and 2 of t to conflict, got %v", conflicts)
+	}
+	// Nothing was locked by asking.
+	if err := tm.Lock(asker, table, 3, concurrency.W_LOCK); err != nil {
+		t.Fatal(err)
+	}
+	if conflicts := tm.WouldConflict(holder, requests[3:]); len(conflicts) != 2 {
+		t.Errorf("expected the asker's keys 3 and 5 to conflict for the holder, got %v", conflicts)
+	}
+	if err := tm.Commit(holder); err != nil {
+		t.Fatal(err)
+	}
+	if conflicts := tm.WouldConflict(asker, requests); len(conflicts) != 0 {
+		t.Errorf("expected no conflicts once the holder committed, got %v", conflicts)
+	}
+}
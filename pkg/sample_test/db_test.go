@@ -0,0 +1,1185 @@
+package test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
+// syncCountingFile counts calls to Sync on the wrapped file.
+type syncCountingFile struct {
+	pager.File
+	syncs int
+}
+
+func (f *syncCountingFile) Sync() error {
+	f.syncs++
+	return f.File.Sync()
+}
+
+func setupDatabase(t testing.TB) (*db.Database, string) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := db.Open(folder)
+	if err != nil {
+		os.RemoveAll(folder)
+		t.Fatal(err)
+	}
+	return d, folder
+}
+
+func TestDatabaseFlush(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+
+	// Create a table of each type and write to them.
+	for _, payload := range []string{"create btree table t1", "create hash table t2"} {
+		if err := db.HandleCreateTable(d, payload, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := make(map[string]*syncCountingFile)
+	for name, table := range d.GetTables() {
+		for i := int64(0); i < 100; i++ {
+			if err := table.Insert(i, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+		table.GetPager().WrapFile(func(f pager.File) pager.File {
+			files[name] = &syncCountingFile{File: f}
+			return files[name]
+		})
+	}
+
+	// Flush; every table should have been synced.
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for name, f := range files {
+		if f.syncs != 1 {
+			t.Errorf("table %s synced %d times; expected 1", name, f.syncs)
+		}
+	}
+
+	// The data should be on disk and readable after a reopen.
+	d.Close()
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	table, err := d.GetTable("t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 100; i++ {
+		if _, err := table.Find(i); err != nil {
+			t.Errorf("key %d missing after flush: %v", i, err)
+		}
+	}
+}
+
+func TestDatabaseReindex(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	for _, payload := range []string{"create btree table t1", "create hash table t2"} {
+		if err := db.HandleCreateTable(d, payload, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const n = 5000
+	for _, table := range d.GetTables() {
+		for i := int64(0); i < n; i++ {
+			if err := table.Insert(i, i*2); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	bt := d.GetTables()["t1"].(*btree.BTreeIndex)
+	ht := d.GetTables()["t2"].(*hash.HashIndex)
+
+	// Point the btree root's first separator past every key, and swap two hash buckets.
+	root, err := bt.GetPager().GetPage(btree.ROOT_PN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	separator := make([]byte, btree.KEY_SIZE)
+	binary.PutVarint(separator, math.MaxInt64/2)
+	root.Update(separator, btree.KEYS_OFFSET, btree.KEY_SIZE)
+	root.Put()
+	buckets := ht.GetTable().GetBuckets()
+	buckets[0], buckets[1] = buckets[1], buckets[0]
+	if _, _, ok, _ := btree.IsBTree(bt); ok {
+		t.Fatal("btree should fail verification after corruption")
+	}
+	if ok, _ := hash.IsHash(ht); ok {
+		t.Fatal("hash table should fail verification after corruption")
+	}
+
+	// Reindexing recovers every entry.
+	for _, name := range []string{"t1", "t2"} {
+		if err := d.Reindex(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, ok, err := btree.IsBTree(bt); !ok || err != nil {
+		t.Errorf("btree fails verification after reindex (err: %v)", err)
+	}
+	if ok, err := hash.IsHash(ht); !ok || err != nil {
+		t.Errorf("hash table fails verification after reindex (err: %v)", err)
+	}
+	for name, table := range d.GetTables() {
+		for i := int64(0); i < n; i++ {
+			entry, err := table.Find(i)
+			if err != nil {
+				t.Fatalf("%s: key %d lost by reindex: %v", name, i, err)
+			}
+			if entry.GetValue() != i*2 {
+				t.Fatalf("%s: key %d has value %d after reindex, expected %d", name, i, entry.GetValue(), i*2)
+			}
+		}
+		// The rebuilt tables still accept writes.
+		if err := table.Insert(n, n); err != nil {
+			t.Errorf("%s: insert after reindex: %v", name, err)
+		}
+	}
+}
+
+func TestDatabaseCompact(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	for _, payload := range []string{"create btree table t1", "create hash table t2"} {
+		if err := db.HandleCreateTable(d, payload, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Compact("t1"); err == nil {
+		t.Error("expected compacting a btree table to fail")
+	}
+	ht := d.GetTables()["t2"].(*hash.HashIndex)
+	const n = 10000
+	for i := int64(0); i < n; i++ {
+		if err := ht.Insert(i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Keep every hundredth key.
+	for i := int64(0); i < n; i++ {
+		if i%100 != 0 {
+			if err := ht.Delete(i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	depth := ht.GetTable().GetDepth()
+	if err := d.Compact("t2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := ht.GetTable().GetDepth(); got >= depth {
+		t.Errorf("expected compaction to lower the global depth from %d, got %d", depth, got)
+	}
+	if ok, err := hash.IsHash(ht); !ok || err != nil {
+		t.Errorf("hash table fails verification after compaction (err: %v)", err)
+	}
+	for i := int64(0); i < n; i++ {
+		_, err := ht.Find(i)
+		if i%100 == 0 && err != nil {
+			t.Fatalf("key %d lost by compaction: %v", i, err)
+		}
+		if i%100 != 0 && err == nil {
+			t.Fatalf("deleted key %d found after compaction", i)
+		}
+	}
+	entries, err := ht.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != n/100 {
+		t.Errorf("expected %d entries after compaction, selected %d", n/100, len(entries))
+	}
+	// The compacted table still grows.
+	for i := int64(n); i < 2*n; i++ {
+		if err := ht.Insert(i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := hash.IsHash(ht); !ok || err != nil {
+		t.Errorf("hash table fails verification after growing again (err: %v)", err)
+	}
+}
+
+// Create a database with the given page size, fill a btree and a hash table, and reopen it.
+func testDatabasePageSize(t *testing.T, pageSize int64) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	d, err := db.OpenWithOptions(folder, db.Options{PageSize: pageSize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range []string{"create btree table bt", "create hash table ht"} {
+		if err := db.HandleCreateTable(d, command, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"bt", "ht"} {
+		table, err := d.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := table.GetPager().GetPageSize(); size != pageSize {
+			t.Errorf("expected %s to have %d byte pages, got %d", name, pageSize, size)
+		}
+		for i := int64(0); i < 2000; i++ {
+			if err := table.Insert(i, i*hash_salt); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(folder, "bt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size()%pageSize != 0 || info.Size() <= pageSize {
+		t.Errorf("expected bt to span several %d byte pages, its file is %d bytes", pageSize, info.Size())
+	}
+
+	// A mismatched page size is refused; a matching or unset one reopens the data.
+	other := pager.DEFAULT_PAGESIZE * 2
+	if pageSize != pager.DEFAULT_PAGESIZE {
+		other = pager.DEFAULT_PAGESIZE
+	}
+	if _, err := db.OpenWithOptions(folder, db.Options{PageSize: other}); err == nil {
+		t.Errorf("expected a database with %d byte pages to refuse to open with %d", pageSize, other)
+	}
+	for _, options := range []db.Options{{PageSize: pageSize}, {}} {
+		d, err = db.OpenWithOptions(folder, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.GetPageSize() != pageSize {
+			t.Errorf("expected the reopened database to have %d byte pages, got %d", pageSize, d.GetPageSize())
+		}
+		bt, err := d.GetTable("bt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < 2000; i++ {
+			entry, err := bt.Find(i)
+			if err != nil {
+				t.Fatalf("key %d lost on reopen: %v", i, err)
+			}
+			if entry.GetValue() != i*hash_salt {
+				t.Errorf("key %d reopened with value %d; expected %d", i, entry.GetValue(), i*hash_salt)
+			}
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDatabasePageSize(t *testing.T) {
+	t.Run("4KB", func(t *testing.T) { testDatabasePageSize(t, 4096) })
+	t.Run("8KB", func(t *testing.T) { testDatabasePageSize(t, 8192) })
+	if _, err := pager.NewPagerWithSize(1000); err == nil {
+		t.Error("expected a page size that isn't a multiple of the block size to be rejected")
+	}
+}
+
+func TestDatabasePageSizesSideBySide(t *testing.T) {
+	// Databases of different page sizes, and pagers of the default size, are open at once.
+	sizes := []int64{4096, 8192, 16384}
+	dbs := make([]*db.Database, len(sizes))
+	for i, size := range sizes {
+		folder, err := ioutil.TempDir(".", "db-*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(folder)
+		if dbs[i], err = db.OpenWithOptions(folder, db.Options{PageSize: size}); err != nil {
+			t.Fatal(err)
+		}
+		defer dbs[i].Close()
+		if err = db.HandleCreateTable(dbs[i], "create btree table bt", ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		if err = db.HandleCreateTable(dbs[i], "create hash table ht", ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tempName := getTempHashDB(t)
+	defer os.Remove(tempName)
+	defer os.Remove(tempName + ".meta")
+	temp, err := hash.OpenTable(tempName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer temp.Close()
+	for i := int64(0); i < 3000; i++ {
+		for _, d := range dbs {
+			for _, name := range []string{"bt", "ht"} {
+				if err := d.Put(name, i, i*hash_salt); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := temp.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, d := range dbs {
+		for _, name := range []string{"bt", "ht"} {
+			table, err := d.GetTable(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := table.GetPager().GetPageSize(); size != sizes[i] {
+				t.Errorf("expected %s to have %d byte pages, got %d", name, sizes[i], size)
+			}
+			for j := int64(0); j < 3000; j += 7 {
+				if value, found, err := d.Get(name, j); err != nil || !found || value != j*hash_salt {
+					t.Fatalf("expected key %d of %s to hold %d, got %d, %v, %v", j, name, j*hash_salt, value, found, err)
+				}
+			}
+		}
+	}
+	if ok, err := hash.IsHash(temp); err != nil || !ok {
+		t.Errorf("expected the temporary table to stay well-formed: %v", err)
+	}
+}
+
+func TestDatabaseKeyValue(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	checkGet := func(key int64, wantValue int64, wantFound bool) {
+		value, found, err := d.Get("t", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != wantFound || value != wantValue {
+			t.Errorf("get %d: expected (%d, %v), got (%d, %v)", key, wantValue, wantFound, value, found)
+		}
+	}
+	// Put inserts, then updates.
+	if err := d.Put("t", 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	checkGet(1, 10, true)
+	if err := d.Put("t", 1, 20); err != nil {
+		t.Fatal(err)
+	}
+	checkGet(1, 20, true)
+	checkGet(2, 0, false)
+	if err := d.Delete("t", 1); err != nil {
+		t.Fatal(err)
+	}
+	checkGet(1, 0, false)
+	if err := d.Delete("t", 1); err == nil {
+		t.Error("expected deleting a missing key to fail")
+	}
+	if _, _, err := d.Get("missing", 1); err == nil {
+		t.Error("expected a get from a missing table to fail")
+	}
+}
+
+func TestDatabasePageChecksum(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 1000; i++ {
+		if err := table.Insert(i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Flip a bit in the middle of page 1.
+	path := filepath.Join(folder, "t")
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := pager.DEFAULT_PAGESIZE + pager.DEFAULT_PAGESIZE/2
+	b := make([]byte, 1)
+	if _, err := file.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0x10
+	if _, err := file.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	p := pager.NewPager()
+	if err := p.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	page, err := p.GetPage(0)
+	if err != nil {
+		t.Fatalf("expected an intact page to read back, got %v", err)
+	}
+	page.Put()
+	if _, err := p.GetPage(1); !errors.Is(err, pager.ErrPageChecksumMismatch) {
+		t.Errorf("expected %v, got %v", pager.ErrPageChecksumMismatch, err)
+	}
+
+	// A database written before pages had checksums is refused.
+	if err := ioutil.WriteFile(filepath.Join(folder, db.META_FILE), []byte(`{"page_size":4096}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Open(folder); err == nil {
+		t.Error("expected a database with the old page layout to be refused")
+	}
+}
+
+func TestDatabaseLegacyPageLayout(t *testing.T) {
+	// Tables written the way databases were before they had metadata: in page layout 0, with
+	// flat buckets and no META_FILE.
+	folder := copyLegacyTables(t)
+	defer os.RemoveAll(folder)
+
+	// Opening the database converts its tables to the current layout.
+	d, err := db.Open(folder)
+	if err != nil {
+		t.Fatalf("expected a database in page layout 0 to open, got %v", err)
+	}
+	table, err := d.GetTable("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 1000; i++ {
+		entry, err := table.Find(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.GetValue() != i*2 {
+			t.Errorf("expected %d for key %d, got %d", i*2, i, entry.GetValue())
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ht, err := hash.OpenTable(filepath.Join(folder, "h"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 1000; i++ {
+		entry, err := ht.Find(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.GetValue() != i*3 {
+			t.Errorf("expected %d for key %d, got %d", i*3, i, entry.GetValue())
+		}
+	}
+	if err := ht.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(folder, db.META_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf(`"page_layout":%d`, pager.PAGE_LAYOUT_VERSION); !strings.Contains(string(data), want) {
+		t.Errorf("expected %s to contain %s, got %s", db.META_FILE, want, data)
+	}
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.Name() == db.CONVERT_FILE || strings.Contains(file.Name(), db.CONVERT_SUFFIX) {
+			t.Errorf("expected %s to be removed after converting", file.Name())
+		}
+	}
+}
+
+func TestPagerBackgroundWriter(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	path := filepath.Join(folder, "pages")
+	p := pager.NewPager()
+	if err := p.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	// Dirty five pages, keeping the last one pinned.
+	var pinned *pager.Page
+	for i := int64(0); i < 5; i++ {
+		page, err := p.GetPage(i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		page.Update([]byte{byte(i + 1)}, 0, 1)
+		if i == 4 {
+			pinned = page
+		} else {
+			page.Put()
+		}
+	}
+	stop := p.StartBackgroundWriter(5 * time.Millisecond)
+	for deadline := time.Now().Add(time.Second); p.GetStats().BackgroundWrites < 4; {
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatalf("expected 4 pages written in the background, got %d", p.GetStats().BackgroundWrites)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	stop()
+	stop()
+	// The unpinned pages are on disk without a flush; the pinned one was left alone.
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 4; i++ {
+		if int64(len(data)) < (i+1)*pager.DEFAULT_PAGESIZE || data[i*pager.DEFAULT_PAGESIZE] != byte(i+1) {
+			t.Errorf("page %d was not written", i)
+		}
+	}
+	if !pinned.IsDirty() {
+		t.Error("expected the pinned page to be left dirty")
+	}
+	pinned.Put()
+	// Once stopped, the writer leaves new dirty pages alone.
+	written := p.GetStats().BackgroundWrites
+	page, err := p.GetPage(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page.Update([]byte{9}, 0, 1)
+	page.Put()
+	time.Sleep(30 * time.Millisecond)
+	if got := p.GetStats().BackgroundWrites; got != written {
+		t.Errorf("expected no writes after stop, got %d more", got-written)
+	}
+}
+
+func TestDatabaseMerge(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	other, otherFolder := setupDatabase(t)
+	defer os.RemoveAll(otherFolder)
+	defer other.Close()
+	fill := func(d *db.Database, payload string, name string, n int64) {
+		if err := db.HandleCreateTable(d, payload, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		table, err := d.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < n; i++ {
+			if err := table.Insert(i, i*10); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	fill(d, "create btree table a", "a", 100)
+	fill(other, "create btree table b", "b", 1000)
+	fill(other, "create hash table h", "h", 500)
+	fill(other, "create btree table shared", "shared", 10)
+	fill(d, "create btree table shared", "shared", 10)
+
+	// A name collision fails the merge before anything moves.
+	if err := d.Merge(other); err == nil {
+		t.Fatal("merged a database with a colliding table name")
+	}
+	if _, err := os.Stat(filepath.Join(otherFolder, "b")); err != nil {
+		t.Fatal("table moved by a failed merge")
+	}
+	if _, found := d.GetTables()["b"]; found {
+		t.Fatal("table registered by a failed merge")
+	}
+
+	if err := other.GetTables()["shared"].Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(filepath.Join(otherFolder, "shared")); err != nil {
+		t.Fatal(err)
+	}
+	delete(other.GetTables(), "shared")
+	if err := d.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int64{"a": 100, "b": 1000, "h": 500, "shared": 10}
+	for name, n := range counts {
+		table, found := d.GetTables()[name]
+		if !found {
+			t.Fatalf("table %s not registered after merge", name)
+		}
+		for i := int64(0); i < n; i++ {
+			entry, err := table.Find(i)
+			if err != nil {
+				t.Fatalf("%s: find %d: %v", name, i, err)
+			}
+			if entry.GetValue() != i*10 {
+				t.Fatalf("%s: expected %d for %d, got %d", name, i*10, i, entry.GetValue())
+			}
+		}
+	}
+	if _, isHash := d.GetTables()["h"].(*hash.HashIndex); !isHash {
+		t.Error("hash table not opened as a hash table after merge")
+	}
+	if len(other.GetTables()) != 0 {
+		t.Errorf("expected no tables left in the merged database, got %d", len(other.GetTables()))
+	}
+	for _, name := range []string{"b", "h", "h.meta"} {
+		if _, err := os.Stat(filepath.Join(otherFolder, name)); !os.IsNotExist(err) {
+			t.Errorf("%s left in the merged database's folder", name)
+		}
+	}
+	if err := d.Merge(d); err == nil {
+		t.Error("merged a database into itself")
+	}
+}
+
+func TestDatabaseNegativeCache(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := table.GetPager()
+	for i := int64(0); i < 2000; i += 2 {
+		if err := d.Put("t", i, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < 2000; i += 2 {
+		if found, err := d.Contains("t", i); err != nil || !found {
+			t.Fatalf("expected %d to be found, got %v, %v", i, found, err)
+		}
+	}
+	// Absent keys are answered from the filter, save for the odd false positive.
+	falsePositives := 0
+	for i := int64(1); i < 2000; i += 2 {
+		before := p.GetStats().PageGets
+		if _, found, err := d.Get("t", i); err != nil || found {
+			t.Fatalf("expected %d to be absent, got %v, %v", i, found, err)
+		}
+		if p.GetStats().PageGets != before {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("expected absent lookups to read no pages, but %d of 1000 did", falsePositives)
+	}
+	// Deleted keys become absent, and keys sharing their counters stay present.
+	for i := int64(0); i < 1000; i += 2 {
+		if err := d.Delete("t", i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < 2000; i += 2 {
+		if found, err := d.Contains("t", i); err != nil || found != (i >= 1000) {
+			t.Fatalf("expected %d to be found: %v, got %v, %v", i, i >= 1000, found, err)
+		}
+	}
+	// Handing the table out again keeps the cache, and inserts through the REPL update it.
+	absent := int64(1)
+	for ; absent < 2000; absent += 2 {
+		before := p.GetStats().PageGets
+		if found, err := d.Contains("t", absent); err != nil || found {
+			t.Fatalf("expected %d to be absent, got %v, %v", absent, found, err)
+		}
+		if p.GetStats().PageGets == before {
+			break
+		}
+	}
+	if _, err := d.GetTable("t"); err != nil {
+		t.Fatal(err)
+	}
+	before := p.GetStats().PageGets
+	if found, err := d.Contains("t", absent); err != nil || found {
+		t.Fatalf("expected %d to be absent, got %v, %v", absent, found, err)
+	}
+	if p.GetStats().PageGets != before {
+		t.Error("expected the negative cache to survive GetTable")
+	}
+	if err := db.HandleInsert(d, fmt.Sprintf("insert %d 1 into t", absent)); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := d.Contains("t", absent); err != nil || !found {
+		t.Errorf("expected a key inserted through the REPL to be found, got %v, %v", found, err)
+	}
+	// Writes that bypass Put and insert still reach the cache.
+	if err := db.HandleUpsert(d, "upsert 2001 20 into t"); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, err := d.Get("t", 2001); err != nil || !found || value != 20 {
+		t.Errorf("expected an upserted key to be found with 20, got %d, %v, %v", value, found, err)
+	}
+	if err := d.Put("t", 2001, 30); err != nil {
+		t.Errorf("expected putting an upserted key to update it, got %v", err)
+	}
+	if value, found, err := d.Get("t", 2001); err != nil || !found || value != 30 {
+		t.Errorf("expected 2001 to map to 30, got %d, %v, %v", value, found, err)
+	}
+	if err := table.Insert(2003, 1); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := d.Contains("t", 2003); err != nil || !found {
+		t.Errorf("expected a key inserted into the table directly to be found, got %v, %v", found, err)
+	}
+}
+
+func TestDatabaseDropTableWaitsForScans(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	for _, payload := range []string{"create btree table b", "create hash table h"} {
+		if err := db.HandleCreateTable(d, payload, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Put("b", 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	// A scan in progress holds the table; the drop waits for it, and holds off new reads.
+	unlockScan := d.RLockTable("b")
+	dropped := make(chan error, 1)
+	go func() { dropped <- d.DropTable("b") }()
+	select {
+	case err := <-dropped:
+		t.Fatalf("expected the drop to wait for the scan, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := d.Get("b", 1)
+		read <- err
+	}()
+	unlockScan()
+	if err := <-dropped; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-read; err == nil {
+		t.Error("expected a read queued behind the drop to find the table gone")
+	}
+	if _, err := os.Stat(filepath.Join(folder, "b")); !os.IsNotExist(err) {
+		t.Errorf("expected the table's file to be gone, got %v", err)
+	}
+	// Hash tables lose their directory too.
+	if err := d.DropTable("h"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, "h.meta")); !os.IsNotExist(err) {
+		t.Errorf("expected the hash table's directory to be gone, got %v", err)
+	}
+	if err := d.DropTable("h"); err == nil {
+		t.Error("expected dropping a missing table to fail")
+	}
+}
+
+// A codec storing the value before the key, each as a fixed-width big-endian integer.
+type valueFirstCodec struct{}
+
+func (valueFirstCodec) Encode(entry utils.Entry) []byte {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data, uint64(entry.GetValue()))
+	binary.BigEndian.PutUint64(data[8:], uint64(entry.GetKey()))
+	return data
+}
+
+func (valueFirstCodec) Decode(data []byte) (utils.Entry, int) {
+	value := int64(binary.BigEndian.Uint64(data))
+	key := int64(binary.BigEndian.Uint64(data[8:]))
+	return utils.KeyValue{Key: key, Value: value}, 16
+}
+
+func TestDatabaseEntryCodec(t *testing.T) {
+	if _, err := utils.GetCodec("valuefirst"); err != nil {
+		if err = utils.RegisterCodec("valuefirst", valueFirstCodec{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := utils.RegisterCodec(utils.DEFAULT_CODEC, valueFirstCodec{}); err == nil {
+		t.Error("expected registering a taken codec name to fail")
+	}
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	if _, err := d.CreateTableWithCodec("t", db.BTreeIndexType, "missing"); err == nil {
+		t.Error("expected creating a table with an unregistered codec to fail")
+	}
+	table, err := d.CreateTableWithCodec("t", db.BTreeIndexType, "valuefirst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Enough entries to split leaves.
+	n := int64(1000)
+	for i := int64(0); i < n; i++ {
+		if err := table.Insert(i, -i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The table records its codec, so it reads back when opened directly, but not with
+	// another codec.
+	if _, err := btree.OpenTableWithOptions(filepath.Join(folder, "t"), btree.TableOptions{Codec: utils.DEFAULT_CODEC}); err == nil {
+		t.Error("expected opening the table with another codec to fail")
+	}
+	raw, err := btree.OpenTable(filepath.Join(folder, "t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := raw.Find(n - 1); err != nil || entry.GetValue() != -(n-1) {
+		t.Errorf("expected the recorded codec to read (%d, %d), got %v, %v", n-1, -(n - 1), entry, err)
+	}
+	if err := raw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The database reopens the table with the codec recorded in its metadata.
+	d, err = db.Open(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	table, err = d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := table.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(entries)) != n {
+		t.Fatalf("expected %d entries, got %d", n, len(entries))
+	}
+	for i, entry := range entries {
+		if entry.GetKey() != int64(i) || entry.GetValue() != -int64(i) {
+			t.Fatalf("entry %d round-tripped as (%d, %d)", i, entry.GetKey(), entry.GetValue())
+		}
+	}
+}
+
+// A codec whose encoding doesn't fit in a slot.
+type oversizeCodec struct{ valueFirstCodec }
+
+func (oversizeCodec) Encode(entry utils.Entry) []byte {
+	return append(valueFirstCodec{}.Encode(entry), make([]byte, utils.ENCODED_ENTRY_SIZE)...)
+}
+
+func TestEntryCodecRecorded(t *testing.T) {
+	for name, codec := range map[string]utils.EntryCodec{"valuefirst": valueFirstCodec{}, "oversize": oversizeCodec{}} {
+		if _, err := utils.GetCodec(name); err != nil {
+			if err = utils.RegisterCodec(name, codec); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := utils.RegisterCodec(strings.Repeat("x", utils.MAX_CODEC_NAME_SIZE+1), valueFirstCodec{}); err == nil {
+		t.Error("expected registering a codec with too long a name to fail")
+	}
+	// Hash tables record their codec in their .meta file.
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTableWithOptions(dbName, hash.TableOptions{Codec: "valuefirst"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 1000; i++ {
+		if err := index.Insert(i, -i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hash.OpenTableWithOptions(dbName, hash.TableOptions{Codec: utils.DEFAULT_CODEC}); err == nil {
+		t.Error("expected opening the table with another codec to fail")
+	}
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 1000; i++ {
+		if entry, err := index.Find(i); err != nil || entry.GetValue() != -i {
+			t.Fatalf("expected the recorded codec to read (%d, %d), got %v, %v", i, -i, entry, err)
+		}
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries a codec can't fit in a slot are refused, rather than truncated.
+	btName, htName := getTempBTreeDB(t), getTempHashDB(t)
+	defer os.Remove(btName)
+	defer os.Remove(btName + btree.CODEC_FILE_SUFFIX)
+	defer os.Remove(htName)
+	defer os.Remove(htName + ".meta")
+	bt, err := btree.OpenTableWithOptions(btName, btree.TableOptions{Codec: "oversize"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bt.Close()
+	ht, err := hash.OpenTableWithOptions(htName, hash.TableOptions{Codec: "oversize"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ht.Close()
+	for _, table := range []db.Index{bt, ht} {
+		if err := table.Insert(1, 1); !errors.Is(err, utils.ErrEntryTooLarge) {
+			t.Errorf("expected %v from an insert, got %v", utils.ErrEntryTooLarge, err)
+		}
+		if entries, err := table.Select(); err != nil || len(entries) != 0 {
+			t.Errorf("expected the refused insert to store nothing, got %v, %v", entries, err)
+		}
+	}
+	loaded := getTempBTreeDB(t)
+	os.Remove(loaded)
+	if _, err := btree.BulkLoad(loaded, []utils.Entry{utils.KeyValue{Key: 1, Value: 1}}, btree.TableOptions{Codec: "oversize"}); !errors.Is(err, utils.ErrEntryTooLarge) {
+		t.Errorf("expected %v from a bulk load, got %v", utils.ErrEntryTooLarge, err)
+	}
+	if _, err := os.Stat(loaded); !os.IsNotExist(err) {
+		t.Errorf("expected the failed bulk load to leave no table, got %v", err)
+	}
+}
+
+func TestDatabaseVerifyCommand(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	for _, payload := range []string{"create btree table t1", "create hash table t2"} {
+		if err := db.HandleCreateTable(d, payload, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, table := range d.GetTables() {
+		for i := int64(0); i < 5000; i++ {
+			if err := table.Insert(i, i); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	verify := func(payload string) string {
+		var out bytes.Buffer
+		if err := db.HandleVerify(d, payload, &out); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	if out := verify("verify t1"); out != "OK\n" {
+		t.Errorf("expected a healthy btree to verify, got %q", out)
+	}
+	if out := verify("verify all"); out != "t1: OK\nt2: OK\n" {
+		t.Errorf("expected every healthy table to verify, got %q", out)
+	}
+
+	// Point the btree root's first separator past every key, and swap two hash buckets.
+	bt := d.GetTables()["t1"].(*btree.BTreeIndex)
+	root, err := bt.GetPager().GetPage(btree.ROOT_PN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	separator := make([]byte, btree.KEY_SIZE)
+	binary.PutVarint(separator, math.MaxInt64/2)
+	root.Update(separator, btree.KEYS_OFFSET, btree.KEY_SIZE)
+	root.Put()
+	buckets := d.GetTables()["t2"].(*hash.HashIndex).GetTable().GetBuckets()
+	buckets[0], buckets[1] = buckets[1], buckets[0]
+	if out := verify("verify t1"); !strings.HasPrefix(out, "page 0: separator ") {
+		t.Errorf("expected the btree root's separator to be reported, got %q", out)
+	}
+	out := verify("verify all")
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 2 ||
+		!strings.HasPrefix(lines[0], "t1: page 0: ") ||
+		!strings.HasPrefix(lines[1], fmt.Sprintf("t2: page %d: key ", buckets[0])) {
+		t.Errorf("expected both tables' violations to be reported, got %q", out)
+	}
+	if err := db.HandleVerify(d, "verify", ioutil.Discard); err == nil {
+		t.Error("expected verify without a table to fail")
+	}
+}
+
+func TestDatabaseForEachEntry(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	for _, payload := range []string{"create btree table b", "create hash table a"} {
+		if err := db.HandleCreateTable(d, payload, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < 100; i++ {
+		if err := d.Put("a", i, i); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Put("b", i*2, -i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	visits := make(map[string]map[int64]int)
+	order := make([]string, 0)
+	err := d.ForEachEntry(func(tableName string, e utils.Entry) error {
+		if len(order) == 0 || order[len(order)-1] != tableName {
+			order = append(order, tableName)
+		}
+		if visits[tableName] == nil {
+			visits[tableName] = make(map[int64]int)
+		}
+		visits[tableName][e.GetKey()]++
+		// Writing from the callback must not deadlock.
+		return d.Put(tableName, e.GetKey(), e.GetValue())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(order) != 2 || order[0] != "a" || order[1] != "b" {
+		t.Errorf("expected the tables to be visited in order of name, got %v", order)
+	}
+	for i := int64(0); i < 100; i++ {
+		if visits["a"][i] != 1 || visits["b"][i*2] != 1 {
+			t.Fatalf("expected key %d of a and key %d of b to be visited once, got %d and %d", i, i*2, visits["a"][i], visits["b"][i*2])
+		}
+	}
+	if len(visits["a"]) != 100 || len(visits["b"]) != 100 {
+		t.Errorf("expected 100 entries per table, got %d and %d", len(visits["a"]), len(visits["b"]))
+	}
+
+	// The first error stops the iteration.
+	stop := errors.New("stop")
+	calls := 0
+	err = d.ForEachEntry(func(tableName string, e utils.Entry) error {
+		calls++
+		return stop
+	})
+	if err != stop || calls != 1 {
+		t.Errorf("expected to stop after the first error, got %v after %d calls", err, calls)
+	}
+}
+
+func TestDatabaseTombstones(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 10; i++ {
+		if err := d.Put("t", i, i*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	grace := 100 * time.Millisecond
+	d.SetTombstoneGracePeriod(grace)
+	if err := d.Delete("t", 3); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("t", 3); err == nil {
+		t.Error("expected deleting a tombstoned key to fail")
+	}
+	// Reads and scans skip the key at once, though its entry is still there.
+	if _, found, err := d.Get("t", 3); err != nil || found {
+		t.Errorf("expected the deleted key not to be found, got %v, %v", found, err)
+	}
+	keys := make([]int64, 0)
+	err := d.ForEachEntry(func(tableName string, e utils.Entry) error {
+		keys = append(keys, e.GetKey())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 9 {
+		t.Errorf("expected the scan to skip the deleted key, got %v", keys)
+	}
+	var out bytes.Buffer
+	if err = db.HandleSelect(d, "select from t", &out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "(3, 30)") {
+		t.Errorf("expected select to skip the deleted key, got %q", out.String())
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = table.Find(3); err != nil {
+		t.Error("expected the tombstoned entry to stay in the table until reaped")
+	}
+	// Nothing is reaped within the grace period.
+	if reaped, err := d.ReapTombstones(); err != nil || reaped != 0 {
+		t.Errorf("expected nothing to be reaped yet, got %d, %v", reaped, err)
+	}
+
+	// A background reaper removes the entry once the grace period is over.
+	stop := d.StartTombstoneReaper(10 * time.Millisecond)
+	defer stop()
+	deadline := time.Now().Add(grace + time.Second)
+	for {
+		if _, err = table.Find(3); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the reaper to remove the tombstoned entry")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stop()
+	if entries, err := table.Select(); err != nil || len(entries) != 9 {
+		t.Errorf("expected 9 entries left after reaping, got %d, %v", len(entries), err)
+	}
+
+	// Putting a tombstoned key brings it back.
+	if err = d.Delete("t", 4); err != nil {
+		t.Fatal(err)
+	}
+	if err = d.Put("t", 4, 44); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, err := d.Get("t", 4); err != nil || !found || value != 44 {
+		t.Errorf("expected key 4 to be back with value 44, got %d, %v, %v", value, found, err)
+	}
+	if reaped, err := d.ReapTombstones(); err != nil || reaped != 0 {
+		t.Errorf("expected no tombstone left, got %d reaped, %v", reaped, err)
+	}
+}
@@ -1,12 +1,16 @@
 package test
 
 import (
+	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
 )
 
 type hash_kv struct {
@@ -380,3 +384,575 @@ func testHashUpdateTen(t *testing.T) {
 	}
 	index.Close()
 }
+
+func TestHashBucketIterator(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+
+	// Init the database
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Insert enough entries to split buckets several times
+	n := int64(2000)
+	for i := int64(0); i < n; i++ {
+		err = index.Insert(i, i%hash_salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Iterate over each distinct bucket, counting every entry seen
+	seen := make(map[int64]int)
+	visited := make(map[int64]bool)
+	table := index.GetTable()
+	for _, pn := range table.GetBuckets() {
+		if visited[pn] {
+			continue
+		}
+		visited[pn] = true
+		bucket, err := table.GetBucketByPN(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iterator := bucket.Iterator()
+		count := int64(0)
+		for entry, ok := iterator.Next(); ok; entry, ok = iterator.Next() {
+			if entry.GetValue() != entry.GetKey()%hash_salt {
+				t.Errorf("entry %d has the wrong value", entry.GetKey())
+			}
+			seen[entry.GetKey()]++
+			count++
+		}
+		iterator.Close()
+		iterator.Close()
+		if _, ok := iterator.Next(); ok {
+			t.Error("closed iterator returned an entry")
+		}
+		if count != bucket.GetNumKeys() {
+			t.Errorf("iterator visited %d entries; bucket holds %d", count, bucket.GetNumKeys())
+		}
+		bucket.GetPage().Put()
+	}
+	// Every entry should have been visited exactly once
+	for i := int64(0); i < n; i++ {
+		if seen[i] != 1 {
+			t.Errorf("key %d visited %d times", i, seen[i])
+		}
+	}
+}
+
+func TestHashCollisionRate(t *testing.T) {
+	collisionRate := func(hasher string, keys []int64) float64 {
+		dbName := getTempHashDB(t)
+		defer os.Remove(dbName)
+		defer os.Remove(dbName + ".meta")
+		index, err := hash.OpenTableWithOptions(dbName, hash.TableOptions{Hasher: hasher})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer index.Close()
+		for _, key := range keys {
+			if err := index.Insert(key, key%hash_salt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Every key is still reachable under the chosen hasher.
+		for _, key := range keys {
+			if _, err := index.Find(key); err != nil {
+				t.Fatalf("key %d not found: %v", key, err)
+			}
+		}
+		rate, err := index.CollisionRate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rate
+	}
+	// Keys that all share their low bits defeat the modulo hasher but not xxHash.
+	strided := make([]int64, 150)
+	for i := range strided {
+		strided[i] = int64(i) << 20
+	}
+	moduloRate := collisionRate(hash.MODULO_HASHER, strided)
+	xxRate := collisionRate(hash.XXHASH_HASHER, strided)
+	if moduloRate < 2 {
+		t.Errorf("expected strided keys to cluster under ModuloHasher, got collision rate %v", moduloRate)
+	}
+	if xxRate >= moduloRate || xxRate > 1.5 {
+		t.Errorf("expected XxHasher to spread strided keys, got collision rate %v (modulo: %v)", xxRate, moduloRate)
+	}
+	// Dense keys spread perfectly under the modulo hasher.
+	dense := make([]int64, 150)
+	for i := range dense {
+		dense[i] = int64(i)
+	}
+	if rate := collisionRate(hash.MODULO_HASHER, dense); rate != 1 {
+		t.Errorf("expected dense keys to spread evenly under ModuloHasher, got collision rate %v", rate)
+	}
+}
+
+func TestHashHasherRecorded(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTableWithOptions(dbName, hash.TableOptions{Hasher: hash.MODULO_HASHER})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 150; i++ {
+		if err := index.Insert(i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Reopening without naming the hasher places keys with the recorded one.
+	index, err = hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 150; i++ {
+		if _, err := index.Find(i); err != nil {
+			t.Fatalf("key %d not found: %v", i, err)
+		}
+	}
+	if rate, err := index.CollisionRate(); err != nil || rate != 1 {
+		t.Errorf("expected dense keys to still spread evenly under ModuloHasher, got %v, %v", rate, err)
+	}
+	if err := index.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Any other hasher is refused.
+	for _, hasher := range []string{hash.XXHASH_HASHER, hash.MURMUR_HASHER} {
+		if _, err := hash.OpenTableWithOptions(dbName, hash.TableOptions{Hasher: hasher}); err == nil {
+			t.Errorf("expected opening a table made with %s with %s to fail", hash.MODULO_HASHER, hasher)
+		}
+	}
+	if _, err := hash.OpenTableWithOptions(dbName+"-unknown", hash.TableOptions{Hasher: "unknown"}); err == nil {
+		t.Error("expected creating a table with an unregistered hasher to fail")
+	}
+	os.Remove(dbName + "-unknown")
+}
+
+func TestHashReopen(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	entries, answerKey := genRandomHashEntries(2000)
+	checkReopened := func(n int) {
+		depth := index.GetTable().GetDepth()
+		if err := index.Reopen(); err != nil {
+			t.Fatal(err)
+		}
+		if got := index.GetTable().GetDepth(); got != depth {
+			t.Errorf("global depth changed across reopen: %d before, %d after", depth, got)
+		}
+		for _, e := range entries[:n] {
+			entry, err := index.Find(e.key)
+			if err != nil {
+				t.Fatalf("key %d not found after reopen: %v", e.key, err)
+			}
+			if entry.GetValue() != answerKey[e.key] {
+				t.Fatalf("key %d has value %d after reopen, expected %d", e.key, entry.GetValue(), answerKey[e.key])
+			}
+		}
+	}
+	// Reopen repeatedly while the directory grows, so each reopen sees a newer directory.
+	inserted := 0
+	for _, n := range []int{100, 1000, len(entries)} {
+		for _, e := range entries[inserted:n] {
+			if err := index.Insert(e.key, e.val); err != nil {
+				t.Fatal(err)
+			}
+		}
+		inserted = n
+		checkReopened(n)
+	}
+}
+
+// Run with -race to check the bucket locking.
+func TestHashConcurrentInsertAndFind(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	const workers, perWorker = 8, 500
+	errs := make(chan error, workers*2)
+	var wg sync.WaitGroup
+	for w := int64(0); w < workers; w++ {
+		wg.Add(2)
+		// Each writer inserts its own keys, splitting buckets as the table grows.
+		go func(w int64) {
+			defer wg.Done()
+			for i := int64(0); i < perWorker; i++ {
+				key := i*workers + w
+				if err := index.Insert(key, key%hash_salt); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+		// Each reader looks up the keys its writer has inserted so far.
+		go func(w int64) {
+			defer wg.Done()
+			for i := int64(0); i < perWorker; i++ {
+				key := i*workers + w
+				if entry, err := index.Find(key); err == nil && entry.GetValue() != key%hash_salt {
+					errs <- fmt.Errorf("key %d has value %d, expected %d", key, entry.GetValue(), key%hash_salt)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != workers*perWorker {
+		t.Errorf("expected %d entries, got %d", workers*perWorker, len(entries))
+	}
+	for key := int64(0); key < workers*perWorker; key++ {
+		entry, err := index.Find(key)
+		if err != nil {
+			t.Fatalf("key %d not found: %v", key, err)
+		}
+		if entry.GetValue() != key%hash_salt {
+			t.Fatalf("key %d has value %d, expected %d", key, entry.GetValue(), key%hash_salt)
+		}
+	}
+}
+
+func TestHashOverflowChainBounded(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	const maxOverflow = 2
+	options := hash.TableOptions{Hasher: hash.MODULO_HASHER, MaxOverflowPages: maxOverflow}
+	index, err := hash.OpenTableWithOptions(dbName, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Keys that share their low bits all land in one bucket until the directory is deep.
+	keys := make([]int64, 2000)
+	for i := range keys {
+		keys[i] = int64(i) << 10
+		if err := index.Insert(keys[i], keys[i]%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	// Iterate over each distinct bucket, overflow pages included, counting every entry seen.
+	table := index.GetTable()
+	longest := int64(0)
+	seen := make(map[int64]int)
+	visited := make(map[int64]bool)
+	for _, pn := range table.GetBuckets() {
+		if visited[pn] {
+			continue
+		}
+		visited[pn] = true
+		bucket, err := table.GetBucketByPN(pn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iterator := bucket.Iterator()
+		for entry, ok := iterator.Next(); ok; entry, ok = iterator.Next() {
+			if entry.GetValue() != entry.GetKey()%hash_salt {
+				t.Errorf("entry %d has the wrong value", entry.GetKey())
+			}
+			seen[entry.GetKey()]++
+		}
+		iterator.Close()
+		length, err := bucket.ChainLength()
+		bucket.GetPage().Put()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if length > longest {
+			longest = length
+		}
+	}
+	if len(seen) != len(keys) {
+		t.Errorf("expected the iterators to visit %d keys, visited %d", len(keys), len(seen))
+	}
+	for _, key := range keys {
+		if seen[key] != 1 {
+			t.Errorf("key %d visited %d times", key, seen[key])
+		}
+	}
+	if longest > maxOverflow {
+		t.Errorf("expected overflow chains of at most %d pages, found one of %d", maxOverflow, longest)
+	}
+	if longest == 0 {
+		t.Error("expected colliding keys to fill some overflow pages before splitting")
+	}
+	for _, key := range keys {
+		entry, err := index.Find(key)
+		if err != nil {
+			t.Fatalf("key %d not found: %v", key, err)
+		}
+		if entry.GetValue() != key%hash_salt {
+			t.Fatalf("key %d has value %d, expected %d", key, entry.GetValue(), key%hash_salt)
+		}
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(keys) {
+		t.Errorf("expected %d entries, selected %d", len(keys), len(entries))
+	}
+	if ok, err := hash.IsHash(index); err != nil || !ok {
+		t.Errorf("expected every key to hash to its bucket: %v", err)
+	}
+}
+
+// Copy the tables in testdata/legacy, written before pages had trailers or buckets had overflow
+// pages, into a new folder: a btree b mapping i to 2i and a hash table h mapping i to 3i, for i
+// in [0, 1000).
+func copyLegacyTables(t testing.TB) string {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"b", "h", "h.meta"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", "legacy", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(folder, name), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return folder
+}
+
+func TestHashFlatBucketLayout(t *testing.T) {
+	folder := copyLegacyTables(t)
+	defer os.RemoveAll(folder)
+	path := filepath.Join(folder, "h")
+	if _, err := hash.OpenTableWithOptions(path, hash.TableOptions{LegacyPageLayout: true, MaxOverflowPages: 1}); err == nil {
+		t.Error("expected a table in page layout 0 to refuse overflow pages")
+	}
+	index, err := hash.OpenTableWithOptions(path, hash.TableOptions{LegacyPageLayout: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for i := int64(0); i < 1000; i++ {
+		entry, err := index.Find(i)
+		if err != nil {
+			t.Fatalf("key %d not found: %v", i, err)
+		}
+		if entry.GetValue() != i*3 {
+			t.Fatalf("key %d has value %d, expected %d", i, entry.GetValue(), i*3)
+		}
+	}
+	// Inserts split the flat buckets without writing over their entries.
+	for i := int64(1000); i < 3000; i++ {
+		if err := index.Insert(i, i*3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := index.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := index.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3000 {
+		t.Errorf("expected 3000 entries, selected %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.GetValue() != entry.GetKey()*3 {
+			t.Fatalf("key %d has value %d, expected %d", entry.GetKey(), entry.GetValue(), entry.GetKey()*3)
+		}
+	}
+	if ok, err := hash.IsHash(index); err != nil || !ok {
+		t.Errorf("expected every key to hash to its bucket: %v", err)
+	}
+}
+
+func TestHashBucketStats(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTableWithOptions(dbName, hash.TableOptions{MaxOverflowPages: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// Spread keys evenly, then pile copies of one hot key into its bucket, where splitting can't help.
+	const spread, hot, copies = 1000, int64(-7), 500
+	for i := int64(0); i < spread; i++ {
+		if err := index.Insert(i, i%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := int64(0); i < copies; i++ {
+		if err := index.Insert(hot, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats, err := index.BucketStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := int64(0)
+	var hottest hash.BucketStat
+	for _, stat := range stats {
+		total += stat.NumKeys
+		if stat.NumKeys > hottest.NumKeys {
+			hottest = stat
+		}
+		if stat.LocalDepth > index.GetTable().GetDepth() {
+			t.Errorf("bucket %d has local depth %d past the global depth %d", stat.PN, stat.LocalDepth, index.GetTable().GetDepth())
+		}
+	}
+	if total != spread+copies {
+		t.Errorf("expected the buckets to hold %d entries, they report %d", spread+copies, total)
+	}
+	if hottest.NumKeys < copies {
+		t.Errorf("expected a bucket with all %d copies of the hot key, the fullest holds %d", copies, hottest.NumKeys)
+	}
+	if want := (hottest.NumKeys - 1) / hash.BucketSize(index.GetPager()); hottest.OverflowPages < want {
+		t.Errorf("expected the hot bucket to chain at least %d overflow pages, reported %d", want, hottest.OverflowPages)
+	}
+	for _, stat := range stats {
+		if stat.PN != hottest.PN && stat.OverflowPages >= hottest.OverflowPages {
+			t.Errorf("bucket %d has as long a chain as the hot bucket (%d pages)", stat.PN, stat.OverflowPages)
+		}
+	}
+	loadFactor, err := index.LoadFactor()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadFactor <= 0 || loadFactor > 1 {
+		t.Errorf("expected a load factor in (0, 1], got %v", loadFactor)
+	}
+}
+
+func TestHashSelectRange(t *testing.T) {
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + ".meta")
+	index, err := hash.OpenTable(dbName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	for _, i := range rand.Perm(1000) {
+		if err := index.Insert(int64(i)-500, int64(i)%hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := index.SelectRange(-20, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int64]bool)
+	for _, entry := range entries {
+		key := entry.GetKey()
+		if key < -20 || key >= 100 || seen[key] {
+			t.Fatalf("expected each key in [-20, 100) once, got key %d", key)
+		}
+		if entry.GetValue() != (key+500)%hash_salt {
+			t.Errorf("expected key %d to hold %d, got %d", key, (key+500)%hash_salt, entry.GetValue())
+		}
+		seen[key] = true
+	}
+	if len(seen) != 120 {
+		t.Errorf("expected the 120 keys in [-20, 100), got %d", len(seen))
+	}
+	if entries, err = index.SelectRange(600, 700); err != nil || len(entries) != 0 {
+		t.Errorf("expected nothing past the last key, got %d entries and %v", len(entries), err)
+	}
+}
+
+func TestHashBucketCapacity(t *testing.T) {
+	buckets := make(map[int64]int)
+	for _, capacity := range []int64{16, 64} {
+		dbName := getTempHashDB(t)
+		defer os.Remove(dbName)
+		defer os.Remove(dbName + ".meta")
+		index, err := hash.OpenTableWithOptions(dbName, hash.TableOptions{BucketCapacity: capacity})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int64(0); i < 2000; i++ {
+			if err = index.Insert(i, i%hash_salt); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stats, err := index.BucketStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, stat := range stats {
+			if stat.NumKeys > capacity {
+				t.Fatalf("expected buckets of at most %d entries, found one of %d", capacity, stat.NumKeys)
+			}
+		}
+		buckets[capacity] = len(stats)
+		if err = index.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The capacity is kept in the .meta file, and must match on reopen.
+		if _, err = hash.OpenTableWithOptions(dbName, hash.TableOptions{BucketCapacity: capacity + 1}); err == nil {
+			t.Errorf("expected reopening with a different bucket capacity to fail")
+		}
+		index, err = hash.OpenTable(dbName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index.GetBucketCapacity() != capacity {
+			t.Errorf("expected the reopened table to have a bucket capacity of %d, got %d", capacity, index.GetBucketCapacity())
+		}
+		for i := int64(0); i < 2000; i++ {
+			entry, err := index.Find(i)
+			if err != nil {
+				t.Fatalf("key %d not found: %v", i, err)
+			}
+			if entry.GetValue() != i%hash_salt {
+				t.Fatalf("key %d has value %d, expected %d", i, entry.GetValue(), i%hash_salt)
+			}
+		}
+		if err = index.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buckets[16] <= buckets[64] {
+		t.Errorf("expected smaller buckets to split more, got %d buckets of 16 and %d of 64", buckets[16], buckets[64])
+	}
+
+	dbName := getTempHashDB(t)
+	defer os.Remove(dbName)
+	for _, capacity := range []int64{1, hash.BucketSize(pager.NewPager()) + 1} {
+		if _, err := hash.OpenTableWithOptions(dbName, hash.TableOptions{BucketCapacity: capacity}); err == nil {
+			t.Errorf("expected a bucket capacity of %d to be rejected", capacity)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package test
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"testing"
+
+	recovery "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/recovery"
+
+	uuid "github.com/google/uuid"
+)
+
+// Characters that can't appear in a table name.
+var nonWordExp = regexp.MustCompile(`\W`)
+
+// Format a log record of the given kind from fuzzed fields, as the recovery manager writes it.
+func fuzzLogLine(kind uint8, id []byte, name string, key int64, oldval int64, newval int64) string {
+	var txId uuid.UUID
+	copy(txId[:], id)
+	name = nonWordExp.ReplaceAllString(name, "_")
+	if name == "" {
+		name = "t"
+	}
+	switch kind % 5 {
+	case 0:
+		return fmt.Sprintf("< create %s table %s >\n", []string{"btree", "hash"}[key&1], name)
+	case 1:
+		action := []recovery.Action{recovery.INSERT_ACTION, recovery.UPDATE_ACTION, recovery.DELETE_ACTION}[kind/5%3]
+		return fmt.Sprintf("< %s, %s, %s, %d, %d, %d >\n", txId, name, action, key, oldval, newval)
+	case 2:
+		return fmt.Sprintf("< %s start >\n", txId)
+	case 3:
+		return fmt.Sprintf("< %s commit >\n", txId)
+	default:
+		// Up to three running transactions, derived from the id.
+		ids := make([]string, 0)
+		for i := 0; i < int(kind/5%4); i++ {
+			ids = append(ids, uuid.NewSHA1(txId, []byte{byte(i)}).String())
+		}
+		if len(ids) == 0 {
+			return "< checkpoint >\n"
+		}
+		return fmt.Sprintf("< %s checkpoint >\n", strings.Join(ids, ", "))
+	}
+}
+
+func FuzzLogRoundTrip(f *testing.F) {
+	id := uuid.MustParse("0f8fad5b-d9cb-469f-a165-70867728950e")
+	for kind := uint8(0); kind < 20; kind++ {
+		f.Add(kind, id[:], "t1", int64(kind), int64(-1), int64(math.MaxInt64))
+	}
+	f.Add(uint8(1), id[:], "table", int64(math.MinInt64), int64(0), int64(-42))
+	f.Fuzz(func(t *testing.T, kind uint8, id []byte, name string, key int64, oldval int64, newval int64) {
+		line := fuzzLogLine(kind, id, name, key, oldval, newval)
+		log, err := recovery.FromString(line)
+		if err != nil {
+			t.Fatalf("could not parse %q: %v", line, err)
+		}
+		if got := recovery.ToString(log); got != line {
+			t.Fatalf("%q parsed and serialized to %q", line, got)
+		}
+	})
+}
+
+func FuzzLogFromString(f *testing.F) {
+	id := uuid.MustParse("0f8fad5b-d9cb-469f-a165-70867728950e")
+	for kind := uint8(0); kind < 20; kind++ {
+		f.Add(fuzzLogLine(kind, id[:], "t1", -7, 0, 99))
+	}
+	f.Add("< create btree table >")
+	f.Add("< 0f8fad5b-d9cb-469f-a165-70867728950e, t, INSERT, 99999999999999999999, 0, 0 >")
+	f.Add("garbage")
+	f.Fuzz(func(t *testing.T, line string) {
+		// Anything that parses should serialize to a line that parses to the same thing.
+		log, err := recovery.FromString(line)
+		if err != nil {
+			return
+		}
+		serialized := recovery.ToString(log)
+		reparsed, err := recovery.FromString(serialized)
+		if err != nil {
+			t.Fatalf("%q parsed, but its serialization %q didn't: %v", line, serialized, err)
+		}
+		if again := recovery.ToString(reparsed); again != serialized {
+			t.Fatalf("%q serialized to %q, then %q", line, serialized, again)
+		}
+	})
+}
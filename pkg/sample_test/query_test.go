@@ -1,15 +1,27 @@
 package test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	btree "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/btree"
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
 	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
 	"github.com/csci1270-fall-2023/dbms-projects-handout/pkg/query"
+	repl "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/repl"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
 )
 
 func TestQueryTA(t *testing.T) {
@@ -20,7 +32,7 @@ func TestQueryTA(t *testing.T) {
 // Mod vals by this value to prevent hardcoding tests
 var query_salt int64 = rand.Int63n(1000)
 
-func getTempQueryDB(t *testing.T) string {
+func getTempQueryDB(t testing.TB) string {
 	tmpfile, err := ioutil.TempFile(".", "db-*")
 	if err != nil {
 		t.Error(err)
@@ -29,7 +41,7 @@ func getTempQueryDB(t *testing.T) string {
 	return tmpfile.Name()
 }
 
-func setupQuery(t *testing.T) (string, string, *hash.HashIndex, *hash.HashIndex) {
+func setupQuery(t testing.TB) (string, string, *hash.HashIndex, *hash.HashIndex) {
 	// Init the first database
 	dbName1 := getTempQueryDB(t)
 	defer os.Remove(dbName1)
@@ -48,7 +60,7 @@ func setupQuery(t *testing.T) (string, string, *hash.HashIndex, *hash.HashIndex)
 	return dbName1, dbName2, index1, index2
 }
 
-func getresults(t *testing.T, index1 *hash.HashIndex, index2 *hash.HashIndex, joinOnLeftKey bool, joinOnRightKey bool) ([]query.EntryPair, error) {
+func getresults(t testing.TB, index1 *hash.HashIndex, index2 *hash.HashIndex, joinOnLeftKey bool, joinOnRightKey bool) ([]query.EntryPair, error) {
 	// Create context.
 	ctx, cancelCtx := context.WithCancel(context.Background())
 	defer cancelCtx()
@@ -91,6 +103,7 @@ func teardownQuery(dbName1 string, dbName2 string, index1 *hash.HashIndex, index
 	index2.Close()
 	os.Remove(dbName1 + ".meta")
 	os.Remove(dbName2 + ".meta")
+	query.DrainPool()
 }
 
 func testQuerySimple(t *testing.T) {
@@ -136,3 +149,895 @@ func testFilterInsertAndCheckSmall(t *testing.T) {
 		}
 	}
 }
+
+func TestFilterClear(t *testing.T) {
+	filter := query.CreateFilter(1024)
+	for i := int64(0); i < 100; i++ {
+		filter.Insert(i * query_salt)
+	}
+	filter.Clear()
+	for i := int64(0); i < 100; i++ {
+		if filter.Contains(i * query_salt) {
+			t.Errorf("cleared filter still contains %d", i*query_salt)
+		}
+	}
+	// The filter is still usable after clearing.
+	filter.Insert(42)
+	if !filter.Contains(42) {
+		t.Error("value inserted after clear not found")
+	}
+}
+
+func TestFilterExtremeKeys(t *testing.T) {
+	keys := []int64{math.MinInt64, math.MinInt64 + 1, -query_salt - 1, -1, 0, 1, math.MaxInt64 - 1, math.MaxInt64}
+	for _, size := range []int64{1, 7, 1024, math.MaxInt64} {
+		for _, key := range keys {
+			for _, hasher := range []func(int64, int64) uint{hash.XxHasher, hash.MurmurHasher, hash.ModuloHasher} {
+				if h := hasher(key, size); uint64(h) >= uint64(size) {
+					t.Errorf("hash of %d is %d, outside [0, %d)", key, h, size)
+				}
+			}
+		}
+	}
+	filter := query.CreateFilter(1024)
+	for _, key := range keys {
+		filter.Insert(key)
+	}
+	for _, key := range keys {
+		if !filter.Contains(key) {
+			t.Errorf("inserted key %d but not found", key)
+		}
+	}
+}
+
+func TestFilterSize(t *testing.T) {
+	const n, p = 5000, 0.01
+	want := int64(math.Ceil(-n * math.Log(p) / (math.Ln2 * math.Ln2)))
+	if got := query.FilterSize(n, p); got != want {
+		t.Errorf("expected %d bits for %d keys at %v, got %d", want, n, p, got)
+	}
+	for _, unknown := range []int64{0, -1} {
+		if got := query.FilterSize(unknown, p); got != query.DEFAULT_FILTER_SIZE {
+			t.Errorf("expected the default size for %d keys, got %d", unknown, got)
+		}
+	}
+	// Keys that were never inserted come up at about the target rate.
+	filter := query.CreateFilterFor(n, p)
+	for i := int64(0); i < n; i++ {
+		filter.Insert(i * 2)
+	}
+	falsePositives := 0
+	const probes = 100000
+	for i := int64(0); i < probes; i++ {
+		if filter.Contains(i*2 + 1) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / probes; rate > 1.5*p {
+		t.Errorf("expected a false positive rate of about %v, got %v", p, rate)
+	}
+	for i := int64(0); i < n; i++ {
+		if !filter.Contains(i * 2) {
+			t.Fatalf("inserted key %d but not found", i*2)
+		}
+	}
+}
+
+func TestJoinFilter(t *testing.T) {
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for i := int64(0); i < 1000; i++ {
+		index1.Insert(i, i)
+		if i%10 == 0 {
+			index2.Insert(i, -i)
+		}
+	}
+	unfiltered, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{Sorted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filtered, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{Sorted: true, Filter: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filtered) != 100 || !reflect.DeepEqual(filtered, unfiltered) {
+		t.Errorf("expected the same 100 pairs with the filter, got %d and %d", len(filtered), len(unfiltered))
+	}
+}
+
+func TestJoinAdaptiveFilter(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		every    int64 // The right table holds every such key of the left table.
+		filtered bool
+	}{
+		{"high overlap", 1, false},
+		{"low overlap", 20, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dbName1, dbName2, index1, index2 := setupQuery(t)
+			defer teardownQuery(dbName1, dbName2, index1, index2)
+			for i := int64(0); i < 1000; i++ {
+				index1.Insert(i, i)
+				if i%tc.every == 0 {
+					index2.Insert(i, -i)
+				}
+			}
+			direct, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{Sorted: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := query.ProbesFiltered()
+			adaptive, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{Sorted: true, AdaptiveFilter: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			skipped := query.ProbesFiltered() - before
+			if int64(len(adaptive)) != 1000/tc.every || !reflect.DeepEqual(adaptive, direct) {
+				t.Errorf("expected the same %d pairs adaptively, got %d and %d", 1000/tc.every, len(adaptive), len(direct))
+			}
+			if tc.filtered && skipped == 0 {
+				t.Error("expected the adaptive join to pre-filter probes on sparse matches")
+			}
+			if !tc.filtered && skipped != 0 {
+				t.Errorf("expected the adaptive join to probe dense matches directly, skipped %d", skipped)
+			}
+		})
+	}
+}
+
+func TestJoinCondition(t *testing.T) {
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for i := int64(0); i < 500; i++ {
+		index1.Insert(i, -i)
+		if i%50 == 0 {
+			index2.Insert(i, i)
+		}
+	}
+	// Match keys at most 2 apart.
+	band := func(l utils.Entry, r utils.Entry) bool {
+		diff := l.GetKey() - r.GetKey()
+		return diff >= -2 && diff <= 2
+	}
+	results, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{Condition: band})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[[2]int64]int)
+	for _, p := range results {
+		if p.GetLeft().GetValue() != -p.GetLeft().GetKey() || p.GetRight().GetValue() != p.GetRight().GetKey() {
+			t.Fatalf("expected the pairs to hold the entries as stored, got %v", p)
+		}
+		got[[2]int64{p.GetLeft().GetKey(), p.GetRight().GetKey()}]++
+	}
+	want := make(map[[2]int64]int)
+	for r := int64(0); r < 500; r += 50 {
+		for l := r - 2; l <= r+2; l++ {
+			if l >= 0 && l < 500 {
+				want[[2]int64{l, r}] = 1
+			}
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %d pairs within the band, each once, got %d: %v", len(want), len(results), got)
+	}
+
+	// The default condition is equality.
+	equal, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{Condition: query.KeysEqual, Sorted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	direct, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{Sorted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(direct) != 10 || !reflect.DeepEqual(equal, direct) {
+		t.Errorf("expected the same 10 pairs with KeysEqual as by default, got %d and %d", len(equal), len(direct))
+	}
+}
+
+func benchmarkJoinTempIndices(b *testing.B, poolSize int) {
+	defer func(old int) { query.MAX_POOLED_INDICES = old }(query.MAX_POOLED_INDICES)
+	query.MAX_POOLED_INDICES = poolSize
+	defer query.DrainPool()
+	dbName1, dbName2, index1, index2 := setupQuery(b)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for i := int64(0); i < 100; i++ {
+		index1.Insert(i, i)
+		index2.Insert(i, i)
+	}
+	created := query.TempIndicesCreated()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := getresults(b, index1, index2, true, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(query.TempIndicesCreated()-created)/float64(b.N), "files/op")
+}
+
+func BenchmarkJoinWithoutPool(b *testing.B) {
+	benchmarkJoinTempIndices(b, 0)
+}
+
+func BenchmarkJoinWithPool(b *testing.B) {
+	benchmarkJoinTempIndices(b, 8)
+}
+
+func TestAggregateJoinCount(t *testing.T) {
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for i := int64(0); i < 100; i++ {
+		index1.Insert(i, i%query_salt)
+		if i%2 == 0 {
+			index2.Insert(i, 1)
+		}
+	}
+	count, err := query.AggregateJoin(context.Background(), index1, index2, true, true, query.COUNT_AGG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 50 {
+		t.Errorf("expected 50 matching pairs, got %d", count)
+	}
+	sum, err := query.AggregateJoin(context.Background(), index1, index2, true, true, query.SUM_RIGHT_AGG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 50 {
+		t.Errorf("expected right values to sum to 50, got %d", sum)
+	}
+}
+
+func TestAggregateJoinCancel(t *testing.T) {
+	// Disable pooling so that cleanup has to remove the temporary files.
+	defer func(old int) { query.MAX_POOLED_INDICES = old }(query.MAX_POOLED_INDICES)
+	query.MAX_POOLED_INDICES = 0
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for i := int64(0); i < 100; i++ {
+		index1.Insert(i, i)
+		index2.Insert(i, i)
+	}
+	before, err := filepath.Glob("db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := query.AggregateJoin(ctx, index1, index2, true, true, query.COUNT_AGG); err != context.Canceled {
+		t.Errorf("expected the cancelled join to fail with %v, got %v", context.Canceled, err)
+	}
+	after, err := filepath.Glob("db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("cancelled join left temporary files behind: %v", after)
+	}
+}
+
+// Collect the results of a batched join, checking that no batch is oversized.
+func getBatchedResults(t testing.TB, index1 *hash.HashIndex, index2 *hash.HashIndex, batchSize int) ([]query.EntryPair, error) {
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	resultsChan, _, group, cleanupCallback, err := query.JoinBatched(ctx, index1, index2, true, true, batchSize)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan bool)
+	results := make([]query.EntryPair, 0)
+	go func() {
+		for batch := range resultsChan {
+			if len(batch) == 0 || len(batch) > batchSize {
+				t.Errorf("got a batch of %d pairs; expected 1 to %d", len(batch), batchSize)
+			}
+			results = append(results, batch...)
+		}
+		done <- true
+	}()
+	err = group.Wait()
+	close(resultsChan)
+	<-done
+	return results, err
+}
+
+func TestJoinBatched(t *testing.T) {
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for i := int64(0); i < 1000; i++ {
+		index1.Insert(i, i%query_salt)
+		if i%3 == 0 {
+			index2.Insert(i, i)
+		}
+	}
+	unbatched, err := getresults(t, index1, index2, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batchSize := range []int{1, 7, 256} {
+		batched, err := getBatchedResults(t, index1, index2, batchSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batched) != len(unbatched) {
+			t.Errorf("batch size %d: expected %d results, got %d", batchSize, len(unbatched), len(batched))
+		}
+	}
+	if _, err := getBatchedResults(t, index1, index2, 0); err == nil {
+		t.Error("expected a batch size of 0 to be rejected")
+	}
+}
+
+// Fill both sides with repeated keys so that the join emits many pairs per build entry.
+func setupHighMatchJoin(b testing.TB) (string, string, *hash.HashIndex, *hash.HashIndex) {
+	dbName1, dbName2, index1, index2 := setupQuery(b)
+	for key := int64(0); key < 100; key++ {
+		for n := int64(0); n < 40; n++ {
+			index1.Insert(key, n)
+			index2.Insert(key, n)
+		}
+	}
+	return dbName1, dbName2, index1, index2
+}
+
+func BenchmarkJoinUnbatched(b *testing.B) {
+	dbName1, dbName2, index1, index2 := setupHighMatchJoin(b)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		results, err := getresults(b, index1, index2, true, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(len(results)), "pairs/op")
+	}
+}
+
+func BenchmarkJoinBatched256(b *testing.B) {
+	dbName1, dbName2, index1, index2 := setupHighMatchJoin(b)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		results, err := getBatchedResults(b, index1, index2, 256)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(len(results)), "pairs/op")
+	}
+}
+
+func TestJoinTempDir(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	// The directory doesn't exist yet; the first temporary file creates it.
+	tempDir := filepath.Join(folder, "tmp")
+	db.SetTempDir(tempDir)
+	defer db.SetTempDir("")
+	query.DrainPool()
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for i := int64(0); i < 100; i++ {
+		index1.Insert(i, i)
+		index2.Insert(i, i)
+	}
+	if _, err := getresults(t, index1, index2, true, true); err != nil {
+		t.Fatal(err)
+	}
+	// The pool keeps the join's temporary indices in the temp dir until drained.
+	pooled, err := filepath.Glob(filepath.Join(tempDir, "db-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pooled) == 0 {
+		t.Errorf("expected the join's temporary files in %s", tempDir)
+	}
+	query.DrainPool()
+	left, err := filepath.Glob(filepath.Join(tempDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("temporary files left behind in %s: %v", tempDir, left)
+	}
+}
+
+func TestJoinSorted(t *testing.T) {
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for _, key := range rand.Perm(500) {
+		index1.Insert(int64(key), int64(key)%query_salt)
+		if key%2 == 0 {
+			index2.Insert(int64(key), int64(key))
+		}
+	}
+	unsorted, err := getresults(t, index1, index2, true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	resultsChan, _, group, cleanupCallback, err := query.JoinWithOptions(ctx, index1, index2, true, true, query.JoinOptions{Sorted: true})
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	sorted := make([]query.EntryPair, 0)
+	go func() {
+		for pair := range resultsChan {
+			sorted = append(sorted, pair)
+		}
+		done <- true
+	}()
+	err = group.Wait()
+	close(resultsChan)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Same pairs, in order of join key.
+	if len(sorted) != len(unsorted) || len(sorted) != 250 {
+		t.Fatalf("expected 250 results both ways, got %d sorted and %d unsorted", len(sorted), len(unsorted))
+	}
+	seen := make(map[int64]bool)
+	for _, pair := range unsorted {
+		seen[pair.GetLeft().GetKey()] = true
+	}
+	for i, pair := range sorted {
+		if i > 0 && pair.GetLeft().GetKey() < sorted[i-1].GetLeft().GetKey() {
+			t.Fatalf("result %d has key %d after key %d", i, pair.GetLeft().GetKey(), sorted[i-1].GetLeft().GetKey())
+		}
+		if !seen[pair.GetLeft().GetKey()] {
+			t.Errorf("sorted join returned key %d, missing from the unsorted join", pair.GetLeft().GetKey())
+		}
+	}
+}
+
+func TestAggregateJoinSumOverflow(t *testing.T) {
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for i := int64(0); i < 3; i++ {
+		index1.Insert(i, math.MaxInt64-i)
+		index2.Insert(i, -math.MaxInt64)
+	}
+	if _, err := query.AggregateJoin(context.Background(), index1, index2, true, true, query.SUM_LEFT_AGG); err != query.ErrSumOverflow {
+		t.Errorf("expected %v, got %v", query.ErrSumOverflow, err)
+	}
+	if _, err := query.AggregateJoin(context.Background(), index1, index2, true, true, query.SUM_RIGHT_AGG); err != query.ErrSumOverflow {
+		t.Errorf("expected %v, got %v", query.ErrSumOverflow, err)
+	}
+	// A sum that only overflows part way through is still exact.
+	index2.Insert(3, math.MaxInt64)
+	index2.Insert(4, math.MaxInt64)
+	index1.Insert(3, 0)
+	index1.Insert(4, 0)
+	sum, err := query.AggregateJoin(context.Background(), index1, index2, true, true, query.SUM_RIGHT_AGG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(-math.MaxInt64); sum != want {
+		t.Errorf("expected the right values to sum to %d, got %d", want, sum)
+	}
+}
+
+// A writer that fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestJoinNDJSON(t *testing.T) {
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for _, key := range rand.Perm(600) {
+		index1.Insert(int64(key), int64(key)*2)
+		if key%3 == 0 {
+			index2.Insert(int64(key), int64(key)+query_salt)
+		}
+	}
+	var out bytes.Buffer
+	if err := query.StreamJoinNDJSON(context.Background(), &out, index1, index2, true, true); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 200 {
+		t.Fatalf("expected 200 lines, got %d", len(lines))
+	}
+	seen := make(map[int64]bool)
+	for _, line := range lines {
+		var pair struct {
+			Left  struct{ Key, Value int64 }
+			Right struct{ Key, Value int64 }
+		}
+		if err := json.Unmarshal([]byte(line), &pair); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		key := pair.Left.Key
+		if seen[key] || key%3 != 0 || pair.Right.Key != key ||
+			pair.Left.Value != key*2 || pair.Right.Value != key+query_salt {
+			t.Fatalf("unexpected line %q", line)
+		}
+		seen[key] = true
+	}
+
+	// A failed write or a cancelled context stops the export with its error.
+	if err := query.StreamJoinNDJSON(context.Background(), failingWriter{}, index1, index2, true, true); err == nil || err.Error() != "disk full" {
+		t.Errorf("expected the write error, got %v", err)
+	}
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	cancelCtx()
+	if err := query.StreamJoinNDJSON(ctx, ioutil.Discard, index1, index2, true, true); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestJoinCommand(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	defer query.DrainPool()
+	r, err := repl.CombineRepls([]*repl.REPL{db.DatabaseRepl(d), query.QueryRepl(d)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newReplClient(r)
+	c.run(t, "create hash table left")
+	c.run(t, "create hash table right")
+	for _, cmd := range []string{
+		"insert 1 10 into left", "insert 2 20 into left", "insert 3 30 into left",
+		"insert 2 3 into right", "insert 3 2 into right", "insert 4 20 into right",
+	} {
+		c.run(t, cmd)
+	}
+	for _, tc := range []struct {
+		payload string
+		want    string
+	}{
+		{"join left right", "{(2, 20), (2, 3)}\n{(3, 30), (3, 2)}\n"},
+		{"join left right on key on value", "{(2, 20), (3, 2)}\n{(3, 30), (2, 3)}\n"},
+		{"join left right on value on value", "{(2, 20), (4, 20)}\n"},
+		{"join left key on right val", "{(2, 20), (3, 2)}\n{(3, 30), (2, 3)}\n"},
+	} {
+		if got := c.run(t, tc.payload); got != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.payload, tc.want, got)
+		}
+	}
+	for _, payload := range []string{"join left", "join left right on row", "join left right with key", "join left missing"} {
+		if err := r.Execute(payload, c.config); err == nil {
+			t.Errorf("%s: expected an error", payload)
+		}
+	}
+}
+
+func getResultsWithOptions(t testing.TB, index1 *hash.HashIndex, index2 *hash.HashIndex, options query.JoinOptions) ([]query.EntryPair, error) {
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	defer cancelCtx()
+	resultsChan, _, group, cleanupCallback, err := query.JoinWithOptions(ctx, index1, index2, true, true, options)
+	if cleanupCallback != nil {
+		defer cleanupCallback()
+	}
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan bool)
+	results := make([]query.EntryPair, 0)
+	go func() {
+		for pair := range resultsChan {
+			results = append(results, pair)
+		}
+		done <- true
+	}()
+	err = group.Wait()
+	close(resultsChan)
+	<-done
+	return results, err
+}
+
+func TestJoinBufferSize(t *testing.T) {
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for i := int64(0); i < 1000; i++ {
+		index1.Insert(i, i%query_salt)
+		if i%3 == 0 {
+			index2.Insert(i, i)
+		}
+	}
+	pairSet := func(results []query.EntryPair) map[[4]int64]int {
+		set := make(map[[4]int64]int)
+		for _, p := range results {
+			set[[4]int64{p.GetLeft().GetKey(), p.GetLeft().GetValue(), p.GetRight().GetKey(), p.GetRight().GetValue()}]++
+		}
+		return set
+	}
+	small, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{BufferSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{BufferSize: 4096})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(small) != 334 || !reflect.DeepEqual(pairSet(small), pairSet(large)) {
+		t.Errorf("expected the same 334 pairs with either buffer size, got %d and %d", len(small), len(large))
+	}
+	if _, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{BufferSize: -1}); err == nil {
+		t.Error("expected a negative buffer size to be rejected")
+	}
+}
+
+func TestJoinLimit(t *testing.T) {
+	dbName1, dbName2, index1, index2 := setupHighMatchJoin(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	before := query.BucketsProbed()
+	all, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	probedAll := query.BucketsProbed() - before
+	// Every bucket pair has far more than 10 matches, so no probe should run to the end.
+	before = query.BucketsProbed()
+	limited, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	probedLimited := query.BucketsProbed() - before
+	if len(limited) != 10 {
+		t.Errorf("expected 10 of the %d pairs, got %d", len(all), len(limited))
+	}
+	if probedLimited >= probedAll {
+		t.Errorf("expected the limit to stop probing early, finished %d of %d bucket pairs", probedLimited, probedAll)
+	}
+	// Sorted joins return the first pairs in order.
+	sorted, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{Sorted: true, Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sorted) != 5 || sorted[0].GetLeft().GetKey() != 0 {
+		t.Errorf("expected the first 5 sorted pairs, got %d", len(sorted))
+	}
+	if _, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{Limit: -1}); err == nil {
+		t.Error("expected a negative limit to be rejected")
+	}
+}
+
+func TestJoinCleanupStopsProbes(t *testing.T) {
+	dbName1, dbName2, index1, index2 := setupHighMatchJoin(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	all, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stop reading after the first pair, leaving the probes blocked on a full buffer.
+	resultsChan, _, _, cleanupCallback, err := query.JoinWithOptions(context.Background(), index1, index2, true, true, query.JoinOptions{BufferSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-resultsChan
+	done := make(chan bool)
+	go func() {
+		cleanupCallback()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cleanup didn't stop the running probes")
+	}
+	// The pooled indices it handed back were idle, so the next join is whole.
+	again, err := getResultsWithOptions(t, index1, index2, query.JoinOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != len(all) {
+		t.Errorf("expected %d pairs from a join after cleanup, got %d", len(all), len(again))
+	}
+}
+
+func BenchmarkJoinBufferSize(b *testing.B) {
+	dbName1, dbName2, index1, index2 := setupHighMatchJoin(b)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for _, size := range []int{1, 64, 1024, 4096} {
+		b.Run(fmt.Sprintf("buffer%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				results, err := getResultsWithOptions(b, index1, index2, query.JoinOptions{BufferSize: size})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.ReportMetric(float64(len(results)), "pairs/op")
+			}
+		})
+	}
+}
+
+// Collect everything Distinct sends.
+func getDistinct(t testing.TB, table db.Index, onKey bool) []utils.Entry {
+	resultsChan, _, group, err := query.Distinct(context.Background(), table, onKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan bool)
+	results := make([]utils.Entry, 0)
+	go func() {
+		for entry := range resultsChan {
+			results = append(results, entry)
+		}
+		done <- true
+	}()
+	err = group.Wait()
+	close(resultsChan)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	return results
+}
+
+func TestDistinct(t *testing.T) {
+	dbName := getTempQueryDB(t)
+	defer os.Remove(dbName)
+	defer os.Remove(dbName + btree.OPTIONS_FILE_SUFFIX)
+	tree, err := btree.OpenTableWithOptions(dbName, btree.TableOptions{AllowDuplicates: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tree.Close()
+	// Each of 200 keys appears 5 times, spanning many leaves, with values cycling through 7.
+	for i := int64(0); i < 1000; i++ {
+		if err := tree.Insert(i%200, i%7); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Keys come out once each, in sorted order.
+	keys := getDistinct(t, tree, true)
+	if len(keys) != 200 {
+		t.Fatalf("expected 200 distinct keys, got %d", len(keys))
+	}
+	for i, entry := range keys {
+		if entry.GetKey() != int64(i) {
+			t.Fatalf("expected key %d at position %d, got %d", i, i, entry.GetKey())
+		}
+	}
+	// Values come out once each, in no particular order.
+	values := make(map[int64]bool)
+	for _, entry := range getDistinct(t, tree, false) {
+		if values[entry.GetValue()] {
+			t.Errorf("value %d sent twice", entry.GetValue())
+		}
+		values[entry.GetValue()] = true
+	}
+	if len(values) != 7 {
+		t.Errorf("expected 7 distinct values, got %d", len(values))
+	}
+	// Hash tables are deduplicated with a set on either column.
+	dbName1, dbName2, index1, index2 := setupQuery(t)
+	defer teardownQuery(dbName1, dbName2, index1, index2)
+	for i := int64(0); i < 1000; i++ {
+		index1.Insert(i, i%query_salt)
+	}
+	if got := getDistinct(t, index1, true); len(got) != 1000 {
+		t.Errorf("expected 1000 distinct keys, got %d", len(got))
+	}
+	if got := getDistinct(t, index1, false); int64(len(got)) != query_salt {
+		t.Errorf("expected %d distinct values, got %d", query_salt, len(got))
+	}
+}
+
+func TestJoinBTree(t *testing.T) {
+	dbName1, dbName2 := getTempQueryDB(t), getTempQueryDB(t)
+	defer os.Remove(dbName1)
+	defer os.Remove(dbName2)
+	defer query.DrainPool()
+	left, err := btree.OpenTable(dbName1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer left.Close()
+	right, err := btree.OpenTable(dbName2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer right.Close()
+	// Enough entries to span several leaves, so that the scans step off the last one.
+	for i := int64(0); i < 1000; i++ {
+		left.Insert(i, i)
+		if i%2 == 0 {
+			right.Insert(i, i)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	count, err := query.AggregateJoin(ctx, left, right, true, true, query.COUNT_AGG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 500 {
+		t.Errorf("expected 500 pairs, got %d", count)
+	}
+}
+
+func TestExternalSort(t *testing.T) {
+	folder, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	db.SetTempDir(folder)
+	defer db.SetTempDir("")
+	feed := func(ctx context.Context, n int) chan utils.Entry {
+		in := make(chan utils.Entry)
+		go func() {
+			defer close(in)
+			for i := 0; i < n; i++ {
+				select {
+				case <-ctx.Done():
+					return
+				case in <- utils.KeyValue{Key: rand.Int63n(1000), Value: int64(i)}:
+				}
+			}
+		}()
+		return in
+	}
+	leftovers := func() []os.FileInfo {
+		files, err := ioutil.ReadDir(folder)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+
+	// Ten times as many entries as fit in memory.
+	spilled := query.RunsSpilled()
+	ctx := context.Background()
+	out, err := query.ExternalSort(ctx, feed(ctx, 5000), 500*query.SORT_ENTRY_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prev utils.Entry
+	count := 0
+	for entry := range out {
+		if prev != nil && (entry.GetKey() < prev.GetKey() ||
+			entry.GetKey() == prev.GetKey() && entry.GetValue() < prev.GetValue()) {
+			t.Fatalf("entry (%d, %d) came after (%d, %d)", entry.GetKey(), entry.GetValue(), prev.GetKey(), prev.GetValue())
+		}
+		prev = entry
+		count++
+	}
+	if count != 5000 {
+		t.Errorf("expected 5000 sorted entries, got %d", count)
+	}
+	if runs := query.RunsSpilled() - spilled; runs != 10 {
+		t.Errorf("expected 10 runs to be spilled, got %d", runs)
+	}
+	if files := leftovers(); len(files) != 0 {
+		t.Errorf("expected the runs to be removed, found %d files", len(files))
+	}
+
+	// Cancelling part way through the merge also removes the runs.
+	cancelCtx, cancel := context.WithCancel(context.Background())
+	out, err = query.ExternalSort(cancelCtx, feed(cancelCtx, 5000), 500*query.SORT_ENTRY_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-out
+	cancel()
+	for range out {
+	}
+	if files := leftovers(); len(files) != 0 {
+		t.Errorf("expected the runs to be removed after cancelling, found %d files", len(files))
+	}
+
+	if _, err := query.ExternalSort(ctx, feed(ctx, 0), 1); err == nil {
+		t.Error("expected a memory limit below one entry to be rejected")
+	}
+}
@@ -0,0 +1,1474 @@
+package test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	concurrency "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/concurrency"
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	pager "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/pager"
+	recovery "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/recovery"
+	repl "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/repl"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+
+	uuid "github.com/google/uuid"
+)
+
+func setupRecovery(t testing.TB, d *db.Database, logName string) (*concurrency.TransactionManager, *recovery.RecoveryManager) {
+	if err := d.CreateLogFile(logName); err != nil {
+		t.Fatal(err)
+	}
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(d, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm, rm
+}
+
+func TestRecoveryLogRotation(t *testing.T) {
+	logDir, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+	logName := filepath.Join(logDir, "db.log")
+
+	// Log a committed and an uncommitted transaction against a small rotation threshold.
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rm := setupRecovery(t, d, logName)
+	rm.SetMaxLogSize(512)
+	rm.Table("btree", "t")
+	committed := uuid.New()
+	rm.Start(committed)
+	for i := int64(0); i < 50; i++ {
+		rm.Edit(committed, table, recovery.INSERT_ACTION, i, 0, i*2)
+	}
+	rm.Commit(committed)
+	uncommitted := uuid.New()
+	rm.Start(uncommitted)
+	rm.Edit(uncommitted, table, recovery.INSERT_ACTION, 1000, 0, 1000)
+	d.Close()
+
+	segments, err := rm.GetLogSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 3 {
+		t.Fatalf("expected the log to be rotated into several segments, got %v", segments)
+	}
+	for _, segment := range segments {
+		if _, err := os.Stat(segment); err != nil {
+			t.Errorf("segment %s missing: %v", segment, err)
+		}
+	}
+
+	// Recover into an empty database; the committed transaction should span every segment.
+	recovered, recoveredFolder := setupDatabase(t)
+	defer os.RemoveAll(recoveredFolder)
+	defer os.RemoveAll(strings.TrimSuffix(recovered.GetBasePath(), "/") + "-recovery")
+	defer recovered.Close()
+	_, rm = setupRecovery(t, recovered, logName)
+	rm.SetMaxLogSize(512)
+	if err := rm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	table, err = recovered.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 50; i++ {
+		entry, err := table.Find(i)
+		if err != nil {
+			t.Fatalf("committed key %d not recovered: %v", i, err)
+		}
+		if entry.GetValue() != i*2 {
+			t.Errorf("key %d recovered with value %d; expected %d", i, entry.GetValue(), i*2)
+		}
+	}
+	if _, err := table.Find(1000); err == nil {
+		t.Error("uncommitted key was not rolled back")
+	}
+
+	// A checkpoint with no running transactions drops the superseded segments.
+	rm.Checkpoint()
+	remaining, err := rm.GetLogSegments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) > 2 {
+		t.Errorf("expected superseded segments to be deleted, still have %v", remaining)
+	}
+}
+
+func TestRecoveryOptimisticCommit(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer os.RemoveAll(strings.TrimSuffix(d.GetBasePath(), "/") + "-recovery")
+	defer d.Close()
+	logName := filepath.Join(folder, "db.log")
+	tm, rm := setupRecovery(t, d, logName)
+	tm.SetMode(concurrency.OPTIMISTIC)
+	r := recovery.RecoveryREPL(d, tm, rm)
+	if _, err := utils.GetCodec("oversize"); err != nil {
+		if err = utils.RegisterCodec("oversize", oversizeCodec{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	setup := newReplClient(r)
+	setup.run(t, "create btree table t")
+	if _, err := d.CreateTableWithCodec("full", db.BTreeIndexType, "oversize"); err != nil {
+		t.Fatal(err)
+	}
+	rm.Table("btree", "full")
+	setup.run(t, "transaction begin")
+	setup.run(t, "insert 1 10 into t")
+	setup.run(t, "transaction commit")
+
+	// The transaction that commits second fails validation, and logs none of its writes.
+	a, b := newReplClient(r), newReplClient(r)
+	a.run(t, "transaction begin")
+	b.run(t, "transaction begin")
+	a.run(t, "find 1 from t")
+	b.run(t, "find 1 from t")
+	a.run(t, "update t 1 20")
+	b.run(t, "update t 1 30")
+	a.run(t, "transaction commit")
+	if err := r.Execute("transaction commit", b.config); !errors.Is(err, concurrency.ErrValidationFailed) {
+		t.Errorf("expected the second commit to fail with %v, got %v", concurrency.ErrValidationFailed, err)
+	}
+	// A write that fails to apply reverts the ones applied before it.
+	c := newReplClient(r)
+	c.run(t, "transaction begin")
+	c.run(t, "insert 2 200 into t")
+	c.run(t, "insert 1 100 into full")
+	if err := r.Execute("transaction commit", c.config); err == nil {
+		t.Error("expected a commit with a write that can't be applied to fail")
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := table.Find(1); err != nil || entry.GetValue() != 20 {
+		t.Errorf("expected key 1 to keep the first commit's value 20, got %v, %v", entry, err)
+	}
+	if _, err := table.Find(2); err == nil {
+		t.Error("expected the failed commit's insert to be reverted")
+	}
+	contents, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.Contains(line, b.config.GetAddr().String()) && strings.Contains(line, "30") {
+			t.Errorf("expected the aborted transaction's write not to be logged, got %q", line)
+		}
+	}
+
+	// Replaying the log agrees with the table.
+	recovered, recoveredFolder := setupDatabase(t)
+	defer os.RemoveAll(recoveredFolder)
+	defer os.RemoveAll(strings.TrimSuffix(recovered.GetBasePath(), "/") + "-recovery")
+	defer recovered.Close()
+	_, rm = setupRecovery(t, recovered, logName)
+	if err := rm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	if table, err = recovered.GetTable("t"); err != nil {
+		t.Fatal(err)
+	}
+	if entry, err := table.Find(1); err != nil || entry.GetValue() != 20 {
+		t.Errorf("expected key 1 to recover as 20, got %v, %v", entry, err)
+	}
+	if _, err := table.Find(2); err == nil {
+		t.Error("expected the failed commit's insert not to be recovered")
+	}
+}
+
+func TestRecoveryCheckpointCommand(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer os.RemoveAll(strings.TrimSuffix(d.GetBasePath(), "/") + "-recovery")
+	defer d.Close()
+	logName := filepath.Join(folder, "db.log")
+	tm, rm := setupRecovery(t, d, logName)
+	r := recovery.RecoveryREPL(d, tm, rm)
+
+	// Leave a transaction running across the checkpoint.
+	clientId := uuid.New()
+	var out bytes.Buffer
+	config := repl.NewREPLConfig(&out, clientId)
+	for _, payload := range []string{
+		"create btree table t",
+		"transaction begin",
+		"insert 1 2 into t",
+		"checkpoint",
+	} {
+		if err := r.Execute(payload, config); err != nil {
+			t.Fatalf("%s: %v", payload, err)
+		}
+	}
+	if !strings.Contains(out.String(), "checkpoint created; ") {
+		t.Errorf("checkpoint did not report pages flushed; output was %q", out.String())
+	}
+
+	// The checkpoint record should name the running transaction.
+	contents, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	last := lines[len(lines)-1]
+	if !strings.Contains(last, "checkpoint") || !strings.Contains(last, clientId.String()) {
+		t.Errorf("expected a checkpoint record for %v at the end of the log, got %q", clientId, last)
+	}
+	if err := r.Execute("transaction commit", config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoveryAbortOnDisconnect(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	tm, rm := setupRecovery(t, d, filepath.Join(folder, "db.log"))
+	r := recovery.RecoveryREPL(d, tm, rm)
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run a client over a connection that drops mid-transaction.
+	server, client := net.Pipe()
+	clientId := uuid.New()
+	config := repl.NewREPLConfig(server, clientId)
+	config.SetDisconnectHandler(rm.AbortOnDisconnect())
+	done := make(chan struct{})
+	go func() {
+		r.RunConfig(server, config, "")
+		close(done)
+	}()
+	go io.Copy(ioutil.Discard, client)
+	io.WriteString(client, "transaction begin\ninsert 1 10 into t\n")
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("REPL did not notice the dropped connection")
+	}
+
+	// The transaction is gone, its insert undone, and its lock released.
+	if _, found := tm.GetTransaction(clientId); found {
+		t.Error("transaction still running after disconnect")
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := table.Find(1); err == nil {
+		t.Error("insert from the dropped transaction was not rolled back")
+	}
+	other := newReplClient(r)
+	other.run(t, "transaction begin")
+	locked := make(chan error)
+	go func() {
+		locked <- other.r.Execute("insert 1 20 into t", other.config)
+	}()
+	select {
+	case err := <-locked:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("lock held by the dropped transaction was never released")
+	}
+	other.run(t, "transaction commit")
+}
+
+func TestRecoveryOpenSnapshotAt(t *testing.T) {
+	d, folder := setupDatabase(t)
+	recoveryFolder := strings.TrimSuffix(d.GetBasePath(), "/") + "-recovery"
+	defer os.RemoveAll(folder)
+	defer os.RemoveAll(recoveryFolder)
+	defer d.Close()
+	tm, rm := setupRecovery(t, d, filepath.Join(folder, "db.log"))
+	r := recovery.RecoveryREPL(d, tm, rm)
+	client := newReplClient(r)
+	for _, payload := range []string{
+		"create btree table t1",
+		"create hash table t2",
+		"transaction begin",
+		"insert 1 10 into t1",
+		"insert 2 20 into t2",
+		"transaction commit",
+		"checkpoint",
+		// Uncommitted edits after the checkpoint.
+		"transaction begin",
+		"insert 3 30 into t1",
+		"update t2 2 21",
+	} {
+		client.run(t, payload)
+	}
+
+	snapshot, err := db.OpenSnapshotAt(recoveryFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	expected := map[string]string{"t1": "(1, 10)\n", "t2": "(2, 20)\n"}
+	for name, want := range expected {
+		table, err := snapshot.GetTable(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := table.Select()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		db.PrintResults(entries, &out)
+		if out.String() != want {
+			t.Errorf("snapshot of %s should hold only checkpointed data %q, got %q", name, want, out.String())
+		}
+		if err := table.Insert(4, 40); !errors.Is(err, db.ErrReadOnly) {
+			t.Errorf("expected writing to the snapshot of %s to fail with %v, got %v", name, db.ErrReadOnly, err)
+		}
+	}
+	if err := db.HandleCreateTable(snapshot, "create btree table t3", ioutil.Discard); !errors.Is(err, db.ErrReadOnly) {
+		t.Errorf("expected creating a table in the snapshot to fail with %v, got %v", db.ErrReadOnly, err)
+	}
+
+	// The live database is unaffected and keeps its uncommitted edits.
+	if got := client.run(t, "select from t1"); got != "(1, 10)\n(3, 30)\n" {
+		t.Errorf("live table changed by the snapshot: %q", got)
+	}
+	client.run(t, "transaction commit")
+}
+
+func TestRecoveryOpenGeneration(t *testing.T) {
+	d, folder := setupDatabase(t)
+	base := strings.TrimSuffix(d.GetBasePath(), "/")
+	defer os.RemoveAll(folder)
+	defer os.RemoveAll(base + "-recovery")
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	_, rm := setupRecovery(t, d, filepath.Join(folder, "db.log"))
+	rm.SetSnapshotGenerations(2)
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		if err := table.Insert(i, i*10); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rm.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(db.GenerationFolder(base, int(i)))
+	}
+
+	// Only the newest two generations are kept.
+	gens, err := db.Generations(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gens) != 2 || gens[0] != 2 || gens[1] != 3 {
+		t.Fatalf("expected generations [2 3], got %v", gens)
+	}
+	if _, err := db.OpenGeneration(base, 1); err == nil {
+		t.Error("expected opening a pruned generation to fail")
+	}
+
+	older, err := db.OpenGeneration(base, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer older.Close()
+	checkTableEntries(t, older, "t", "(1, 10)\n(2, 20)\n")
+	olderTable, err := older.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := olderTable.Insert(4, 40); !errors.Is(err, db.ErrReadOnly) {
+		t.Errorf("expected a generation to be read-only, got %v", err)
+	}
+	latest, err := db.OpenGeneration(base, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer latest.Close()
+	checkTableEntries(t, latest, "t", "(1, 10)\n(2, 20)\n(3, 30)\n")
+}
+
+func TestRecoveryLogBufferedUntilCommit(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logName := filepath.Join(folder, "db.log")
+	_, rm := setupRecovery(t, d, logName)
+	clientId := uuid.New()
+	rm.Start(clientId)
+	for i := int64(0); i < 100; i++ {
+		rm.Edit(clientId, table, recovery.INSERT_ACTION, i, 0, i)
+	}
+	rm.Commit(clientId)
+	if writes := rm.LogWrites(); writes >= 102 {
+		t.Errorf("expected the burst to take fewer writes than its 102 records, took %d", writes)
+	}
+
+	// Once Commit returns, every record up to the commit is on disk.
+	contents, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	if len(lines) != 102 {
+		t.Fatalf("expected 102 records on disk after commit, got %d", len(lines))
+	}
+	if last := lines[len(lines)-1]; !strings.Contains(last, "commit") || !strings.Contains(last, clientId.String()) {
+		t.Errorf("expected the commit record last, got %q", last)
+	}
+}
+
+func BenchmarkRecoveryLogBurst(b *testing.B) {
+	d, folder := setupDatabase(b)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		b.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, rm := setupRecovery(b, d, filepath.Join(folder, "db.log"))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clientId := uuid.New()
+		rm.Start(clientId)
+		for key := int64(0); key < 100; key++ {
+			rm.Edit(clientId, table, recovery.INSERT_ACTION, key, 0, key)
+		}
+		rm.Commit(clientId)
+	}
+	b.ReportMetric(float64(rm.LogWrites())/float64(b.N), "writes/op")
+}
+
+func TestRecoveryDurability(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rm := setupRecovery(t, d, filepath.Join(folder, "db.log"))
+	var counter *syncCountingFile
+	table.GetPager().WrapFile(func(f pager.File) pager.File {
+		counter = &syncCountingFile{File: f}
+		return counter
+	})
+	commit := func() {
+		clientId := uuid.New()
+		rm.Start(clientId)
+		rm.Edit(clientId, table, recovery.INSERT_ACTION, 1, 0, 1)
+		rm.Commit(clientId)
+	}
+	for _, tc := range []struct {
+		durability pager.Durability
+		syncs      int64
+	}{{pager.NO_SYNC, 0}, {pager.SYNC, 1}} {
+		rm.SetDurability(tc.durability)
+		table.GetPager().SetDurability(tc.durability)
+		logSyncs, fileSyncs := rm.LogSyncs(), counter.syncs
+		commit()
+		if got := rm.LogSyncs() - logSyncs; got != tc.syncs {
+			t.Errorf("durability %d: expected %d log syncs per commit, got %d", tc.durability, tc.syncs, got)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := int64(counter.syncs - fileSyncs); got != tc.syncs {
+			t.Errorf("durability %d: expected %d table syncs per flush, got %d", tc.durability, tc.syncs, got)
+		}
+	}
+}
+
+// Commit one-insert transactions, flushing the table every 100 commits.
+func benchmarkRecoveryDurability(b *testing.B, durability pager.Durability) {
+	d, folder := setupDatabase(b)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		b.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, rm := setupRecovery(b, d, filepath.Join(folder, "db.log"))
+	rm.SetDurability(durability)
+	table.GetPager().SetDurability(durability)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		clientId := uuid.New()
+		rm.Start(clientId)
+		rm.Edit(clientId, table, recovery.INSERT_ACTION, int64(i), 0, int64(i))
+		rm.Commit(clientId)
+		if i%100 == 99 {
+			d.Flush()
+		}
+	}
+}
+
+func BenchmarkRecoveryDurabilitySync(b *testing.B) {
+	benchmarkRecoveryDurability(b, pager.SYNC)
+}
+
+func BenchmarkRecoveryDurabilityNoSync(b *testing.B) {
+	benchmarkRecoveryDurability(b, pager.NO_SYNC)
+}
+
+// Recover the given log into a new database, returning the recovered value of key 1.
+func recoverInconsistentLog(t *testing.T, logName string, strict bool) (int64, error) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err := recovery.NewRecoveryManager(d, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm.SetStrict(strict)
+	if err := rm.Recover(); err != nil {
+		return 0, err
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry, err := table.Find(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry.GetValue(), nil
+}
+
+func TestRecoveryStrictMode(t *testing.T) {
+	logDir, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+	logName := filepath.Join(logDir, "db.log")
+
+	// Log a committed transaction that inserts the same key twice.
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rm := setupRecovery(t, d, logName)
+	rm.Table("btree", "t")
+	clientId := uuid.New()
+	rm.Start(clientId)
+	rm.Edit(clientId, table, recovery.INSERT_ACTION, 1, 0, 10)
+	rm.Edit(clientId, table, recovery.INSERT_ACTION, 1, 0, 20)
+	rm.Commit(clientId)
+
+	// By default, the second insert falls back to an update.
+	value, err := recoverInconsistentLog(t, logName, false)
+	if err != nil {
+		t.Fatalf("expected lenient recovery to succeed, got %v", err)
+	}
+	if value != 20 {
+		t.Errorf("expected lenient recovery to leave key 1 at 20, got %d", value)
+	}
+
+	// In strict mode, the inconsistency is reported.
+	_, err = recoverInconsistentLog(t, logName, true)
+	if err == nil || !strings.Contains(err.Error(), "redo insert of key 1 into t") {
+		t.Errorf("expected strict recovery to report the duplicate insert, got %v", err)
+	}
+}
+
+// Check that a table holds exactly the given entries.
+func checkTableEntries(t *testing.T, d *db.Database, name string, want string) {
+	table, err := d.GetTable(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := table.Select()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	db.PrintResults(entries, &out)
+	if out.String() != want {
+		t.Errorf("expected %s to hold %q, got %q", name, want, out.String())
+	}
+}
+
+func TestRecoveryNestedTransactions(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	logName := filepath.Join(folder, "db.log")
+	tm, rm := setupRecovery(t, d, logName)
+	if err := recovery.HandleCreateTable(d, tm, rm, "create btree table t", ioutil.Discard, uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	run := func(payload string, clientId uuid.UUID) {
+		var err error
+		switch strings.Fields(payload)[0] {
+		case "insert":
+			err = recovery.HandleInsert(d, tm, rm, payload, clientId)
+		case "update":
+			err = recovery.HandleUpdate(d, tm, rm, payload, clientId)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", payload, err)
+		}
+	}
+	root := uuid.New()
+	rm.Start(root)
+	if err := tm.Begin(root); err != nil {
+		t.Fatal(err)
+	}
+	run("insert 1 10 into t", root)
+
+	// Two levels of nesting; each level writes to keys locked by its parent.
+	child, err := rm.BeginNested(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run("insert 2 20 into t", child)
+	run("update t 1 11", child)
+	grandchild, err := rm.BeginNested(child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run("insert 3 30 into t", grandchild)
+	run("update t 2 21", grandchild)
+	if err := tm.Commit(child); !errors.Is(err, concurrency.ErrNestedTxRunning) {
+		t.Errorf("expected committing past a running nested transaction to fail with %v, got %v", concurrency.ErrNestedTxRunning, err)
+	}
+
+	// Aborting the inner transaction undoes only its edits.
+	if err := rm.Rollback(grandchild); err != nil {
+		t.Fatal(err)
+	}
+	checkTableEntries(t, d, "t", "(1, 11)\n(2, 20)\n")
+	if _, found := tm.GetTransaction(grandchild); found {
+		t.Error("rolled back nested transaction still running")
+	}
+
+	// Committing the middle one hands its locks to the root.
+	rm.Commit(child)
+	if err := tm.Commit(child); err != nil {
+		t.Fatal(err)
+	}
+	rootTx, found := tm.GetTransaction(root)
+	if !found {
+		t.Fatal("root transaction ended with its child")
+	}
+	if n := len(rootTx.GetResources()); n != 2 {
+		t.Errorf("expected the root to hold the locks on keys 1 and 2, holds %d locks", n)
+	}
+	rm.Commit(root)
+	if err := tm.Commit(root); err != nil {
+		t.Fatal(err)
+	}
+	checkTableEntries(t, d, "t", "(1, 11)\n(2, 20)\n")
+
+	// The log replays to the same state.
+	recovered, recoveredFolder := setupDatabase(t)
+	defer os.RemoveAll(recoveredFolder)
+	defer recovered.Close()
+	rm, err = recovery.NewRecoveryManager(recovered, concurrency.NewTransactionManager(concurrency.NewLockManager()), logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	checkTableEntries(t, recovered, "t", "(1, 11)\n(2, 20)\n")
+}
+
+func TestRecoveryKeyValueLogged(t *testing.T) {
+	logDir, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+	logName := filepath.Join(logDir, "db.log")
+
+	// Write through the key-value API, logging each write.
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	_, rm := setupRecovery(t, d, logName)
+	rm.Table("btree", "t")
+	d.SetEditLogger(rm.EditLogger())
+	for _, write := range [][2]int64{{1, 10}, {2, 5}, {1, 20}} {
+		if err := d.Put("t", write[0], write[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Delete("t", 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replaying the log into an empty database gives the same table.
+	value, err := recoverInconsistentLog(t, logName, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 20 {
+		t.Errorf("expected key 1 to be recovered as 20, got %d", value)
+	}
+}
+
+func TestRecoveryUpsert(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	tm, rm := setupRecovery(t, d, filepath.Join(folder, "db.log"))
+	if err := recovery.HandleCreateTable(d, tm, rm, "create btree table t", ioutil.Discard, uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	begin := func() uuid.UUID {
+		clientId := uuid.New()
+		rm.Start(clientId)
+		if err := tm.Begin(clientId); err != nil {
+			t.Fatal(err)
+		}
+		return clientId
+	}
+	upsert := func(payload string, clientId uuid.UUID) {
+		if err := recovery.HandleUpsert(d, tm, rm, payload, clientId); err != nil {
+			t.Fatalf("%s: %v", payload, err)
+		}
+	}
+	setup := begin()
+	upsert("upsert 1 10 into t", setup)
+	rm.Commit(setup)
+	if err := tm.Commit(setup); err != nil {
+		t.Fatal(err)
+	}
+
+	// Upserting an existing key updates it; upserting a new one inserts it.
+	aborted := begin()
+	upsert("upsert 1 11 into t", aborted)
+	upsert("upsert 2 20 into t", aborted)
+	checkTableEntries(t, d, "t", "(1, 11)\n(2, 20)\n")
+	// Rolling back restores the old value and removes the new key.
+	if err := rm.Rollback(aborted); err != nil {
+		t.Fatal(err)
+	}
+	checkTableEntries(t, d, "t", "(1, 10)\n")
+
+	committed := begin()
+	upsert("upsert 2 21 into t", committed)
+	upsert("upsert 2 22 into t", committed)
+	rm.Commit(committed)
+	if err := tm.Commit(committed); err != nil {
+		t.Fatal(err)
+	}
+	checkTableEntries(t, d, "t", "(1, 10)\n(2, 22)\n")
+}
+
+func TestRecoveryUndoToLSN(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	tm, rm := setupRecovery(t, d, filepath.Join(folder, "db.log"))
+	if err := recovery.HandleCreateTable(d, tm, rm, "create btree table t", ioutil.Discard, uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	run := func(payload string, clientId uuid.UUID) {
+		var err error
+		switch strings.Fields(payload)[0] {
+		case "insert":
+			err = recovery.HandleInsert(d, tm, rm, payload, clientId)
+		case "update":
+			err = recovery.HandleUpdate(d, tm, rm, payload, clientId)
+		case "delete":
+			err = recovery.HandleDelete(d, tm, rm, payload, clientId)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", payload, err)
+		}
+	}
+	clientId := uuid.New()
+	rm.Start(clientId)
+	if err := tm.Begin(clientId); err != nil {
+		t.Fatal(err)
+	}
+	run("insert 1 10 into t", clientId)
+	run("update t 1 11", clientId)
+	run("insert 2 20 into t", clientId)
+	lsn := rm.LastLSN()
+	run("update t 1 12", clientId)
+	run("insert 3 30 into t", clientId)
+	run("delete 2 from t", clientId)
+	checkTableEntries(t, d, "t", "(1, 12)\n(3, 30)\n")
+
+	// Only the edits after the LSN are undone, and the transaction keeps running.
+	if err := rm.UndoToLSN(clientId, lsn); err != nil {
+		t.Fatal(err)
+	}
+	checkTableEntries(t, d, "t", "(1, 11)\n(2, 20)\n")
+	if _, found := tm.GetTransaction(clientId); !found {
+		t.Fatal("transaction ended after undoing to an LSN")
+	}
+	// Rolling back afterwards undoes the remaining edits, and any made since.
+	run("insert 4 40 into t", clientId)
+	if err := rm.Rollback(clientId); err != nil {
+		t.Fatal(err)
+	}
+	checkTableEntries(t, d, "t", "")
+	if err := rm.UndoToLSN(clientId, lsn); !errors.Is(err, concurrency.ErrTxNotFound) {
+		t.Errorf("expected %v, got %v", concurrency.ErrTxNotFound, err)
+	}
+}
+
+func TestRecoveryMerge(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer os.RemoveAll(strings.TrimSuffix(folder, "/") + "-recovery")
+	defer d.Close()
+	logName := filepath.Join(folder, "db.log")
+	_, rm := setupRecovery(t, d, logName)
+	other, otherFolder := setupDatabase(t)
+	defer os.RemoveAll(otherFolder)
+	defer other.Close()
+	for _, payload := range []string{"create btree table b", "create hash table h"} {
+		if err := db.HandleCreateTable(other, payload, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	table, err := other.GetTable("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := table.Insert(1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.Merge(other); err != nil {
+		t.Fatal(err)
+	}
+	log, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range []string{"< create btree table b >", "< create hash table h >"} {
+		if !strings.Contains(string(log), record) {
+			t.Errorf("expected %q in the log, got %q", record, log)
+		}
+	}
+	// The checkpoint copies the merged tables into the recovery folder.
+	if _, err := os.Stat(filepath.Join(strings.TrimSuffix(folder, "/")+"-recovery", "b")); err != nil {
+		t.Errorf("merged table not in the recovery copy: %v", err)
+	}
+	checkTableEntries(t, d, "b", "(1, 10)\n")
+}
+
+// memorySink keeps the records it gets; if block is set, writes wait for it to be closed.
+type memorySink struct {
+	mtx     sync.Mutex
+	records bytes.Buffer
+	block   chan struct{}
+}
+
+func (s *memorySink) Write(record []byte) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.records.Write(record)
+	return nil
+}
+
+func TestRecoveryLogSink(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer os.RemoveAll(strings.TrimSuffix(folder, "/") + "-recovery")
+	defer d.Close()
+	logName := filepath.Join(folder, "db.log")
+	tm, rm := setupRecovery(t, d, logName)
+	sink := &memorySink{}
+	handle := rm.AddSink(sink, recovery.SINK_FAIL)
+	if err := recovery.HandleCreateTable(d, tm, rm, "create btree table t", ioutil.Discard, uuid.New()); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 50; i++ {
+		clientId := uuid.New()
+		rm.Start(clientId)
+		rm.Edit(clientId, table, recovery.INSERT_ACTION, i, 0, i)
+		rm.Commit(clientId)
+	}
+	rm.Checkpoint()
+	rm.RemoveSink(handle)
+	if err := handle.Err(); err != nil {
+		t.Fatal(err)
+	}
+	log, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sink.records.String() != string(log) {
+		t.Errorf("sink got\n%s\nlog has\n%s", sink.records.String(), log)
+	}
+	// Records written after the sink is removed don't reach it.
+	rm.Checkpoint()
+	if sink.records.String() != string(log) {
+		t.Error("removed sink got a record")
+	}
+
+	// A stalled sink doesn't hold up the log; it loses records according to its policy.
+	for _, policy := range []recovery.SinkPolicy{recovery.SINK_DROP, recovery.SINK_FAIL} {
+		stalled := &memorySink{block: make(chan struct{})}
+		handle := rm.AddSink(stalled, policy)
+		for i := 0; i < 2*recovery.SINK_BUFFER_SIZE; i++ {
+			rm.Start(uuid.New())
+		}
+		close(stalled.block)
+		rm.RemoveSink(handle)
+		if policy == recovery.SINK_DROP && (handle.Dropped() == 0 || handle.Err() != nil) {
+			t.Errorf("expected dropped records and no error, got %d and %v", handle.Dropped(), handle.Err())
+		}
+		if policy == recovery.SINK_FAIL && !errors.Is(handle.Err(), recovery.ErrSinkFull) {
+			t.Errorf("expected %v, got %v", recovery.ErrSinkFull, handle.Err())
+		}
+	}
+}
+
+// errorAfterReader returns err once r runs out, like a connection that dropped.
+type errorAfterReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e errorAfterReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		return n, e.err
+	}
+	return n, err
+}
+
+func TestRecoveryApplyLogStream(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer os.RemoveAll(strings.TrimSuffix(folder, "/") + "-recovery")
+	defer d.Close()
+	tm, rm := setupRecovery(t, d, filepath.Join(folder, "db.log"))
+	sink := &memorySink{}
+	handle := rm.AddSink(sink, recovery.SINK_FAIL)
+	run := func(payload string, clientId uuid.UUID) {
+		var err error
+		switch strings.Fields(payload)[0] {
+		case "create":
+			err = recovery.HandleCreateTable(d, tm, rm, payload, ioutil.Discard, clientId)
+		case "transaction":
+			err = recovery.HandleTransaction(d, tm, rm, payload, ioutil.Discard, clientId)
+		case "abort":
+			err = recovery.HandleAbort(d, tm, rm, payload, ioutil.Discard, clientId)
+		case "insert":
+			err = recovery.HandleInsert(d, tm, rm, payload, clientId)
+		case "update":
+			err = recovery.HandleUpdate(d, tm, rm, payload, clientId)
+		case "delete":
+			err = recovery.HandleDelete(d, tm, rm, payload, clientId)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", payload, err)
+		}
+	}
+	a, b, c, e := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	run("create btree table t", a)
+	run("create hash table h", a)
+	run("transaction begin", a)
+	run("insert 1 10 into t", a)
+	run("insert 2 20 into h", a)
+	run("transaction commit", a)
+	run("transaction begin", b)
+	run("insert 3 30 into t", b)
+	run("transaction begin", c)
+	run("update t 1 11", c)
+	run("delete 2 from h", c)
+	run("transaction commit", c)
+	rm.Checkpoint()
+	run("insert 5 50 into h", b)
+	run("transaction commit", b)
+	run("transaction begin", a)
+	run("insert 4 40 into t", a)
+	run("abort", a)
+	run("transaction begin", e)
+	run("insert 6 60 into t", e)
+	rm.RemoveSink(handle)
+	records := strings.SplitAfter(sink.records.String(), "\n")
+
+	follower, followerFolder := setupDatabase(t)
+	defer os.RemoveAll(followerFolder)
+	defer follower.Close()
+	followerTm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+	// The connection drops partway through the record after the checkpoint.
+	cut := 0
+	for i, record := range records {
+		if strings.Contains(record, "checkpoint") {
+			cut = i + 1
+		}
+	}
+	shipped := strings.Join(records[:cut], "") + records[cut][:5]
+	dropped := errors.New("connection reset")
+	err := recovery.ApplyLogStream(follower, followerTm, errorAfterReader{strings.NewReader(shipped), dropped})
+	if !errors.Is(err, dropped) {
+		t.Fatalf("expected %v, got %v", dropped, err)
+	}
+	checkTableEntries(t, follower, "t", "(1, 11)\n")
+	checkTableEntries(t, follower, "h", "")
+	applied, err := recovery.AppliedLSN(follower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b was uncommitted when the stream dropped, so it resumes at b's start.
+	if applied >= int64(cut) {
+		t.Fatalf("expected the applied LSN to stop before uncommitted b, got %d of %d", applied, cut)
+	}
+	err = recovery.ApplyLogStream(follower, followerTm, strings.NewReader(strings.Join(records[applied:], "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTableEntries(t, follower, "t", "(1, 11)\n(3, 30)\n")
+	checkTableEntries(t, follower, "h", "(5, 50)\n")
+	// e's insert is applied once its commit arrives.
+	applied, err = recovery.AppliedLSN(follower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run("transaction commit", e)
+	rm.Checkpoint()
+	log, err := ioutil.ReadFile(filepath.Join(folder, "db.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records = strings.SplitAfter(string(log), "\n")
+	if err := recovery.ApplyLogStream(follower, followerTm, strings.NewReader(strings.Join(records[applied:], ""))); err != nil {
+		t.Fatal(err)
+	}
+	checkTableEntries(t, follower, "t", "(1, 11)\n(3, 30)\n(6, 60)\n")
+	checkTableEntries(t, follower, "h", "(5, 50)\n")
+}
+
+func TestRecoveryRebuildSnapshot(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	recoveryFolder := strings.TrimSuffix(folder, "/") + "-recovery"
+	defer os.RemoveAll(recoveryFolder)
+	_, rm := setupRecovery(t, d, filepath.Join(folder, "db.log"))
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(1); i <= 3; i++ {
+		if err := table.Insert(i, i*10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Corrupt the snapshot the checkpoint left.
+	rm.Checkpoint()
+	if err := ioutil.WriteFile(filepath.Join(recoveryFolder, "t"), []byte("garbage"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	c := newReplClient(recovery.RecoveryREPL(d, nil, rm))
+	if got := c.run(t, "rebuild_snapshot"); !strings.HasPrefix(got, "snapshot rebuilt;") || strings.HasPrefix(got, "snapshot rebuilt; 0 bytes") {
+		t.Errorf("expected the bytes copied to be reported, got %q", got)
+	}
+	if _, err := os.Stat(recoveryFolder + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary copy to be gone, got %v", err)
+	}
+	// Priming from the rebuilt snapshot gets the live state back.
+	d.Close()
+	primed, err := recovery.Prime(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primed.Close()
+	checkTableEntries(t, primed, "t", "(1, 10)\n(2, 20)\n(3, 30)\n")
+}
+
+// A logged event.
+type logEvent struct {
+	level   string
+	msg     string
+	keyvals []interface{}
+}
+
+// A logger that records every event.
+type capturingLogger struct {
+	mtx    sync.Mutex
+	events []logEvent
+}
+
+func (l *capturingLogger) log(level string, msg string, keyvals []interface{}) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.events = append(l.events, logEvent{level: level, msg: msg, keyvals: keyvals})
+}
+
+func (l *capturingLogger) Debug(msg string, keyvals ...interface{}) { l.log("debug", msg, keyvals) }
+func (l *capturingLogger) Info(msg string, keyvals ...interface{})  { l.log("info", msg, keyvals) }
+func (l *capturingLogger) Warn(msg string, keyvals ...interface{})  { l.log("warn", msg, keyvals) }
+func (l *capturingLogger) Error(msg string, keyvals ...interface{}) { l.log("error", msg, keyvals) }
+
+// Count the events logged at the given level with the given message.
+func (l *capturingLogger) count(level string, msg string) int {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	n := 0
+	for _, event := range l.events {
+		if event.level == level && event.msg == msg {
+			n++
+		}
+	}
+	return n
+}
+
+// A file whose writes fail while failing is set.
+type failingWriteFile struct {
+	pager.File
+	failing bool
+}
+
+func (f *failingWriteFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.failing {
+		return 0, errors.New("disk full")
+	}
+	return f.File.WriteAt(p, off)
+}
+
+func TestRecoveryCheckpointLogsFlushFailure(t *testing.T) {
+	logger := &capturingLogger{}
+	utils.SetLogger(logger)
+	defer utils.SetLogger(nil)
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer os.RemoveAll(strings.TrimSuffix(folder, "/") + "-recovery")
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rm := setupRecovery(t, d, filepath.Join(folder, "db.log"))
+	var file *failingWriteFile
+	table.GetPager().WrapFile(func(f pager.File) pager.File {
+		file = &failingWriteFile{File: f, failing: true}
+		return file
+	})
+	if err := table.Insert(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if flushed, err := rm.Checkpoint(); err == nil || flushed != 0 {
+		t.Errorf("expected the checkpoint to fail with no pages flushed, got %d pages and error %v", flushed, err)
+	}
+	if logger.count("warn", "page flush failed") == 0 {
+		t.Error("expected a warning for the failed page flush")
+	}
+	// The page stays dirty, so that the next checkpoint flushes it.
+	file.failing = false
+	if flushed, err := rm.Checkpoint(); err != nil || flushed == 0 {
+		t.Errorf("expected the dirty page to be flushed once writes succeed, got %d pages and error %v", flushed, err)
+	}
+	if n := logger.count("error", "log write failed") + logger.count("error", "log sync failed"); n != 0 {
+		t.Errorf("expected no log errors, got %d", n)
+	}
+}
+
+func TestRecoveryCheckpointFlushFailure(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer os.RemoveAll(strings.TrimSuffix(folder, "/") + "-recovery")
+	defer d.Close()
+	for _, name := range []string{"good", "bad"} {
+		if err := db.HandleCreateTable(d, "create btree table "+name, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+	}
+	logName := filepath.Join(folder, "db.log")
+	_, rm := setupRecovery(t, d, logName)
+	bad, err := d.GetTable("bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file *failingWriteFile
+	bad.GetPager().WrapFile(func(f pager.File) pager.File {
+		file = &failingWriteFile{File: f, failing: true}
+		return file
+	})
+	for _, table := range d.GetTables() {
+		if err := table.Insert(1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := rm.Checkpoint(); err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("expected the checkpoint to fail with the flush error, got %v", err)
+	}
+	contents, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), "checkpoint") {
+		t.Errorf("expected no checkpoint record after a failed flush, got %q", contents)
+	}
+
+	// Once the table can be written again, the checkpoint goes through.
+	file.failing = false
+	if _, err := rm.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err = ioutil.ReadFile(logName); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(contents), "checkpoint") {
+		t.Errorf("expected a checkpoint record, got %q", contents)
+	}
+}
+
+func TestRecoveryRedoCreateExistingTable(t *testing.T) {
+	logDir, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+	logName := filepath.Join(logDir, "db.log")
+
+	// Log a table's creation, then a committed insert into it.
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rm := setupRecovery(t, d, logName)
+	rm.Table("btree", "t")
+	clientId := uuid.New()
+	rm.Start(clientId)
+	rm.Edit(clientId, table, recovery.INSERT_ACTION, 1, 0, 10)
+	rm.Commit(clientId)
+
+	// Recover into databases where the table already exists.
+	recoverInto := func(tableType string) error {
+		d, folder := setupDatabase(t)
+		defer os.RemoveAll(folder)
+		defer d.Close()
+		if err := db.HandleCreateTable(d, "create "+tableType+" table t", ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+		tm := concurrency.NewTransactionManager(concurrency.NewLockManager())
+		rm, err := recovery.NewRecoveryManager(d, tm, logName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rm.SetStrict(true)
+		if err := rm.Recover(); err != nil {
+			return err
+		}
+		checkTableEntries(t, d, "t", "(1, 10)\n")
+		return nil
+	}
+	if err := recoverInto("btree"); err != nil {
+		t.Errorf("expected recovery to continue past the existing table, got %v", err)
+	}
+	if err := recoverInto("hash"); !errors.Is(err, recovery.ErrTableTypeMismatch) {
+		t.Errorf("expected a table type mismatch, got %v", err)
+	}
+}
+
+func TestRecoveryRedoOnly(t *testing.T) {
+	logDir, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+	logName := filepath.Join(logDir, "db.log")
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer os.RemoveAll(strings.TrimSuffix(folder, "/") + "-recovery")
+	tm, rm := setupRecovery(t, d, logName)
+	rm.SetRecoveryMode(recovery.REDO_ONLY)
+	r := recovery.RecoveryREPL(d, tm, rm)
+	committer, crasher := newReplClient(r), newReplClient(r)
+	for _, payload := range []string{
+		"create btree table t",
+		"transaction begin",
+		"insert 1 10 into t",
+		"transaction commit",
+		"checkpoint",
+		"transaction begin",
+		"insert 2 20 into t",
+	} {
+		committer.run(t, payload)
+	}
+	crasher.run(t, "transaction begin")
+	crasher.run(t, "insert 3 30 into t")
+	crasher.run(t, "update t 1 11")
+	committer.run(t, "transaction commit")
+	// The snapshot would hold the running transaction's changes.
+	if _, err := rm.Checkpoint(); !errors.Is(err, recovery.ErrUncommittedCheckpoint) {
+		t.Fatalf("expected checkpointing with a running transaction to fail, got %v", err)
+	}
+
+	// Crash with the transaction still running, its changes in the tables.
+	d.Close()
+	before, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primed, err := recovery.Prime(folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primed.Close()
+	tm = concurrency.NewTransactionManager(concurrency.NewLockManager())
+	rm, err = recovery.NewRecoveryManager(primed, tm, logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rm.SetRecoveryMode(recovery.REDO_ONLY)
+	rm.SetStrict(true)
+	if err := rm.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	checkTableEntries(t, primed, "t", "(1, 10)\n(2, 20)\n")
+	// Nothing was undone, so nothing was logged.
+	after, err := ioutil.ReadFile(logName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Errorf("expected recovery to leave the log alone, it grew from %d to %d bytes", len(before), len(after))
+	}
+	if n := tm.ActiveCount(); n != 0 {
+		t.Errorf("expected no transactions running after recovery, got %d", n)
+	}
+}
+
+func TestRecoveryReadLogsSince(t *testing.T) {
+	logDir, err := ioutil.TempDir(".", "db-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+	logName := filepath.Join(logDir, "db.log")
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer os.RemoveAll(strings.TrimSuffix(folder, "/") + "-recovery")
+	defer d.Close()
+	if err := db.HandleCreateTable(d, "create btree table t", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	table, err := d.GetTable("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rm := setupRecovery(t, d, logName)
+	// Rotate often, so that the records read span several segments.
+	rm.SetMaxLogSize(512)
+	rm.Table("btree", "t")
+	id := uuid.New()
+	rm.Start(id)
+	for i := int64(0); i < 20; i++ {
+		rm.Edit(id, table, recovery.INSERT_ACTION, i, 0, i)
+	}
+	lsn := rm.LastLSN()
+	for i := int64(20); i < 50; i++ {
+		rm.Edit(id, table, recovery.INSERT_ACTION, i, 0, i)
+	}
+	rm.Commit(id)
+
+	logs, err := rm.ReadLogsSince(lsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logs) != 31 {
+		t.Fatalf("expected the 31 records written since LSN %d, got %d", lsn, len(logs))
+	}
+	for i, log := range logs[:30] {
+		want := fmt.Sprintf("< %s, t, INSERT, %d, 0, %d >\n", id, i+20, i+20)
+		if got := recovery.ToString(log); got != want {
+			t.Fatalf("expected record %d to be %q, got %q", i, want, got)
+		}
+	}
+	if got, want := recovery.ToString(logs[30]), fmt.Sprintf("< %s commit >\n", id); got != want {
+		t.Errorf("expected the last record to be %q, got %q", want, got)
+	}
+	if logs, err = rm.ReadLogsSince(rm.LastLSN()); err != nil || len(logs) != 0 {
+		t.Errorf("expected no records since the last LSN, got %d, %v", len(logs), err)
+	}
+	if logs, err = rm.ReadLogsSince(0); err != nil || int64(len(logs)) != rm.LastLSN() {
+		t.Errorf("expected every record since LSN 0, got %d, %v", len(logs), err)
+	}
+
+	// A checkpoint with no running transactions deletes the old segments.
+	if _, err = rm.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = rm.ReadLogsSince(lsn); !errors.Is(err, recovery.ErrLogTruncated) {
+		t.Errorf("expected reading truncated records to fail, got %v", err)
+	}
+}
@@ -0,0 +1,360 @@
+package test
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	db "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/db"
+	repl "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/repl"
+	uuid "github.com/google/uuid"
+)
+
+func TestReplTiming(t *testing.T) {
+	r := repl.NewRepl()
+	r.AddCommand("slow", func(payload string, replConfig *repl.REPLConfig) error {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprintln(replConfig.GetWriter(), "done")
+		return nil
+	}, "Sleep for a while. usage: slow")
+	out := new(bytes.Buffer)
+	config := repl.NewREPLConfig(out, uuid.New())
+
+	// Timing is off by default.
+	if err := r.Execute("slow", config); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "done\n" {
+		t.Errorf("expected no timing by default, got %q", got)
+	}
+	out.Reset()
+	if err := r.Execute(".timing on", config); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Execute("slow", config); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || lines[0] != "done" {
+		t.Fatalf("expected the output followed by its timing, got %q", out.String())
+	}
+	var ms float64
+	if _, err := fmt.Sscanf(lines[1], "Time: %fms", &ms); err != nil {
+		t.Fatalf("couldn't parse timing line %q: %v", lines[1], err)
+	}
+	if ms < 20 {
+		t.Errorf("expected the slow command to take at least 20ms, reported %vms", ms)
+	}
+	out.Reset()
+	if err := r.Execute(".timing off", config); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Execute("slow", config); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "done\n" {
+		t.Errorf("expected timing to turn off, got %q", got)
+	}
+	if err := r.Execute(".timing maybe", config); err == nil {
+		t.Error("expected a bad .timing argument to be rejected")
+	}
+}
+
+func TestReplPreparedCommands(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	r := db.DatabaseRepl(d)
+	out := new(bytes.Buffer)
+	config := repl.NewREPLConfig(out, uuid.New())
+	if err := r.Execute("create btree table t", config); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Prepare("ins", "insert ? ? into t"); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 10; i++ {
+		if err := r.Exec("ins", config, i, i*hash_salt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Prepare("get", "find ? from t"); err != nil {
+		t.Fatal(err)
+	}
+	for i := int64(0); i < 10; i++ {
+		out.Reset()
+		if err := r.Exec("get", config, i); err != nil {
+			t.Fatal(err)
+		}
+		if want := fmt.Sprintf("found entry: (%d, %d)\n", i, i*hash_salt); out.String() != want {
+			t.Errorf("expected %q, got %q", want, out.String())
+		}
+	}
+	if err := r.Exec("ins", config, 1); err == nil {
+		t.Error("expected too few arguments to be rejected")
+	}
+	if err := r.Exec("ins", config, "1 2", 3); err == nil {
+		t.Error("expected an argument with spaces to be rejected")
+	}
+	if err := r.Exec("missing", config); err == nil {
+		t.Error("expected an unknown prepared command to be rejected")
+	}
+	if err := r.Prepare("bad", "? 1 into t"); err == nil {
+		t.Error("expected a template without a command to be rejected")
+	}
+}
+
+func TestReplTypedCommands(t *testing.T) {
+	r := repl.NewRepl()
+	out := new(bytes.Buffer)
+	config := repl.NewREPLConfig(out, uuid.New())
+	var got []interface{}
+	r.AddTypedCommand("put", []repl.ArgType{repl.INT64_ARG, "into", repl.STRING_ARG}, func(args []interface{}, replConfig *repl.REPLConfig) error {
+		got = args
+		return nil
+	}, "usage: put <key> into <table>")
+	if err := r.Execute("put -42 into t", config); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != int64(-42) || got[1] != "t" {
+		t.Errorf("expected [-42 t], got %v", got)
+	}
+	got = nil
+	if err := r.Execute("put 1 into", config); err == nil || !strings.Contains(err.Error(), "expected 3 arguments, got 2") {
+		t.Errorf("expected too few arguments to be rejected, got %v", err)
+	}
+	if err := r.Execute("put one into t", config); err == nil || !strings.Contains(err.Error(), "argument 1 must be an int64") {
+		t.Errorf("expected a non-integer key to be rejected, got %v", err)
+	}
+	if err := r.Execute("put 1 onto t", config); err == nil || !strings.Contains(err.Error(), `argument 2 must be "into"`) {
+		t.Errorf("expected a wrong keyword to be rejected, got %v", err)
+	}
+	if got != nil {
+		t.Errorf("handler ran on bad arguments: %v", got)
+	}
+}
+
+func TestDatabaseReplTypedCommands(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	r := db.DatabaseRepl(d)
+	out := new(bytes.Buffer)
+	config := repl.NewREPLConfig(out, uuid.New())
+	for _, command := range []string{"create hash table t", "insert 1 2 into t", "update t 1 3", "find 1 from t"} {
+		if err := r.Execute(command, config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !strings.HasSuffix(out.String(), "found entry: (1, 3)\n") {
+		t.Errorf("expected the updated entry to be found, got %q", out.String())
+	}
+	if err := r.Execute("update t x 3", config); err == nil {
+		t.Error("expected a non-integer key to be rejected")
+	}
+	if err := r.Execute("find 1 t", config); err == nil {
+		t.Error("expected a find without from to be rejected")
+	}
+}
+
+func TestReplRemoveCommand(t *testing.T) {
+	r := repl.NewRepl()
+	config := repl.NewREPLConfig(new(bytes.Buffer), uuid.New())
+	if r.HasCommand("ping") {
+		t.Error("expected an empty REPL to have no commands")
+	}
+	r.AddCommand("ping", func(payload string, replConfig *repl.REPLConfig) error { return nil }, "usage: ping")
+	if !r.HasCommand("ping") {
+		t.Error("expected the added command to be found")
+	}
+	if err := r.Execute("ping", config); err != nil {
+		t.Fatal(err)
+	}
+	if !r.RemoveCommand("ping") {
+		t.Error("expected removing an existing command to report it existed")
+	}
+	if r.HasCommand("ping") {
+		t.Error("expected the removed command to be gone")
+	}
+	if strings.Contains(r.HelpString(), "ping") {
+		t.Errorf("expected the removed command's help to be gone, got %q", r.HelpString())
+	}
+	if err := r.Execute("ping", config); err == nil {
+		t.Error("expected running the removed command to fail")
+	}
+	if r.RemoveCommand("ping") {
+		t.Error("expected removing a missing command to report it didn't exist")
+	}
+}
+
+func TestDatabaseReplHashStats(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	r := db.DatabaseRepl(d)
+	out := new(bytes.Buffer)
+	config := repl.NewREPLConfig(out, uuid.New())
+	for _, command := range []string{"create hash table h", "create btree table b", "insert 1 2 into h", "insert 3 4 into h"} {
+		if err := r.Execute(command, config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	out.Reset()
+	if err := r.Execute("hash_stats h", config); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), ", 0 overflow pages\n") || !strings.HasPrefix(out.String(), "bucket ") {
+		t.Errorf("expected a line per bucket, got %q", out.String())
+	}
+	if !strings.Contains(out.String(), "\nload factor: ") {
+		t.Errorf("expected the load factor, got %q", out.String())
+	}
+	if err := r.Execute("hash_stats b", config); err == nil {
+		t.Error("expected hash_stats on a btree table to fail")
+	}
+}
+
+func TestReplRateLimit(t *testing.T) {
+	r := repl.NewRepl()
+	ran := 0
+	r.AddCommand("ping", func(payload string, replConfig *repl.REPLConfig) error {
+		ran++
+		return nil
+	}, "Do nothing. usage: ping")
+	config := repl.NewREPLConfig(new(bytes.Buffer), uuid.New())
+
+	// Unlimited by default.
+	for i := 0; i < 100; i++ {
+		if err := r.Execute("ping", config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ran = 0
+	config.SetRateLimit(50, 5)
+	start := time.Now()
+	rejected := 0
+	for i := 0; i < 200; i++ {
+		err := r.Execute("ping", config)
+		if errors.Is(err, repl.ErrRateLimitExceeded) {
+			rejected++
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	if rejected == 0 || ran+rejected != 200 {
+		t.Fatalf("expected some of 200 commands to be rejected, ran %d and rejected %d", ran, rejected)
+	}
+	// At most the burst, plus what refilled meanwhile.
+	if allowed := 5 + int(50*elapsed.Seconds()); ran < 5 || ran > allowed {
+		t.Errorf("expected between 5 and %d commands to run, ran %d", allowed, ran)
+	}
+
+	// The bucket refills over time.
+	time.Sleep(100 * time.Millisecond)
+	if err := r.Execute("ping", config); err != nil {
+		t.Errorf("expected a command to run once the bucket refilled, got %v", err)
+	}
+	config.SetRateLimit(0, 0)
+	for i := 0; i < 100; i++ {
+		if err := r.Execute("ping", config); err != nil {
+			t.Fatalf("expected no limit once lifted, got %v", err)
+		}
+	}
+}
+
+func TestReplServerRateLimit(t *testing.T) {
+	r := repl.NewRepl()
+	r.AddCommand("ping", func(payload string, replConfig *repl.REPLConfig) error {
+		fmt.Fprintln(replConfig.GetWriter(), "pong")
+		return nil
+	}, "Reply. usage: ping")
+	server := repl.NewServer(r, nil, "")
+	server.SetRateLimit(0.1, 2)
+	client, conn := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		server.ServeConn(conn)
+		done <- true
+	}()
+	go io.WriteString(client, strings.Repeat("ping\n", 4))
+	reader := bufio.NewReader(client)
+	replies := make([]string, 0)
+	for len(replies) < 4 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, strings.TrimSpace(line))
+	}
+	client.Close()
+	<-done
+	want := []string{"pong", "pong", "rate limit exceeded", "rate limit exceeded"}
+	if !reflect.DeepEqual(replies, want) {
+		t.Errorf("expected two commands to run and two to be rejected, got %q", replies)
+	}
+}
+
+func TestReplHelpStringSorted(t *testing.T) {
+	r := repl.NewRepl()
+	for _, trigger := range []string{"select", "create", "insert", "drop", "find", "update"} {
+		r.AddCommand(trigger, func(payload string, replConfig *repl.REPLConfig) error { return nil }, "usage: "+trigger)
+	}
+	want := "create: usage: create\ndrop: usage: drop\nfind: usage: find\n" +
+		"insert: usage: insert\nselect: usage: select\nupdate: usage: update\n"
+	for i := 0; i < 5; i++ {
+		if help := r.HelpString(); help != want {
+			t.Fatalf("expected the help lines in order of trigger, got %q", help)
+		}
+	}
+}
+
+func TestDatabaseReplBench(t *testing.T) {
+	d, folder := setupDatabase(t)
+	defer os.RemoveAll(folder)
+	defer d.Close()
+	r := db.DatabaseRepl(d)
+	out := new(bytes.Buffer)
+	config := repl.NewREPLConfig(out, uuid.New())
+	for _, command := range []string{"create btree table b", "insert 10 -1 into b"} {
+		if err := r.Execute(command, config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Reports a positive throughput, leaving existing rows alone.
+	for _, bench := range []struct {
+		command string
+		want    int64
+	}{{"bench insert b 100", 100}, {"bench scan b", 101}} {
+		command, want := bench.command, bench.want
+		out.Reset()
+		if err := r.Execute(command, config); err != nil {
+			t.Fatal(err)
+		}
+		var verb string
+		var rows int64
+		var elapsed, rate float64
+		if _, err := fmt.Sscanf(out.String(), "%s %d rows in %fms (%f rows/sec)", &verb, &rows, &elapsed, &rate); err != nil {
+			t.Fatalf("expected a throughput report from %q, got %q: %v", command, out.String(), err)
+		}
+		if rows != want || rate <= 0 {
+			t.Errorf("expected %q to report %d rows at a positive rate, got %q", command, want, out.String())
+		}
+	}
+	if value, found, err := d.Get("b", 10); err != nil || !found || value != -1 {
+		t.Errorf("expected the existing row to be left alone, got %d, %v, %v", value, found, err)
+	}
+	for _, command := range []string{"bench insert b 0", "bench insert missing 10", "bench scan missing", "bench"} {
+		if err := r.Execute(command, config); err == nil {
+			t.Errorf("expected %q to fail", command)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"testing"
+
+	hash "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/hash"
+	utils "github.com/csci1270-fall-2023/dbms-projects-handout/pkg/utils"
+)
+
+func newEntry(key int64, value int64) utils.Entry {
+	entry := hash.HashEntry{}
+	entry.SetKey(key)
+	entry.SetValue(value)
+	return entry
+}
+
+func TestCompareEntries(t *testing.T) {
+	cases := []struct {
+		a, b     utils.Entry
+		expected int
+	}{
+		{newEntry(1, 0), newEntry(2, 0), -1},
+		{newEntry(2, 0), newEntry(1, 0), 1},
+		{newEntry(1, 5), newEntry(1, 7), 0},
+		{newEntry(-1, 0), newEntry(1, 0), -1},
+	}
+	for _, c := range cases {
+		if got := utils.CompareEntries(c.a, c.b); got != c.expected {
+			t.Errorf("CompareEntries(%d, %d) = %d; expected %d", c.a.GetKey(), c.b.GetKey(), got, c.expected)
+		}
+	}
+}
+
+func TestKeyInRange(t *testing.T) {
+	cases := []struct {
+		key       int64
+		inclusive bool
+		expected  bool
+	}{
+		{9, false, false},
+		{10, false, true},
+		{15, false, true},
+		{20, false, false},
+		{20, true, true},
+		{21, true, false},
+	}
+	for _, c := range cases {
+		if got := utils.KeyInRange(newEntry(c.key, 0), 10, 20, c.inclusive); got != c.expected {
+			t.Errorf("KeyInRange(%d, 10, 20, %v) = %v; expected %v", c.key, c.inclusive, got, c.expected)
+		}
+	}
+}
+
+func TestEntrySliceSorted(t *testing.T) {
+	if !utils.EntrySliceSorted(nil) {
+		t.Error("empty slice should be sorted")
+	}
+	if !utils.EntrySliceSorted([]utils.Entry{newEntry(1, 0), newEntry(1, 1), newEntry(3, 0)}) {
+		t.Error("slice with equal keys in order should be sorted")
+	}
+	if utils.EntrySliceSorted([]utils.Entry{newEntry(1, 0), newEntry(3, 0), newEntry(2, 0)}) {
+		t.Error("out-of-order slice reported as sorted")
+	}
+}
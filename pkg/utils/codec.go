@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Serializes entries into the fixed-size slots of table pages. Encode must return at most
+// ENCODED_ENTRY_SIZE bytes; a shorter encoding is padded with zeroes. Decode reads an entry
+// back from a slot, returning it and the number of bytes it used.
+type EntryCodec interface {
+	Encode(entry Entry) []byte
+	Decode(data []byte) (Entry, int)
+}
+
+// Size of the slot an encoded entry is stored in: room for a varint key and value.
+const ENCODED_ENTRY_SIZE = binary.MaxVarintLen64 * 2
+
+// Name of the codec tables use unless created with another.
+const DEFAULT_CODEC = "varint"
+
+// Longest name a codec can be registered under, so that tables can record it.
+const MAX_CODEC_NAME_SIZE = 32
+
+// Returned when a codec encodes an entry into more than ENCODED_ENTRY_SIZE bytes.
+var ErrEntryTooLarge = errors.New("encoded entry doesn't fit in a slot")
+
+// Encode an entry with a codec into a slot of ENCODED_ENTRY_SIZE bytes, padded with zeroes.
+// Fails with ErrEntryTooLarge if the encoding doesn't fit.
+func EncodeEntry(codec EntryCodec, entry Entry) ([]byte, error) {
+	encoded := codec.Encode(entry)
+	if len(encoded) > ENCODED_ENTRY_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d", ErrEntryTooLarge, len(encoded), ENCODED_ENTRY_SIZE)
+	}
+	data := make([]byte, ENCODED_ENTRY_SIZE)
+	copy(data, encoded)
+	return data, nil
+}
+
+// A key-value pair, as decoded by the built-in codecs.
+type KeyValue struct {
+	Key   int64
+	Value int64
+}
+
+// Get key.
+func (kv KeyValue) GetKey() int64 {
+	return kv.Key
+}
+
+// Get value.
+func (kv KeyValue) GetValue() int64 {
+	return kv.Value
+}
+
+// Marshal serializes the pair with the default codec.
+func (kv KeyValue) Marshal() []byte {
+	return VarintCodec{}.Encode(kv)
+}
+
+// The default codec: the key then the value, each a varint padded to binary.MaxVarintLen64.
+type VarintCodec struct{}
+
+func (VarintCodec) Encode(entry Entry) []byte {
+	data := make([]byte, ENCODED_ENTRY_SIZE)
+	binary.PutVarint(data, entry.GetKey())
+	binary.PutVarint(data[binary.MaxVarintLen64:], entry.GetValue())
+	return data
+}
+
+func (VarintCodec) Decode(data []byte) (Entry, int) {
+	key, _ := binary.Varint(data[:binary.MaxVarintLen64])
+	value, _ := binary.Varint(data[binary.MaxVarintLen64:ENCODED_ENTRY_SIZE])
+	return KeyValue{Key: key, Value: value}, ENCODED_ENTRY_SIZE
+}
+
+// Codecs tables can be created with, by name.
+var codecs = map[string]EntryCodec{DEFAULT_CODEC: VarintCodec{}}
+var codecMtx sync.RWMutex
+
+// Register a codec under a name, so that tables can be created with it and reopened later.
+// Register it before opening any table that uses it, and never change what a name refers to.
+func RegisterCodec(name string, codec EntryCodec) error {
+	if name == "" || len(name) > MAX_CODEC_NAME_SIZE {
+		return fmt.Errorf("codec name must be 1 to %d bytes, got %q", MAX_CODEC_NAME_SIZE, name)
+	}
+	codecMtx.Lock()
+	defer codecMtx.Unlock()
+	if _, found := codecs[name]; found {
+		return fmt.Errorf("codec %s already registered", name)
+	}
+	codecs[name] = codec
+	return nil
+}
+
+// Get the codec registered under a name; "" names the default codec.
+func GetCodec(name string) (EntryCodec, error) {
+	if name == "" {
+		name = DEFAULT_CODEC
+	}
+	codecMtx.RLock()
+	defer codecMtx.RUnlock()
+	codec, found := codecs[name]
+	if !found {
+		return nil, fmt.Errorf("codec %s not registered", name)
+	}
+	return codec, nil
+}
+
+// Get the name of the codec a table's entries are stored with, given the name the table recorded
+// and the name it is being opened with. Tables record "" for the default codec, as do tables
+// from before codecs were recorded; the name returned is in that form too. A table can be opened
+// without naming its codec, but not with one other than the one it recorded.
+func ResolveCodec(recorded string, requested string) (string, error) {
+	if recorded == "" {
+		if requested == DEFAULT_CODEC {
+			return "", nil
+		}
+		return requested, nil
+	}
+	if requested != "" && requested != recorded {
+		return "", fmt.Errorf("table stores its entries with codec %s, not %s", recorded, requested)
+	}
+	return recorded, nil
+}
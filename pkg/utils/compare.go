@@ -0,0 +1,35 @@
+package utils
+
+// CompareEntries orders two entries by key, returning -1, 0, or 1.
+func CompareEntries(a, b Entry) int {
+	switch aKey, bKey := a.GetKey(), b.GetKey(); {
+	case aKey < bKey:
+		return -1
+	case aKey > bKey:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// KeyInRange checks whether an entry's key lies in [lo, hi), or [lo, hi] if inclusive.
+func KeyInRange(e Entry, lo, hi int64, inclusive bool) bool {
+	key := e.GetKey()
+	if key < lo {
+		return false
+	}
+	if inclusive {
+		return key <= hi
+	}
+	return key < hi
+}
+
+// EntrySliceSorted checks whether a slice of entries is in non-decreasing key order.
+func EntrySliceSorted(es []Entry) bool {
+	for i := 1; i < len(es); i++ {
+		if CompareEntries(es[i-1], es[i]) > 0 {
+			return false
+		}
+	}
+	return true
+}
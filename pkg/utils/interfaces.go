@@ -7,9 +7,11 @@ type Entry interface {
 	Marshal() []byte
 }
 
-// Interface for a cursor that traverses a table.
+// Interface for a cursor that traverses a table. A cursor may hold locks on the table until
+// it is closed, so Close must be called once it is no longer needed, even part way through.
 type Cursor interface {
 	StepForward() bool
 	IsEnd() bool
 	GetEntry() (Entry, error)
+	Close()
 }
@@ -0,0 +1,45 @@
+package utils
+
+import "sync/atomic"
+
+// Receives the engine's internal diagnostics, like errors it has no caller to return to. Each
+// event is a message followed by alternating keys and values describing it.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// A logger that drops every event.
+type NopLogger struct{}
+
+func (NopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (NopLogger) Info(msg string, keyvals ...interface{})  {}
+func (NopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (NopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// Wraps the logger, so that atomic.Value always stores the same concrete type.
+type loggerBox struct {
+	logger Logger
+}
+
+// The logger every package reports to.
+var logger atomic.Value
+
+func init() {
+	logger.Store(loggerBox{logger: NopLogger{}})
+}
+
+// Set the logger every package reports to. Process-wide; nil restores the default NopLogger.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = NopLogger{}
+	}
+	logger.Store(loggerBox{logger: l})
+}
+
+// Get the logger every package reports to.
+func GetLogger() Logger {
+	return logger.Load().(loggerBox).logger
+}
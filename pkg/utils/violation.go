@@ -0,0 +1,13 @@
+package utils
+
+import "fmt"
+
+// An invariant a table's structure breaks, as found by verifying it.
+type Violation struct {
+	PageNum int64  // The page the violation was found on.
+	Reason  string // What is wrong there.
+}
+
+func (v *Violation) Error() string {
+	return fmt.Sprintf("page %d: %s", v.PageNum, v.Reason)
+}